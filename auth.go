@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// --- Auth constants ---
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+
+	sessionCookieName = "session"
+	sessionTTL        = 7 * 24 * time.Hour
+
+	minPasswordLength = 8
+	maxPasswordLength = 72 // bcrypt ignores anything past 72 bytes
+)
+
+// --- Auth types ---
+
+type AuthUser struct {
+	ID   string `json:"id"`
+	Role string `json:"role"`
+}
+
+type authContextKey struct{}
+
+type RegisterRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type LoginRequest struct {
+	UserID   string `json:"user_id"`
+	Password string `json:"password"`
+}
+
+type SetPasswordRequest struct {
+	Password string `json:"password"`
+	Role     string `json:"role,omitempty"`
+}
+
+type AuthResponse struct {
+	UserID    string    `json:"user_id"`
+	Role      string    `json:"role"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func withAuthUser(ctx context.Context, u AuthUser) context.Context {
+	return context.WithValue(ctx, authContextKey{}, u)
+}
+
+func authUserFromContext(ctx context.Context) (AuthUser, bool) {
+	u, ok := ctx.Value(authContextKey{}).(AuthUser)
+	return u, ok
+}
+
+// --- Passwords and sessions ---
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func checkPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return errors.New("password too short")
+	}
+	if len(password) > maxPasswordLength {
+		return errors.New("password too long")
+	}
+	return nil
+}
+
+// hashToken returns the form a session token is stored in. Only the hash is
+// persisted so a leaked database does not leak usable sessions.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Server) createSession(ctx context.Context, userID string) (string, time.Time, error) {
+	token := rand.Text()
+	expiresAt := time.Now().Add(sessionTTL).UTC().Truncate(time.Second)
+
+	if err := s.store.CreateSession(ctx, hashToken(token), userID, expiresAt); err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// sessionToken extracts the session token from a bearer Authorization header
+// or the session cookie, in that order.
+func sessionToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); h != "" {
+		if token, ok := strings.CutPrefix(h, "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	if c, err := r.Cookie(sessionCookieName); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// authenticate resolves the caller from the request credentials. The second
+// return value reports whether credentials were supplied at all, so callers
+// can tell anonymous requests from invalid ones.
+func (s *Server) authenticate(r *http.Request) (AuthUser, bool, error) {
+	token := sessionToken(r)
+	if token == "" {
+		return AuthUser{}, false, nil
+	}
+
+	sess, err := s.store.Session(r.Context(), hashToken(token))
+	if errors.Is(err, errNotFound) || (err == nil && time.Now().After(sess.ExpiresAt)) {
+		return AuthUser{}, true, errors.New("invalid or expired session")
+	}
+	if err != nil {
+		return AuthUser{}, true, err
+	}
+	return AuthUser{ID: sess.UserID, Role: sess.Role}, true, nil
+}
+
+// --- Middleware ---
+
+// requireUser rejects requests that are not authenticated as the user named by
+// the {id} path value. Admins may act on any user. In dev mode, requests
+// without credentials are let through unchanged.
+func (s *Server) requireUser(next http.HandlerFunc) http.HandlerFunc {
+	return s.authorizeUser(next, true)
+}
+
+// requireAccountOwner is requireUser without the dev mode exception, for
+// routes that could otherwise be used to take over an account.
+func (s *Server) requireAccountOwner(next http.HandlerFunc) http.HandlerFunc {
+	return s.authorizeUser(next, false)
+}
+
+func (s *Server) authorizeUser(next http.HandlerFunc, devBypass bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, supplied, err := s.authenticate(r)
+		if !supplied && devBypass && s.cfg.DevMode {
+			next(w, r)
+			return
+		}
+		if !supplied || err != nil {
+			if err != nil {
+				slog.Warn("Authentication failed", "path", r.URL.Path, "error", err)
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="vespa-demo"`)
+			writeProblem(w, r, http.StatusUnauthorized, codeAuthRequired, "Authentication required")
+			return
+		}
+
+		if id := r.PathValue("id"); id != "" && id != u.ID && u.Role != RoleAdmin {
+			writeProblem(w, r, http.StatusForbidden, codeForbidden, "Not allowed to act on this user")
+			return
+		}
+
+		next(w, r.WithContext(withAuthUser(r.Context(), u)))
+	}
+}
+
+// requireAdmin rejects requests that are not authenticated as an admin.
+// Dev mode does not relax this check.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, supplied, err := s.authenticate(r)
+		if !supplied || err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="vespa-demo"`)
+			writeProblem(w, r, http.StatusUnauthorized, codeAuthRequired, "Authentication required")
+			return
+		}
+		if u.Role != RoleAdmin {
+			writeProblem(w, r, http.StatusForbidden, codeForbidden, "Admin role required")
+			return
+		}
+		next(w, r.WithContext(withAuthUser(r.Context(), u)))
+	}
+}
+
+// --- Account bootstrap ---
+
+// bootstrapAdmin creates or updates the "admin" account when an admin
+// password is configured, so there is always a way to act on behalf of other
+// users.
+func (s *Server) bootstrapAdmin() {
+	if s.cfg.AdminPassword == "" {
+		return
+	}
+	if err := validatePassword(s.cfg.AdminPassword); err != nil {
+		log.Fatal("Invalid ADMIN_PASSWORD:", err)
+	}
+	hash, err := hashPassword(s.cfg.AdminPassword)
+	if err != nil {
+		log.Fatal("Failed to hash admin password:", err)
+	}
+
+	ctx := context.Background()
+	if err := s.store.CreateUser(ctx, User{ID: "admin", Name: "Admin"}); err != nil && !errors.Is(err, errUserExists) {
+		log.Fatal("Failed to create admin user:", err)
+	}
+	if err := s.store.SetCredentials(ctx, Credentials{UserID: "admin", PasswordHash: hash, Role: RoleAdmin}, true); err != nil {
+		log.Fatal("Failed to store admin credentials:", err)
+	}
+
+	slog.Info("Admin account ready", "user_id", "admin")
+}
+
+// --- HTTP handlers ---
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string, expiresAt time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
+
+	var req RegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON: "+err.Error())
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 50 {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, "Name must be between 1 and 50 characters")
+		return
+	}
+	if err := validatePassword(req.Password); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidPassword, "Invalid password: "+err.Error())
+		return
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		internalError(w, r, "Failed to hash password", "error", err)
+		return
+	}
+
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	userID := hex.EncodeToString(buf)
+
+	if err := s.store.CreateAccount(r.Context(), User{ID: userID, Name: req.Name},
+		Credentials{UserID: userID, PasswordHash: hash, Role: RoleUser}); err != nil {
+		internalError(w, r, "Failed to create account", "user_id", userID, "error", err)
+		return
+	}
+
+	token, expiresAt, err := s.createSession(r.Context(), userID)
+	if err != nil {
+		internalError(w, r, "Failed to create session", "user_id", userID, "error", err)
+		return
+	}
+
+	slog.Info("User registered", "user_id", userID)
+
+	setSessionCookie(w, r, token, expiresAt)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(AuthResponse{UserID: userID, Role: RoleUser, Token: token, ExpiresAt: expiresAt})
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
+
+	var req LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON: "+err.Error())
+		return
+	}
+
+	creds, err := s.store.Credentials(r.Context(), req.UserID)
+	if err != nil && !errors.Is(err, errNotFound) {
+		internalError(w, r, "Failed to look up credentials", "user_id", req.UserID, "error", err)
+		return
+	}
+	if err != nil || !checkPassword(creds.PasswordHash, req.Password) {
+		slog.Warn("Login failed", "user_id", req.UserID)
+		writeProblem(w, r, http.StatusUnauthorized, codeInvalidCredentials, "Invalid user ID or password")
+		return
+	}
+
+	token, expiresAt, err := s.createSession(r.Context(), req.UserID)
+	if err != nil {
+		internalError(w, r, "Failed to create session", "user_id", req.UserID, "error", err)
+		return
+	}
+
+	slog.Info("User logged in", "user_id", req.UserID)
+
+	setSessionCookie(w, r, token, expiresAt)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AuthResponse{UserID: req.UserID, Role: creds.Role, Token: token, ExpiresAt: expiresAt})
+}
+
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if token := sessionToken(r); token != "" {
+		if err := s.store.DeleteSession(r.Context(), hashToken(token)); err != nil {
+			internalError(w, r, "Failed to delete session", "error", err)
+			return
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: "", Path: "/", MaxAge: -1})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+func (s *Server) handleMe(w http.ResponseWriter, r *http.Request) {
+	u, ok := authUserFromContext(r.Context())
+	if !ok {
+		writeProblem(w, r, http.StatusUnauthorized, codeAuthRequired, "Authentication required")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(u)
+}
+
+// handleSetPassword sets or replaces a user's password, turning a demo user
+// into a real account. An existing password can only be replaced by the user
+// or an admin, and replacing it signs the user out everywhere. Only admins
+// may change roles.
+func (s *Server) handleSetPassword(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("id")
+
+	if !s.checkUserExists(w, r, userID) {
+		return
+	}
+	caller, authenticated := authUserFromContext(r.Context())
+	_, err := s.store.Credentials(r.Context(), userID)
+	if err != nil && !errors.Is(err, errNotFound) {
+		internalError(w, r, "Failed to look up credentials", "user_id", userID, "error", err)
+		return
+	}
+	if err == nil && (!authenticated || (caller.ID != userID && caller.Role != RoleAdmin)) {
+		writeProblem(w, r, http.StatusForbidden, codeForbidden, "Only the user or an admin can replace an existing password")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
+
+	var req SetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON: "+err.Error())
+		return
+	}
+	if err := validatePassword(req.Password); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidPassword, "Invalid password: "+err.Error())
+		return
+	}
+	if req.Role != "" && req.Role != RoleUser && req.Role != RoleAdmin {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidRole, "Invalid role: "+req.Role)
+		return
+	}
+	if req.Role != "" {
+		if !authenticated || caller.Role != RoleAdmin {
+			writeProblem(w, r, http.StatusForbidden, codeForbidden, "Only admins can change roles")
+			return
+		}
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		internalError(w, r, "Failed to hash password", "error", err)
+		return
+	}
+
+	role := req.Role
+	if role == "" {
+		role = RoleUser
+	}
+	// An existing role is kept unless an admin explicitly changes it.
+	creds := Credentials{UserID: userID, PasswordHash: hash, Role: role}
+	if err := s.store.SetCredentials(r.Context(), creds, req.Role != ""); err != nil {
+		internalError(w, r, "Failed to store credentials", "user_id", userID, "error", err)
+		return
+	}
+	if err := s.store.DeleteUserSessions(r.Context(), userID); err != nil {
+		internalError(w, r, "Failed to revoke sessions", "user_id", userID, "error", err)
+		return
+	}
+
+	slog.Info("Password updated", "user_id", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// =============================================================================
+// Passwords and sessions
+// =============================================================================
+
+func TestHashPassword(t *testing.T) {
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatalf("hashPassword failed: %v", err)
+	}
+	if hash == "correct horse" {
+		t.Fatal("hash must not equal the plaintext password")
+	}
+	if !checkPassword(hash, "correct horse") {
+		t.Error("checkPassword should accept the original password")
+	}
+	if checkPassword(hash, "wrong horse") {
+		t.Error("checkPassword should reject a different password")
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		wantErr  bool
+	}{
+		{"too short", "short", true},
+		{"minimum length", strings.Repeat("a", minPasswordLength), false},
+		{"maximum length", strings.Repeat("a", maxPasswordLength), false},
+		{"too long", strings.Repeat("a", maxPasswordLength+1), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePassword(tt.password)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validatePassword(len=%d) error = %v, wantErr %v", len(tt.password), err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSessionToken(t *testing.T) {
+	t.Run("bearer header", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer abc123")
+		if got := sessionToken(req); got != "abc123" {
+			t.Errorf("expected abc123, got %q", got)
+		}
+	})
+
+	t.Run("cookie", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "cookie-token"})
+		if got := sessionToken(req); got != "cookie-token" {
+			t.Errorf("expected cookie-token, got %q", got)
+		}
+	})
+
+	t.Run("non-bearer header ignored", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+		if got := sessionToken(req); got != "" {
+			t.Errorf("expected empty token, got %q", got)
+		}
+	})
+}
+
+// =============================================================================
+// Middleware and handlers
+// =============================================================================
+
+// setupTestAccount gives an existing user a password and role and returns a
+// valid session token for them.
+func setupTestAccount(t *testing.T, srv *Server, userID, role string) string {
+	t.Helper()
+	hash, err := hashPassword("password123")
+	if err != nil {
+		t.Fatalf("hashPassword failed: %v", err)
+	}
+	ctx := context.Background()
+	if err := srv.store.CreateUser(ctx, User{ID: userID, Name: "User " + userID}); err != nil && !errors.Is(err, errUserExists) {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	if err := srv.store.SetCredentials(ctx, Credentials{UserID: userID, PasswordHash: hash, Role: role}, true); err != nil {
+		t.Fatalf("failed to store credentials: %v", err)
+	}
+	token, _, err := srv.createSession(ctx, userID)
+	if err != nil {
+		t.Fatalf("createSession failed: %v", err)
+	}
+	return token
+}
+
+func TestRequireUser(t *testing.T) {
+	okHandler := func(w http.ResponseWriter, r *http.Request) {
+		u, _ := authUserFromContext(r.Context())
+		w.Write([]byte(u.ID))
+	}
+
+	call := func(srv *Server, pathID, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/api/users/"+pathID+"/preferences", nil)
+		req.SetPathValue("id", pathID)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		srv.requireUser(okHandler)(w, req)
+		return w
+	}
+
+	t.Run("no credentials rejected", func(t *testing.T) {
+		srv := newTestServer(t)
+		srv.cfg.DevMode = false
+
+		w := call(srv, "1", "")
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401, got %d", w.Code)
+		}
+		if w.Header().Get("WWW-Authenticate") == "" {
+			t.Error("expected WWW-Authenticate header on 401")
+		}
+	})
+
+	t.Run("invalid token rejected", func(t *testing.T) {
+		srv := newTestServer(t)
+		srv.cfg.DevMode = false
+
+		if w := call(srv, "1", "not-a-real-token"); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401, got %d", w.Code)
+		}
+	})
+
+	t.Run("own id allowed", func(t *testing.T) {
+		srv := newTestServer(t)
+		srv.cfg.DevMode = false
+		token := setupTestAccount(t, srv, "1", RoleUser)
+
+		w := call(srv, "1", token)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if w.Body.String() != "1" {
+			t.Errorf("expected authenticated user 1 in context, got %q", w.Body.String())
+		}
+	})
+
+	t.Run("other id forbidden", func(t *testing.T) {
+		srv := newTestServer(t)
+		srv.cfg.DevMode = false
+		token := setupTestAccount(t, srv, "1", RoleUser)
+
+		if w := call(srv, "2", token); w.Code != http.StatusForbidden {
+			t.Errorf("expected 403, got %d", w.Code)
+		}
+	})
+
+	t.Run("admin may act on anyone", func(t *testing.T) {
+		srv := newTestServer(t)
+		srv.cfg.DevMode = false
+		token := setupTestAccount(t, srv, "admin", RoleAdmin)
+
+		if w := call(srv, "1", token); w.Code != http.StatusOK {
+			t.Errorf("expected 200 for admin, got %d", w.Code)
+		}
+	})
+
+	t.Run("dev mode allows anonymous", func(t *testing.T) {
+		srv := newTestServer(t)
+		srv.cfg.DevMode = true
+
+		if w := call(srv, "1", ""); w.Code != http.StatusOK {
+			t.Errorf("expected 200 in dev mode, got %d", w.Code)
+		}
+	})
+
+	t.Run("dev mode still enforces supplied credentials", func(t *testing.T) {
+		srv := newTestServer(t)
+		srv.cfg.DevMode = true
+		token := setupTestAccount(t, srv, "1", RoleUser)
+
+		if w := call(srv, "2", token); w.Code != http.StatusForbidden {
+			t.Errorf("expected 403, got %d", w.Code)
+		}
+	})
+}
+
+func TestRequireAdmin(t *testing.T) {
+	srv := newTestServer(t)
+	srv.cfg.DevMode = true
+	userToken := setupTestAccount(t, srv, "1", RoleUser)
+	adminToken := setupTestAccount(t, srv, "admin", RoleAdmin)
+
+	handler := srv.requireAdmin(func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, tt := range []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"anonymous even in dev mode", "", http.StatusUnauthorized},
+		{"regular user", userToken, http.StatusForbidden},
+		{"admin", adminToken, http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			handler(w, req)
+			if w.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, w.Code)
+			}
+		})
+	}
+}
+
+func TestHandleLogin(t *testing.T) {
+	t.Run("valid credentials", func(t *testing.T) {
+		srv := newTestServer(t)
+		setupTestAccount(t, srv, "1", RoleUser)
+
+		body := `{"user_id":"1","password":"password123"}`
+		req := httptest.NewRequest(http.MethodPost, "/api/auth/login", strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		srv.handleLogin(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp AuthResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if resp.Token == "" || resp.UserID != "1" || resp.Role != RoleUser {
+			t.Errorf("unexpected login response: %+v", resp)
+		}
+
+		var cookieSet bool
+		for _, c := range w.Result().Cookies() {
+			if c.Name == sessionCookieName && c.Value == resp.Token && c.HttpOnly {
+				cookieSet = true
+			}
+		}
+		if !cookieSet {
+			t.Error("expected HttpOnly session cookie carrying the token")
+		}
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		srv := newTestServer(t)
+		setupTestAccount(t, srv, "1", RoleUser)
+
+		body := `{"user_id":"1","password":"wrong-password"}`
+		req := httptest.NewRequest(http.MethodPost, "/api/auth/login", strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		srv.handleLogin(w, req)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401, got %d", w.Code)
+		}
+	})
+
+	t.Run("user without account", func(t *testing.T) {
+		srv := newTestServer(t)
+
+		body := `{"user_id":"1","password":"password123"}`
+		req := httptest.NewRequest(http.MethodPost, "/api/auth/login", strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		srv.handleLogin(w, req)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401, got %d", w.Code)
+		}
+	})
+}
+
+func TestHandleRegister(t *testing.T) {
+	srv := newTestServer(t)
+
+	body := `{"name":"Newcomer","password":"long-enough"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/register", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	srv.handleRegister(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp AuthResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	users, err := srv.store.ListUsers(context.Background())
+	if err != nil {
+		t.Fatalf("ListUsers failed: %v", err)
+	}
+	var name string
+	for _, u := range users {
+		if u.ID == resp.UserID {
+			name = u.Name
+		}
+	}
+	if name != "Newcomer" {
+		t.Errorf("expected registered user named Newcomer, got %q", name)
+	}
+
+	// The returned token should authenticate the new user
+	authReq := httptest.NewRequest(http.MethodGet, "/api/auth/me", nil)
+	authReq.Header.Set("Authorization", "Bearer "+resp.Token)
+	u, _, err := srv.authenticate(authReq)
+	if err != nil || u.ID != resp.UserID {
+		t.Errorf("token should authenticate %s, got %+v (err=%v)", resp.UserID, u, err)
+	}
+}
+
+func TestHandleLogout(t *testing.T) {
+	srv := newTestServer(t)
+	token := setupTestAccount(t, srv, "1", RoleUser)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+
+	srv.handleLogout(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if _, _, err := srv.authenticate(req); err == nil {
+		t.Error("session should no longer authenticate after logout")
+	}
+}
+
+func TestHandleSetPassword(t *testing.T) {
+	t.Run("user sets own password", func(t *testing.T) {
+		srv := newTestServer(t)
+
+		body := `{"password":"new-password"}`
+		req := httptest.NewRequest(http.MethodPut, "/api/users/1/password", strings.NewReader(body))
+		req.SetPathValue("id", "1")
+		w := httptest.NewRecorder()
+
+		srv.handleSetPassword(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		creds, _ := srv.store.Credentials(context.Background(), "1")
+		if !checkPassword(creds.PasswordHash, "new-password") {
+			t.Error("stored hash should match the new password")
+		}
+		if creds.Role != RoleUser {
+			t.Errorf("expected role=user, got %s", creds.Role)
+		}
+	})
+
+	t.Run("non-admin cannot change role", func(t *testing.T) {
+		srv := newTestServer(t)
+
+		body := `{"password":"new-password","role":"admin"}`
+		req := httptest.NewRequest(http.MethodPut, "/api/users/1/password", strings.NewReader(body))
+		req.SetPathValue("id", "1")
+		req = req.WithContext(withAuthUser(req.Context(), AuthUser{ID: "1", Role: RoleUser}))
+		w := httptest.NewRecorder()
+
+		srv.handleSetPassword(w, req)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected 403, got %d", w.Code)
+		}
+	})
+
+	t.Run("admin grants role", func(t *testing.T) {
+		srv := newTestServer(t)
+
+		body := `{"password":"new-password","role":"admin"}`
+		req := httptest.NewRequest(http.MethodPut, "/api/users/1/password", strings.NewReader(body))
+		req.SetPathValue("id", "1")
+		req = req.WithContext(withAuthUser(req.Context(), AuthUser{ID: "admin", Role: RoleAdmin}))
+		w := httptest.NewRecorder()
+
+		srv.handleSetPassword(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		creds, _ := srv.store.Credentials(context.Background(), "1")
+		if creds.Role != RoleAdmin {
+			t.Errorf("expected role=admin, got %s", creds.Role)
+		}
+	})
+
+	t.Run("short password", func(t *testing.T) {
+		srv := newTestServer(t)
+
+		body := `{"password":"short"}`
+		req := httptest.NewRequest(http.MethodPut, "/api/users/1/password", strings.NewReader(body))
+		req.SetPathValue("id", "1")
+		w := httptest.NewRecorder()
+
+		srv.handleSetPassword(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("anonymous reset rejected in dev mode", func(t *testing.T) {
+		srv := newTestServer(t)
+		srv.cfg.DevMode = true
+		srv.limiter.SetLimits(RateLimits{})
+		setupTestAccount(t, srv, "admin", RoleAdmin)
+
+		body := `{"password":"taken-over"}`
+		req := httptest.NewRequest(http.MethodPut, "/api/users/admin/password", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+
+		srv.routes().ServeHTTP(w, req)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401, got %d: %s", w.Code, w.Body.String())
+		}
+		creds, _ := srv.store.Credentials(context.Background(), "admin")
+		if !checkPassword(creds.PasswordHash, "password123") {
+			t.Error("admin password should be unchanged")
+		}
+	})
+
+	t.Run("other user cannot replace password", func(t *testing.T) {
+		srv := newTestServer(t)
+		setupTestAccount(t, srv, "1", RoleUser)
+
+		body := `{"password":"new-password"}`
+		req := httptest.NewRequest(http.MethodPut, "/api/users/1/password", strings.NewReader(body))
+		req.SetPathValue("id", "1")
+		req = req.WithContext(withAuthUser(req.Context(), AuthUser{ID: "2", Role: RoleUser}))
+		w := httptest.NewRecorder()
+
+		srv.handleSetPassword(w, req)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected 403, got %d", w.Code)
+		}
+	})
+
+	t.Run("replacing password revokes sessions", func(t *testing.T) {
+		srv := newTestServer(t)
+		token := setupTestAccount(t, srv, "1", RoleUser)
+
+		body := `{"password":"new-password"}`
+		req := httptest.NewRequest(http.MethodPut, "/api/users/1/password", strings.NewReader(body))
+		req.SetPathValue("id", "1")
+		req = req.WithContext(withAuthUser(req.Context(), AuthUser{ID: "1", Role: RoleUser}))
+		w := httptest.NewRecorder()
+
+		srv.handleSetPassword(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if _, err := srv.store.Session(context.Background(), hashToken(token)); !errors.Is(err, errNotFound) {
+			t.Errorf("expected the old session to be revoked, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// --- Catalog lookups ---
+
+const (
+	catalogCacheTTL      = 10 * time.Minute
+	catalogFetchParallel = 8
+)
+
+var errFilmNotFound = errors.New("film not found")
+
+// filmCache keeps recently fetched film documents. The catalog changes only
+// when it is re-fed, so a short TTL is enough to keep it fresh.
+type filmCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]filmCacheEntry
+}
+
+type filmCacheEntry struct {
+	hit       VespaHit
+	fetchedAt time.Time
+}
+
+func newFilmCache(ttl time.Duration) *filmCache {
+	return &filmCache{ttl: ttl, entries: map[string]filmCacheEntry{}}
+}
+
+func (c *filmCache) get(filmID string) (VespaHit, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[filmID]
+	if !ok || time.Since(e.fetchedAt) > c.ttl {
+		return VespaHit{}, false
+	}
+	return e.hit, true
+}
+
+func (c *filmCache) put(filmID string, hit VespaHit) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[filmID] = filmCacheEntry{hit: hit, fetchedAt: time.Now()}
+}
+
+// fetchFilmDocument reads a single film from the Vespa document API.
+func (s *Server) fetchFilmDocument(ctx context.Context, filmID string) (VespaHit, error) {
+	docURL := s.cfg.Vespa.URL + "/document/v1/films/film/docid/" + url.PathEscape(filmID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, docURL, nil)
+	if err != nil {
+		return VespaHit{}, err
+	}
+
+	resp, err := s.vespa.Do(req)
+	if err != nil {
+		return VespaHit{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return VespaHit{}, errFilmNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return VespaHit{}, fmt.Errorf("vespa document API status %d: %s", resp.StatusCode, body)
+	}
+
+	// Document API responses share the id/fields shape of search hits
+	var hit VespaHit
+	if err := json.NewDecoder(resp.Body).Decode(&hit); err != nil {
+		return VespaHit{}, err
+	}
+	return hit, nil
+}
+
+// lookupFilms fetches catalog documents for the given film IDs, serving what
+// it can from the server's film cache. Films that cannot be fetched are left out of the
+// result, so callers must treat it as best effort.
+func (s *Server) lookupFilms(ctx context.Context, filmIDs []string) map[string]VespaHit {
+	found := map[string]VespaHit{}
+	var missing []string
+	seen := map[string]bool{}
+	for _, id := range filmIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		hit, ok := s.catalog.get(id)
+		s.metrics.cacheLookup("film", ok)
+		if ok {
+			found[id] = hit
+		} else {
+			missing = append(missing, id)
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, catalogFetchParallel)
+	for _, id := range missing {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			hit, err := s.fetchFilmDocument(ctx, id)
+			if err != nil {
+				if !errors.Is(err, errFilmNotFound) {
+					slog.Warn("Failed to fetch film document", "film_id", id, "error", err)
+				}
+				return
+			}
+			s.catalog.put(id, hit)
+			mu.Lock()
+			found[id] = hit
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	return found
+}
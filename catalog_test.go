@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setupMockCatalog serves film documents from the Vespa document API and
+// points srv at it with an empty cache. Unknown IDs return 404.
+func setupMockCatalog(t *testing.T, srv *Server, films map[string]string) *atomic.Int32 {
+	t.Helper()
+	var calls atomic.Int32
+	mockVespa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		id := strings.TrimPrefix(r.URL.Path, "/document/v1/films/film/docid/")
+		fields, ok := films[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":"id:films:film::%s","fields":%s}`, id, fields)
+	}))
+	t.Cleanup(mockVespa.Close)
+
+	srv.cfg.Vespa.URL = mockVespa.URL
+	srv.catalog = newFilmCache(catalogCacheTTL)
+	return &calls
+}
+
+func TestLookupFilms(t *testing.T) {
+	srv := newServer(defaultConfig(), nil)
+	calls := setupMockCatalog(t, srv, map[string]string{
+		"1": `{"title":"The Shawshank Redemption","director":"Frank Darabont","cast":["Tim Robbins"]}`,
+		"2": `{"title":"The Godfather","director":"Francis Ford Coppola"}`,
+	})
+
+	films := srv.lookupFilms(context.Background(), []string{"1", "2", "2", "missing"})
+
+	if len(films) != 2 {
+		t.Fatalf("expected 2 films, got %d", len(films))
+	}
+	if films["1"].Fields.Director != "Frank Darabont" || films["1"].Fields.Cast[0] != "Tim Robbins" {
+		t.Errorf("unexpected film 1: %+v", films["1"].Fields)
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("expected 3 document fetches (duplicates collapsed), got %d", got)
+	}
+
+	// Found films are cached; missing ones are retried
+	srv.lookupFilms(context.Background(), []string{"1", "2", "missing"})
+	if got := calls.Load(); got != 4 {
+		t.Errorf("expected only the missing film to be refetched, got %d total calls", got)
+	}
+}
+
+func TestFilmCacheExpiry(t *testing.T) {
+	c := newFilmCache(time.Millisecond)
+	c.put("1", VespaHit{ID: "id:films:film::1"})
+
+	if _, ok := c.get("1"); !ok {
+		t.Fatal("fresh entry should be served")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.get("1"); ok {
+		t.Error("expired entry should not be served")
+	}
+}
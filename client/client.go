@@ -0,0 +1,406 @@
+// Package client is a typed Go client for the vespa-demo HTTP API.
+//
+// Search and recommendations use API v2; everything else uses v1. Failed
+// requests return an *APIError carrying the server's stable error code.
+// Requests that hit a rate limit or a temporarily unavailable server are
+// retried with backoff.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxRetries = 3
+	defaultBackoff    = 200 * time.Millisecond
+	maxBackoff        = 10 * time.Second
+)
+
+// Client calls the API. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	token      string
+	maxRetries int
+	backoff    time.Duration
+}
+
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for requests. The default is
+// http.DefaultClient.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithToken authenticates every request with a session token.
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithRetries sets how often a failed request is retried and the initial
+// backoff, which doubles on every attempt. Zero retries turns retrying off.
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.backoff = backoff
+	}
+}
+
+// New returns a client for the server at baseURL, such as
+// "http://localhost:3000".
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		maxRetries: defaultMaxRetries,
+		backoff:    defaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithToken returns a copy of c that authenticates with token, for example
+// the one returned by Login.
+func (c *Client) WithToken(token string) *Client {
+	c2 := *c
+	c2.token = token
+	return &c2
+}
+
+// --- Requests ---
+
+// retryable reports whether a response status is worth retrying. 429 means
+// the request was not processed, so it is retried for every method; server
+// errors are only retried for idempotent methods.
+func retryable(method string, status int) bool {
+	switch status {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return method != http.MethodPost
+	}
+	return false
+}
+
+// do sends a request and decodes a successful JSON response into out, if
+// out is not nil.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in, out any) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return fmt.Errorf("encoding request: %w", err)
+		}
+	}
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, method, u, body)
+		if err != nil {
+			if ctx.Err() != nil || attempt >= c.maxRetries || method == http.MethodPost {
+				return err
+			}
+			if err := c.wait(ctx, attempt, 0); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			defer resp.Body.Close()
+			if out == nil {
+				io.Copy(io.Discard, resp.Body)
+				return nil
+			}
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				return fmt.Errorf("decoding %s %s response: %w", method, path, err)
+			}
+			return nil
+		}
+
+		apiErr := decodeError(resp)
+		resp.Body.Close()
+		if attempt >= c.maxRetries || !retryable(method, resp.StatusCode) {
+			return apiErr
+		}
+		if err := c.wait(ctx, attempt, retryAfter(resp)); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, u string, body []byte) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.httpClient.Do(req)
+}
+
+// wait sleeps before the next attempt: the server's Retry-After if it sent
+// one, otherwise exponential backoff with jitter, capped at maxBackoff.
+func (c *Client) wait(ctx context.Context, attempt int, after time.Duration) error {
+	d := after
+	if d <= 0 {
+		d = c.backoff << attempt
+		d = d/2 + rand.N(d/2+1)
+	}
+	d = min(d, maxBackoff)
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// retryAfter parses a Retry-After header given in seconds.
+func retryAfter(resp *http.Response) time.Duration {
+	secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// --- Search and recommendations ---
+
+// SearchParams are the inputs to Search. Preferences, when set, are used
+// instead of the user's stored preferences. Zero Limit uses the server's
+// default page size. Weights override ranking weights by name, such as
+// "rating_weight", and require an admin session.
+type SearchParams struct {
+	Query         string
+	UserID        string
+	Preferences   []Preference
+	ExcludeHidden bool
+	Limit         int
+	Offset        int
+	Weights       map[string]float64
+}
+
+func (c *Client) Search(ctx context.Context, p SearchParams) (*SearchResult, error) {
+	q := url.Values{}
+	if p.Query != "" {
+		q.Set("q", p.Query)
+	}
+	if p.UserID != "" {
+		q.Set("user", p.UserID)
+	}
+	if p.Preferences != nil {
+		prefs, err := json.Marshal(p.Preferences)
+		if err != nil {
+			return nil, fmt.Errorf("encoding preferences: %w", err)
+		}
+		q.Set("prefs", string(prefs))
+	}
+	if p.ExcludeHidden {
+		q.Set("exclude_hidden", "true")
+	}
+	if p.Limit > 0 {
+		q.Set("limit", strconv.Itoa(p.Limit))
+	}
+	if p.Offset > 0 {
+		q.Set("offset", strconv.Itoa(p.Offset))
+	}
+	if len(p.Weights) > 0 {
+		weights := make([]string, 0, len(p.Weights))
+		for _, name := range slices.Sorted(maps.Keys(p.Weights)) {
+			weights = append(weights, name+":"+strconv.FormatFloat(p.Weights[name], 'g', -1, 64))
+		}
+		q.Set("weights", strings.Join(weights, ","))
+	}
+
+	var result SearchResult
+	if err := c.do(ctx, http.MethodGet, "/api/v2/search", q, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// SendEvents reports what happened to the results of the search with
+// queryID, for learning-to-rank training data.
+func (c *Client) SendEvents(ctx context.Context, queryID string, events []Event) error {
+	body := struct {
+		QueryID string  `json:"query_id"`
+		Events  []Event `json:"events"`
+	}{queryID, events}
+	return c.do(ctx, http.MethodPost, "/api/v1/events", nil, body, nil)
+}
+
+// Recommendations returns films for userID that it has not watched or
+// hidden. An empty mode uses the server default, WatchlistInclude.
+func (c *Client) Recommendations(ctx context.Context, userID string, mode WatchlistMode) (*RecommendationList, error) {
+	q := url.Values{}
+	if mode != "" {
+		q.Set("watchlist", string(mode))
+	}
+	var list RecommendationList
+	if err := c.do(ctx, http.MethodGet, userPath(userID, "recommendations", "v2"), q, nil, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// GroupRecommendations returns films for userIDs to watch together. An empty
+// strategy uses the server default, GroupAverage. Films any member has
+// watched are left out, unless onlyShared is set, in which case only films
+// every member has watched are returned. Non-admin callers must be members,
+// and the other members must be in a watch party with them.
+func (c *Client) GroupRecommendations(ctx context.Context, userIDs []string, strategy GroupStrategy, onlyShared bool) (*GroupRecommendationList, error) {
+	body := struct {
+		UserIDs  []string      `json:"user_ids"`
+		Strategy GroupStrategy `json:"strategy,omitempty"`
+		Watched  string        `json:"watched,omitempty"`
+	}{UserIDs: userIDs, Strategy: strategy}
+	if onlyShared {
+		body.Watched = "shared"
+	}
+	var list GroupRecommendationList
+	if err := c.do(ctx, http.MethodPost, "/api/v1/group-recommendations", nil, body, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// --- Users ---
+
+func userPath(userID, resource, version string) string {
+	return "/api/" + version + "/users/" + url.PathEscape(userID) + "/" + resource
+}
+
+func (c *Client) Users(ctx context.Context) ([]User, error) {
+	var users []User
+	err := c.do(ctx, http.MethodGet, "/api/v1/users", nil, nil, &users)
+	return users, err
+}
+
+// UpdatePreferences replaces all of the user's preferences.
+func (c *Client) UpdatePreferences(ctx context.Context, userID string, prefs []Preference) error {
+	if prefs == nil {
+		prefs = []Preference{}
+	}
+	body := struct {
+		Preferences []Preference `json:"preferences"`
+	}{prefs}
+	return c.do(ctx, http.MethodPut, userPath(userID, "preferences", "v1"), nil, body, nil)
+}
+
+func (c *Client) History(ctx context.Context, userID string) ([]WatchHistoryEntry, error) {
+	var history []WatchHistoryEntry
+	err := c.do(ctx, http.MethodGet, userPath(userID, "history", "v1"), nil, nil, &history)
+	return history, err
+}
+
+// AddHistory records a watched film. The server also takes it off the
+// watchlist.
+func (c *Client) AddHistory(ctx context.Context, userID string, entry WatchHistoryEntry) error {
+	return c.do(ctx, http.MethodPost, userPath(userID, "history", "v1"), nil, entry, nil)
+}
+
+func (c *Client) Watchlist(ctx context.Context, userID string) ([]WatchlistEntry, error) {
+	var entries []WatchlistEntry
+	err := c.do(ctx, http.MethodGet, userPath(userID, "watchlist", "v1"), nil, nil, &entries)
+	return entries, err
+}
+
+func (c *Client) AddToWatchlist(ctx context.Context, userID string, req AddWatchlistRequest) error {
+	return c.do(ctx, http.MethodPost, userPath(userID, "watchlist", "v1"), nil, req, nil)
+}
+
+func (c *Client) RemoveFromWatchlist(ctx context.Context, userID, filmID string) error {
+	return c.do(ctx, http.MethodDelete, userPath(userID, "watchlist/"+url.PathEscape(filmID), "v1"), nil, nil, nil)
+}
+
+func (c *Client) Feedback(ctx context.Context, userID string) ([]FeedbackEntry, error) {
+	var entries []FeedbackEntry
+	err := c.do(ctx, http.MethodGet, userPath(userID, "feedback", "v1"), nil, nil, &entries)
+	return entries, err
+}
+
+func (c *Client) AddFeedback(ctx context.Context, userID string, req FeedbackRequest) error {
+	return c.do(ctx, http.MethodPost, userPath(userID, "feedback", "v1"), nil, req, nil)
+}
+
+func (c *Client) RemoveFeedback(ctx context.Context, userID, filmID string) error {
+	return c.do(ctx, http.MethodDelete, userPath(userID, "feedback/"+url.PathEscape(filmID), "v1"), nil, nil, nil)
+}
+
+// --- Authentication ---
+
+// Register creates an account and returns its session. Use WithToken to
+// make authenticated calls with it.
+func (c *Client) Register(ctx context.Context, name, password string) (*AuthResponse, error) {
+	body := map[string]string{"name": name, "password": password}
+	var auth AuthResponse
+	if err := c.do(ctx, http.MethodPost, "/api/v1/auth/register", nil, body, &auth); err != nil {
+		return nil, err
+	}
+	return &auth, nil
+}
+
+// Login starts a session. Use WithToken to make authenticated calls with it.
+func (c *Client) Login(ctx context.Context, userID, password string) (*AuthResponse, error) {
+	body := map[string]string{"user_id": userID, "password": password}
+	var auth AuthResponse
+	if err := c.do(ctx, http.MethodPost, "/api/v1/auth/login", nil, body, &auth); err != nil {
+		return nil, err
+	}
+	return &auth, nil
+}
+
+// Logout ends the client's session.
+func (c *Client) Logout(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/api/v1/auth/logout", nil, nil, nil)
+}
+
+// Me returns the user the client is authenticated as.
+func (c *Client) Me(ctx context.Context) (*AuthUser, error) {
+	var u AuthUser
+	if err := c.do(ctx, http.MethodGet, "/api/v1/auth/me", nil, nil, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// SetPassword sets a user's password. Only admins may pass a role; leave it
+// empty to keep the current one.
+func (c *Client) SetPassword(ctx context.Context, userID, password, role string) error {
+	body := map[string]string{"password": password}
+	if role != "" {
+		body["role"] = role
+	}
+	return c.do(ctx, http.MethodPut, userPath(userID, "password", "v1"), nil, body, nil)
+}
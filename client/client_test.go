@@ -0,0 +1,123 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyServer fails the first failures requests with status, then answers
+// with an empty search result.
+func flakyServer(t *testing.T, failures int32, status int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(status)
+			w.Write([]byte(`{"status":503,"code":"upstream_unavailable","title":"Bad Gateway","request_id":"abc"}`))
+			return
+		}
+		w.Write([]byte(`{"query":"*","films":[],"facets":{},"paging":{"offset":0,"limit":10,"total":0}}`))
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &calls
+}
+
+func TestRetries(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("retries until success", func(t *testing.T) {
+		ts, calls := flakyServer(t, 2, http.StatusServiceUnavailable)
+		c := New(ts.URL, WithRetries(3, time.Millisecond))
+		if _, err := c.Search(ctx, SearchParams{}); err != nil {
+			t.Fatalf("expected success after retries, got %v", err)
+		}
+		if calls.Load() != 3 {
+			t.Errorf("expected 3 calls, got %d", calls.Load())
+		}
+	})
+
+	t.Run("gives up after max retries", func(t *testing.T) {
+		ts, calls := flakyServer(t, 10, http.StatusBadGateway)
+		c := New(ts.URL, WithRetries(2, time.Millisecond))
+		_, err := c.Search(ctx, SearchParams{})
+		if !HasCode(err, CodeUpstreamUnavailable) {
+			t.Fatalf("expected upstream_unavailable, got %v", err)
+		}
+		if calls.Load() != 3 {
+			t.Errorf("expected 3 calls, got %d", calls.Load())
+		}
+	})
+
+	t.Run("POST is not retried on server errors", func(t *testing.T) {
+		ts, calls := flakyServer(t, 10, http.StatusBadGateway)
+		c := New(ts.URL, WithRetries(3, time.Millisecond))
+		c.AddHistory(ctx, "1", WatchHistoryEntry{FilmID: "1", UserRating: 5})
+		if calls.Load() != 1 {
+			t.Errorf("expected 1 call, got %d", calls.Load())
+		}
+	})
+
+	t.Run("POST is retried when rate limited", func(t *testing.T) {
+		ts, calls := flakyServer(t, 1, http.StatusTooManyRequests)
+		c := New(ts.URL, WithRetries(3, time.Millisecond))
+		if err := c.AddHistory(ctx, "1", WatchHistoryEntry{FilmID: "1", UserRating: 5}); err != nil {
+			t.Fatalf("expected success after retry, got %v", err)
+		}
+		if calls.Load() != 2 {
+			t.Errorf("expected 2 calls, got %d", calls.Load())
+		}
+	})
+
+	t.Run("context cancels the wait", func(t *testing.T) {
+		ts, _ := flakyServer(t, 10, http.StatusServiceUnavailable)
+		c := New(ts.URL, WithRetries(3, time.Hour))
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		if _, err := c.Search(ctx, SearchParams{}); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected deadline exceeded, got %v", err)
+		}
+	})
+}
+
+func TestDecodeError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/users" {
+			w.Header().Set("X-Request-ID", "from-header")
+			http.Error(w, "proxy says no", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"type":"/problems/user_not_found","title":"Not Found","status":404,
+			"detail":"User 9 does not exist","code":"user_not_found","request_id":"req-1"}`))
+	}))
+	defer ts.Close()
+	c := New(ts.URL, WithRetries(0, 0))
+
+	_, err := c.History(context.Background(), "9")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected *APIError, got %T", err)
+	}
+	if apiErr.StatusCode != 404 || apiErr.Code != CodeUserNotFound || apiErr.RequestID != "req-1" || apiErr.Detail != "User 9 does not exist" {
+		t.Errorf("unexpected error: %+v", apiErr)
+	}
+	if !IsNotFound(err) {
+		t.Error("expected IsNotFound")
+	}
+	if want := "vespa-demo API: 404 user_not_found: User 9 does not exist (request req-1)"; err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+
+	_, err = c.Users(context.Background())
+	if !errors.As(err, &apiErr) || apiErr.Code != "" || apiErr.Detail != "proxy says no" || apiErr.RequestID != "from-header" {
+		t.Errorf("expected a plain-text error to be kept as detail, got %+v", apiErr)
+	}
+}
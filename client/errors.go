@@ -0,0 +1,108 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Error codes the server puts in problem responses. They are stable; the
+// detail text is not.
+const (
+	CodeInvalidJSON         = "invalid_json"
+	CodeInvalidRequest      = "invalid_request"
+	CodeQueryTooLong        = "query_too_long"
+	CodeInvalidPreference   = "invalid_preference"
+	CodeInvalidGenre        = "invalid_genre"
+	CodeInvalidTag          = "invalid_tag"
+	CodeInvalidRating       = "invalid_rating"
+	CodeInvalidPassword     = "invalid_password"
+	CodeInvalidRole         = "invalid_role"
+	CodeAuthRequired        = "authentication_required"
+	CodeInvalidCredentials  = "invalid_credentials"
+	CodeForbidden           = "forbidden"
+	CodeUserNotFound        = "user_not_found"
+	CodeNotFound            = "not_found"
+	CodeRateLimited         = "rate_limited"
+	CodeUpstreamUnavailable = "upstream_unavailable"
+	CodeInternal            = "internal_error"
+)
+
+// APIError is a failed request, decoded from the server's RFC 7807 problem
+// response. Responses that are not problem documents, for example from a
+// proxy in front of the server, still produce an APIError with Code empty.
+type APIError struct {
+	StatusCode int
+	Code       string
+	Title      string
+	Detail     string
+	Instance   string
+	RequestID  string
+}
+
+func (e *APIError) Error() string {
+	msg := e.Detail
+	if msg == "" {
+		msg = e.Title
+	}
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	s := fmt.Sprintf("vespa-demo API: %d", e.StatusCode)
+	if e.Code != "" {
+		s += " " + e.Code
+	}
+	s += ": " + msg
+	if e.RequestID != "" {
+		s += " (request " + e.RequestID + ")"
+	}
+	return s
+}
+
+// HasCode reports whether err is an APIError with the given code.
+func HasCode(err error, code string) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
+
+// IsNotFound reports whether err is a 404 from the server.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// maxErrorBody bounds how much of an error response is read.
+const maxErrorBody = 64 << 10
+
+func decodeError(resp *http.Response) *APIError {
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+		RequestID:  resp.Header.Get("X-Request-ID"),
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+
+	if strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		var p struct {
+			Title     string `json:"title"`
+			Detail    string `json:"detail"`
+			Instance  string `json:"instance"`
+			Code      string `json:"code"`
+			RequestID string `json:"request_id"`
+		}
+		if json.Unmarshal(body, &p) == nil {
+			apiErr.Code = p.Code
+			apiErr.Title = p.Title
+			apiErr.Detail = p.Detail
+			apiErr.Instance = p.Instance
+			if p.RequestID != "" {
+				apiErr.RequestID = p.RequestID
+			}
+			return apiErr
+		}
+	}
+	apiErr.Detail = strings.TrimSpace(string(body))
+	return apiErr
+}
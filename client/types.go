@@ -0,0 +1,193 @@
+package client
+
+import "time"
+
+// --- Constants ---
+
+const (
+	PrefTypeGenre    = "genre"
+	PrefTypeTag      = "tag"
+	PrefStateLike    = "like"
+	PrefStateDislike = "dislike"
+
+	FeedbackNotInterested = "not_interested"
+	FeedbackHide          = "hide"
+
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+
+	EventImpression = "impression"
+	EventClick      = "click"
+	EventPlay       = "play"
+)
+
+// WatchlistMode says how recommendations treat films on the watchlist.
+type WatchlistMode string
+
+const (
+	// WatchlistInclude ranks watchlisted films like any other. It is the
+	// server's default.
+	WatchlistInclude WatchlistMode = "include"
+	WatchlistExclude WatchlistMode = "exclude"
+	// WatchlistSurface moves watchlisted films ahead of the rest.
+	WatchlistSurface WatchlistMode = "surface"
+)
+
+// GroupStrategy says how group recommendations combine the members'
+// satisfaction with a film.
+type GroupStrategy string
+
+const (
+	// GroupAverage is the server's default.
+	GroupAverage      GroupStrategy = "average"
+	GroupLeastMisery  GroupStrategy = "least_misery"
+	GroupMostPleasure GroupStrategy = "most_pleasure"
+)
+
+// --- Films (API v2) ---
+
+type Film struct {
+	ID          string   `json:"id"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Genre       string   `json:"genre"`
+	Director    string   `json:"director"`
+	Year        int      `json:"year"`
+	Rating      float64  `json:"rating"`
+	Tags        []string `json:"tags"`
+	Cast        []string `json:"cast"`
+}
+
+// ScoredFilm is a film with its ranking score for the request.
+type ScoredFilm struct {
+	Film
+	Score float64 `json:"score"`
+}
+
+type FacetValue struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// Paging describes where a page of results sits. NextOffset is nil on the
+// last page.
+type Paging struct {
+	Offset     int  `json:"offset"`
+	Limit      int  `json:"limit"`
+	Total      int  `json:"total"`
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+type SearchResult struct {
+	// QueryID identifies this search in SendEvents.
+	QueryID string                  `json:"query_id"`
+	Query   string                  `json:"query"`
+	Films   []ScoredFilm            `json:"films"`
+	Facets  map[string][]FacetValue `json:"facets"`
+	Paging  Paging                  `json:"paging"`
+}
+
+// Event reports that a search result was shown, clicked or played.
+// Position is the film's zero-based rank in the results.
+type Event struct {
+	Type     string `json:"type"`
+	FilmID   string `json:"film_id"`
+	Position int    `json:"position"`
+}
+
+type RecommendationList struct {
+	UserID        string        `json:"user_id"`
+	WatchlistMode WatchlistMode `json:"watchlist_mode"`
+	Films         []ScoredFilm  `json:"films"`
+}
+
+// GroupFilm is a film with the group's score, from 0 to 1, and each
+// member's predicted satisfaction by user ID.
+type GroupFilm struct {
+	ScoredFilm
+	Satisfaction map[string]float64 `json:"satisfaction"`
+}
+
+type GroupRecommendationList struct {
+	UserIDs  []string      `json:"user_ids"`
+	Strategy GroupStrategy `json:"strategy"`
+	Watched  string        `json:"watched"`
+	Films    []GroupFilm   `json:"films"`
+}
+
+// --- Users ---
+
+type Preference struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	State string `json:"state"`
+}
+
+type User struct {
+	ID          string       `json:"id"`
+	Name        string       `json:"name"`
+	Preferences []Preference `json:"preferences"`
+}
+
+type WatchHistoryEntry struct {
+	FilmID     string   `json:"film_id"`
+	FilmTitle  string   `json:"film_title"`
+	FilmGenre  string   `json:"film_genre"`
+	FilmYear   int      `json:"film_year"`
+	FilmTags   []string `json:"film_tags"`
+	UserRating int      `json:"user_rating"`
+}
+
+type WatchlistEntry struct {
+	FilmID    string    `json:"film_id"`
+	FilmTitle string    `json:"film_title"`
+	FilmGenre string    `json:"film_genre"`
+	FilmYear  int       `json:"film_year"`
+	Note      string    `json:"note"`
+	Position  int       `json:"position"`
+	AddedAt   time.Time `json:"added_at"`
+}
+
+// AddWatchlistRequest adds a film to the watchlist or updates it. Position
+// is zero-based; leave it nil to append new films and keep existing ones in
+// place.
+type AddWatchlistRequest struct {
+	FilmID    string `json:"film_id"`
+	FilmTitle string `json:"film_title,omitempty"`
+	FilmGenre string `json:"film_genre,omitempty"`
+	FilmYear  int    `json:"film_year,omitempty"`
+	Note      string `json:"note,omitempty"`
+	Position  *int   `json:"position,omitempty"`
+}
+
+type FeedbackEntry struct {
+	FilmID       string    `json:"film_id"`
+	Action       string    `json:"action"`
+	FilmTitle    string    `json:"film_title"`
+	FilmGenre    string    `json:"film_genre"`
+	FilmDirector string    `json:"film_director"`
+	FilmTags     []string  `json:"film_tags"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// FeedbackRequest hides a film. The server looks up the film's genre,
+// director and tags for the not-interested ranking penalty itself.
+type FeedbackRequest struct {
+	FilmID    string `json:"film_id"`
+	Action    string `json:"action"`
+	FilmTitle string `json:"film_title,omitempty"`
+}
+
+// --- Authentication ---
+
+type AuthResponse struct {
+	UserID    string    `json:"user_id"`
+	Role      string    `json:"role"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type AuthUser struct {
+	ID   string `json:"id"`
+	Role string `json:"role"`
+}
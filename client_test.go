@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"vespa-demo/client"
+)
+
+// TestGoClient runs the client package against the real handlers.
+func TestGoClient(t *testing.T) {
+	mockVespa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		group := ""
+		if strings.Contains(r.URL.Query().Get("yql"), "all(group") {
+			group = `,` + testGroupingResult
+		}
+		w.Write([]byte(`{"root":{"fields":{"totalCount":1},"children":[` + testMatrixHit + group + `]}}`))
+	}))
+	defer mockVespa.Close()
+
+	srv := newTestServer(t)
+	srv.cfg.Vespa.URL = mockVespa.URL
+	setupTestAccount(t, srv, "1", RoleUser)
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	ctx := context.Background()
+	anon := client.New(ts.URL, client.WithRetries(0, 0))
+
+	auth, err := anon.Login(ctx, "1", "password123")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	c := anon.WithToken(auth.Token)
+	if me, err := c.Me(ctx); err != nil || me.ID != "1" {
+		t.Fatalf("Me = %+v, %v", me, err)
+	}
+
+	t.Run("search", func(t *testing.T) {
+		res, err := anon.Search(ctx, client.SearchParams{Query: "matrix", UserID: "1", Limit: 5})
+		if err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		if len(res.Films) != 1 || res.Films[0].ID != "42" || res.Paging.Limit != 5 {
+			t.Errorf("unexpected result: %+v", res)
+		}
+		if len(res.Facets["genre"]) == 0 {
+			t.Errorf("expected genre facets, got %+v", res.Facets)
+		}
+		if _, err := c.Search(ctx, client.SearchParams{Query: "matrix", Weights: map[string]float64{"rating_weight": 2}}); !client.HasCode(err, client.CodeForbidden) {
+			t.Errorf("expected forbidden for weights without an admin session, got %v", err)
+		}
+
+		events := []client.Event{{Type: client.EventImpression, FilmID: "42", Position: 0}, {Type: client.EventClick, FilmID: "42", Position: 0}}
+		if err := anon.SendEvents(ctx, res.QueryID, events); err != nil {
+			t.Errorf("SendEvents failed: %v", err)
+		}
+		if err := anon.SendEvents(ctx, res.QueryID, nil); !client.HasCode(err, client.CodeInvalidRequest) {
+			t.Errorf("expected invalid_request for no events, got %v", err)
+		}
+	})
+
+	t.Run("preferences", func(t *testing.T) {
+		prefs := []client.Preference{{Type: client.PrefTypeGenre, Value: "Sci-Fi", State: client.PrefStateLike}}
+		if err := c.UpdatePreferences(ctx, "1", prefs); err != nil {
+			t.Fatalf("UpdatePreferences failed: %v", err)
+		}
+		users, err := anon.Users(ctx)
+		if err != nil {
+			t.Fatalf("Users failed: %v", err)
+		}
+		for _, u := range users {
+			if u.ID == "1" && (len(u.Preferences) != 1 || u.Preferences[0].Value != "Sci-Fi") {
+				t.Errorf("preferences not stored: %+v", u.Preferences)
+			}
+		}
+
+		prefs[0].Value = "Nope"
+		if err := c.UpdatePreferences(ctx, "1", prefs); !client.HasCode(err, client.CodeInvalidGenre) {
+			t.Errorf("expected invalid_genre, got %v", err)
+		}
+	})
+
+	t.Run("history", func(t *testing.T) {
+		entry := client.WatchHistoryEntry{FilmID: "7", FilmTitle: "Heat", FilmGenre: "Crime", FilmYear: 1995, UserRating: 4}
+		if err := c.AddHistory(ctx, "1", entry); err != nil {
+			t.Fatalf("AddHistory failed: %v", err)
+		}
+		history, err := c.History(ctx, "1")
+		if err != nil {
+			t.Fatalf("History failed: %v", err)
+		}
+		found := false
+		for _, h := range history {
+			found = found || h.FilmID == "7"
+		}
+		if !found {
+			t.Errorf("expected film 7 in history, got %+v", history)
+		}
+	})
+
+	t.Run("group recommendations", func(t *testing.T) {
+		setupTestAccount(t, srv, "2", RoleUser)
+		for _, id := range []string{"1", "2"} {
+			if _, _, err := srv.party.join("client-test", id); err != nil {
+				t.Fatalf("joining a party failed: %v", err)
+			}
+		}
+		recs, err := c.GroupRecommendations(ctx, []string{"1", "2"}, client.GroupLeastMisery, false)
+		if err != nil {
+			t.Fatalf("GroupRecommendations failed: %v", err)
+		}
+		if recs.Strategy != client.GroupLeastMisery || recs.Watched != "exclude" || len(recs.Films) != 1 {
+			t.Fatalf("unexpected result: %+v", recs)
+		}
+		if _, ok := recs.Films[0].Satisfaction["2"]; !ok {
+			t.Errorf("expected a satisfaction for each member, got %+v", recs.Films[0].Satisfaction)
+		}
+		if _, err := c.GroupRecommendations(ctx, []string{"2", "3"}, "", false); !client.HasCode(err, client.CodeForbidden) {
+			t.Errorf("expected forbidden for a group without the caller, got %v", err)
+		}
+	})
+
+	t.Run("watchlist and feedback", func(t *testing.T) {
+		if err := c.AddToWatchlist(ctx, "1", client.AddWatchlistRequest{FilmID: "42", FilmTitle: "The Matrix"}); err != nil {
+			t.Fatalf("AddToWatchlist failed: %v", err)
+		}
+		if list, err := c.Watchlist(ctx, "1"); err != nil || len(list) != 1 {
+			t.Fatalf("Watchlist = %+v, %v", list, err)
+		}
+		recs, err := c.Recommendations(ctx, "1", client.WatchlistSurface)
+		if err != nil {
+			t.Fatalf("Recommendations failed: %v", err)
+		}
+		if recs.WatchlistMode != client.WatchlistSurface {
+			t.Errorf("expected surface mode, got %q", recs.WatchlistMode)
+		}
+		if err := c.RemoveFromWatchlist(ctx, "1", "42"); err != nil {
+			t.Fatalf("RemoveFromWatchlist failed: %v", err)
+		}
+		if err := c.RemoveFromWatchlist(ctx, "1", "42"); !client.IsNotFound(err) {
+			t.Errorf("expected not found, got %v", err)
+		}
+
+		if err := c.AddFeedback(ctx, "1", client.FeedbackRequest{FilmID: "42", Action: client.FeedbackHide}); err != nil {
+			t.Fatalf("AddFeedback failed: %v", err)
+		}
+		if fb, err := c.Feedback(ctx, "1"); err != nil || len(fb) != 1 || fb[0].Action != client.FeedbackHide {
+			t.Errorf("Feedback = %+v, %v", fb, err)
+		}
+		if err := c.RemoveFeedback(ctx, "1", "42"); err != nil {
+			t.Errorf("RemoveFeedback failed: %v", err)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		if _, err := anon.History(ctx, "1"); !client.HasCode(err, client.CodeAuthRequired) {
+			t.Errorf("expected authentication_required, got %v", err)
+		}
+		if _, err := c.History(ctx, "2"); !client.HasCode(err, client.CodeForbidden) {
+			t.Errorf("expected forbidden, got %v", err)
+		}
+		_, err := anon.Login(ctx, "1", "wrong-password")
+		apiErr, ok := err.(*client.APIError)
+		if !ok || apiErr.Code != client.CodeInvalidCredentials || apiErr.RequestID == "" {
+			t.Errorf("expected invalid_credentials with a request ID, got %v", err)
+		}
+	})
+
+	if err := c.Logout(ctx); err != nil {
+		t.Fatalf("Logout failed: %v", err)
+	}
+	if _, err := c.Me(ctx); !client.HasCode(err, client.CodeAuthRequired) {
+		t.Errorf("expected the session to be gone, got %v", err)
+	}
+}
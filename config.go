@@ -0,0 +1,609 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// --- Configuration ---
+//
+// Settings are resolved in increasing order of precedence: built-in defaults,
+// the YAML config file (-config or CONFIG_FILE), environment variables, and
+// finally command-line flags.
+
+const (
+	redacted = "REDACTED"
+
+	StoreSQLite = "sqlite"
+	StoreMemory = "memory"
+)
+
+type Config struct {
+	ListenAddr string `yaml:"listen_addr"`
+	// Store selects the storage backend. The memory store starts from the
+	// seed data on every run.
+	Store         string `yaml:"store"`
+	DatabaseDSN   string `yaml:"database_dsn"`
+	StaticDir     string `yaml:"static_dir"`
+	DevMode       bool   `yaml:"dev_mode"`
+	AdminPassword string `yaml:"admin_password"`
+
+	HTTP      HTTPConfig      `yaml:"http"`
+	Vespa     VespaConfig     `yaml:"vespa"`
+	Search    SearchConfig    `yaml:"search"`
+	Ranking   RankingConfig   `yaml:"ranking"`
+	CORS      CORSConfig      `yaml:"cors"`
+	Tracing   TracingConfig   `yaml:"tracing"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	SearchLog SearchLogConfig `yaml:"search_log"`
+	Party     PartyConfig     `yaml:"party"`
+	Stream    StreamConfig    `yaml:"stream"`
+	Features  FeaturesConfig  `yaml:"features"`
+
+	// Experiments can only be set in the config file.
+	Experiments []ExperimentConfig `yaml:"experiments"`
+}
+
+// HTTPConfig bounds how long a client may hold a connection. WriteTimeout
+// covers the whole handler, so it must leave room for the Vespa round trip.
+type HTTPConfig struct {
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	MaxHeaderBytes    int           `yaml:"max_header_bytes"`
+	// ShutdownTimeout is how long in-flight requests get to finish after
+	// SIGINT or SIGTERM.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+type VespaConfig struct {
+	URL       string        `yaml:"url"`
+	ConfigURL string        `yaml:"config_url"`
+	Timeout   time.Duration `yaml:"timeout"`
+	// TraceLevel, when positive, asks Vespa for a query trace on sampled
+	// requests and records it as span events.
+	TraceLevel int `yaml:"trace_level"`
+}
+
+type SearchConfig struct {
+	Hits                int `yaml:"hits"`
+	RecommendationCount int `yaml:"recommendation_count"`
+}
+
+// RankingConfig also holds the weights of the personalized rank profile,
+// which are sent to Vespa as query inputs of the same name. They only apply
+// to personalized ranking, i.e. searches with preferences or feedback (or an
+// experiment variant that picks that profile); other searches rank by text
+// relevance alone and are sent none of the weights.
+type RankingConfig struct {
+	FeedbackPenalty    float64 `yaml:"feedback_penalty"`
+	MaxFeedbackPenalty float64 `yaml:"max_feedback_penalty"`
+
+	GenreBoostWeight   float64 `yaml:"genre_boost_weight"`
+	GenrePenaltyWeight float64 `yaml:"genre_penalty_weight"`
+	TagBoostWeight     float64 `yaml:"tag_boost_weight"`
+	TagPenaltyWeight   float64 `yaml:"tag_penalty_weight"`
+	// RatingWeight scales the film's rating, divided by 10.
+	RatingWeight float64 `yaml:"rating_weight"`
+	// RecencyWeight scales a score that is 1 for this year's films and
+	// drops by 0.01 per year of age.
+	RecencyWeight float64 `yaml:"recency_weight"`
+}
+
+type CORSConfig struct {
+	AllowedOrigins []string `yaml:"allowed_origins"`
+}
+
+type TracingConfig struct {
+	// Exporter is none, stdout or otlp.
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the OTLP/HTTP collector URL. When empty the standard
+	// OTEL_EXPORTER_OTLP_* variables apply.
+	Endpoint    string  `yaml:"endpoint"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+type RateLimitConfig struct {
+	// TrustedProxies lists the addresses or CIDR ranges whose
+	// X-Forwarded-For header is believed.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	RateLimits     `yaml:",inline"`
+}
+
+// SearchLogConfig controls how search log entries are written and kept.
+// Entries are written when BatchSize have queued up or every FlushInterval,
+// whichever comes first. Zero Retention keeps entries forever.
+type SearchLogConfig struct {
+	Retention     time.Duration `yaml:"retention"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	BatchSize     int           `yaml:"batch_size"`
+}
+
+// PartyConfig controls watch party sessions. A session ends SessionTTL after
+// it was created if its members have not agreed on a film by then.
+type PartyConfig struct {
+	SessionTTL time.Duration `yaml:"session_ttl"`
+	// Candidates is the number of films members vote on.
+	Candidates int `yaml:"candidates"`
+	// PickRating is the rating recorded when a session's pick is logged to
+	// the members' watch history.
+	PickRating int `yaml:"pick_rating"`
+	// MaxSessions caps the sessions open at once; joins that would create
+	// another are turned away.
+	MaxSessions int `yaml:"max_sessions"`
+}
+
+// StreamConfig controls the recommendation event stream. A comment is sent
+// every HeartbeatInterval so proxies do not drop idle streams.
+type StreamConfig struct {
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+}
+
+// LimitConfig is a token bucket: Rate requests per second on average, with
+// bursts of up to Burst. A zero rate disables the limit.
+type LimitConfig struct {
+	Rate  float64 `json:"rate" yaml:"rate"`
+	Burst int     `json:"burst" yaml:"burst"`
+}
+
+type FeaturesConfig struct {
+	Registration      bool `yaml:"registration"`
+	Watchlist         bool `yaml:"watchlist"`
+	Feedback          bool `yaml:"feedback"`
+	Stats             bool `yaml:"stats"`
+	Metrics           bool `yaml:"metrics"`
+	RequestValidation bool `yaml:"request_validation"`
+	SearchLog         bool `yaml:"search_log"`
+	Events            bool `yaml:"events"`
+	Party             bool `yaml:"party"`
+	Stream            bool `yaml:"stream"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		ListenAddr:  ":3000",
+		Store:       StoreSQLite,
+		DatabaseDSN: "vespa-demo.db",
+		StaticDir:   "static/dist",
+		HTTP: HTTPConfig{
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       15 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			MaxHeaderBytes:    64 << 10,
+			ShutdownTimeout:   15 * time.Second,
+		},
+		Vespa: VespaConfig{
+			URL:       "http://localhost:8080",
+			ConfigURL: "http://localhost:19071",
+			Timeout:   10 * time.Second,
+		},
+		Search: SearchConfig{
+			Hits:                100,
+			RecommendationCount: 5,
+		},
+		Ranking: RankingConfig{
+			FeedbackPenalty:    feedbackPenalty,
+			MaxFeedbackPenalty: maxFeedbackPenalty,
+			// Same as the defaults in film.sd
+			GenreBoostWeight:   10,
+			GenrePenaltyWeight: 10,
+			TagBoostWeight:     5,
+			TagPenaltyWeight:   5,
+		},
+		Tracing: TracingConfig{
+			Exporter:    TraceExporterNone,
+			SampleRatio: 1.0,
+		},
+		RateLimit: RateLimitConfig{
+			RateLimits: RateLimits{
+				Search:          LimitConfig{Rate: 5, Burst: 20},
+				Recommendations: LimitConfig{Rate: 2, Burst: 10},
+				Writes:          LimitConfig{Rate: 5, Burst: 30},
+			},
+		},
+		SearchLog: SearchLogConfig{
+			Retention:     30 * 24 * time.Hour,
+			FlushInterval: 2 * time.Second,
+			BatchSize:     100,
+		},
+		Party: PartyConfig{
+			SessionTTL:  2 * time.Hour,
+			Candidates:  20,
+			PickRating:  3,
+			MaxSessions: 1000,
+		},
+		Stream: StreamConfig{
+			HeartbeatInterval: 15 * time.Second,
+		},
+		Features: FeaturesConfig{
+			Registration:      true,
+			Watchlist:         true,
+			Feedback:          true,
+			Stats:             true,
+			Metrics:           true,
+			RequestValidation: true,
+			SearchLog:         true,
+			Events:            true,
+			Party:             true,
+			Stream:            true,
+		},
+	}
+}
+
+// Validate reports every invalid setting at once.
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.ListenAddr != "", "listen_addr must not be empty")
+	check(c.Store == StoreSQLite || c.Store == StoreMemory, "store must be %s or %s, got %q", StoreSQLite, StoreMemory, c.Store)
+	check(c.Store != StoreSQLite || c.DatabaseDSN != "", "database_dsn must not be empty")
+	check(c.HTTP.ReadHeaderTimeout > 0, "http.read_header_timeout must be positive")
+	check(c.HTTP.ReadTimeout > 0, "http.read_timeout must be positive")
+	check(c.HTTP.IdleTimeout > 0, "http.idle_timeout must be positive")
+	check(c.HTTP.WriteTimeout > c.Vespa.Timeout, "http.write_timeout must be longer than vespa.timeout")
+	check(c.HTTP.MaxHeaderBytes >= 4<<10, "http.max_header_bytes must be at least 4096, got %d", c.HTTP.MaxHeaderBytes)
+	check(c.HTTP.ShutdownTimeout > 0, "http.shutdown_timeout must be positive")
+	check(isHTTPURL(c.Vespa.URL), "vespa.url must be an http(s) URL, got %q", c.Vespa.URL)
+	check(isHTTPURL(c.Vespa.ConfigURL), "vespa.config_url must be an http(s) URL, got %q", c.Vespa.ConfigURL)
+	check(c.Vespa.Timeout > 0, "vespa.timeout must be positive")
+	// Vespa rejects more than 400 hits per query by default
+	check(c.Search.Hits >= 1 && c.Search.Hits <= 400, "search.hits must be between 1 and 400, got %d", c.Search.Hits)
+	// Vespa's trace levels run from 0 (off) to 9
+	check(c.Vespa.TraceLevel >= 0 && c.Vespa.TraceLevel <= 9, "vespa.trace_level must be between 0 and 9, got %d", c.Vespa.TraceLevel)
+	check(c.Search.RecommendationCount >= 1 && c.Search.RecommendationCount <= 50,
+		"search.recommendation_count must be between 1 and 50, got %d", c.Search.RecommendationCount)
+	check(c.Ranking.FeedbackPenalty >= 0, "ranking.feedback_penalty must not be negative")
+	check(c.Ranking.MaxFeedbackPenalty >= c.Ranking.FeedbackPenalty,
+		"ranking.max_feedback_penalty must be at least ranking.feedback_penalty")
+	weights := c.Ranking.weights()
+	for _, name := range rankingWeightNames {
+		check(isValidWeight(weights[name]), "ranking.%s must be a non-negative number, got %g", name, weights[name])
+	}
+	for _, o := range c.CORS.AllowedOrigins {
+		check(o == "*" || isHTTPURL(o), "cors.allowed_origins entry %q must be * or an http(s) origin", o)
+	}
+	check(c.Tracing.Exporter == TraceExporterNone || c.Tracing.Exporter == TraceExporterStdout || c.Tracing.Exporter == TraceExporterOTLP,
+		"tracing.exporter must be %s, %s or %s, got %q", TraceExporterNone, TraceExporterStdout, TraceExporterOTLP, c.Tracing.Exporter)
+	check(c.Tracing.Endpoint == "" || isHTTPURL(c.Tracing.Endpoint), "tracing.endpoint must be an http(s) URL, got %q", c.Tracing.Endpoint)
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
+	if err := c.RateLimit.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("rate_limit: %w", err))
+	}
+	check(c.SearchLog.Retention >= 0, "search_log.retention must not be negative")
+	check(c.SearchLog.FlushInterval > 0, "search_log.flush_interval must be positive")
+	check(c.SearchLog.BatchSize >= 1 && c.SearchLog.BatchSize <= 1000, "search_log.batch_size must be between 1 and 1000, got %d", c.SearchLog.BatchSize)
+	check(c.Party.SessionTTL > 0, "party.session_ttl must be positive")
+	check(c.Party.Candidates >= 1 && c.Party.Candidates <= 100, "party.candidates must be between 1 and 100, got %d", c.Party.Candidates)
+	check(c.Party.PickRating >= 1 && c.Party.PickRating <= 5, "party.pick_rating must be between 1 and 5, got %d", c.Party.PickRating)
+	check(c.Party.MaxSessions >= 1, "party.max_sessions must be at least 1, got %d", c.Party.MaxSessions)
+	check(c.Stream.HeartbeatInterval > 0, "stream.heartbeat_interval must be positive")
+	if err := validateExperiments(c.Experiments); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseTrustedProxies(c.RateLimit.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("rate_limit.trusted_proxies: %w", err))
+	}
+	if c.AdminPassword != "" {
+		if err := validatePassword(c.AdminPassword); err != nil {
+			errs = append(errs, fmt.Errorf("admin_password: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Redacted returns a copy of the config that is safe to print or log.
+func (c Config) Redacted() Config {
+	if c.AdminPassword != "" {
+		c.AdminPassword = redacted
+	}
+	c.CORS.AllowedOrigins = append([]string(nil), c.CORS.AllowedOrigins...)
+	c.RateLimit.TrustedProxies = append([]string(nil), c.RateLimit.TrustedProxies...)
+	return c
+}
+
+// --- Flag and environment bindings ---
+
+// setting binds one config field to a command-line flag and an environment
+// variable. bind returns a flag.Value that reads and writes the field.
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	bind  func(c *Config) flag.Value
+}
+
+var settings = []setting{
+	{"listen", "LISTEN_ADDR", "HTTP listen address",
+		func(c *Config) flag.Value { return (*stringValue)(&c.ListenAddr) }},
+	{"store", "STORE", "storage backend: sqlite or memory",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Store) }},
+	{"db", "DATABASE_DSN", "SQLite database path or DSN",
+		func(c *Config) flag.Value { return (*stringValue)(&c.DatabaseDSN) }},
+	{"static-dir", "STATIC_DIR", "directory of the built frontend",
+		func(c *Config) flag.Value { return (*stringValue)(&c.StaticDir) }},
+	{"dev", "DEV_MODE", "let unauthenticated requests act as any user",
+		func(c *Config) flag.Value { return (*boolValue)(&c.DevMode) }},
+	{"admin-password", "ADMIN_PASSWORD", "password for the bootstrapped admin account",
+		func(c *Config) flag.Value { return (*stringValue)(&c.AdminPassword) }},
+	{"read-header-timeout", "HTTP_READ_HEADER_TIMEOUT", "time allowed to read request headers",
+		func(c *Config) flag.Value { return (*durationValue)(&c.HTTP.ReadHeaderTimeout) }},
+	{"read-timeout", "HTTP_READ_TIMEOUT", "time allowed to read a whole request",
+		func(c *Config) flag.Value { return (*durationValue)(&c.HTTP.ReadTimeout) }},
+	{"write-timeout", "HTTP_WRITE_TIMEOUT", "time allowed to handle a request and write the response",
+		func(c *Config) flag.Value { return (*durationValue)(&c.HTTP.WriteTimeout) }},
+	{"idle-timeout", "HTTP_IDLE_TIMEOUT", "how long idle keep-alive connections stay open",
+		func(c *Config) flag.Value { return (*durationValue)(&c.HTTP.IdleTimeout) }},
+	{"max-header-bytes", "HTTP_MAX_HEADER_BYTES", "maximum size of request headers",
+		func(c *Config) flag.Value { return (*intValue)(&c.HTTP.MaxHeaderBytes) }},
+	{"shutdown-timeout", "SHUTDOWN_TIMEOUT", "how long to drain in-flight requests on shutdown",
+		func(c *Config) flag.Value { return (*durationValue)(&c.HTTP.ShutdownTimeout) }},
+	{"vespa-url", "VESPA_URL", "Vespa query and document API endpoint",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Vespa.URL) }},
+	{"vespa-config-url", "VESPA_CONFIG_URL", "Vespa config server endpoint",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Vespa.ConfigURL) }},
+	{"vespa-timeout", "VESPA_TIMEOUT", "timeout for Vespa requests",
+		func(c *Config) flag.Value { return (*durationValue)(&c.Vespa.Timeout) }},
+	{"vespa-trace-level", "VESPA_TRACE_LEVEL", "Vespa trace.level recorded on sampled spans (0 disables)",
+		func(c *Config) flag.Value { return (*intValue)(&c.Vespa.TraceLevel) }},
+	{"search-hits", "SEARCH_HITS", "hits requested from Vespa per search",
+		func(c *Config) flag.Value { return (*intValue)(&c.Search.Hits) }},
+	{"recommendation-count", "RECOMMENDATION_COUNT", "number of recommendations returned",
+		func(c *Config) flag.Value { return (*intValue)(&c.Search.RecommendationCount) }},
+	{"feedback-penalty", "FEEDBACK_PENALTY", "affinity penalty per not-interested film",
+		func(c *Config) flag.Value { return (*floatValue)(&c.Ranking.FeedbackPenalty) }},
+	{"max-feedback-penalty", "MAX_FEEDBACK_PENALTY", "cap on the total feedback penalty per label",
+		func(c *Config) flag.Value { return (*floatValue)(&c.Ranking.MaxFeedbackPenalty) }},
+	{"genre-boost-weight", "GENRE_BOOST_WEIGHT", "score added for a liked genre",
+		func(c *Config) flag.Value { return (*floatValue)(&c.Ranking.GenreBoostWeight) }},
+	{"genre-penalty-weight", "GENRE_PENALTY_WEIGHT", "score taken off for a disliked genre",
+		func(c *Config) flag.Value { return (*floatValue)(&c.Ranking.GenrePenaltyWeight) }},
+	{"tag-boost-weight", "TAG_BOOST_WEIGHT", "score added for films with a liked tag",
+		func(c *Config) flag.Value { return (*floatValue)(&c.Ranking.TagBoostWeight) }},
+	{"tag-penalty-weight", "TAG_PENALTY_WEIGHT", "score taken off for films with a disliked tag",
+		func(c *Config) flag.Value { return (*floatValue)(&c.Ranking.TagPenaltyWeight) }},
+	{"rating-weight", "RATING_WEIGHT", "weight of the film rating in personalized ranking",
+		func(c *Config) flag.Value { return (*floatValue)(&c.Ranking.RatingWeight) }},
+	{"recency-weight", "RECENCY_WEIGHT", "weight of the release year in personalized ranking",
+		func(c *Config) flag.Value { return (*floatValue)(&c.Ranking.RecencyWeight) }},
+	{"cors-origins", "CORS_ALLOWED_ORIGINS", "comma-separated origins allowed by CORS",
+		func(c *Config) flag.Value { return (*listValue)(&c.CORS.AllowedOrigins) }},
+	{"trace-exporter", "TRACE_EXPORTER", "trace exporter: none, stdout or otlp",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Tracing.Exporter) }},
+	{"trace-endpoint", "TRACE_ENDPOINT", "OTLP/HTTP collector URL",
+		func(c *Config) flag.Value { return (*stringValue)(&c.Tracing.Endpoint) }},
+	{"trace-sample-ratio", "TRACE_SAMPLE_RATIO", "fraction of new traces to sample",
+		func(c *Config) flag.Value { return (*floatValue)(&c.Tracing.SampleRatio) }},
+	{"trusted-proxies", "TRUSTED_PROXIES", "comma-separated proxy addresses or CIDRs trusted for X-Forwarded-For",
+		func(c *Config) flag.Value { return (*listValue)(&c.RateLimit.TrustedProxies) }},
+	{"search-rate", "RATE_LIMIT_SEARCH_RATE", "searches per second per client (0 disables)",
+		func(c *Config) flag.Value { return (*floatValue)(&c.RateLimit.Search.Rate) }},
+	{"search-burst", "RATE_LIMIT_SEARCH_BURST", "search burst per client",
+		func(c *Config) flag.Value { return (*intValue)(&c.RateLimit.Search.Burst) }},
+	{"recommendations-rate", "RATE_LIMIT_RECOMMENDATIONS_RATE", "recommendation requests per second per client (0 disables)",
+		func(c *Config) flag.Value { return (*floatValue)(&c.RateLimit.Recommendations.Rate) }},
+	{"recommendations-burst", "RATE_LIMIT_RECOMMENDATIONS_BURST", "recommendation burst per client",
+		func(c *Config) flag.Value { return (*intValue)(&c.RateLimit.Recommendations.Burst) }},
+	{"writes-rate", "RATE_LIMIT_WRITES_RATE", "write requests per second per client (0 disables)",
+		func(c *Config) flag.Value { return (*floatValue)(&c.RateLimit.Writes.Rate) }},
+	{"writes-burst", "RATE_LIMIT_WRITES_BURST", "write burst per client",
+		func(c *Config) flag.Value { return (*intValue)(&c.RateLimit.Writes.Burst) }},
+	{"search-log-retention", "SEARCH_LOG_RETENTION", "how long search log entries are kept (0 keeps them forever)",
+		func(c *Config) flag.Value { return (*durationValue)(&c.SearchLog.Retention) }},
+	{"search-log-flush-interval", "SEARCH_LOG_FLUSH_INTERVAL", "longest time a search log entry waits before being written",
+		func(c *Config) flag.Value { return (*durationValue)(&c.SearchLog.FlushInterval) }},
+	{"search-log-batch-size", "SEARCH_LOG_BATCH_SIZE", "search log entries written per batch",
+		func(c *Config) flag.Value { return (*intValue)(&c.SearchLog.BatchSize) }},
+	{"party-session-ttl", "PARTY_SESSION_TTL", "how long a watch party session lasts without a pick",
+		func(c *Config) flag.Value { return (*durationValue)(&c.Party.SessionTTL) }},
+	{"party-candidates", "PARTY_CANDIDATES", "films offered for voting in a watch party",
+		func(c *Config) flag.Value { return (*intValue)(&c.Party.Candidates) }},
+	{"party-pick-rating", "PARTY_PICK_RATING", "rating recorded when a watch party pick is logged to watch history",
+		func(c *Config) flag.Value { return (*intValue)(&c.Party.PickRating) }},
+	{"party-max-sessions", "PARTY_MAX_SESSIONS", "most watch party sessions open at once",
+		func(c *Config) flag.Value { return (*intValue)(&c.Party.MaxSessions) }},
+	{"stream-heartbeat-interval", "STREAM_HEARTBEAT_INTERVAL", "how often idle recommendation streams send a heartbeat",
+		func(c *Config) flag.Value { return (*durationValue)(&c.Stream.HeartbeatInterval) }},
+	{"enable-registration", "ENABLE_REGISTRATION", "allow self-service account registration",
+		func(c *Config) flag.Value { return (*boolValue)(&c.Features.Registration) }},
+	{"enable-watchlist", "ENABLE_WATCHLIST", "serve the watchlist endpoints",
+		func(c *Config) flag.Value { return (*boolValue)(&c.Features.Watchlist) }},
+	{"enable-feedback", "ENABLE_FEEDBACK", "serve the feedback endpoints",
+		func(c *Config) flag.Value { return (*boolValue)(&c.Features.Feedback) }},
+	{"enable-stats", "ENABLE_STATS", "serve the stats endpoint",
+		func(c *Config) flag.Value { return (*boolValue)(&c.Features.Stats) }},
+	{"enable-metrics", "ENABLE_METRICS", "serve Prometheus metrics at /metrics",
+		func(c *Config) flag.Value { return (*boolValue)(&c.Features.Metrics) }},
+	{"enable-request-validation", "ENABLE_REQUEST_VALIDATION", "validate API requests against the OpenAPI spec",
+		func(c *Config) flag.Value { return (*boolValue)(&c.Features.RequestValidation) }},
+	{"enable-search-log", "ENABLE_SEARCH_LOG", "record searches and serve the search analytics endpoint",
+		func(c *Config) flag.Value { return (*boolValue)(&c.Features.SearchLog) }},
+	{"enable-events", "ENABLE_EVENTS", "accept impression, click and play events at /api/events",
+		func(c *Config) flag.Value { return (*boolValue)(&c.Features.Events) }},
+	{"enable-party", "ENABLE_PARTY", "serve watch party sessions at /ws/party/{code}",
+		func(c *Config) flag.Value { return (*boolValue)(&c.Features.Party) }},
+	{"enable-stream", "ENABLE_STREAM", "serve live recommendation updates at /api/users/{id}/recommendations/stream",
+		func(c *Config) flag.Value { return (*boolValue)(&c.Features.Stream) }},
+}
+
+// addConfigFlags registers every setting on fset and returns the -config flag.
+// Flags are parsed into a scratch config so that loadConfig can layer them
+// over the file and environment afterwards.
+func addConfigFlags(fset *flag.FlagSet) *string {
+	scratch := defaultConfig()
+	for _, s := range settings {
+		fset.Var(s.bind(&scratch), s.flag, s.usage+" (env "+s.env+")")
+	}
+	return fset.String("config", "", "path to a YAML config file (env CONFIG_FILE)")
+}
+
+// loadConfig resolves the effective config. fset must have been set up with
+// addConfigFlags and already parsed.
+func loadConfig(fset *flag.FlagSet, configPath string) (Config, error) {
+	cfg := defaultConfig()
+
+	if configPath == "" {
+		configPath = getEnv("CONFIG_FILE", "")
+	}
+	if configPath != "" {
+		data, err := os.ReadFile(configPath)
+		if err != nil {
+			return Config{}, fmt.Errorf("reading config file: %w", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&cfg); err != nil && err != io.EOF {
+			return Config{}, fmt.Errorf("parsing config file %s: %w", configPath, err)
+		}
+	}
+
+	for _, s := range settings {
+		if v := getEnv(s.env, ""); v != "" {
+			if err := s.bind(&cfg).Set(v); err != nil {
+				return Config{}, fmt.Errorf("environment variable %s: %w", s.env, err)
+			}
+		}
+	}
+
+	byFlag := map[string]setting{}
+	for _, s := range settings {
+		byFlag[s.flag] = s
+	}
+	var flagErr error
+	fset.Visit(func(f *flag.Flag) {
+		if s, ok := byFlag[f.Name]; ok && flagErr == nil {
+			flagErr = s.bind(&cfg).Set(f.Value.String())
+		}
+	})
+	if flagErr != nil {
+		return Config{}, flagErr
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return cfg, nil
+}
+
+// --- CLI ---
+
+// runConfig implements `vespa-demo config print`.
+func runConfig(args []string, stdout io.Writer) error {
+	fset := flag.NewFlagSet("config", flag.ContinueOnError)
+	configPath := addConfigFlags(fset)
+	fset.Usage = func() {
+		fmt.Fprintln(fset.Output(), "Usage: vespa-demo config [flags] print")
+		fset.PrintDefaults()
+	}
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if fset.NArg() != 1 || fset.Arg(0) != "print" {
+		fset.Usage()
+		return errors.New("expected: print")
+	}
+
+	cfg, err := loadConfig(fset, *configPath)
+	if err != nil {
+		return err
+	}
+	enc := yaml.NewEncoder(stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(cfg.Redacted()); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// --- flag.Value adapters ---
+
+type stringValue string
+
+func (v *stringValue) String() string     { return string(*v) }
+func (v *stringValue) Set(s string) error { *v = stringValue(s); return nil }
+
+type intValue int
+
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid integer %q", s)
+	}
+	*v = intValue(n)
+	return nil
+}
+
+type floatValue float64
+
+func (v *floatValue) String() string { return strconv.FormatFloat(float64(*v), 'f', -1, 64) }
+func (v *floatValue) Set(s string) error {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %q", s)
+	}
+	*v = floatValue(f)
+	return nil
+}
+
+type boolValue bool
+
+func (v *boolValue) String() string   { return strconv.FormatBool(bool(*v)) }
+func (v *boolValue) IsBoolFlag() bool { return true }
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("invalid boolean %q", s)
+	}
+	*v = boolValue(b)
+	return nil
+}
+
+type durationValue time.Duration
+
+func (v *durationValue) String() string { return time.Duration(*v).String() }
+func (v *durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*v = durationValue(d)
+	return nil
+}
+
+// listValue is a comma-separated list. Setting it replaces the whole list.
+type listValue []string
+
+func (v *listValue) String() string { return strings.Join(*v, ",") }
+func (v *listValue) Set(s string) error {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	*v = items
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func parseConfig(t *testing.T, args ...string) (Config, error) {
+	t.Helper()
+	fset := flag.NewFlagSet("test", flag.ContinueOnError)
+	fset.SetOutput(io.Discard)
+	configPath := addConfigFlags(fset)
+	if err := fset.Parse(args); err != nil {
+		t.Fatalf("parse flags: %v", err)
+	}
+	return loadConfig(fset, *configPath)
+}
+
+func TestLoadConfig_Defaults(t *testing.T) {
+	c, err := parseConfig(t)
+	if err != nil {
+		t.Fatalf("defaults should be valid: %v", err)
+	}
+	if c.ListenAddr != ":3000" || c.DatabaseDSN != "vespa-demo.db" || c.StaticDir != "static/dist" {
+		t.Errorf("unexpected defaults: %+v", c)
+	}
+	if c.Vespa.Timeout != 10*time.Second || c.Search.Hits != 100 || c.Search.RecommendationCount != 5 {
+		t.Errorf("unexpected defaults: %+v", c)
+	}
+	if !c.Features.Registration || !c.Features.Watchlist || !c.Features.Feedback || !c.Features.Stats {
+		t.Errorf("all features should default to enabled: %+v", c.Features)
+	}
+}
+
+func TestLoadConfig_Precedence(t *testing.T) {
+	path := writeConfigFile(t, `
+listen_addr: ":4000"
+database_dsn: file.db
+vespa:
+  url: http://file-vespa:8080
+  timeout: 3s
+search:
+  hits: 50
+features:
+  stats: false
+`)
+	t.Setenv("DATABASE_DSN", "env.db")
+	t.Setenv("VESPA_URL", "http://env-vespa:8080")
+	t.Setenv("SEARCH_HITS", "60")
+
+	c, err := parseConfig(t, "-config", path, "-search-hits", "70")
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		got  any
+		want any
+	}{
+		{"file over default", c.ListenAddr, ":4000"},
+		{"file duration", c.Vespa.Timeout, 3 * time.Second},
+		{"file bool", c.Features.Stats, false},
+		{"env over file", c.DatabaseDSN, "env.db"},
+		{"env over file (legacy VESPA_URL)", c.Vespa.URL, "http://env-vespa:8080"},
+		{"flag over env", c.Search.Hits, 70},
+		{"untouched default", c.Search.RecommendationCount, 5},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfig_ConfigFileFromEnv(t *testing.T) {
+	t.Setenv("CONFIG_FILE", writeConfigFile(t, "static_dir: public\n"))
+
+	c, err := parseConfig(t)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if c.StaticDir != "public" {
+		t.Errorf("expected static_dir from CONFIG_FILE, got %q", c.StaticDir)
+	}
+}
+
+func TestLoadConfig_Errors(t *testing.T) {
+	t.Run("unknown key", func(t *testing.T) {
+		path := writeConfigFile(t, "vespa:\n  ulr: http://typo:8080\n")
+		if _, err := parseConfig(t, "-config", path); err == nil {
+			t.Error("expected an error for an unknown config key")
+		}
+	})
+
+	t.Run("bad env value", func(t *testing.T) {
+		t.Setenv("VESPA_TIMEOUT", "soon")
+		_, err := parseConfig(t)
+		if err == nil || !strings.Contains(err.Error(), "VESPA_TIMEOUT") {
+			t.Errorf("expected error naming VESPA_TIMEOUT, got %v", err)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		if _, err := parseConfig(t, "-config", filepath.Join(t.TempDir(), "nope.yaml")); err == nil {
+			t.Error("expected an error for a missing config file")
+		}
+	})
+}
+
+func TestConfigValidate(t *testing.T) {
+	c := defaultConfig()
+	c.Vespa.URL = "localhost:8080"
+	c.Search.Hits = 0
+	c.Ranking.MaxFeedbackPenalty = 0.5
+	c.Ranking.RatingWeight = -1
+	c.CORS.AllowedOrigins = []string{"example.com"}
+	c.HTTP.WriteTimeout = c.Vespa.Timeout
+	c.SearchLog.BatchSize = 0
+	c.Party.PickRating = 0
+	c.Party.MaxSessions = 0
+	c.Stream.HeartbeatInterval = 0
+	c.Experiments = []ExperimentConfig{{Name: "ranking"}}
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{"vespa.url", "search.hits", "ranking.max_feedback_penalty", "ranking.rating_weight", "cors.allowed_origins", "http.write_timeout", "search_log.batch_size", "party.pick_rating", "party.max_sessions", "stream.heartbeat_interval", "experiment \"ranking\""} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to mention %s, got:\n%v", want, err)
+		}
+	}
+}
+
+func TestRunConfigPrint(t *testing.T) {
+	t.Setenv("ADMIN_PASSWORD", "super-secret-password")
+
+	var out bytes.Buffer
+	if err := runConfig([]string{"-cors-origins", "http://a.test, http://b.test", "print"}, &out); err != nil {
+		t.Fatalf("config print: %v", err)
+	}
+
+	printed := out.String()
+	if strings.Contains(printed, "super-secret-password") {
+		t.Error("admin password should be redacted")
+	}
+	for _, want := range []string{"admin_password: " + redacted, "timeout: 10s", "- http://a.test", "- http://b.test"} {
+		if !strings.Contains(printed, want) {
+			t.Errorf("expected %q in output:\n%s", want, printed)
+		}
+	}
+
+	if err := runConfig([]string{"show"}, io.Discard); err == nil {
+		t.Error("expected an error for an unknown config command")
+	}
+}
+
+func TestWithCORS(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := withCORS([]string{"http://allowed.test"}, next)
+
+	t.Run("allowed origin", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+		req.Header.Set("Origin", "http://allowed.test")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "http://allowed.test" {
+			t.Errorf("expected allowed origin echoed, got %q", got)
+		}
+		if w.Code != http.StatusTeapot {
+			t.Errorf("request should reach the handler, got %d", w.Code)
+		}
+		exposed := w.Header().Get("Access-Control-Expose-Headers")
+		for _, h := range []string{requestIDHeader, experimentsHeader, "Retry-After", "RateLimit-Remaining"} {
+			if !strings.Contains(exposed, h) {
+				t.Errorf("expected %s in Access-Control-Expose-Headers, got %q", h, exposed)
+			}
+		}
+	})
+
+	t.Run("other origin", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+		req.Header.Set("Origin", "http://evil.test")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("unlisted origin should get no CORS headers, got %q", got)
+		}
+	})
+
+	t.Run("preflight", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodOptions, "/api/users/1/preferences", nil)
+		req.Header.Set("Origin", "http://allowed.test")
+		req.Header.Set("Access-Control-Request-Method", http.MethodPatch)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusNoContent {
+			t.Errorf("expected 204 for preflight, got %d", w.Code)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(got, http.MethodPatch) {
+			t.Errorf("expected PATCH in Access-Control-Allow-Methods on preflight, got %q", got)
+		}
+	})
+
+	t.Run("wildcard", func(t *testing.T) {
+		handler := withCORS([]string{"*", "http://allowed.test"}, next)
+		for origin, want := range map[string]string{"http://other.test": "*", "http://allowed.test": "http://allowed.test"} {
+			req := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+			req.Header.Set("Origin", origin)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != want {
+				t.Errorf("%s: expected Access-Control-Allow-Origin %q, got %q", origin, want, got)
+			}
+			if got, creds := w.Header().Get("Access-Control-Allow-Credentials"), want != "*"; (got == "true") != creds {
+				t.Errorf("%s: expected credentials allowed=%v, got %q", origin, creds, got)
+			}
+		}
+	})
+}
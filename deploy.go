@@ -0,0 +1,297 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// --- Application deployment ---
+//
+// deploy replaces `vespa deploy`: it zips the application package, sends it
+// to the config server's deploy API and waits until every service runs the
+// new config generation.
+
+const (
+	// deployInstancePath is the only application instance a self-hosted
+	// Vespa runs.
+	deployInstancePath = "/application/v2/tenant/default/application/default/environment/prod/region/default/instance/default"
+	deployPreparePath  = "/application/v2/tenant/default/prepareandactivate"
+	// deployPollInterval is how often convergence is checked.
+	deployPollInterval = 2 * time.Second
+	// deployRequestTimeout bounds each call to the config server. Preparing
+	// a large package can take minutes.
+	deployRequestTimeout = 5 * time.Minute
+)
+
+// DeployLogEntry is a message the config server logged while preparing.
+type DeployLogEntry struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+// DeployService is a service affected by a config change.
+type DeployService struct {
+	ServiceName string `json:"serviceName"`
+	ServiceType string `json:"serviceType"`
+	ConfigID    string `json:"configId"`
+	HostName    string `json:"hostName"`
+}
+
+// DeployAction is a step the deployment needs before all of it takes effect,
+// such as restarting services or re-feeding documents.
+type DeployAction struct {
+	// Name identifies refeed and reindex actions, e.g. field-type-change.
+	Name         string          `json:"name"`
+	DocumentType string          `json:"documentType"`
+	ClusterName  string          `json:"clusterName"`
+	Messages     []string        `json:"messages"`
+	Services     []DeployService `json:"services"`
+}
+
+type DeployChangeActions struct {
+	Restart []DeployAction `json:"restart"`
+	Refeed  []DeployAction `json:"refeed"`
+	Reindex []DeployAction `json:"reindex"`
+}
+
+// DeployResult is the config server's answer to a deployment.
+type DeployResult struct {
+	SessionID     string              `json:"session-id"`
+	Message       string              `json:"message"`
+	Log           []DeployLogEntry    `json:"log"`
+	ChangeActions DeployChangeActions `json:"configChangeActions"`
+}
+
+// deployError is the config server's error response.
+type deployError struct {
+	Code    string `json:"error-code"`
+	Message string `json:"message"`
+}
+
+// ServiceConvergence reports whether the services run the wanted config
+// generation.
+type ServiceConvergence struct {
+	Converged         bool  `json:"converged"`
+	WantedGeneration  int64 `json:"wantedGeneration"`
+	CurrentGeneration int64 `json:"currentGeneration"`
+}
+
+// zipApplication packages the application in dir. Hidden files are left out.
+func zipApplication(dir string) ([]byte, error) {
+	if _, err := os.Stat(filepath.Join(dir, "services.xml")); err != nil {
+		return nil, fmt.Errorf("%s is not a Vespa application package: %w", dir, err)
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		w, err := zw.Create(filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// deployApplication sends the zipped package to the config server. A dry run
+// validates the package and reports the changes it would need without
+// activating it.
+func deployApplication(ctx context.Context, client *http.Client, configURL string, pkg []byte, dryRun bool) (DeployResult, error) {
+	u := strings.TrimRight(configURL, "/") + deployPreparePath
+	if dryRun {
+		u += "?dryRun=true"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(pkg))
+	if err != nil {
+		return DeployResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/zip")
+	resp, err := client.Do(req)
+	if err != nil {
+		return DeployResult{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return DeployResult{}, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var e deployError
+		if json.Unmarshal(body, &e) == nil && e.Message != "" {
+			return DeployResult{}, fmt.Errorf("config server rejected the deployment (%s): %s", e.Code, e.Message)
+		}
+		return DeployResult{}, fmt.Errorf("config server returned %s", resp.Status)
+	}
+	var result DeployResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		return DeployResult{}, fmt.Errorf("invalid deploy response: %w", err)
+	}
+	return result, nil
+}
+
+// waitForConvergence polls the config server until every service runs the
+// latest config generation or ctx is done.
+func waitForConvergence(ctx context.Context, client *http.Client, configURL string, interval time.Duration) (ServiceConvergence, error) {
+	u := strings.TrimRight(configURL, "/") + deployInstancePath + "/serviceconverge"
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last ServiceConvergence
+	var lastErr error
+	for {
+		var c ServiceConvergence
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return c, err
+		}
+		resp, err := client.Do(req)
+		if err == nil {
+			err = json.NewDecoder(resp.Body).Decode(&c)
+			resp.Body.Close()
+		}
+		// Services only report once they are up, so errors are retried
+		// until ctx ends.
+		switch {
+		case err == nil && c.Converged:
+			return c, nil
+		case err == nil:
+			last, lastErr = c, nil
+		case ctx.Err() == nil:
+			lastErr = err
+		}
+
+		select {
+		case <-ctx.Done():
+			if lastErr != nil || last.WantedGeneration == 0 {
+				return last, fmt.Errorf("services did not converge: %w", cmp.Or(lastErr, ctx.Err()))
+			}
+			return last, fmt.Errorf("services did not converge: at generation %d, want %d", last.CurrentGeneration, last.WantedGeneration)
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeDeployResult prints the config server's messages and the actions the
+// deployment needs.
+func writeDeployResult(w io.Writer, result DeployResult) {
+	fmt.Fprintln(w, result.Message)
+	for _, e := range result.Log {
+		if e.Level == "WARNING" || e.Level == "ERROR" {
+			fmt.Fprintf(w, "%s: %s\n", e.Level, e.Message)
+		}
+	}
+
+	actions := result.ChangeActions
+	if len(actions.Restart)+len(actions.Refeed)+len(actions.Reindex) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Actions needed:")
+	for _, a := range actions.Restart {
+		var services []string
+		for _, s := range a.Services {
+			services = append(services, s.ServiceName+" on "+s.HostName)
+		}
+		fmt.Fprintf(w, "  restart %s in cluster %s: %s\n", strings.Join(services, ", "), a.ClusterName, strings.Join(a.Messages, "; "))
+	}
+	for _, a := range actions.Refeed {
+		fmt.Fprintf(w, "  re-feed %s documents in cluster %s (%s): %s\n", a.DocumentType, a.ClusterName, a.Name, strings.Join(a.Messages, "; "))
+	}
+	for _, a := range actions.Reindex {
+		fmt.Fprintf(w, "  reindex %s documents in cluster %s (%s): %s\n", a.DocumentType, a.ClusterName, a.Name, strings.Join(a.Messages, "; "))
+	}
+}
+
+func runDeploy(args []string, stdout io.Writer) error {
+	fset := flag.NewFlagSet("deploy", flag.ContinueOnError)
+	configPath := addConfigFlags(fset)
+	dryRun := fset.Bool("dry-run", false, "validate the package and report needed actions without activating it")
+	wait := fset.Duration("wait", 5*time.Minute, "how long to wait for services to converge; 0 skips waiting")
+	fset.Usage = func() {
+		fmt.Fprintln(fset.Output(), "Usage: vespa-demo deploy [flags] [application-dir]")
+		fset.PrintDefaults()
+	}
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if fset.NArg() > 1 {
+		fset.Usage()
+		return errors.New("expected at most one application directory")
+	}
+	if *wait < 0 {
+		return errors.New("-wait must not be negative")
+	}
+	dir := "vespa-app"
+	if fset.NArg() == 1 {
+		dir = fset.Arg(0)
+	}
+
+	cfg, err := loadConfig(fset, *configPath)
+	if err != nil {
+		return err
+	}
+	pkg, err := zipApplication(dir)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	client := &http.Client{Timeout: deployRequestTimeout}
+	result, err := deployApplication(ctx, client, cfg.Vespa.ConfigURL, pkg, *dryRun)
+	if err != nil {
+		return err
+	}
+	writeDeployResult(stdout, result)
+	if *dryRun || *wait == 0 {
+		return nil
+	}
+
+	fmt.Fprintln(stdout, "Waiting for services to converge...")
+	ctx, cancel := context.WithTimeout(ctx, *wait)
+	defer cancel()
+	c, err := waitForConvergence(ctx, client, cfg.Vespa.ConfigURL, deployPollInterval)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Services converged on config generation %d\n", c.CurrentGeneration)
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestZipApplication(t *testing.T) {
+	pkg, err := zipApplication("vespa-app")
+	if err != nil {
+		t.Fatalf("zipApplication failed: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(pkg), int64(len(pkg)))
+	if err != nil {
+		t.Fatalf("invalid zip: %v", err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if !slices.Contains(names, "services.xml") || !slices.Contains(names, "schemas/film.sd") {
+		t.Errorf("expected services.xml and schemas/film.sd, got %v", names)
+	}
+
+	if _, err := zipApplication(t.TempDir()); err == nil || !strings.Contains(err.Error(), "not a Vespa application package") {
+		t.Errorf("expected an error for a directory without services.xml, got %v", err)
+	}
+}
+
+// fakeConfigServer answers the deploy API like a Vespa config server.
+// Convergence is reported after pending polls.
+func fakeConfigServer(t *testing.T, pending int32) (*httptest.Server, *atomic.Int32, *atomic.Int32) {
+	t.Helper()
+	var deploys, polls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == deployPreparePath:
+			deploys.Add(1)
+			body, _ := io.ReadAll(r.Body)
+			zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+			if r.Header.Get("Content-Type") != "application/zip" || err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error-code":"BAD_REQUEST","message":"expected a zipped application"}`))
+				return
+			}
+			for _, f := range zr.File {
+				if f.Name == "schemas/film.sd" {
+					rc, _ := f.Open()
+					sd, _ := io.ReadAll(rc)
+					rc.Close()
+					if strings.Contains(string(sd), "invalid") {
+						w.WriteHeader(http.StatusBadRequest)
+						w.Write([]byte(`{"error-code":"INVALID_APPLICATION_PACKAGE","message":"Invalid application package: film.sd has errors"}`))
+						return
+					}
+				}
+			}
+			verb := "prepared and activated"
+			if r.URL.Query().Get("dryRun") == "true" {
+				verb = "prepared"
+			}
+			w.Write([]byte(`{"session-id":"3","message":"Session 3 for tenant 'default' ` + verb + `.",
+				"log":[{"level":"INFO","message":"ok"},{"level":"WARNING","message":"Field 'year' changed type"}],
+				"configChangeActions":{
+					"restart":[{"clusterName":"films","messages":["Change in attribute"],"services":[{"serviceName":"searchnode","hostName":"vespa-container"}]}],
+					"refeed":[{"name":"field-type-change","documentType":"film","clusterName":"films","messages":["year: int -> long"]}],
+					"reindex":[]}}`))
+		case r.Method == http.MethodGet && r.URL.Path == deployInstancePath+"/serviceconverge":
+			if polls.Add(1) <= pending {
+				w.Write([]byte(`{"converged":false,"wantedGeneration":3,"currentGeneration":2}`))
+				return
+			}
+			w.Write([]byte(`{"converged":true,"wantedGeneration":3,"currentGeneration":3}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &deploys, &polls
+}
+
+func TestRunDeploy(t *testing.T) {
+	ts, deploys, polls := fakeConfigServer(t, 0)
+
+	var out bytes.Buffer
+	if err := runDeploy([]string{"-vespa-config-url", ts.URL}, &out); err != nil {
+		t.Fatalf("runDeploy failed: %v", err)
+	}
+	for _, want := range []string{
+		"Session 3 for tenant 'default' prepared and activated.",
+		"WARNING: Field 'year' changed type",
+		"restart searchnode on vespa-container in cluster films: Change in attribute",
+		"re-feed film documents in cluster films (field-type-change): year: int -> long",
+		"Services converged on config generation 3",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected output to contain %q, got\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "INFO") {
+		t.Errorf("expected info log entries to be left out, got\n%s", out.String())
+	}
+	if deploys.Load() != 1 || polls.Load() != 1 {
+		t.Errorf("expected one deploy and one convergence check, got %d and %d", deploys.Load(), polls.Load())
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := runDeploy([]string{"-vespa-config-url", ts.URL, "-dry-run", "vespa-app"}, &out); err != nil {
+			t.Fatalf("runDeploy failed: %v", err)
+		}
+		if !strings.Contains(out.String(), "prepared.") || strings.Contains(out.String(), "converge") {
+			t.Errorf("expected a validation without waiting, got\n%s", out.String())
+		}
+		if polls.Load() != 1 {
+			t.Errorf("expected no convergence check for a dry run, got %d", polls.Load())
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "services.xml"), []byte("<services/>"), 0o644)
+		os.Mkdir(filepath.Join(dir, "schemas"), 0o755)
+		os.WriteFile(filepath.Join(dir, "schemas", "film.sd"), []byte("invalid"), 0o644)
+		err := runDeploy([]string{"-vespa-config-url", ts.URL, dir}, io.Discard)
+		if err == nil || !strings.Contains(err.Error(), "INVALID_APPLICATION_PACKAGE") || !strings.Contains(err.Error(), "film.sd has errors") {
+			t.Errorf("expected the config server's error, got %v", err)
+		}
+	})
+}
+
+func TestWaitForConvergence(t *testing.T) {
+	ts, _, polls := fakeConfigServer(t, 2)
+	c, err := waitForConvergence(context.Background(), http.DefaultClient, ts.URL, time.Millisecond)
+	if err != nil || !c.Converged || c.CurrentGeneration != 3 || polls.Load() != 3 {
+		t.Errorf("expected convergence on the third poll, got %+v after %d polls: %v", c, polls.Load(), err)
+	}
+
+	ts, _, _ = fakeConfigServer(t, 1000)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = waitForConvergence(ctx, http.DefaultClient, ts.URL, time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "at generation 2, want 3") {
+		t.Errorf("expected a timeout error with the generations, got %v", err)
+	}
+}
+
+func TestRunDeployFlags(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"a", "b"}, "at most one"},
+		{[]string{"-wait", "-1s"}, "-wait"},
+		{[]string{"missing-dir"}, "not a Vespa application package"},
+	} {
+		if err := runDeploy(tc.args, io.Discard); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("runDeploy(%v) = %v, want an error about %s", tc.args, err, tc.want)
+		}
+	}
+}
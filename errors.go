@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// --- API errors ---
+//
+// Every API error is an RFC 7807 problem document. Code is a stable,
+// machine-readable identifier clients can switch on; Detail is meant for
+// people and never carries internal error text. Internal details are logged
+// together with the request ID instead, so a report from a user can be
+// matched to the log line.
+
+const (
+	codeInvalidJSON         = "invalid_json"
+	codeInvalidRequest      = "invalid_request"
+	codeQueryTooLong        = "query_too_long"
+	codeInvalidPreference   = "invalid_preference"
+	codeInvalidGenre        = "invalid_genre"
+	codeInvalidTag          = "invalid_tag"
+	codeInvalidRating       = "invalid_rating"
+	codeInvalidPassword     = "invalid_password"
+	codeInvalidRole         = "invalid_role"
+	codeAuthRequired        = "authentication_required"
+	codeInvalidCredentials  = "invalid_credentials"
+	codeForbidden           = "forbidden"
+	codeUserNotFound        = "user_not_found"
+	codeNotFound            = "not_found"
+	codeRateLimited         = "rate_limited"
+	codeUpstreamUnavailable = "upstream_unavailable"
+	codeInternal            = "internal_error"
+	codeServiceUnavailable  = "service_unavailable"
+
+	problemContentType = "application/problem+json"
+	problemTypePrefix  = "/problems/"
+)
+
+// Problem is an RFC 7807 problem details object with two extension members,
+// code and request_id.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// writeProblem sends a problem document. detail must be safe to show to the
+// client.
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	p := Problem{
+		Type:      problemTypePrefix + code,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		Code:      code,
+		RequestID: requestIDFromContext(r.Context()),
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", problemContentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// internalError logs msg and args with the request ID and sends a generic
+// 500. Pass the underlying error in args; it never reaches the client.
+func internalError(w http.ResponseWriter, r *http.Request, msg string, args ...any) {
+	slog.Error(msg, append(args, "request_id", requestIDFromContext(r.Context()))...)
+	writeProblem(w, r, http.StatusInternalServerError, codeInternal, "An internal error occurred")
+}
+
+// upstreamError is internalError for failed Vespa calls, sent as a 502.
+func upstreamError(w http.ResponseWriter, r *http.Request, msg string, args ...any) {
+	slog.Error(msg, append(args, "request_id", requestIDFromContext(r.Context()))...)
+	writeProblem(w, r, http.StatusBadGateway, codeUpstreamUnavailable, "The search backend is unavailable")
+}
+
+// handleAPINotFound answers API paths that match no route, which would
+// otherwise fall through to the static file server.
+func handleAPINotFound(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusNotFound, codeNotFound, "No such API endpoint")
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// decodeProblem checks that w holds a problem document with the given status
+// and code and returns it.
+func decodeProblem(t *testing.T, w *httptest.ResponseRecorder, status int, code string) Problem {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("expected %d, got %d: %s", status, w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != problemContentType {
+		t.Errorf("expected Content-Type %s, got %q", problemContentType, ct)
+	}
+	var p Problem
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatalf("failed to decode problem: %v", err)
+	}
+	if p.Code != code || p.Status != status || p.Type != problemTypePrefix+code {
+		t.Errorf("expected code %s and status %d, got %+v", code, status, p)
+	}
+	if p.RequestID == "" || p.RequestID != w.Header().Get(requestIDHeader) {
+		t.Errorf("expected request_id to match the %s header %q, got %q", requestIDHeader, w.Header().Get(requestIDHeader), p.RequestID)
+	}
+	return p
+}
+
+func TestProblemResponses(t *testing.T) {
+	srv := newTestServer(t)
+	srv.cfg.Vespa.URL = "http://127.0.0.1:1"
+	h := srv.routes()
+	token := setupTestAccount(t, srv, "1", RoleUser)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("query too long", func(t *testing.T) {
+		w := do(http.MethodGet, "/api/search?q="+strings.Repeat("a", maxQueryLength+1), "")
+		p := decodeProblem(t, w, http.StatusBadRequest, codeQueryTooLong)
+		if p.Instance != "/api/search" || p.Title != "Bad Request" {
+			t.Errorf("expected instance and title to be set, got %+v", p)
+		}
+	})
+
+	t.Run("invalid genre", func(t *testing.T) {
+		w := do(http.MethodPut, "/api/users/1/preferences", `{"preferences":[{"type":"genre","value":"Nope","state":"like"}]}`)
+		decodeProblem(t, w, http.StatusBadRequest, codeInvalidGenre)
+	})
+
+	t.Run("upstream errors are not leaked", func(t *testing.T) {
+		w := do(http.MethodGet, "/api/search?q=x", "")
+		p := decodeProblem(t, w, http.StatusBadGateway, codeUpstreamUnavailable)
+		if strings.Contains(p.Detail, "127.0.0.1") || strings.Contains(p.Detail, "refused") {
+			t.Errorf("detail leaks the transport error: %q", p.Detail)
+		}
+	})
+
+	t.Run("unknown API path", func(t *testing.T) {
+		w := do(http.MethodGet, "/api/nope", "")
+		decodeProblem(t, w, http.StatusNotFound, codeNotFound)
+	})
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/auth/me", nil))
+		decodeProblem(t, w, http.StatusUnauthorized, codeAuthRequired)
+	})
+}
+
+func TestRequestID(t *testing.T) {
+	h := newServer(defaultConfig(), nil).routes()
+	get := func(id string) string {
+		req := httptest.NewRequest(http.MethodGet, "/livez", nil)
+		if id != "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Header().Get(requestIDHeader)
+	}
+
+	if got := get("abc-123_x.y"); got != "abc-123_x.y" {
+		t.Errorf("expected a valid incoming ID to be kept, got %q", got)
+	}
+	for _, bad := range []string{"", "has space", "new\nline", strings.Repeat("a", maxRequestIDLength+1)} {
+		if got := get(bad); got == bad || !validRequestID(got) {
+			t.Errorf("expected %q to be replaced with a generated ID, got %q", bad, got)
+		}
+	}
+	if get("") == get("") {
+		t.Error("expected generated IDs to differ")
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"text/tabwriter"
+)
+
+// --- Offline ranking evaluation ---
+//
+// `vespa-demo eval` runs a judgments file through buildVespaQuery once per
+// rank profile and scores the results against the graded relevance in the
+// file. Vespa responses can be recorded and replayed, so a report can be
+// reproduced, or checked in CI, without a running Vespa.
+
+const defaultEvalK = 10
+
+// EvalCase is one line of a judgments file.
+type EvalCase struct {
+	ID          string       `json:"id"`
+	Query       string       `json:"query"`
+	Preferences []Preference `json:"preferences"`
+	// Relevant grades films by film ID. Higher is more relevant; films that
+	// are left out, or graded 0, are not relevant.
+	Relevant map[string]int `json:"relevant"`
+}
+
+// EvalMetrics are computed over the top k hits.
+type EvalMetrics struct {
+	NDCG      float64 `json:"ndcg"`
+	MRR       float64 `json:"mrr"`
+	Recall    float64 `json:"recall"`
+	Precision float64 `json:"precision"`
+}
+
+type EvalCaseResult struct {
+	ID string `json:"id"`
+	// Hits are the film IDs returned, best first.
+	Hits []string `json:"hits"`
+	EvalMetrics
+}
+
+type EvalProfileReport struct {
+	Profile string           `json:"profile"`
+	Mean    EvalMetrics      `json:"mean"`
+	Cases   []EvalCaseResult `json:"cases"`
+}
+
+type EvalReport struct {
+	K        int                 `json:"k"`
+	Cases    int                 `json:"cases"`
+	Profiles []EvalProfileReport `json:"profiles"`
+}
+
+// readJudgments parses a JSONL judgments file. Blank lines are skipped.
+func readJudgments(r io.Reader) ([]EvalCase, error) {
+	var cases []EvalCase
+	ids := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		dec := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		dec.DisallowUnknownFields()
+		var c EvalCase
+		if err := dec.Decode(&c); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := c.validate(); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if ids[c.ID] {
+			return nil, fmt.Errorf("line %d: duplicate id %q", line, c.ID)
+		}
+		ids[c.ID] = true
+		cases = append(cases, c)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(cases) == 0 {
+		return nil, errors.New("no judgments found")
+	}
+	return cases, nil
+}
+
+func (c EvalCase) validate() error {
+	if c.ID == "" {
+		return errors.New("id must not be empty")
+	}
+	if len(c.Query) > maxQueryLength {
+		return fmt.Errorf("case %s: query longer than %d characters", c.ID, maxQueryLength)
+	}
+	relevant := 0
+	for filmID, grade := range c.Relevant {
+		if grade < 0 {
+			return fmt.Errorf("case %s: film %s has a negative grade", c.ID, filmID)
+		}
+		if grade > 0 {
+			relevant++
+		}
+	}
+	if relevant == 0 {
+		return fmt.Errorf("case %s: needs at least one film with a positive grade", c.ID)
+	}
+	return nil
+}
+
+// --- Metrics ---
+
+// evalMetrics scores hits against relevant. NDCG uses the exponential gain
+// 2^grade - 1.
+func evalMetrics(hits []string, relevant map[string]int, k int) EvalMetrics {
+	var m EvalMetrics
+	hits = hits[:min(len(hits), k)]
+
+	var dcg float64
+	found := 0
+	for i, filmID := range hits {
+		grade := relevant[filmID]
+		if grade <= 0 {
+			continue
+		}
+		dcg += (math.Pow(2, float64(grade)) - 1) / math.Log2(float64(i+2))
+		found++
+		if m.MRR == 0 {
+			m.MRR = 1 / float64(i+1)
+		}
+	}
+
+	var grades []int
+	for _, grade := range relevant {
+		if grade > 0 {
+			grades = append(grades, grade)
+		}
+	}
+	slices.SortFunc(grades, func(a, b int) int { return b - a })
+	var idcg float64
+	for i, grade := range grades[:min(len(grades), k)] {
+		idcg += (math.Pow(2, float64(grade)) - 1) / math.Log2(float64(i+2))
+	}
+
+	if idcg > 0 {
+		m.NDCG = dcg / idcg
+	}
+	if len(grades) > 0 {
+		m.Recall = float64(found) / float64(len(grades))
+	}
+	m.Precision = float64(found) / float64(k)
+	return m
+}
+
+func meanMetrics(results []EvalCaseResult) EvalMetrics {
+	var m EvalMetrics
+	if len(results) == 0 {
+		return m
+	}
+	for _, r := range results {
+		m.NDCG += r.NDCG
+		m.MRR += r.MRR
+		m.Recall += r.Recall
+		m.Precision += r.Precision
+	}
+	n := float64(len(results))
+	return EvalMetrics{NDCG: m.NDCG / n, MRR: m.MRR / n, Recall: m.Recall / n, Precision: m.Precision / n}
+}
+
+// --- Running ---
+
+// evaluate runs every case with each rank profile and requests k hits per
+// query.
+func (s *Server) evaluate(ctx context.Context, cases []EvalCase, profiles []string, k int) (EvalReport, error) {
+	report := EvalReport{K: k, Cases: len(cases)}
+	for _, profile := range profiles {
+		pr := EvalProfileReport{Profile: profile}
+		for _, c := range cases {
+			query := c.Query
+			if query == "" {
+				query = "*"
+			}
+			vespaResp, _, err := s.queryVespa(ctx, "eval", s.buildVespaQuery(query, c.Preferences, k, withRankProfile(profile)))
+			if err != nil {
+				return report, fmt.Errorf("case %s with %s: %w", c.ID, profile, err)
+			}
+			hits := []string{}
+			for _, hit := range vespaResp.Root.Children {
+				hits = append(hits, filmIDFromDocID(hit.ID))
+			}
+			pr.Cases = append(pr.Cases, EvalCaseResult{ID: c.ID, Hits: hits, EvalMetrics: evalMetrics(hits, c.Relevant, k)})
+		}
+		pr.Mean = meanMetrics(pr.Cases)
+		report.Profiles = append(report.Profiles, pr)
+	}
+	return report, nil
+}
+
+// writeEvalTable prints the mean metrics of each profile. Profiles after the
+// first also show their difference from it.
+func writeEvalTable(w io.Writer, report EvalReport) error {
+	fmt.Fprintf(w, "%d cases, k=%d\n\n", report.Cases, report.K)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "PROFILE\tNDCG@%d\tMRR\tRECALL@%d\tP@%d\n", report.K, report.K, report.K)
+	for i, p := range report.Profiles {
+		base := report.Profiles[0].Mean
+		cell := func(v, b float64) string {
+			if i == 0 {
+				return fmt.Sprintf("%.4f", v)
+			}
+			return fmt.Sprintf("%.4f (%+.4f)", v, v-b)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", p.Profile,
+			cell(p.Mean.NDCG, base.NDCG), cell(p.Mean.MRR, base.MRR),
+			cell(p.Mean.Recall, base.Recall), cell(p.Mean.Precision, base.Precision))
+	}
+	return tw.Flush()
+}
+
+// --- Recorded Vespa responses ---
+
+// vespaRecording maps query URIs, without scheme and host, to Vespa's
+// response bodies. url.Values.Encode sorts parameters, so the same query
+// always has the same key.
+type vespaRecording struct {
+	mu        sync.Mutex
+	Responses map[string]json.RawMessage `json:"responses"`
+}
+
+func loadVespaRecording(path string) (*vespaRecording, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rec vespaRecording
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("parsing recording %s: %w", path, err)
+	}
+	return &rec, nil
+}
+
+func (rec *vespaRecording) save(path string) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// replayTransport answers from a recording and fails for queries it does
+// not hold.
+type replayTransport struct {
+	rec *vespaRecording
+}
+
+func (t replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.rec.mu.Lock()
+	body, ok := t.rec.Responses[req.URL.RequestURI()]
+	t.rec.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no recorded response for %s", req.URL.RequestURI())
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+// recordTransport passes queries on to Vespa and records the successful
+// responses.
+type recordTransport struct {
+	next http.RoundTripper
+	rec  *vespaRecording
+}
+
+func (t recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	t.rec.mu.Lock()
+	t.rec.Responses[req.URL.RequestURI()] = json.RawMessage(body)
+	t.rec.mu.Unlock()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// --- CLI ---
+
+// runEval implements `vespa-demo eval`.
+func runEval(args []string, stdout io.Writer) error {
+	fset := flag.NewFlagSet("eval", flag.ContinueOnError)
+	configPath := addConfigFlags(fset)
+	profiles := listValue{"personalized"}
+	fset.Var(&profiles, "profiles", "comma-separated rank profiles to compare; the first is the baseline")
+	k := fset.Int("k", defaultEvalK, "number of hits to score per query")
+	output := fset.String("o", "", "also write the JSON report to this file")
+	record := fset.String("record", "", "record Vespa's responses to this file")
+	replay := fset.String("replay", "", "answer queries from a recording instead of Vespa")
+	fset.Usage = func() {
+		fmt.Fprintln(fset.Output(), "Usage: vespa-demo eval [flags] judgments.jsonl")
+		fset.PrintDefaults()
+	}
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if fset.NArg() != 1 {
+		fset.Usage()
+		return errors.New("expected one judgments file")
+	}
+	if len(profiles) == 0 {
+		return errors.New("-profiles must name at least one rank profile")
+	}
+	for _, p := range profiles {
+		if !isRankingName(p) {
+			return fmt.Errorf("-profiles: %q is not a valid profile name", p)
+		}
+	}
+	// Vespa rejects more than 400 hits per query by default
+	if *k < 1 || *k > 400 {
+		return errors.New("-k must be between 1 and 400")
+	}
+	if *record != "" && *replay != "" {
+		return errors.New("-record and -replay cannot be used together")
+	}
+
+	f, err := os.Open(fset.Arg(0))
+	if err != nil {
+		return err
+	}
+	cases, err := readJudgments(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", fset.Arg(0), err)
+	}
+
+	cfg, err := loadConfig(fset, *configPath)
+	if err != nil {
+		return err
+	}
+	srv := newServer(cfg, nil)
+	defer srv.close()
+
+	// Recording and replay sit below the metrics and tracing transport
+	transport := srv.vespa.Transport.(vespaTransport)
+	var rec *vespaRecording
+	switch {
+	case *replay != "":
+		if rec, err = loadVespaRecording(*replay); err != nil {
+			return err
+		}
+		transport.next = replayTransport{rec: rec}
+	case *record != "":
+		rec = &vespaRecording{Responses: map[string]json.RawMessage{}}
+		transport.next = recordTransport{next: transport.next, rec: rec}
+	}
+	srv.vespa.Transport = transport
+
+	report, err := srv.evaluate(context.Background(), cases, profiles, *k)
+	if err != nil {
+		return err
+	}
+	if *record != "" {
+		if err := rec.save(*record); err != nil {
+			return fmt.Errorf("saving recording: %w", err)
+		}
+	}
+	if *output != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(*output, append(data, '\n'), 0o644); err != nil {
+			return err
+		}
+	}
+	return writeEvalTable(stdout, report)
+}
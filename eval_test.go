@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEvalMetrics(t *testing.T) {
+	relevant := map[string]int{"a": 3, "b": 1}
+
+	m := evalMetrics([]string{"b", "x", "a", "c"}, relevant, 3)
+	// DCG = 1/log2(2) + 7/log2(4) = 4.5, ideal DCG = 7 + 1/log2(3)
+	wantNDCG := 4.5 / (7 + 1/math.Log2(3))
+	if math.Abs(m.NDCG-wantNDCG) > 1e-9 {
+		t.Errorf("expected NDCG %f, got %f", wantNDCG, m.NDCG)
+	}
+	if m.MRR != 1 || m.Recall != 1 || math.Abs(m.Precision-2.0/3) > 1e-9 {
+		t.Errorf("unexpected metrics: %+v", m)
+	}
+
+	m = evalMetrics([]string{"x", "a"}, relevant, 1)
+	if m != (EvalMetrics{}) {
+		t.Errorf("expected zero metrics when nothing relevant is in the top k, got %+v", m)
+	}
+
+	m = evalMetrics([]string{"x", "a"}, relevant, 10)
+	if m.MRR != 0.5 || m.Recall != 0.5 || m.Precision != 0.1 {
+		t.Errorf("unexpected metrics: %+v", m)
+	}
+}
+
+func TestReadJudgments(t *testing.T) {
+	cases, err := readJudgments(strings.NewReader(`{"id":"a","query":"matrix","relevant":{"9":3}}
+
+{"id":"b","preferences":[{"type":"genre","value":"Sci-Fi","state":"like"}],"relevant":{"14":2,"1":0}}
+`))
+	if err != nil {
+		t.Fatalf("readJudgments failed: %v", err)
+	}
+	if len(cases) != 2 || cases[0].Query != "matrix" || len(cases[1].Preferences) != 1 || cases[1].Relevant["14"] != 2 {
+		t.Errorf("unexpected cases: %+v", cases)
+	}
+
+	for _, tc := range []struct {
+		name, input, want string
+	}{
+		{"empty", "\n", "no judgments"},
+		{"bad json", `{"id":`, "line 1"},
+		{"unknown field", `{"id":"a","relevant":{"1":1},"grades":{}}`, "line 1"},
+		{"missing id", `{"relevant":{"1":1}}`, "id must not be empty"},
+		{"nothing relevant", `{"id":"a","relevant":{"1":0}}`, "positive grade"},
+		{"negative grade", `{"id":"a","relevant":{"1":-1}}`, "negative grade"},
+		{"duplicate id", "{\"id\":\"a\",\"relevant\":{\"1\":1}}\n{\"id\":\"a\",\"relevant\":{\"2\":1}}", "line 2: duplicate id"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := readJudgments(strings.NewReader(tc.input)); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("expected error containing %q, got %v", tc.want, err)
+			}
+		})
+	}
+}
+
+func TestSampleJudgments(t *testing.T) {
+	f, err := os.Open("eval/judgments.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := readJudgments(f); err != nil {
+		t.Errorf("eval/judgments.jsonl is invalid: %v", err)
+	}
+}
+
+func TestRunEval(t *testing.T) {
+	queries := 0
+	mockVespa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries++
+		// "better" ranks the relevant film first, "personalized" second
+		ids := []string{"2", "1"}
+		if r.URL.Query().Get("ranking.profile") == "better" {
+			ids = []string{"1", "2"}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"root":{"fields":{"totalCount":2},"children":[
+			{"id":"id:films:film::` + ids[0] + `","relevance":2},
+			{"id":"id:films:film::` + ids[1] + `","relevance":1}]}}`))
+	}))
+	defer mockVespa.Close()
+
+	dir := t.TempDir()
+	judgments := filepath.Join(dir, "judgments.jsonl")
+	os.WriteFile(judgments, []byte(`{"id":"one","query":"matrix","relevant":{"1":1}}`+"\n"), 0o644)
+	recording := filepath.Join(dir, "recording.json")
+	reportPath := filepath.Join(dir, "report.json")
+
+	var out bytes.Buffer
+	err := runEval([]string{"-vespa-url", mockVespa.URL, "-profiles", "personalized,better", "-k", "2",
+		"-record", recording, "-o", reportPath, judgments}, &out)
+	if err != nil {
+		t.Fatalf("runEval failed: %v", err)
+	}
+	if queries != 2 {
+		t.Errorf("expected one query per profile, got %d", queries)
+	}
+	for _, want := range []string{"1 cases, k=2", "NDCG@2", "personalized  0.6309", "better        1.0000 (+0.3691)"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected table to contain %q, got\n%s", want, out.String())
+		}
+	}
+
+	data, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report EvalReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("invalid JSON report: %v", err)
+	}
+	if report.K != 2 || report.Cases != 1 || len(report.Profiles) != 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	better := report.Profiles[1]
+	if better.Profile != "better" || better.Mean.MRR != 1 || len(better.Cases) != 1 || better.Cases[0].Hits[0] != "1" {
+		t.Errorf("unexpected profile report: %+v", better)
+	}
+
+	t.Run("replay", func(t *testing.T) {
+		var replayed bytes.Buffer
+		// Nothing listens on this address, so every answer must come from the recording
+		err := runEval([]string{"-vespa-url", "http://127.0.0.1:1", "-profiles", "personalized,better", "-k", "2",
+			"-replay", recording, judgments}, &replayed)
+		if err != nil {
+			t.Fatalf("replay failed: %v", err)
+		}
+		if replayed.String() != out.String() {
+			t.Errorf("replayed table differs:\n%s\nwant\n%s", replayed.String(), out.String())
+		}
+
+		err = runEval([]string{"-profiles", "other", "-replay", recording, judgments}, io.Discard)
+		if err == nil || !strings.Contains(err.Error(), "no recorded response") {
+			t.Errorf("expected an error for a query missing from the recording, got %v", err)
+		}
+	})
+}
+
+func TestRunEvalFlags(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{}, "judgments file"},
+		{[]string{"-k", "0", "j.jsonl"}, "-k"},
+		{[]string{"-profiles", "bad-name", "j.jsonl"}, "-profiles"},
+		{[]string{"-record", "a", "-replay", "b", "j.jsonl"}, "-record"},
+	} {
+		if err := runEval(tc.args, io.Discard); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("runEval(%v) = %v, want an error about %s", tc.args, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// --- Search events ---
+//
+// The frontend reports which results it showed (impressions) and which the
+// user clicked or played, quoting the query_id returned by search. Joined to
+// the search log they become the click labels for export-ltr.
+
+const (
+	EventImpression = "impression"
+	EventClick      = "click"
+	EventPlay       = "play"
+
+	maxEventsPerRequest = 100
+)
+
+type SearchEvent struct {
+	QueryID string
+	Type    string
+	FilmID  string
+	// Position is the zero-based rank of the film in the results.
+	Position int
+	Time     time.Time
+}
+
+type EventInput struct {
+	Type     string `json:"type"`
+	FilmID   string `json:"film_id"`
+	Position int    `json:"position"`
+}
+
+type EventsRequest struct {
+	QueryID string       `json:"query_id"`
+	Events  []EventInput `json:"events"`
+}
+
+func isValidEventType(t string) bool {
+	return t == EventImpression || t == EventClick || t == EventPlay
+}
+
+// --- Labeled queries ---
+
+// LabeledQuery is a logged search together with what the user did with its
+// results.
+type LabeledQuery struct {
+	QueryID     string
+	Query       string
+	UserID      string
+	Preferences []Preference
+	Time        time.Time
+	// Films are the films with events, in result order.
+	Films []LabeledFilm
+}
+
+type LabeledFilm struct {
+	FilmID    string
+	Position  int
+	Impressed bool
+	Clicked   bool
+	Played    bool
+}
+
+// Label grades the film for the query: 2 if it was played, 1 if it was
+// clicked, 0 if it was only shown.
+func (f LabeledFilm) Label() int {
+	switch {
+	case f.Played:
+		return 2
+	case f.Clicked:
+		return 1
+	}
+	return 0
+}
+
+// addEvent folds one event into q. A film keeps the position of its first
+// event.
+func (q *LabeledQuery) addEvent(eventType, filmID string, position int) {
+	i := slices.IndexFunc(q.Films, func(f LabeledFilm) bool { return f.FilmID == filmID })
+	if i < 0 {
+		q.Films = append(q.Films, LabeledFilm{FilmID: filmID, Position: position})
+		i = len(q.Films) - 1
+	}
+	switch eventType {
+	case EventImpression:
+		q.Films[i].Impressed = true
+	case EventClick:
+		q.Films[i].Clicked = true
+	case EventPlay:
+		q.Films[i].Played = true
+	}
+}
+
+// sortFilms puts q.Films in result order.
+func (q *LabeledQuery) sortFilms() {
+	slices.SortStableFunc(q.Films, func(a, b LabeledFilm) int { return cmp.Compare(a.Position, b.Position) })
+}
+
+// --- HTTP handlers ---
+
+func (s *Server) handleAddEvents(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
+
+	var req EventsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON: "+err.Error())
+		return
+	}
+	if !validRequestID(req.QueryID) {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, "query_id must be the query_id returned by search")
+		return
+	}
+	if len(req.Events) == 0 || len(req.Events) > maxEventsPerRequest {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("events must hold between 1 and %d events", maxEventsPerRequest))
+		return
+	}
+
+	now := time.Now()
+	events := make([]SearchEvent, 0, len(req.Events))
+	for i, e := range req.Events {
+		if !isValidEventType(e.Type) {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("events[%d].type must be %s, %s or %s", i, EventImpression, EventClick, EventPlay))
+			return
+		}
+		if e.FilmID == "" || e.Position < 0 {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("events[%d] needs a film_id and a non-negative position", i))
+			return
+		}
+		events = append(events, SearchEvent{QueryID: req.QueryID, Type: e.Type, FilmID: e.FilmID, Position: e.Position, Time: now})
+	}
+
+	if err := s.store.AddEvents(r.Context(), events); err != nil {
+		internalError(w, r, "Failed to store events", "query_id", req.QueryID, "error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
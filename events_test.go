@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleAddEvents(t *testing.T) {
+	srv := newTestServer(t)
+	h := srv.routes()
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/events", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post(`{"query_id":"q-1","events":[{"type":"impression","film_id":"42","position":0},{"type":"play","film_id":"42","position":0}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	srv.store.AddSearchLogs(context.Background(), []SearchLogEntry{{Time: time.Now(), QueryID: "q-1", API: "v2", Query: "matrix"}})
+	queries, err := srv.store.LabeledQueries(context.Background(), time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("LabeledQueries failed: %v", err)
+	}
+	if len(queries) != 1 || len(queries[0].Films) != 1 || !queries[0].Films[0].Played {
+		t.Errorf("expected the play to be stored, got %+v", queries)
+	}
+
+	for name, body := range map[string]string{
+		"unknown type":  `{"query_id":"q-1","events":[{"type":"hover","film_id":"42","position":0}]}`,
+		"no events":     `{"query_id":"q-1","events":[]}`,
+		"too many":      `{"query_id":"q-1","events":[` + strings.Repeat(`{"type":"click","film_id":"1","position":0},`, maxEventsPerRequest) + `{"type":"click","film_id":"1","position":0}]}`,
+		"bad query_id":  `{"query_id":"not a query id","events":[{"type":"click","film_id":"42","position":0}]}`,
+		"negative rank": `{"query_id":"q-1","events":[{"type":"click","film_id":"42","position":-1}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			decodeProblem(t, post(body), http.StatusBadRequest, codeInvalidRequest)
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.Features.Events = false
+		srv := newServer(cfg, newMemoryStore())
+		defer srv.close()
+		req := httptest.NewRequest(http.MethodPost, "/api/events", strings.NewReader(`{}`))
+		w := httptest.NewRecorder()
+		srv.routes().ServeHTTP(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", w.Code)
+		}
+	})
+}
+
+func TestSearchReturnsQueryID(t *testing.T) {
+	mockVespa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"root":{"fields":{"totalCount":1},"children":[` + testMatrixHit + `]}}`))
+	}))
+	defer mockVespa.Close()
+
+	srv := newTestServer(t)
+	srv.cfg.Vespa.URL = mockVespa.URL
+	h := srv.routes()
+
+	var ids []string
+	for _, path := range []string{"/api/search?q=matrix", "/api/v2/search?q=matrix"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		var resp struct {
+			QueryID string `json:"query_id"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || !validRequestID(resp.QueryID) {
+			t.Fatalf("GET %s: expected a query_id, got %q (%v)", path, resp.QueryID, err)
+		}
+		ids = append(ids, resp.QueryID)
+	}
+	if ids[0] == ids[1] {
+		t.Errorf("expected a new query_id per search, got %q twice", ids[0])
+	}
+
+	// The search log links the query_id to the search
+	srv.searchLog.close()
+	srv.store.AddEvents(context.Background(), []SearchEvent{{QueryID: ids[1], Type: EventClick, FilmID: "42", Time: time.Now()}})
+	queries, _ := srv.store.LabeledQueries(context.Background(), time.Now().Add(-time.Hour))
+	if len(queries) != 1 || queries[0].QueryID != ids[1] || queries[0].Query != "matrix" {
+		t.Errorf("expected the click joined to the v2 search, got %+v", queries)
+	}
+}
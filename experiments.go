@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Experiments ---
+//
+// Experiments split signed-in searchers between variants of the ranking. A
+// user's variant is chosen by hashing the experiment name with the user ID,
+// so it stays the same across requests and restarts for as long as the
+// experiment's variants and weights are unchanged. Anonymous searches are
+// never part of an experiment.
+
+const (
+	experimentsHeader = "X-Experiments"
+
+	defaultReportWindow = 7 * 24 * time.Hour
+)
+
+type ExperimentConfig struct {
+	Name     string          `yaml:"name" json:"name"`
+	Variants []VariantConfig `yaml:"variants" json:"variants"`
+}
+
+// VariantConfig is one arm of an experiment. Settings left empty keep the
+// server's normal behaviour, so a control variant needs only a name and a
+// weight.
+type VariantConfig struct {
+	Name string `yaml:"name" json:"name"`
+	// Weight is the variant's share of users relative to the other variants.
+	Weight int `yaml:"weight" json:"weight"`
+	// RankProfile replaces the profile otherwise picked from the user's
+	// preferences.
+	RankProfile string `yaml:"rank_profile,omitempty" json:"rank_profile,omitempty"`
+	// Inputs are sent to Vespa as input.query(<name>)=<value>.
+	Inputs map[string]string `yaml:"inputs,omitempty" json:"inputs,omitempty"`
+	// Hits, when positive, replaces search.hits.
+	Hits int `yaml:"hits,omitempty" json:"hits,omitempty"`
+}
+
+// validateExperiments reports every invalid experiment setting at once.
+func validateExperiments(exps []ExperimentConfig) error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	names := map[string]bool{}
+	for i, e := range exps {
+		check(isValidPreferenceValue(e.Name), "experiments[%d].name %q must be letters, digits, - and _", i, e.Name)
+		check(!names[e.Name], "experiment %q is defined twice", e.Name)
+		names[e.Name] = true
+		check(len(e.Variants) > 0, "experiment %q needs at least one variant", e.Name)
+
+		variants := map[string]bool{}
+		for _, v := range e.Variants {
+			check(isValidPreferenceValue(v.Name), "experiment %q: variant name %q must be letters, digits, - and _", e.Name, v.Name)
+			check(!variants[v.Name], "experiment %q: variant %q is defined twice", e.Name, v.Name)
+			variants[v.Name] = true
+			check(v.Weight > 0, "experiment %q: variant %q weight must be positive", e.Name, v.Name)
+			check(v.RankProfile == "" || isRankingName(v.RankProfile),
+				"experiment %q: variant %q rank_profile %q is not a valid profile name", e.Name, v.Name, v.RankProfile)
+			for name, value := range v.Inputs {
+				check(isRankingName(name), "experiment %q: variant %q input %q is not a valid query feature name", e.Name, v.Name, name)
+				if slices.Contains(rankingWeightNames, name) {
+					f, err := strconv.ParseFloat(value, 64)
+					check(err == nil && isValidWeight(f), "experiment %q: variant %q input %s must be a non-negative number, got %q", e.Name, v.Name, name, value)
+				}
+			}
+			// Same bound as search.hits
+			check(v.Hits >= 0 && v.Hits <= 400, "experiment %q: variant %q hits must be between 0 and 400, got %d", e.Name, v.Name, v.Hits)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// isRankingName reports whether s can name a Vespa rank profile or query
+// feature.
+func isRankingName(s string) bool {
+	if s == "" || len(s) > 64 || (s[0] >= '0' && s[0] <= '9') {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// variantFor picks userID's variant by weight.
+func (e *ExperimentConfig) variantFor(userID string) *VariantConfig {
+	total := 0
+	for _, v := range e.Variants {
+		total += v.Weight
+	}
+	h := fnv.New64a()
+	h.Write([]byte(e.Name))
+	h.Write([]byte{0})
+	h.Write([]byte(userID))
+	bucket := int(h.Sum64() % uint64(total))
+	for i := range e.Variants {
+		bucket -= e.Variants[i].Weight
+		if bucket < 0 {
+			return &e.Variants[i]
+		}
+	}
+	return &e.Variants[len(e.Variants)-1]
+}
+
+// --- Assignments ---
+
+type variantAssignment struct {
+	experiment string
+	variant    *VariantConfig
+}
+
+// variantAssignments holds a user's variant in each experiment, in config
+// order.
+type variantAssignments []variantAssignment
+
+func assignVariants(exps []ExperimentConfig, userID string) variantAssignments {
+	if userID == "" {
+		return nil
+	}
+	var a variantAssignments
+	for i := range exps {
+		a = append(a, variantAssignment{experiment: exps[i].Name, variant: exps[i].variantFor(userID)})
+	}
+	return a
+}
+
+// String formats the assignments as "experiment=variant,...", the form used
+// in the X-Experiments header and in logs.
+func (a variantAssignments) String() string {
+	parts := make([]string, len(a))
+	for i, v := range a {
+		parts[i] = v.experiment + "=" + v.variant.Name
+	}
+	return strings.Join(parts, ",")
+}
+
+func (a variantAssignments) byExperiment() map[string]string {
+	m := make(map[string]string, len(a))
+	for _, v := range a {
+		m[v.experiment] = v.variant.Name
+	}
+	return m
+}
+
+// hits returns the hit count to request, def unless a variant overrides it.
+// When several experiments set it, the last one wins.
+func (a variantAssignments) hits(def int) int {
+	for _, v := range a {
+		if v.variant.Hits > 0 {
+			def = v.variant.Hits
+		}
+	}
+	return def
+}
+
+// queryOption applies the variants' rank profiles and inputs, later
+// experiments overriding earlier ones.
+func (a variantAssignments) queryOption() queryOption {
+	return func(params url.Values) {
+		for _, v := range a {
+			if v.variant.RankProfile != "" {
+				params.Set("ranking.profile", v.variant.RankProfile)
+			}
+			for name, value := range v.variant.Inputs {
+				params.Set("input.query("+name+")", value)
+			}
+		}
+	}
+}
+
+// --- Reports ---
+
+// VariantOutcome compares how a variant's searches went. A search counts as
+// clicked when any of its results was clicked or played. Ratings are the
+// watch history ratings users gave to films they clicked or played in the
+// variant's results.
+type VariantOutcome struct {
+	Variant string `json:"variant"`
+	// Weight is zero for variants no longer in the config.
+	Weight           int     `json:"weight"`
+	Searches         int     `json:"searches"`
+	ClickedSearches  int     `json:"clicked_searches"`
+	ClickThroughRate float64 `json:"click_through_rate"`
+	Impressions      int     `json:"impressions"`
+	Clicks           int     `json:"clicks"`
+	Plays            int     `json:"plays"`
+	Ratings          int     `json:"ratings"`
+	AverageRating    float64 `json:"average_rating"`
+}
+
+type ExperimentReport struct {
+	Experiment string           `json:"experiment"`
+	Window     string           `json:"window"`
+	Since      time.Time        `json:"since"`
+	Variants   []VariantOutcome `json:"variants"`
+}
+
+// mergeOutcomes lists every configured variant of e in config order, with
+// zero counts where there were no searches, followed by variants that only
+// appear in the log.
+func mergeOutcomes(e ExperimentConfig, outcomes []VariantOutcome) []VariantOutcome {
+	merged := make([]VariantOutcome, 0, len(e.Variants))
+	for _, v := range e.Variants {
+		o := VariantOutcome{Variant: v.Name}
+		if i := slices.IndexFunc(outcomes, func(o VariantOutcome) bool { return o.Variant == v.Name }); i >= 0 {
+			o = outcomes[i]
+		}
+		o.Weight = v.Weight
+		merged = append(merged, o)
+	}
+	for _, o := range outcomes {
+		if !slices.ContainsFunc(e.Variants, func(v VariantConfig) bool { return v.Name == o.Variant }) {
+			merged = append(merged, o)
+		}
+	}
+	for i := range merged {
+		if merged[i].Searches > 0 {
+			merged[i].ClickThroughRate = math.Round(float64(merged[i].ClickedSearches)/float64(merged[i].Searches)*10000) / 10000
+		}
+	}
+	return merged
+}
+
+// --- HTTP handlers ---
+
+func (s *Server) handleExperiments(w http.ResponseWriter, r *http.Request) {
+	exps := s.cfg.Experiments
+	if exps == nil {
+		exps = []ExperimentConfig{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(exps)
+}
+
+// handleExperimentReport compares the variants of one experiment over the
+// last window, 7 days by default.
+func (s *Server) handleExperimentReport(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	i := slices.IndexFunc(s.cfg.Experiments, func(e ExperimentConfig) bool { return e.Name == name })
+	if i < 0 {
+		writeProblem(w, r, http.StatusNotFound, codeNotFound, "Experiment "+name+" does not exist")
+		return
+	}
+	window, ok := parseWindow(w, r, defaultReportWindow)
+	if !ok {
+		return
+	}
+
+	since := time.Now().Add(-window)
+	outcomes, err := s.store.VariantOutcomes(r.Context(), name, since)
+	if err != nil {
+		internalError(w, r, "Failed to compute experiment outcomes", "experiment", name, "error", err)
+		return
+	}
+	report := ExperimentReport{
+		Experiment: name,
+		Window:     window.String(),
+		Since:      since.UTC().Truncate(time.Second),
+		Variants:   mergeOutcomes(s.cfg.Experiments[i], outcomes),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
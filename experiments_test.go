@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoadExperiments(t *testing.T) {
+	path := writeConfigFile(t, `
+experiments:
+  - name: ranking
+    variants:
+      - name: control
+        weight: 3
+      - name: lexical
+        weight: 1
+        rank_profile: default
+        inputs:
+          freshness: 0.5
+        hits: 20
+`)
+	c, err := parseConfig(t, "-config", path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if len(c.Experiments) != 1 || len(c.Experiments[0].Variants) != 2 {
+		t.Fatalf("unexpected experiments: %+v", c.Experiments)
+	}
+	v := c.Experiments[0].Variants[1]
+	if v.RankProfile != "default" || v.Inputs["freshness"] != "0.5" || v.Hits != 20 || v.Weight != 1 {
+		t.Errorf("unexpected variant: %+v", v)
+	}
+}
+
+func TestValidateExperiments(t *testing.T) {
+	valid := []ExperimentConfig{{Name: "ranking", Variants: []VariantConfig{
+		{Name: "control", Weight: 1},
+		{Name: "treatment", Weight: 1, RankProfile: "personalized_v2", Inputs: map[string]string{"bm25_weight": "2", "rating_weight": "1.5"}, Hits: 50},
+	}}}
+	if err := validateExperiments(valid); err != nil {
+		t.Errorf("expected a valid config, got %v", err)
+	}
+
+	err := validateExperiments([]ExperimentConfig{
+		{Name: "ranking", Variants: []VariantConfig{
+			{Name: "control", Weight: 0},
+			{Name: "control", Weight: 1},
+			{Name: "bad", Weight: 1, RankProfile: "drop table", Inputs: map[string]string{"query(x)": "1", "recency_weight": "soon"}, Hits: 1000},
+		}},
+		{Name: "ranking", Variants: []VariantConfig{{Name: "only", Weight: 1}}},
+		{Name: "empty"},
+		{Name: "has space", Variants: []VariantConfig{{Name: "a", Weight: 1}}},
+	})
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{
+		`"control" weight must be positive`,
+		`variant "control" is defined twice`,
+		`rank_profile "drop table"`,
+		`input "query(x)"`,
+		"input recency_weight must be a non-negative number",
+		"hits must be between 0 and 400",
+		`experiment "ranking" is defined twice`,
+		`"empty" needs at least one variant`,
+		`name "has space"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to mention %s, got:\n%v", want, err)
+		}
+	}
+}
+
+func TestAssignVariants(t *testing.T) {
+	exps := []ExperimentConfig{
+		{Name: "ranking", Variants: []VariantConfig{{Name: "control", Weight: 3}, {Name: "treatment", Weight: 1}}},
+		{Name: "hits", Variants: []VariantConfig{{Name: "all", Weight: 1, Hits: 7}}},
+	}
+
+	if a := assignVariants(exps, ""); a != nil {
+		t.Errorf("expected anonymous users to be left out, got %v", a)
+	}
+
+	a := assignVariants(exps, "42")
+	if len(a) != 2 || a.hits(100) != 7 {
+		t.Fatalf("unexpected assignments: %v", a)
+	}
+	if got := assignVariants(exps, "42").String(); got != a.String() {
+		t.Errorf("assignment changed between calls: %s, then %s", a, got)
+	}
+	if !strings.HasPrefix(a.String(), "ranking=") || !strings.HasSuffix(a.String(), ",hits=all") {
+		t.Errorf("unexpected String(): %s", a)
+	}
+
+	counts := map[string]int{}
+	for i := range 4000 {
+		counts[assignVariants(exps[:1], fmt.Sprint(i))[0].variant.Name]++
+	}
+	// 3:1 weights, allowing for hashing noise
+	if counts["treatment"] < 800 || counts["treatment"] > 1200 {
+		t.Errorf("expected about 1000 of 4000 users in treatment, got %v", counts)
+	}
+}
+
+func TestExperimentSearch(t *testing.T) {
+	var mu sync.Mutex
+	var queries []url.Values
+	mockVespa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries = append(queries, r.URL.Query())
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"root":{"fields":{"totalCount":1},"children":[` + testMatrixHit + `]}}`))
+	}))
+	defer mockVespa.Close()
+
+	srv := newTestServer(t)
+	srv.cfg.Vespa.URL = mockVespa.URL
+	srv.cfg.Experiments = []ExperimentConfig{{Name: "ranking", Variants: []VariantConfig{
+		{Name: "lexical", Weight: 1, RankProfile: "default", Inputs: map[string]string{"freshness": "0.5"}, Hits: 7},
+	}}}
+	h := srv.routes()
+	token := setupTestAccount(t, srv, "1", RoleUser)
+	search := func(path string, authed bool) (*httptest.ResponseRecorder, url.Values) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if authed {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: expected 200, got %d: %s", path, w.Code, w.Body.String())
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return w, queries[len(queries)-1]
+	}
+
+	prefs := url.QueryEscape(`[{"type":"genre","value":"Sci-Fi","state":"like"}]`)
+	for _, path := range []string{"/api/search?q=matrix&user=1&prefs=" + prefs, "/api/v2/search?q=matrix&user=1&prefs=" + prefs} {
+		w, q := search(path, true)
+		if got := w.Header().Get(experimentsHeader); got != "ranking=lexical" {
+			t.Errorf("GET %s: expected X-Experiments ranking=lexical, got %q", path, got)
+		}
+		if q.Get("ranking.profile") != "default" || q.Get("input.query(freshness)") != "0.5" || q.Get("hits") != "7" {
+			t.Errorf("GET %s: variant not applied to the Vespa query: %v", path, q)
+		}
+	}
+
+	for _, path := range []string{"/api/search?q=matrix&prefs=" + prefs, "/api/search?q=matrix&user=1&prefs=" + prefs} {
+		w, q := search(path, false)
+		if got := w.Header().Get(experimentsHeader); got != "" {
+			t.Errorf("GET %s: expected no X-Experiments for an anonymous search, got %q", path, got)
+		}
+		if q.Get("ranking.profile") != "personalized" || q.Get("hits") != "100" {
+			t.Errorf("GET %s: expected the normal query for an anonymous search, got %v", path, q)
+		}
+	}
+
+	srv.searchLog.close()
+	outcomes, err := srv.store.VariantOutcomes(context.Background(), "ranking", time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("VariantOutcomes failed: %v", err)
+	}
+	if len(outcomes) != 1 || outcomes[0].Variant != "lexical" || outcomes[0].Searches != 2 {
+		t.Errorf("expected both signed-in searches logged under lexical, got %+v", outcomes)
+	}
+}
+
+func TestHandleExperimentReport(t *testing.T) {
+	srv := newTestServer(t)
+	srv.cfg.Experiments = []ExperimentConfig{{Name: "ranking", Variants: []VariantConfig{
+		{Name: "control", Weight: 1},
+		{Name: "treatment", Weight: 1},
+		{Name: "unused", Weight: 2},
+	}}}
+	h := srv.routes()
+	adminToken := setupTestAccount(t, srv, "admin", RoleAdmin)
+
+	ctx := context.Background()
+	now := time.Now()
+	srv.store.AddSearchLogs(ctx, []SearchLogEntry{
+		{Time: now, QueryID: "q-1", API: "v2", Query: "matrix", UserID: "1", Experiments: map[string]string{"ranking": "treatment"}},
+		{Time: now, QueryID: "q-2", API: "v2", Query: "heat", UserID: "1", Experiments: map[string]string{"ranking": "treatment"}},
+		{Time: now, QueryID: "q-3", API: "v2", Query: "alien", UserID: "2", Experiments: map[string]string{"ranking": "control"}},
+		{Time: now, QueryID: "q-4", API: "v2", Query: "old", UserID: "3", Experiments: map[string]string{"ranking": "retired"}},
+	})
+	srv.store.AddEvents(ctx, []SearchEvent{
+		{QueryID: "q-1", Type: EventImpression, FilmID: "42", Time: now},
+		{QueryID: "q-1", Type: EventClick, FilmID: "42", Time: now},
+		{QueryID: "q-3", Type: EventImpression, FilmID: "7", Time: now},
+	})
+
+	do := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("/api/admin/experiments/ranking/report?window=1h")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var report ExperimentReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatalf("failed to decode report: %v", err)
+	}
+	if report.Experiment != "ranking" || report.Window != "1h0m0s" || len(report.Variants) != 4 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	want := []VariantOutcome{
+		{Variant: "control", Weight: 1, Searches: 1, Impressions: 1},
+		{Variant: "treatment", Weight: 1, Searches: 2, ClickedSearches: 1, ClickThroughRate: 0.5, Impressions: 1, Clicks: 1},
+		{Variant: "unused", Weight: 2},
+		{Variant: "retired", Searches: 1},
+	}
+	for i, v := range report.Variants {
+		// Ratings depend on the seeded history and are covered by the store tests
+		v.Ratings, v.AverageRating = 0, 0
+		if v != want[i] {
+			t.Errorf("variant %d = %+v, want %+v", i, v, want[i])
+		}
+	}
+
+	t.Run("unknown experiment", func(t *testing.T) {
+		decodeProblem(t, do("/api/admin/experiments/nope/report"), http.StatusNotFound, codeNotFound)
+	})
+
+	t.Run("invalid window", func(t *testing.T) {
+		decodeProblem(t, do("/api/admin/experiments/ranking/report?window=0s"), http.StatusBadRequest, codeInvalidRequest)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		w := do("/api/admin/experiments")
+		var exps []ExperimentConfig
+		if err := json.NewDecoder(w.Body).Decode(&exps); err != nil || len(exps) != 1 || len(exps[0].Variants) != 3 {
+			t.Errorf("unexpected experiments: %s", w.Body.String())
+		}
+	})
+}
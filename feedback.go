@@ -0,0 +1,231 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// --- Feedback constants ---
+
+const (
+	// FeedbackNotInterested hides a film and nudges ranking away from similar
+	// films. FeedbackHide only hides the film.
+	FeedbackNotInterested = "not_interested"
+	FeedbackHide          = "hide"
+
+	// feedbackPenalty is subtracted from a genre, tag or director affinity for
+	// every not-interested film that has it, down to maxFeedbackPenalty. Both
+	// are small next to the 10/5 preference weights in the rank profile. They
+	// are the defaults for ranking.feedback_penalty and ranking.max_feedback_penalty.
+	feedbackPenalty    = 1.0
+	maxFeedbackPenalty = 4.0
+)
+
+// --- Feedback types ---
+
+type FeedbackEntry struct {
+	FilmID       string    `json:"film_id"`
+	Action       string    `json:"action"`
+	FilmTitle    string    `json:"film_title"`
+	FilmGenre    string    `json:"film_genre"`
+	FilmDirector string    `json:"film_director"`
+	FilmTags     []string  `json:"film_tags"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// FeedbackRequest records feedback on a film. The film's genre, director and
+// tags are read from the catalog; FilmTitle is only used when the film is
+// not found there.
+type FeedbackRequest struct {
+	FilmID    string `json:"film_id"`
+	Action    string `json:"action"`
+	FilmTitle string `json:"film_title"`
+}
+
+// Affinities are per-label score adjustments sent to the personalized rank
+// profile as mapped query tensors.
+type Affinities struct {
+	Genre    map[string]float64
+	Tag      map[string]float64
+	Director map[string]float64
+}
+
+func (a Affinities) empty() bool {
+	return len(a.Genre) == 0 && len(a.Tag) == 0 && len(a.Director) == 0
+}
+
+// --- Query options ---
+
+// isValidAffinityLabel reports whether s is safe to use as a quoted tensor
+// label. It is looser than isValidPreferenceValue because director names
+// contain spaces and punctuation.
+func isValidAffinityLabel(s string) bool {
+	if len(s) == 0 || len(s) > 100 {
+		return false
+	}
+	for _, r := range s {
+		if !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == ' ' || r == '-' || r == '\'' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func formatAffinityTensor(dim string, values map[string]float64) string {
+	var parts []string
+	for _, label := range slices.Sorted(maps.Keys(values)) {
+		if !isValidAffinityLabel(label) {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("{%s:\"%s\"}:%s", dim, label, strconv.FormatFloat(values[label], 'f', -1, 64)))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// withAffinities adds affinity tensors to the query, switching to the
+// personalized rank profile when there is anything to apply.
+func withAffinities(a Affinities) queryOption {
+	return func(params url.Values) {
+		if a.empty() {
+			return
+		}
+		params.Set("ranking.profile", "personalized")
+		if t := formatAffinityTensor("genre", a.Genre); t != "" {
+			params.Set("input.query(genre_affinity)", t)
+		}
+		if t := formatAffinityTensor("tag", a.Tag); t != "" {
+			params.Set("input.query(tag_affinity)", t)
+		}
+		if t := formatAffinityTensor("director", a.Director); t != "" {
+			params.Set("input.query(director_affinity)", t)
+		}
+	}
+}
+
+// --- Affinities ---
+
+// feedbackAffinities turns not-interested feedback into small negative
+// affinities for the genres, tags and directors of those films.
+func feedbackAffinities(entries []FeedbackEntry, ranking RankingConfig) Affinities {
+	a := Affinities{Genre: map[string]float64{}, Tag: map[string]float64{}, Director: map[string]float64{}}
+	penalize := func(m map[string]float64, label string) {
+		if label == "" {
+			return
+		}
+		m[label] = max(m[label]-ranking.FeedbackPenalty, -ranking.MaxFeedbackPenalty)
+	}
+	for _, e := range entries {
+		if e.Action != FeedbackNotInterested {
+			continue
+		}
+		penalize(a.Genre, e.FilmGenre)
+		penalize(a.Director, e.FilmDirector)
+		for _, tag := range e.FilmTags {
+			penalize(a.Tag, tag)
+		}
+	}
+	return a
+}
+
+// withFilmFields fills in e's title, genre, director and tags from the
+// catalog.
+func withFilmFields(e FeedbackEntry, hit VespaHit) FeedbackEntry {
+	e.FilmTitle = cmp.Or(hit.Fields.Title, e.FilmTitle)
+	e.FilmGenre = hit.Fields.Genre
+	e.FilmDirector = hit.Fields.Director
+	e.FilmTags = hit.Fields.Tags
+	if e.FilmTags == nil {
+		e.FilmTags = []string{}
+	}
+	return e
+}
+
+// --- HTTP handlers ---
+
+func (s *Server) handleFeedback(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("id")
+
+	entries, err := s.store.Feedback(r.Context(), userID)
+	if err != nil {
+		internalError(w, r, "Failed to query feedback", "user_id", userID, "error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+func (s *Server) handleAddFeedback(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("id")
+
+	if !s.checkUserExists(w, r, userID) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
+
+	var req FeedbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON: "+err.Error())
+		return
+	}
+	if req.FilmID == "" {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, "film_id is required")
+		return
+	}
+	if req.Action != FeedbackNotInterested && req.Action != FeedbackHide {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid feedback action: "+req.Action)
+		return
+	}
+	entry := FeedbackEntry{FilmID: req.FilmID, Action: req.Action, FilmTitle: req.FilmTitle, FilmTags: []string{}}
+	if hit, ok := s.lookupFilms(r.Context(), []string{req.FilmID})[req.FilmID]; ok {
+		entry = withFilmFields(entry, hit)
+	} else {
+		slog.Warn("Feedback recorded without catalog data", "user_id", userID, "film_id", req.FilmID)
+	}
+	if err := s.store.PutFeedback(r.Context(), userID, entry); err != nil {
+		internalError(w, r, "Failed to store feedback", "user_id", userID, "error", err)
+		return
+	}
+
+	slog.Info("Feedback recorded", "user_id", userID, "film_id", req.FilmID, "action", req.Action)
+	s.changes.publish(userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+func (s *Server) handleDeleteFeedback(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("id")
+	filmID := r.PathValue("filmID")
+
+	err := s.store.DeleteFeedback(r.Context(), userID, filmID)
+	if errors.Is(err, errNotFound) {
+		writeProblem(w, r, http.StatusNotFound, codeNotFound, "No feedback for film")
+		return
+	}
+	if err != nil {
+		internalError(w, r, "Failed to delete feedback", "user_id", userID, "error", err)
+		return
+	}
+
+	slog.Info("Feedback removed", "user_id", userID, "film_id", filmID)
+	s.changes.publish(userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
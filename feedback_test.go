@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func addFeedback(t *testing.T, srv *Server, userID, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/users/"+userID+"/feedback", strings.NewReader(body))
+	req.SetPathValue("id", userID)
+	w := httptest.NewRecorder()
+	srv.handleAddFeedback(w, req)
+	return w
+}
+
+func TestIsValidAffinityLabel(t *testing.T) {
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{"Christopher Nolan", true},
+		{"Bong Joon-ho", true},
+		{"Guillermo del Toro", true},
+		{"J.J. Abrams", true},
+		{"Action", true},
+		{"", false},
+		{strings.Repeat("a", 101), false},
+		{`say "hi"`, false},
+		{"a}b", false},
+		{"a:b", false},
+		{`back\slash`, false},
+	}
+
+	for _, tt := range tests {
+		if got := isValidAffinityLabel(tt.input); got != tt.want {
+			t.Errorf("isValidAffinityLabel(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestFeedbackAffinities(t *testing.T) {
+	entries := []FeedbackEntry{
+		{FilmID: "1", Action: FeedbackNotInterested, FilmGenre: "Horror", FilmDirector: "James Wan", FilmTags: []string{"blockbuster"}},
+		{FilmID: "2", Action: FeedbackNotInterested, FilmGenre: "Horror", FilmDirector: "Ari Aster", FilmTags: []string{"indie"}},
+		{FilmID: "3", Action: FeedbackHide, FilmGenre: "Comedy", FilmDirector: "Todd Phillips"},
+	}
+	for i := 0; i < 10; i++ {
+		entries = append(entries, FeedbackEntry{Action: FeedbackNotInterested, FilmGenre: "Drama"})
+	}
+
+	a := feedbackAffinities(entries, defaultConfig().Ranking)
+
+	if a.Genre["Horror"] != -2*feedbackPenalty {
+		t.Errorf("expected Horror affinity %v, got %v", -2*feedbackPenalty, a.Genre["Horror"])
+	}
+	if a.Director["James Wan"] != -feedbackPenalty || a.Tag["indie"] != -feedbackPenalty {
+		t.Errorf("expected single penalties for director and tag, got %+v", a)
+	}
+	if _, ok := a.Genre["Comedy"]; ok {
+		t.Error("hide feedback should not affect affinities")
+	}
+	if a.Genre["Drama"] != -maxFeedbackPenalty {
+		t.Errorf("penalty should be capped at %v, got %v", -maxFeedbackPenalty, a.Genre["Drama"])
+	}
+}
+
+func TestBuildVespaQuery_WithAffinities(t *testing.T) {
+	srv := newServer(defaultConfig(), nil)
+	srv.cfg.Vespa.URL = "http://test:8080"
+
+	t.Run("affinities set personalized profile and tensors", func(t *testing.T) {
+		a := Affinities{
+			Genre:    map[string]float64{"Horror": -2},
+			Tag:      map[string]float64{"indie": -1},
+			Director: map[string]float64{"Bong Joon-ho": -1, "bad}label": -1},
+		}
+		u, _ := url.Parse(srv.buildVespaQuery("*", nil, 10, withAffinities(a)))
+		params := u.Query()
+
+		if params.Get("ranking.profile") != "personalized" {
+			t.Errorf("expected personalized profile, got %q", params.Get("ranking.profile"))
+		}
+		if got := params.Get("input.query(genre_affinity)"); got != `{{genre:"Horror"}:-2}` {
+			t.Errorf("unexpected genre_affinity: %s", got)
+		}
+		if got := params.Get("input.query(tag_affinity)"); got != `{{tag:"indie"}:-1}` {
+			t.Errorf("unexpected tag_affinity: %s", got)
+		}
+		if got := params.Get("input.query(director_affinity)"); got != `{{director:"Bong Joon-ho"}:-1}` {
+			t.Errorf("invalid labels should be skipped, got director_affinity: %s", got)
+		}
+	})
+
+	t.Run("empty affinities leave query unchanged", func(t *testing.T) {
+		u, _ := url.Parse(srv.buildVespaQuery("*", nil, 10, withAffinities(Affinities{})))
+		if u.Query().Get("ranking.profile") != "" {
+			t.Error("empty affinities should not set a ranking profile")
+		}
+	})
+}
+
+func TestHandleAddFeedback(t *testing.T) {
+	t.Run("valid feedback", func(t *testing.T) {
+		srv := newTestServer(t)
+		setupMockCatalog(t, srv, map[string]string{
+			"22": `{"title":"The Shining","genre":"Horror","director":"Stanley Kubrick","tags":["classic"]}`,
+		})
+
+		// Film fields come from the catalog, whatever the client sends
+		w := addFeedback(t, srv, "1", `{"film_id":"22","action":"not_interested","film_title":"Shining","film_genre":"Comedy","film_director":"Someone Else"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		entries, err := srv.store.Feedback(context.Background(), "1")
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("expected 1 feedback entry, got %d (err=%v)", len(entries), err)
+		}
+		e := entries[0]
+		if e.FilmTitle != "The Shining" || e.FilmGenre != "Horror" || e.FilmDirector != "Stanley Kubrick" || len(e.FilmTags) != 1 || e.Action != FeedbackNotInterested {
+			t.Errorf("unexpected entry: %+v", e)
+		}
+	})
+
+	t.Run("changing action replaces entry", func(t *testing.T) {
+		srv := newTestServer(t)
+		addFeedback(t, srv, "1", `{"film_id":"22","action":"not_interested"}`)
+
+		addFeedback(t, srv, "1", `{"film_id":"22","action":"hide"}`)
+
+		entries, _ := srv.store.Feedback(context.Background(), "1")
+		if len(entries) != 1 || entries[0].Action != FeedbackHide {
+			t.Errorf("expected single hide entry, got %+v", entries)
+		}
+	})
+
+	t.Run("invalid action", func(t *testing.T) {
+		srv := newTestServer(t)
+
+		if w := addFeedback(t, srv, "1", `{"film_id":"22","action":"love"}`); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("missing film_id", func(t *testing.T) {
+		srv := newTestServer(t)
+
+		if w := addFeedback(t, srv, "1", `{"action":"hide"}`); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("user not found", func(t *testing.T) {
+		srv := newTestServer(t)
+
+		if w := addFeedback(t, srv, "999", `{"film_id":"22","action":"hide"}`); w.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", w.Code)
+		}
+	})
+}
+
+func TestHandleFeedbackAndUndo(t *testing.T) {
+	srv := newTestServer(t)
+	addFeedback(t, srv, "1", `{"film_id":"22","action":"hide","film_title":"The Shining"}`)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/users/1/feedback", nil)
+	req.SetPathValue("id", "1")
+	w := httptest.NewRecorder()
+	srv.handleFeedback(w, req)
+
+	var entries []FeedbackEntry
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(entries) != 1 || entries[0].FilmTitle != "The Shining" {
+		t.Fatalf("expected hidden film in list, got %+v", entries)
+	}
+
+	del := httptest.NewRequest(http.MethodDelete, "/api/users/1/feedback/22", nil)
+	del.SetPathValue("id", "1")
+	del.SetPathValue("filmID", "22")
+	w = httptest.NewRecorder()
+	srv.handleDeleteFeedback(w, del)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	srv.handleDeleteFeedback(w, del)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 when undoing twice, got %d", w.Code)
+	}
+}
+
+func TestRecommendationsExcludeHiddenFilms(t *testing.T) {
+	srv := newTestServer(t)
+	addFeedback(t, srv, "1", `{"film_id":"film-2","action":"hide"}`)
+	addFeedback(t, srv, "1", `{"film_id":"film-3","action":"not_interested"}`)
+
+	vespaResp := VespaResponse{}
+	for i := 1; i <= 8; i++ {
+		var hit VespaHit
+		hit.ID = fmt.Sprintf("id:films:film::film-%d", i)
+		vespaResp.Root.Children = append(vespaResp.Root.Children, hit)
+	}
+
+	var capturedParams url.Values
+	mockVespa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/document/v1/films/film/docid/film-3" {
+			fmt.Fprint(w, `{"id":"id:films:film::film-3","fields":{"genre":"Horror","director":"James Wan"}}`)
+			return
+		}
+		capturedParams = r.URL.Query()
+		json.NewEncoder(w).Encode(vespaResp)
+	}))
+	defer mockVespa.Close()
+
+	srv.cfg.Vespa.URL = mockVespa.URL
+
+	req := httptest.NewRequest(http.MethodGet, "/api/users/1/recommendations", nil)
+	req.SetPathValue("id", "1")
+	w := httptest.NewRecorder()
+	srv.handleRecommendations(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var result VespaResponse
+	json.NewDecoder(w.Body).Decode(&result)
+
+	var ids []string
+	for _, hit := range result.Root.Children {
+		ids = append(ids, filmIDFromDocID(hit.ID))
+	}
+	if got := strings.Join(ids, ","); got != "film-4,film-5,film-6,film-7,film-8" {
+		t.Errorf("watched and hidden films should be excluded, got %s", got)
+	}
+
+	if !strings.Contains(capturedParams.Get("input.query(genre_affinity)"), "Horror") {
+		t.Errorf("not_interested feedback should penalize its genre, got %q", capturedParams.Get("input.query(genre_affinity)"))
+	}
+	if !strings.Contains(capturedParams.Get("input.query(director_affinity)"), "James Wan") {
+		t.Errorf("not_interested feedback should penalize its director, got %q", capturedParams.Get("input.query(director_affinity)"))
+	}
+}
+
+func TestHandleSearch_ExcludeHidden(t *testing.T) {
+	srv := newTestServer(t)
+	addFeedback(t, srv, "1", `{"film_id":"2","action":"hide"}`)
+
+	mockVespa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"root":{"fields":{"totalCount":3},"children":[{"id":"id:films:film::1"},{"id":"id:films:film::2"},{"id":"id:films:film::3"}]}}`)
+	}))
+	defer mockVespa.Close()
+
+	srv.cfg.Vespa.URL = mockVespa.URL
+	tokens := map[string]string{
+		"1":     setupTestAccount(t, srv, "1", RoleUser),
+		"2":     setupTestAccount(t, srv, "2", RoleUser),
+		"admin": setupTestAccount(t, srv, "admin", RoleAdmin),
+	}
+
+	search := func(query, caller string) VespaResponse {
+		req := httptest.NewRequest(http.MethodGet, "/api/search?"+query, nil)
+		if caller != "" {
+			req.Header.Set("Authorization", "Bearer "+tokens[caller])
+		}
+		w := httptest.NewRecorder()
+		srv.handleSearch(w, req)
+		var result VespaResponse
+		json.NewDecoder(w.Body).Decode(&result)
+		return result
+	}
+
+	if got := search("q=x&user=1", "1"); len(got.Root.Children) != 3 {
+		t.Errorf("hidden films should stay in search by default, got %d hits", len(got.Root.Children))
+	}
+
+	for _, caller := range []string{"1", "admin"} {
+		got := search("q=x&user=1&exclude_hidden=true", caller)
+		if len(got.Root.Children) != 2 || got.Root.Fields.TotalCount != 2 {
+			t.Fatalf("as %s: expected 2 hits with exclude_hidden, got %d (totalCount=%d)", caller, len(got.Root.Children), got.Root.Fields.TotalCount)
+		}
+		for _, hit := range got.Root.Children {
+			if filmIDFromDocID(hit.ID) == "2" {
+				t.Errorf("as %s: hidden film 2 should be excluded from search", caller)
+			}
+		}
+	}
+
+	// Anyone else naming user 1 must not learn what they hid
+	for _, caller := range []string{"", "2"} {
+		if got := search("q=x&user=1&exclude_hidden=true", caller); len(got.Root.Children) != 3 {
+			t.Errorf("as %q: expected user 1's hidden films to be ignored, got %d hits", caller, len(got.Root.Children))
+		}
+	}
+}
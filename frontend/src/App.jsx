@@ -19,14 +19,14 @@ function AppInner() {
       if (users.length > 0) {
         dispatch({ type: 'SET_CURRENT_USER', payload: users[0].id });
       }
-    });
+    }).catch((err) => console.error('Loading users failed', err.code, err.requestId, err));
   }, [dispatch]);
 
   useEffect(() => {
     if (!currentUserId) return;
     fetchHistory(currentUserId).then((data) => {
       dispatch({ type: 'SET_HISTORY', payload: data });
-    });
+    }).catch((err) => console.error('Loading history failed', err.code, err.requestId, err));
   }, [currentUserId, dispatch]);
 
   useSearch();
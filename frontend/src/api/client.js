@@ -1,6 +1,33 @@
+// ApiError carries the problem document the server sends for failed
+// requests. code is stable and safe to branch on; message is for display.
+export class ApiError extends Error {
+  constructor(status, problem) {
+    super(problem.detail || problem.title || `Request failed (${status})`);
+    this.name = 'ApiError';
+    this.status = status;
+    this.code = problem.code || 'unknown_error';
+    this.requestId = problem.request_id || null;
+  }
+}
+
+async function handleResponse(resp) {
+  if (resp.ok) {
+    return resp.json();
+  }
+  let problem = {};
+  const contentType = resp.headers.get('Content-Type') || '';
+  if (contentType.includes('json')) {
+    problem = await resp.json().catch(() => ({}));
+  }
+  if (!problem.request_id) {
+    problem.request_id = resp.headers.get('X-Request-ID');
+  }
+  throw new ApiError(resp.status, problem);
+}
+
 export async function fetchUsers() {
   const resp = await fetch('/api/users');
-  return resp.json();
+  return handleResponse(resp);
 }
 
 export async function savePreferences(userId, preferences) {
@@ -9,12 +36,12 @@ export async function savePreferences(userId, preferences) {
     headers: { 'Content-Type': 'application/json' },
     body: JSON.stringify({ preferences }),
   });
-  return resp.json();
+  return handleResponse(resp);
 }
 
 export async function fetchHistory(userId) {
   const resp = await fetch(`/api/users/${userId}/history`);
-  return resp.json();
+  return handleResponse(resp);
 }
 
 export async function searchFilms(query, userId, preferences) {
@@ -22,11 +49,44 @@ export async function searchFilms(query, userId, preferences) {
   if (preferences) {
     params.set('prefs', JSON.stringify(preferences));
   }
-  const resp = await fetch(`/api/search?${params}`);
-  return resp.json();
+  const resp = await fetch(`/api/v2/search?${params}`);
+  return handleResponse(resp);
 }
 
 export async function fetchRecommendations(userId) {
-  const resp = await fetch(`/api/users/${userId}/recommendations`);
-  return resp.json();
+  const resp = await fetch(`/api/v2/users/${userId}/recommendations`);
+  return handleResponse(resp);
+}
+
+// subscribeRecommendations calls onList with a fresh recommendation list
+// whenever the user's preferences, history, feedback or watchlist change.
+// EventSource reconnects on its own. Call the returned function to stop.
+export function subscribeRecommendations(userId, onList) {
+  const source = new EventSource(`/api/users/${userId}/recommendations/stream`);
+  source.addEventListener('recommendations', (e) => onList(JSON.parse(e.data)));
+  source.addEventListener('error', (e) => {
+    if (e.data) {
+      const problem = JSON.parse(e.data);
+      console.error('Recommendation stream failed', problem.code, problem.request_id);
+    }
+  });
+  return () => source.close();
+}
+
+// sendEvents reports impressions, clicks and plays for the search with
+// queryId. They only feed training data, so failures are not surfaced.
+export async function sendEvents(queryId, events) {
+  if (!queryId || events.length === 0) {
+    return;
+  }
+  try {
+    await fetch('/api/events', {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ query_id: queryId, events }),
+      keepalive: true,
+    });
+  } catch {
+    // Ignore: a lost event only costs a training row
+  }
 }
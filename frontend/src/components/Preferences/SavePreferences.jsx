@@ -17,7 +17,13 @@ export default function SavePreferences() {
       return { type, value: rest.join(':'), state };
     });
 
-    await savePreferences(currentUserId, preferences);
+    try {
+      await savePreferences(currentUserId, preferences);
+    } catch (err) {
+      console.error('Saving preferences failed', err.code, err.requestId, err);
+      dispatch({ type: 'SET_SAVE_STATUS', payload: 'error' });
+      return;
+    }
 
     dispatch({ type: 'UPDATE_USER_PREFS', payload: { userId: currentUserId, preferences } });
     dispatch({ type: 'BUMP_SEARCH_VERSION' });
@@ -37,7 +43,7 @@ export default function SavePreferences() {
       </button>
       {saveStatus && (
         <span className={styles.saveStatus}>
-          {saveStatus === 'saving' ? 'Saving...' : 'Saved!'}
+          {saveStatus === 'saving' ? 'Saving...' : saveStatus === 'error' ? 'Save failed' : 'Saved!'}
         </span>
       )}
     </div>
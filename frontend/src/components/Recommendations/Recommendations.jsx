@@ -1,6 +1,6 @@
-import { useCallback } from 'react';
+import { useCallback, useEffect } from 'react';
 import { useAppState, useAppDispatch } from '../../context/AppContext';
-import { fetchRecommendations } from '../../api/client';
+import { fetchRecommendations, subscribeRecommendations } from '../../api/client';
 import FilmCard from '../SearchResults/FilmCard';
 import styles from './Recommendations.module.css';
 
@@ -11,12 +11,26 @@ export default function Recommendations() {
   const handleRecommend = useCallback(async () => {
     if (!currentUserId) return;
     dispatch({ type: 'SET_RECOMMEND_LOADING', payload: true });
-    const data = await fetchRecommendations(currentUserId);
-    dispatch({ type: 'SET_RECOMMENDATIONS', payload: data });
-    dispatch({ type: 'SET_RECOMMEND_LOADING', payload: false });
+    try {
+      const data = await fetchRecommendations(currentUserId);
+      dispatch({ type: 'SET_RECOMMENDATIONS', payload: data });
+    } catch (err) {
+      console.error('Recommendations failed', err.code, err.requestId, err);
+    } finally {
+      dispatch({ type: 'SET_RECOMMEND_LOADING', payload: false });
+    }
   }, [currentUserId, dispatch]);
 
-  const films = recommendations?.root?.children || [];
+  // Once shown, recommendations follow the user's changes
+  const shown = recommendations !== null;
+  useEffect(() => {
+    if (!currentUserId || !shown) return undefined;
+    return subscribeRecommendations(currentUserId, (data) => {
+      dispatch({ type: 'SET_RECOMMENDATIONS', payload: data });
+    });
+  }, [currentUserId, shown, dispatch]);
+
+  const films = recommendations?.films || [];
 
   return (
     <div className={styles.recsSection}>
@@ -32,8 +46,8 @@ export default function Recommendations() {
       </div>
       {films.length > 0 && (
         <div className={styles.recsList}>
-          {films.map((hit, i) => (
-            <FilmCard key={i} hit={hit} />
+          {films.map((film) => (
+            <FilmCard key={film.id} film={film} />
           ))}
         </div>
       )}
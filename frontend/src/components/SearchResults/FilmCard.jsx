@@ -1,23 +1,22 @@
 import Tag from './Tag';
 import styles from './SearchResults.module.css';
 
-export default function FilmCard({ hit }) {
-  const f = hit.fields;
+export default function FilmCard({ film: f, onClick }) {
   return (
-    <div className={styles.film}>
+    <div className={styles.film} onClick={onClick}>
       <div className={styles.filmHeader}>
         <span className={styles.filmName}>{f.title} ({f.year})</span>
-        <span className={styles.filmScore}>score: {hit.relevance.toFixed(4)}</span>
+        <span className={styles.filmScore}>score: {f.score.toFixed(4)}</span>
       </div>
       <div className={styles.filmDesc}>{f.description}</div>
       <div className={styles.filmMeta}>
         <Tag type="genre" value={f.genre} />
-        {(f.tags || []).map((t) => (
+        {f.tags.map((t) => (
           <Tag key={t} type="tag" value={t} />
         ))}
         {' '}&middot; {f.director}
-        {' '}&middot; {f.rating?.toFixed(1)}
-        {f.cast && f.cast.length > 0 && (
+        {' '}&middot; {f.rating.toFixed(1)}
+        {f.cast.length > 0 && (
           <> &middot; {f.cast.join(', ')}</>
         )}
       </div>
@@ -1,18 +1,33 @@
+import { useEffect } from 'react';
 import { useAppState } from '../../context/AppContext';
+import { sendEvents } from '../../api/client';
 import FilmCard from './FilmCard';
 import styles from './SearchResults.module.css';
 
 export default function SearchResults() {
   const { searchResults } = useAppState();
 
-  const films = searchResults?.root?.children || [];
+  const films = searchResults?.films || [];
+  const queryId = searchResults?.query_id;
+
+  useEffect(() => {
+    sendEvents(
+      queryId,
+      films.map((film, position) => ({ type: 'impression', film_id: film.id, position })),
+    );
+    // Every search returns a new queryId, so films need not be a dependency
+  }, [queryId]);
+
+  const handleClick = (film, position) => {
+    sendEvents(queryId, [{ type: 'click', film_id: film.id, position }]);
+  };
 
   return (
     <div>
       <h2 className={styles.heading}>Search Results</h2>
-      <div className={styles.count}>{films.length} results</div>
-      {films.map((hit, i) => (
-        <FilmCard key={i} hit={hit} />
+      <div className={styles.count}>{searchResults?.paging?.total ?? films.length} results</div>
+      {films.map((film, position) => (
+        <FilmCard key={film.id} film={film} onClick={() => handleClick(film, position)} />
       ))}
     </div>
   );
@@ -22,6 +22,8 @@ export function useSearch() {
     searchFilms(debouncedQuery, currentUserId, preferences).then((data) => {
       if (versionRef.current !== thisVersion) return;
       dispatch({ type: 'SET_SEARCH_RESULTS', payload: data });
+    }).catch((err) => {
+      console.error('Search failed', err.code, err.requestId, err);
     });
   }, [debouncedQuery, currentUserId, prefState, searchVersion, dispatch]);
 }
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// --- Group recommendations ---
+//
+// Group recommendations rank films for several users watching together. Each
+// member's own personalized ranking is turned into a predicted satisfaction
+// between 0 and 1 per film, and the strategy combines the members'
+// satisfactions into the group's score.
+
+const (
+	GroupStrategyAverage      = "average"
+	GroupStrategyLeastMisery  = "least_misery"
+	GroupStrategyMostPleasure = "most_pleasure"
+
+	// GroupWatchedExclude drops films any member has watched;
+	// GroupWatchedShared keeps only films every member has watched.
+	GroupWatchedExclude = "exclude"
+	GroupWatchedShared  = "shared"
+
+	minGroupSize = 2
+	maxGroupSize = 10
+	// groupCandidateHits is Vespa's default hit limit. The catalog fits in
+	// one page, so every member's ranking covers the same films.
+	groupCandidateHits = 400
+	// neutralSatisfaction is used for members whose ranking does not tell
+	// films apart, such as members without preferences.
+	neutralSatisfaction = 0.5
+)
+
+type GroupRecommendationRequest struct {
+	UserIDs []string `json:"user_ids"`
+	// Strategy defaults to average.
+	Strategy string `json:"strategy"`
+	// Watched defaults to exclude.
+	Watched string `json:"watched"`
+}
+
+// GroupFilm is a film with the group's score and each member's predicted
+// satisfaction, both between 0 and 1.
+type GroupFilm struct {
+	ScoredFilm
+	Satisfaction map[string]float64 `json:"satisfaction"`
+
+	// mean is the average satisfaction, which breaks ties.
+	mean float64
+}
+
+type GroupRecommendationList struct {
+	UserIDs  []string    `json:"user_ids"`
+	Strategy string      `json:"strategy"`
+	Watched  string      `json:"watched"`
+	Films    []GroupFilm `json:"films"`
+}
+
+func isValidGroupStrategy(s string) bool {
+	return s == GroupStrategyAverage || s == GroupStrategyLeastMisery || s == GroupStrategyMostPleasure
+}
+
+// groupScore combines the members' satisfactions with strategy.
+func groupScore(strategy string, satisfaction []float64) float64 {
+	switch strategy {
+	case GroupStrategyLeastMisery:
+		return slices.Min(satisfaction)
+	case GroupStrategyMostPleasure:
+		return slices.Max(satisfaction)
+	default:
+		var sum float64
+		for _, v := range satisfaction {
+			sum += v
+		}
+		return sum / float64(len(satisfaction))
+	}
+}
+
+// memberSatisfaction scales a member's hit relevances to 0-1 by film ID,
+// from their lowest ranked film to their best. Films the member's ranking did
+// not return are left out and count as 0.
+func memberSatisfaction(hits []VespaHit) map[string]float64 {
+	sat := map[string]float64{}
+	if len(hits) == 0 {
+		return sat
+	}
+	lo, hi := hits[0].Relevance, hits[0].Relevance
+	for _, hit := range hits {
+		lo = min(lo, hit.Relevance)
+		hi = max(hi, hit.Relevance)
+	}
+	for _, hit := range hits {
+		v := neutralSatisfaction
+		if hi > lo {
+			v = (hit.Relevance - lo) / (hi - lo)
+		}
+		sat[filmIDFromDocID(hit.ID)] = v
+	}
+	return sat
+}
+
+func round4(v float64) float64 {
+	return math.Round(v*10000) / 10000
+}
+
+// recommendForGroup ranks films for userIDs, who must all exist.
+func (s *Server) recommendForGroup(ctx context.Context, req GroupRecommendationRequest) ([]GroupFilm, error) {
+	type member struct {
+		hits    []VespaHit
+		watched map[string]bool
+		hidden  map[string]bool
+		err     error
+	}
+	members := make([]member, len(req.UserIDs))
+	var wg sync.WaitGroup
+	for i, userID := range req.UserIDs {
+		wg.Go(func() {
+			m := &members[i]
+			m.watched = s.watchedFilmIDs(ctx, userID)
+			m.hidden = s.hiddenFilmIDs(ctx, userID)
+			opts := append(s.vespaTraceOptions(ctx), withAffinities(s.userAffinities(ctx, userID)))
+			vespaURL := s.buildVespaQuery("*", s.userPreferences(ctx, userID), groupCandidateHits, opts...)
+			resp, _, err := s.queryVespa(ctx, "group_recommendations", vespaURL)
+			if err != nil {
+				m.err = fmt.Errorf("user %s: %w", userID, err)
+				return
+			}
+			m.hits = resp.Root.Children
+		})
+	}
+	wg.Wait()
+
+	var errs []error
+	for _, m := range members {
+		errs = append(errs, m.err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	films := map[string]VespaHit{}
+	satisfaction := make([]map[string]float64, len(members))
+	for i, m := range members {
+		satisfaction[i] = memberSatisfaction(m.hits)
+		for _, hit := range m.hits {
+			films[filmIDFromDocID(hit.ID)] = hit
+		}
+	}
+
+	var recs []GroupFilm
+	for filmID, hit := range films {
+		// Films any member has hidden are always dropped
+		keep := true
+		for _, m := range members {
+			wantWatched := req.Watched == GroupWatchedShared
+			if m.hidden[filmID] || m.watched[filmID] != wantWatched {
+				keep = false
+				break
+			}
+		}
+		if !keep {
+			continue
+		}
+
+		f := GroupFilm{ScoredFilm: scoredFilmFromHit(hit), Satisfaction: map[string]float64{}}
+		values := make([]float64, len(members))
+		for i, userID := range req.UserIDs {
+			values[i] = satisfaction[i][filmID]
+			f.Satisfaction[userID] = round4(values[i])
+		}
+		f.Score = round4(groupScore(req.Strategy, values))
+		f.mean = groupScore(GroupStrategyAverage, values)
+		recs = append(recs, f)
+	}
+
+	// Ties, common with least misery and most pleasure, go to the film the
+	// group likes more on average
+	slices.SortFunc(recs, func(a, b GroupFilm) int {
+		if c := cmp.Compare(b.Score, a.Score); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(b.mean, a.mean); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+	if count := s.cfg.Search.RecommendationCount; len(recs) > count {
+		recs = recs[:count]
+	}
+	return recs, nil
+}
+
+// --- HTTP handlers ---
+
+func (s *Server) handleGroupRecommendations(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
+
+	var req GroupRecommendationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON: "+err.Error())
+		return
+	}
+	if req.Strategy == "" {
+		req.Strategy = GroupStrategyAverage
+	}
+	if req.Watched == "" {
+		req.Watched = GroupWatchedExclude
+	}
+	if len(req.UserIDs) < minGroupSize || len(req.UserIDs) > maxGroupSize {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("user_ids must hold between %d and %d users", minGroupSize, maxGroupSize))
+		return
+	}
+	for i, id := range req.UserIDs {
+		if slices.Contains(req.UserIDs[:i], id) {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, "user_ids lists user "+id+" twice")
+			return
+		}
+	}
+	if !isValidGroupStrategy(req.Strategy) {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("strategy must be %s, %s or %s",
+			GroupStrategyAverage, GroupStrategyLeastMisery, GroupStrategyMostPleasure))
+		return
+	}
+	if req.Watched != GroupWatchedExclude && req.Watched != GroupWatchedShared {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("watched must be %s or %s", GroupWatchedExclude, GroupWatchedShared))
+		return
+	}
+	// Scores and shared watches reveal each member's taste and history, so
+	// other members must have agreed to share them by being in a watch
+	// party with the caller. Dev mode lets requests without credentials
+	// through unchecked.
+	if u, ok := authUserFromContext(r.Context()); ok && u.Role != RoleAdmin {
+		if !slices.Contains(req.UserIDs, u.ID) {
+			writeProblem(w, r, http.StatusForbidden, codeForbidden, "Only members of the group can get its recommendations")
+			return
+		}
+		for _, id := range req.UserIDs {
+			if id != u.ID && !s.party.together(u.ID, id) {
+				writeProblem(w, r, http.StatusForbidden, codeForbidden, "User "+id+" is not in a watch party with you")
+				return
+			}
+		}
+	}
+	for _, id := range req.UserIDs {
+		if !s.checkUserExists(w, r, id) {
+			return
+		}
+	}
+
+	films, err := s.recommendForGroup(r.Context(), req)
+	if err != nil {
+		upstreamError(w, r, "Vespa query failed for group recommendations", "error", err)
+		return
+	}
+	if films == nil {
+		films = []GroupFilm{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GroupRecommendationList{
+		UserIDs:  req.UserIDs,
+		Strategy: req.Strategy,
+		Watched:  req.Watched,
+		Films:    films,
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGroupScore(t *testing.T) {
+	sat := []float64{0.2, 0.5, 0.8}
+	for strategy, want := range map[string]float64{
+		GroupStrategyAverage:      0.5,
+		GroupStrategyLeastMisery:  0.2,
+		GroupStrategyMostPleasure: 0.8,
+	} {
+		if got := groupScore(strategy, sat); got != want {
+			t.Errorf("groupScore(%s) = %v, want %v", strategy, got, want)
+		}
+	}
+}
+
+func TestMemberSatisfaction(t *testing.T) {
+	hit := func(id string, relevance float64) VespaHit {
+		return VespaHit{ID: "id:films:film::" + id, Relevance: relevance}
+	}
+	sat := memberSatisfaction([]VespaHit{hit("1", 5), hit("2", 3), hit("3", 1)})
+	if sat["1"] != 1 || sat["2"] != 0.5 || sat["3"] != 0 {
+		t.Errorf("unexpected satisfaction: %v", sat)
+	}
+	sat = memberSatisfaction([]VespaHit{hit("1", 0), hit("2", 0)})
+	if sat["1"] != neutralSatisfaction || sat["2"] != neutralSatisfaction {
+		t.Errorf("expected neutral satisfaction when all hits score the same, got %v", sat)
+	}
+}
+
+func TestHandleGroupRecommendations(t *testing.T) {
+	// Member 2 likes Sci-Fi and member 3 Comedy; they rank films 10-13
+	// differently
+	relevance := map[string]map[string]float64{
+		"Sci-Fi": {"10": 3, "11": 2, "12": 1, "13": 0},
+		"Comedy": {"10": 0, "11": 2.5, "12": 3, "13": 1},
+	}
+	mockVespa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rel map[string]float64
+		for genre, m := range relevance {
+			if strings.Contains(r.URL.Query().Get("input.query(genre_boost)"), genre) {
+				rel = m
+			}
+		}
+		var hits []string
+		for _, id := range []string{"10", "11", "12", "13"} {
+			hits = append(hits, fmt.Sprintf(`{"id":"id:films:film::%s","relevance":%g,"fields":{"title":"Film %s"}}`, id, rel[id], id))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"root":{"fields":{"totalCount":4},"children":[` + strings.Join(hits, ",") + `]}}`))
+	}))
+	defer mockVespa.Close()
+
+	srv := newTestServer(t)
+	srv.cfg.Vespa.URL = mockVespa.URL
+	srv.limiter.SetLimits(RateLimits{})
+	ctx := context.Background()
+	for id, genre := range map[string]string{"2": "Sci-Fi", "3": "Comedy"} {
+		srv.store.CreateUser(ctx, User{ID: id, Name: "Member " + id})
+		srv.store.ReplacePreferences(ctx, id, []Preference{{Type: "genre", Value: genre, State: "like"}})
+	}
+	token := setupTestAccount(t, srv, "2", RoleUser)
+	// Members share their taste with the caller by joining a party together
+	for _, id := range []string{"2", "3"} {
+		if _, _, err := srv.party.join("group", id); err != nil {
+			t.Fatalf("joining a party failed: %v", err)
+		}
+	}
+	h := srv.routes()
+
+	recommend := func(body string) (int, GroupRecommendationList) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/api/group-recommendations", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		var list GroupRecommendationList
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+		}
+		return w.Code, list
+	}
+	order := func(list GroupRecommendationList) string {
+		var ids []string
+		for _, f := range list.Films {
+			ids = append(ids, f.ID)
+		}
+		return strings.Join(ids, ",")
+	}
+
+	for _, tc := range []struct{ strategy, want string }{
+		{GroupStrategyAverage, "11,12,10,13"},
+		{GroupStrategyLeastMisery, "11,12,10,13"},
+		// 10 and 12 each delight one member; 12 is better on average
+		{GroupStrategyMostPleasure, "12,10,11,13"},
+	} {
+		code, list := recommend(`{"user_ids":["2","3"],"strategy":"` + tc.strategy + `"}`)
+		if code != http.StatusOK {
+			t.Fatalf("strategy %q: expected 200, got %d", tc.strategy, code)
+		}
+		if got := order(list); got != tc.want {
+			t.Errorf("strategy %q: expected films %s, got %s", tc.strategy, tc.want, got)
+		}
+	}
+
+	code, list := recommend(`{"user_ids":["2","3"],"strategy":"least_misery"}`)
+	if code != http.StatusOK || list.Strategy != GroupStrategyLeastMisery || list.Watched != GroupWatchedExclude {
+		t.Fatalf("unexpected response %d: %+v", code, list)
+	}
+	first := list.Films[0]
+	if first.Satisfaction["2"] != 0.6667 || first.Satisfaction["3"] != 0.8333 || first.Score != 0.6667 {
+		t.Errorf("unexpected scores for film 11: %+v", first)
+	}
+
+	srv.store.AddWatch(ctx, "2", WatchHistoryEntry{FilmID: "12", FilmTitle: "Film 12", UserRating: 4})
+	srv.store.AddWatch(ctx, "2", WatchHistoryEntry{FilmID: "13", FilmTitle: "Film 13", UserRating: 2})
+	srv.store.AddWatch(ctx, "3", WatchHistoryEntry{FilmID: "12", FilmTitle: "Film 12", UserRating: 5})
+	srv.store.PutFeedback(ctx, "3", FeedbackEntry{FilmID: "10", Action: FeedbackHide})
+
+	if _, list := recommend(`{"user_ids":["2","3"]}`); order(list) != "11" {
+		t.Errorf("expected watched and hidden films excluded, got %s", order(list))
+	}
+	if _, list := recommend(`{"user_ids":["2","3"],"watched":"shared"}`); order(list) != "12" {
+		t.Errorf("expected only the film both have watched, got %s", order(list))
+	}
+
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		{`{"user_ids":["2"]}`, http.StatusBadRequest},
+		{`{"user_ids":["2","2"]}`, http.StatusBadRequest},
+		{`{"user_ids":["2","3"],"strategy":"dictator"}`, http.StatusBadRequest},
+		{`{"user_ids":["2","3"],"watched":"all"}`, http.StatusBadRequest},
+		{`{"user_ids":["1","3"]}`, http.StatusForbidden},
+		// User 1 is a stranger to the caller
+		{`{"user_ids":["2","1"]}`, http.StatusForbidden},
+		{`{"user_ids":["2","3","1"]}`, http.StatusForbidden},
+		{`{"user_ids":["2","999"]}`, http.StatusForbidden},
+	} {
+		if code, _ := recommend(tc.body); code != tc.want {
+			t.Errorf("%s: expected %d, got %d", tc.body, tc.want, code)
+		}
+	}
+}
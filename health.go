@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Liveness and readiness ---
+//
+// /livez only says the process is serving. /readyz checks every dependency a
+// search needs, and results are cached briefly so frequent probes do not
+// turn into load on Vespa.
+
+const (
+	readinessCacheTTL = 5 * time.Second
+	readinessTimeout  = 3 * time.Second
+
+	probeDocumentType = "film"
+	probeRankProfile  = "personalized"
+)
+
+type CheckResult struct {
+	Status    string  `json:"status"` // "ok" or "error"
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+type ReadinessResponse struct {
+	Status    string                 `json:"status"` // "ready" or "not_ready"
+	Checks    map[string]CheckResult `json:"checks"`
+	CheckedAt time.Time              `json:"checked_at"`
+}
+
+// readinessCache holds the last readiness result. The mutex is held while
+// checks run, so concurrent probes wait for one round instead of each
+// starting their own.
+type readinessCache struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	last *ReadinessResponse
+}
+
+func newReadinessCache(ttl time.Duration) *readinessCache {
+	return &readinessCache{ttl: ttl}
+}
+
+func (c *readinessCache) get(check func() ReadinessResponse) ReadinessResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.last == nil || time.Since(c.last.CheckedAt) > c.ttl {
+		resp := check()
+		c.last = &resp
+	}
+	return *c.last
+}
+
+func (s *Server) handleLivez(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// handleReadyz reports the checks when every one passes. Otherwise it sends a
+// problem naming the failed checks; why they failed is only logged.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	resp := s.readiness.get(s.checkReadiness)
+	if resp.Status != "ready" {
+		var failed []string
+		for name, check := range resp.Checks {
+			if check.Status != "ok" {
+				failed = append(failed, name)
+			}
+		}
+		slices.Sort(failed)
+		writeProblem(w, r, http.StatusServiceUnavailable, codeServiceUnavailable, "Dependency checks failed: "+strings.Join(failed, ", "))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// checkReadiness runs every dependency check concurrently. Checks run on a
+// background context so a probe that gives up early does not poison the
+// cached result. Failures are logged once per round rather than per probe.
+func (s *Server) checkReadiness() ReadinessResponse {
+	checks := map[string]func(context.Context) error{
+		"store":        s.store.Ping,
+		"vespa":        s.checkVespaHealth,
+		"film_schema":  s.checkProbeQuery(url.Values{}),
+		"rank_profile": s.checkProbeQuery(url.Values{"ranking.profile": {probeRankProfile}}),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), readinessTimeout)
+	defer cancel()
+
+	resp := ReadinessResponse{Status: "ready", Checks: map[string]CheckResult{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Go(func() {
+			start := time.Now()
+			err := check(ctx)
+			result := CheckResult{Status: "ok", LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				slog.Error("Readiness check failed", "check", name, "error", err)
+				result.Status = "error"
+			}
+			mu.Lock()
+			resp.Checks[name] = result
+			if err != nil {
+				resp.Status = "not_ready"
+			}
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+	resp.CheckedAt = time.Now().UTC()
+	return resp
+}
+
+// checkVespaHealth asks the Vespa container whether it is up.
+func (s *Server) checkVespaHealth(ctx context.Context) error {
+	resp, err := s.vespaGet(ctx, s.cfg.Vespa.URL+"/state/v1/health")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	var health struct {
+		Status struct {
+			Code string `json:"code"`
+		} `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return fmt.Errorf("parsing health response: %w", err)
+	}
+	if health.Status.Code != "up" {
+		return fmt.Errorf("vespa status is %q", health.Status.Code)
+	}
+	return nil
+}
+
+// checkProbeQuery returns a check that runs a zero-hit query against the film
+// document type with extra parameters. Vespa rejects the query if the schema
+// or the requested rank profile is not deployed.
+func (s *Server) checkProbeQuery(extra url.Values) func(context.Context) error {
+	return func(ctx context.Context) error {
+		params := url.Values{}
+		params.Set("yql", "select * from "+probeDocumentType+" where true")
+		params.Set("hits", "0")
+		for k, v := range extra {
+			params[k] = v
+		}
+
+		resp, err := s.vespaGet(ctx, s.cfg.Vespa.URL+"/search/?"+params.Encode())
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		var result struct {
+			Root struct {
+				Errors []struct {
+					Message string `json:"message"`
+				} `json:"errors"`
+			} `json:"root"`
+		}
+		body, _ := io.ReadAll(resp.Body)
+		json.Unmarshal(body, &result)
+		if len(result.Root.Errors) > 0 {
+			return fmt.Errorf("status %d: %s", resp.StatusCode, result.Root.Errors[0].Message)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("status %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
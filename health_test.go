@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mockVespaForReadiness serves /state/v1/health and probe queries. The
+// rank profile probe fails unless hasProfile is set.
+func mockVespaForReadiness(t *testing.T, healthCode string, hasProfile bool) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/state/v1/health":
+			w.Write([]byte(`{"status":{"code":"` + healthCode + `"}}`))
+		case r.URL.Path == "/search/" && r.URL.Query().Get("ranking.profile") != "" && !hasProfile:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"root":{"errors":[{"code":4,"message":"Requested rank profile 'personalized' is undefined for document type 'film'"}]}}`))
+		case r.URL.Path == "/search/":
+			w.Write([]byte(`{"root":{"fields":{"totalCount":100}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &calls
+}
+
+func getReadyz(t *testing.T, srv *Server) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	srv.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	return w
+}
+
+func TestHandleLivez(t *testing.T) {
+	srv := newServer(defaultConfig(), nil)
+	w := httptest.NewRecorder()
+	srv.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+}
+
+func TestHandleReadyz(t *testing.T) {
+	t.Run("all dependencies ready", func(t *testing.T) {
+		mockVespa, _ := mockVespaForReadiness(t, "up", true)
+		srv := newTestServer(t)
+		srv.cfg.Vespa.URL = mockVespa.URL
+
+		w := getReadyz(t, srv)
+		var resp ReadinessResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode readiness response: %v", err)
+		}
+		if w.Code != http.StatusOK || resp.Status != "ready" {
+			t.Fatalf("expected 200 ready, got %d %+v", w.Code, resp)
+		}
+		for _, name := range []string{"store", "vespa", "film_schema", "rank_profile"} {
+			if resp.Checks[name].Status != "ok" {
+				t.Errorf("expected %s ok, got %+v", name, resp.Checks[name])
+			}
+		}
+	})
+
+	t.Run("missing rank profile", func(t *testing.T) {
+		mockVespa, _ := mockVespaForReadiness(t, "up", false)
+		srv := newTestServer(t)
+		srv.cfg.Vespa.URL = mockVespa.URL
+
+		p := decodeProblem(t, getReadyz(t, srv), http.StatusServiceUnavailable, codeServiceUnavailable)
+		if p.Detail != "Dependency checks failed: rank_profile" {
+			t.Errorf("expected only rank_profile to fail, got %q", p.Detail)
+		}
+		if strings.Contains(p.Detail, "undefined") {
+			t.Errorf("Vespa's error message should not reach the client, got %q", p.Detail)
+		}
+	})
+
+	t.Run("vespa down", func(t *testing.T) {
+		mockVespa, _ := mockVespaForReadiness(t, "down", true)
+		srv := newTestServer(t)
+		srv.cfg.Vespa.URL = mockVespa.URL
+
+		p := decodeProblem(t, getReadyz(t, srv), http.StatusServiceUnavailable, codeServiceUnavailable)
+		if p.Detail != "Dependency checks failed: vespa" {
+			t.Errorf("expected the vespa check to fail, got %q", p.Detail)
+		}
+	})
+
+	t.Run("vespa unreachable", func(t *testing.T) {
+		srv := newTestServer(t)
+		srv.cfg.Vespa.URL = "http://127.0.0.1:1"
+
+		p := decodeProblem(t, getReadyz(t, srv), http.StatusServiceUnavailable, codeServiceUnavailable)
+		if p.Detail != "Dependency checks failed: film_schema, rank_profile, vespa" {
+			t.Errorf("expected every Vespa check but not the store to fail, got %q", p.Detail)
+		}
+	})
+
+	t.Run("results are cached", func(t *testing.T) {
+		mockVespa, calls := mockVespaForReadiness(t, "up", true)
+		srv := newTestServer(t)
+		srv.cfg.Vespa.URL = mockVespa.URL
+
+		getReadyz(t, srv)
+		first := calls.Load()
+		getReadyz(t, srv)
+		if calls.Load() != first {
+			t.Errorf("expected cached result, Vespa calls went from %d to %d", first, calls.Load())
+		}
+
+		srv.readiness.ttl = 0
+		time.Sleep(time.Millisecond)
+		getReadyz(t, srv)
+		if calls.Load() == first {
+			t.Error("expected checks to rerun once the cache expired")
+		}
+	})
+}
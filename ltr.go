@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Learning-to-rank export ---
+//
+// export-ltr turns logged searches and their events into training rows. Each
+// search is re-run against Vespa with the personalized_features rank profile,
+// which returns the summary-features behind every hit's score.
+
+const (
+	LTRFormatJSONL    = "jsonl"
+	LTRFormatSVMLight = "svmlight"
+
+	ltrRankProfile = "personalized_features"
+	// ltrHitSlack is how far past the lowest shown position the re-run search
+	// looks, in case the ranking has shifted since.
+	ltrHitSlack = 20
+	maxLTRHits  = 400
+)
+
+// ltrFeatures are the summary-features of the personalized_features profile.
+// Their order fixes the SVMLight feature numbers, starting at 1, so only
+// append to it.
+var ltrFeatures = []string{
+	"bm25(title)",
+	"bm25(description)",
+	"attribute(rating)",
+	"attribute(year)",
+	"genre_boost_match",
+	"genre_penalty_match",
+	"tag_boost_match",
+	"tag_penalty_match",
+	"genre_affinity_score",
+	"tag_affinity_score",
+	"director_affinity_score",
+	"firstPhase",
+	"rating_score",
+	"recency_score",
+}
+
+// LTRRow is one training example: a film shown for a query, with its
+// features and click label.
+type LTRRow struct {
+	QueryID     string             `json:"query_id"`
+	Query       string             `json:"query"`
+	UserID      string             `json:"user_id"`
+	Preferences []Preference       `json:"preferences"`
+	FilmID      string             `json:"film_id"`
+	Position    int                `json:"position"`
+	Label       int                `json:"label"`
+	Clicked     bool               `json:"clicked"`
+	Played      bool               `json:"played"`
+	Features    map[string]float64 `json:"features"`
+}
+
+type ltrExportStats struct {
+	queries int
+	rows    int
+	// missing counts films Vespa no longer returned for their query.
+	missing int
+}
+
+func withRankProfile(profile string) queryOption {
+	return func(params url.Values) {
+		params.Set("ranking.profile", profile)
+	}
+}
+
+// rankFeatures re-runs q and returns the summary-features of each hit by
+// film ID.
+func (s *Server) rankFeatures(ctx context.Context, q LabeledQuery) (map[string]map[string]float64, error) {
+	lowest := 0
+	for _, f := range q.Films {
+		lowest = max(lowest, f.Position)
+	}
+	hits := min(lowest+1+ltrHitSlack, maxLTRHits)
+
+	p := searchParams{query: q.Query, userID: q.UserID, prefs: q.Preferences}
+	if p.query == "" {
+		p.query = "*"
+	}
+	_, body, err := s.search(ctx, p, hits, withRankProfile(ltrRankProfile))
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Root struct {
+			Children []struct {
+				ID     string `json:"id"`
+				Fields struct {
+					SummaryFeatures map[string]float64 `json:"summaryfeatures"`
+				} `json:"fields"`
+			} `json:"children"`
+		} `json:"root"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("parsing summary-features: %w", err)
+	}
+	features := map[string]map[string]float64{}
+	for _, hit := range resp.Root.Children {
+		f := map[string]float64{}
+		for name, v := range hit.Fields.SummaryFeatures {
+			if !strings.HasPrefix(name, "vespa.") {
+				f[name] = v
+			}
+		}
+		features[filmIDFromDocID(hit.ID)] = f
+	}
+	return features, nil
+}
+
+// exportLTR writes a row for every film with events in the searches logged
+// at or after since.
+func (s *Server) exportLTR(ctx context.Context, w io.Writer, format string, since time.Time) (ltrExportStats, error) {
+	var stats ltrExportStats
+	queries, err := s.store.LabeledQueries(ctx, since)
+	if err != nil {
+		return stats, err
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	qid := 0
+	for _, q := range queries {
+		features, err := s.rankFeatures(ctx, q)
+		if err != nil {
+			return stats, fmt.Errorf("query %s: %w", q.QueryID, err)
+		}
+		stats.queries++
+		qid++
+		for _, f := range q.Films {
+			fv, ok := features[f.FilmID]
+			if !ok {
+				stats.missing++
+				continue
+			}
+			row := LTRRow{
+				QueryID:     q.QueryID,
+				Query:       q.Query,
+				UserID:      q.UserID,
+				Preferences: q.Preferences,
+				FilmID:      f.FilmID,
+				Position:    f.Position,
+				Label:       f.Label(),
+				Clicked:     f.Clicked,
+				Played:      f.Played,
+				Features:    fv,
+			}
+			if format == LTRFormatSVMLight {
+				err = writeSVMLight(bw, qid, row)
+			} else {
+				err = enc.Encode(row)
+			}
+			if err != nil {
+				return stats, err
+			}
+			stats.rows++
+		}
+	}
+	return stats, bw.Flush()
+}
+
+// writeSVMLight writes row as "<label> qid:<n> 1:<v> 2:<v> ... # <query_id>
+// <film_id>". Features the hit did not return are left out.
+func writeSVMLight(w io.Writer, qid int, row LTRRow) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d qid:%d", row.Label, qid)
+	for i, name := range ltrFeatures {
+		if v, ok := row.Features[name]; ok {
+			fmt.Fprintf(&b, " %d:%s", i+1, strconv.FormatFloat(v, 'g', -1, 64))
+		}
+	}
+	fmt.Fprintf(&b, " # %s %s\n", row.QueryID, row.FilmID)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// --- CLI ---
+
+// runExportLTR implements `vespa-demo export-ltr`.
+func runExportLTR(args []string, stdout io.Writer) error {
+	fset := flag.NewFlagSet("export-ltr", flag.ContinueOnError)
+	configPath := addConfigFlags(fset)
+	format := fset.String("format", LTRFormatJSONL, "output format: jsonl or svmlight")
+	since := fset.Duration("since", 30*24*time.Hour, "export searches logged within this long")
+	output := fset.String("o", "", "output file (default stdout)")
+	fset.Usage = func() {
+		fmt.Fprintln(fset.Output(), "Usage: vespa-demo export-ltr [flags]")
+		fset.PrintDefaults()
+	}
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if *format != LTRFormatJSONL && *format != LTRFormatSVMLight {
+		return fmt.Errorf("-format must be %s or %s, got %q", LTRFormatJSONL, LTRFormatSVMLight, *format)
+	}
+	if *since <= 0 {
+		return errors.New("-since must be positive")
+	}
+
+	cfg, err := loadConfig(fset, *configPath)
+	if err != nil {
+		return err
+	}
+	// The export only reads the log; it must not start pruning it
+	cfg.Features.SearchLog = false
+	store, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	srv := newServer(cfg, store)
+	defer srv.close()
+
+	w := stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	stats, err := srv.exportLTR(context.Background(), w, *format, time.Now().Add(-*since))
+	if err != nil {
+		return err
+	}
+	slog.Info("Exported learning-to-rank data", "queries", stats.queries, "rows", stats.rows, "missing_films", stats.missing)
+	return nil
+}
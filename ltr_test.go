@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportLTR(t *testing.T) {
+	mockVespa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("ranking.profile"); got != ltrRankProfile {
+			t.Errorf("expected ranking.profile %s, got %q", ltrRankProfile, got)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"root":{"fields":{"totalCount":2},"children":[
+			{"id":"id:films:film::42","relevance":2.5,"fields":{"title":"The Matrix",
+				"summaryfeatures":{"bm25(title)":1.5,"attribute(rating)":8.7,"firstPhase":2.5,"vespa.summaryFeatures.cached":0}}},
+			{"id":"id:films:film::43","relevance":1.0,"fields":{"title":"Matrix Reloaded",
+				"summaryfeatures":{"bm25(title)":0.5,"attribute(rating)":7.2,"firstPhase":1}}}]}}`))
+	}))
+	defer mockVespa.Close()
+
+	srv := newTestServer(t)
+	srv.cfg.Vespa.URL = mockVespa.URL
+	ctx := context.Background()
+	now := time.Now()
+	srv.store.AddSearchLogs(ctx, []SearchLogEntry{{Time: now, QueryID: "q-1", API: "v2", Query: "matrix", UserID: "1"}})
+	srv.store.AddEvents(ctx, []SearchEvent{
+		{QueryID: "q-1", Type: EventImpression, FilmID: "42", Position: 0, Time: now},
+		{QueryID: "q-1", Type: EventImpression, FilmID: "43", Position: 1, Time: now},
+		{QueryID: "q-1", Type: EventImpression, FilmID: "99", Position: 2, Time: now},
+		{QueryID: "q-1", Type: EventClick, FilmID: "42", Position: 0, Time: now},
+	})
+
+	t.Run("jsonl", func(t *testing.T) {
+		var buf bytes.Buffer
+		stats, err := srv.exportLTR(ctx, &buf, LTRFormatJSONL, now.Add(-time.Hour))
+		if err != nil {
+			t.Fatalf("exportLTR failed: %v", err)
+		}
+		if stats.queries != 1 || stats.rows != 2 || stats.missing != 1 {
+			t.Errorf("unexpected stats: %+v", stats)
+		}
+		dec := json.NewDecoder(&buf)
+		var rows []LTRRow
+		for {
+			var row LTRRow
+			if err := dec.Decode(&row); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("invalid JSONL: %v", err)
+			}
+			rows = append(rows, row)
+		}
+		if len(rows) != 2 || rows[0].FilmID != "42" || rows[0].Label != 1 || !rows[0].Clicked || rows[1].Label != 0 {
+			t.Fatalf("unexpected rows: %+v", rows)
+		}
+		if rows[0].Query != "matrix" || rows[0].UserID != "1" || rows[0].Features["bm25(title)"] != 1.5 {
+			t.Errorf("unexpected row: %+v", rows[0])
+		}
+		if _, ok := rows[0].Features["vespa.summaryFeatures.cached"]; ok {
+			t.Errorf("expected vespa.* features to be dropped, got %+v", rows[0].Features)
+		}
+	})
+
+	t.Run("svmlight", func(t *testing.T) {
+		var buf bytes.Buffer
+		if _, err := srv.exportLTR(ctx, &buf, LTRFormatSVMLight, now.Add(-time.Hour)); err != nil {
+			t.Fatalf("exportLTR failed: %v", err)
+		}
+		want := "1 qid:1 1:1.5 3:8.7 12:2.5 # q-1 42\n" +
+			"0 qid:1 1:0.5 3:7.2 12:1 # q-1 43\n"
+		if buf.String() != want {
+			t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+		}
+	})
+}
+
+func TestRunExportLTRFlags(t *testing.T) {
+	for _, args := range [][]string{
+		{"-format", "csv"},
+		{"-since", "-1h"},
+	} {
+		if err := runExportLTR(args, io.Discard); err == nil || !strings.Contains(err.Error(), args[0]) {
+			t.Errorf("runExportLTR(%v) = %v, want an error about %s", args, err, args[0])
+		}
+	}
+}
@@ -4,17 +4,22 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"log/slog"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
+	"go.opentelemetry.io/otel"
 	_ "modernc.org/sqlite"
 )
 
@@ -31,14 +36,6 @@ const (
 )
 
 var (
-	db *sql.DB
-
-	vespaBaseURL = getEnv("VESPA_URL", "http://localhost:8080")
-
-	vespaClient = &http.Client{
-		Timeout: 10 * time.Second,
-	}
-
 	validGenres = map[string]bool{
 		"Action": true, "Comedy": true, "Drama": true, "Sci-Fi": true,
 		"Horror": true, "Romance": true, "Thriller": true, "Animation": true,
@@ -68,6 +65,12 @@ type VespaResponse struct {
 		} `json:"fields"`
 		Children []VespaHit `json:"children"`
 	} `json:"root"`
+	// Trace is only present when the query set trace.level. It is recorded
+	// on the request span and never passed on to clients.
+	Trace *vespaTrace `json:"trace,omitempty"`
+	// QueryID is added by the server on /api/search so clients can report
+	// events for the results.
+	QueryID string `json:"query_id,omitempty"`
 }
 
 type VespaHit struct {
@@ -138,57 +141,32 @@ func isValidPreferenceValue(s string) bool {
 
 // --- Database setup ---
 
-func initDB() {
-	var err error
-	db, err = sql.Open("sqlite", "vespa-demo.db")
-	if err != nil {
-		log.Fatal("Failed to open database:", err)
-	}
-
-	if err := db.Ping(); err != nil {
-		log.Fatal("Failed to connect to database:", err)
-	}
-
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS users (
-			id TEXT PRIMARY KEY,
-			name TEXT NOT NULL
-		);
-		CREATE TABLE IF NOT EXISTS user_preferences (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id TEXT NOT NULL,
-			pref_type TEXT NOT NULL,
-			pref_value TEXT NOT NULL,
-			pref_state TEXT NOT NULL,
-			FOREIGN KEY (user_id) REFERENCES users(id)
-		);
-		CREATE TABLE IF NOT EXISTS watch_history (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id TEXT NOT NULL,
-			film_id TEXT NOT NULL,
-			film_title TEXT NOT NULL,
-			film_genre TEXT NOT NULL,
-			film_year INTEGER NOT NULL,
-			film_tags TEXT NOT NULL,
-			user_rating INTEGER NOT NULL,
-			FOREIGN KEY (user_id) REFERENCES users(id)
-		);
-	`)
+// openDB opens and pings the SQLite database at dsn.
+func openDB(dsn string) (*sql.DB, error) {
+	conn, err := sql.Open("sqlite", dsn)
 	if err != nil {
-		log.Fatal("Failed to create tables:", err)
+		return nil, err
 	}
-
-	// Seed users if empty
-	var count int
-	db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
-	if count == 0 {
-		seedData()
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, err
 	}
+	return conn, nil
+}
 
-	slog.Info("Database connection established")
+// seedIfEmpty loads the demo users into a store that has none.
+func seedIfEmpty(ctx context.Context, store Store) error {
+	users, err := store.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		return nil
+	}
+	return seedData(ctx, store)
 }
 
-func seedData() {
+func seedData(ctx context.Context, store Store) error {
 	type seedUser struct {
 		id    string
 		name  string
@@ -371,17 +349,12 @@ func seedData() {
 		"100": {"Everything Everywhere All at Once", "Sci-Fi", 2022, []string{"oscar-winner", "visually-stunning", "indie"}},
 	}
 
-	tx, err := db.Begin()
-	if err != nil {
-		log.Fatal("Failed to begin seed transaction:", err)
-	}
-	defer tx.Rollback()
-
 	for _, u := range users {
-		tx.Exec("INSERT INTO users (id, name) VALUES (?, ?)", u.id, u.name)
-		for _, p := range u.likes {
-			tx.Exec("INSERT INTO user_preferences (user_id, pref_type, pref_value, pref_state) VALUES (?, ?, ?, ?)",
-				u.id, p.Type, p.Value, p.State)
+		if err := store.CreateUser(ctx, User{ID: u.id, Name: u.name}); err != nil {
+			return err
+		}
+		if err := store.ReplacePreferences(ctx, u.id, u.likes); err != nil {
+			return err
 		}
 
 		var likedGenres, dislikedGenres []string
@@ -407,10 +380,12 @@ func seedData() {
 				if !watched[fid] {
 					watched[fid] = true
 					fm := filmDB[fid]
-					tagsJSON, _ := json.Marshal(fm.tags)
 					rating := 4 + rand.Intn(2)
-					tx.Exec("INSERT INTO watch_history (user_id, film_id, film_title, film_genre, film_year, film_tags, user_rating) VALUES (?, ?, ?, ?, ?, ?, ?)",
-						u.id, fid, fm.title, fm.genre, fm.year, string(tagsJSON), rating)
+					if err := store.AddWatch(ctx, u.id, WatchHistoryEntry{
+						FilmID: fid, FilmTitle: fm.title, FilmGenre: fm.genre, FilmYear: fm.year, FilmTags: fm.tags, UserRating: rating,
+					}); err != nil {
+						return err
+					}
 				}
 			}
 		}
@@ -439,10 +414,12 @@ func seedData() {
 				if !watched[fid] {
 					watched[fid] = true
 					fm := filmDB[fid]
-					tagsJSON, _ := json.Marshal(fm.tags)
 					rating := 2 + rand.Intn(3)
-					tx.Exec("INSERT INTO watch_history (user_id, film_id, film_title, film_genre, film_year, film_tags, user_rating) VALUES (?, ?, ?, ?, ?, ?, ?)",
-						u.id, fid, fm.title, fm.genre, fm.year, string(tagsJSON), rating)
+					if err := store.AddWatch(ctx, u.id, WatchHistoryEntry{
+						FilmID: fid, FilmTitle: fm.title, FilmGenre: fm.genre, FilmYear: fm.year, FilmTags: fm.tags, UserRating: rating,
+					}); err != nil {
+						return err
+					}
 					count++
 				}
 			}
@@ -454,72 +431,37 @@ func seedData() {
 				if !watched[fid] {
 					watched[fid] = true
 					fm := filmDB[fid]
-					tagsJSON, _ := json.Marshal(fm.tags)
 					rating := 1 + rand.Intn(2)
-					tx.Exec("INSERT INTO watch_history (user_id, film_id, film_title, film_genre, film_year, film_tags, user_rating) VALUES (?, ?, ?, ?, ?, ?, ?)",
-						u.id, fid, fm.title, fm.genre, fm.year, string(tagsJSON), rating)
+					if err := store.AddWatch(ctx, u.id, WatchHistoryEntry{
+						FilmID: fid, FilmTitle: fm.title, FilmGenre: fm.genre, FilmYear: fm.year, FilmTags: fm.tags, UserRating: rating,
+					}); err != nil {
+						return err
+					}
 				}
 			}
 		}
 	}
 
-	if err := tx.Commit(); err != nil {
-		log.Fatal("Failed to commit seed data:", err)
-	}
-
 	slog.Info("Seeded database with 5 users and watch history")
+	return nil
 }
 
-// --- Database helpers ---
-
-func getUserPreferences(ctx context.Context, userID string) []Preference {
-	rows, err := db.QueryContext(ctx, "SELECT pref_type, pref_value, pref_state FROM user_preferences WHERE user_id = ?", userID)
-	if err != nil {
-		slog.Error("Failed to query preferences", "user_id", userID, "error", err)
-		return []Preference{}
-	}
-	defer rows.Close()
-
-	var prefs []Preference
-	for rows.Next() {
-		var p Preference
-		if err := rows.Scan(&p.Type, &p.Value, &p.State); err != nil {
-			slog.Error("Failed to scan preference row", "user_id", userID, "error", err)
-			continue
-		}
-		prefs = append(prefs, p)
-	}
-	if err := rows.Err(); err != nil {
-		slog.Error("Error iterating preference rows", "user_id", userID, "error", err)
-		return []Preference{}
-	}
-	if prefs == nil {
-		prefs = []Preference{}
-	}
-	return prefs
-}
-
-func getWatchedFilmIDs(ctx context.Context, userID string) map[string]bool {
-	rows, err := db.QueryContext(ctx, "SELECT film_id FROM watch_history WHERE user_id = ?", userID)
-	if err != nil {
-		slog.Error("Failed to query watch history", "user_id", userID, "error", err)
-		return map[string]bool{}
-	}
-	defer rows.Close()
+// --- Vespa query building ---
 
-	watched := map[string]bool{}
-	for rows.Next() {
-		var filmID string
-		if err := rows.Scan(&filmID); err == nil {
-			watched[filmID] = true
-		}
+// filmIDFromDocID extracts the film ID from a Vespa document ID such as
+// "id:films:film::42". It returns "" for IDs that do not have that shape.
+func filmIDFromDocID(docID string) string {
+	if parts := strings.Split(docID, "::"); len(parts) == 2 {
+		return parts[1]
 	}
-	return watched
+	return ""
 }
 
-// --- Vespa query building ---
+// queryOption adjusts the parameters built by buildVespaQuery. Options run
+// after the preference tensors are set, so they may override them.
+type queryOption func(params url.Values)
 
-func buildVespaQuery(query string, prefs []Preference, hits int) string {
+func (s *Server) buildVespaQuery(query string, prefs []Preference, hits int, opts ...queryOption) string {
 	params := url.Values{}
 	yql := "select * from film where true"
 	if query != "*" {
@@ -597,102 +539,217 @@ func buildVespaQuery(query string, prefs []Preference, hits int) string {
 		}
 	}
 
-	return vespaBaseURL + "/search/?" + params.Encode()
+	s.cfg.Ranking.weights().queryOption()(params)
+	for _, opt := range opts {
+		opt(params)
+	}
+	dropUnusedWeights(params)
+
+	return s.cfg.Vespa.URL + "/search/?" + params.Encode()
 }
 
-// --- HTTP handlers ---
+// vespaGet issues a GET to Vespa on behalf of the request in ctx, so the
+// call is traced and cancelled along with it.
+func (s *Server) vespaGet(ctx context.Context, vespaURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, vespaURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.vespa.Do(req)
+}
 
-func handleSearch(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	query := r.URL.Query().Get("q")
-	userID := r.URL.Query().Get("user")
+// --- HTTP handlers ---
 
-	if query == "" {
-		query = "*"
-	} else if len(query) > maxQueryLength {
-		http.Error(w, fmt.Sprintf("Query too long (max %d characters)", maxQueryLength), http.StatusBadRequest)
-		return
-	}
+// searchParams are the inputs shared by every version of the search
+// endpoint.
+type searchParams struct {
+	query  string
+	userID string
+	// callerID is the signed-in user making the search, "" for anonymous
+	// callers. userID is only a claim and may name anyone.
+	callerID string
+	// trusted is set when the caller is signed in as userID or is an admin,
+	// so userID's feedback may shape the results.
+	trusted       bool
+	prefs         []Preference
+	excludeHidden bool
+	// prefsOverridden is set when prefs came from the request rather than
+	// the store.
+	prefsOverridden bool
+	// queryID identifies this search in the search log and in the events
+	// the client reports for its results.
+	queryID string
+	// variants are the user's experiment variants, nil for anonymous
+	// searches.
+	variants variantAssignments
+	// weights are an admin's overrides of the ranking weights.
+	weights rankWeights
+}
 
-	prefsJSON := r.URL.Query().Get("prefs")
-	var prefs []Preference
-	if prefsJSON != "" {
-		if err := json.Unmarshal([]byte(prefsJSON), &prefs); err != nil {
+// parseSearchParams reads q, user, prefs, exclude_hidden and the admin-only
+// weights, and assigns the user's experiment variants, which are echoed in
+// the X-Experiments header. When the parameters are invalid it writes the
+// problem response and returns false.
+func (s *Server) parseSearchParams(w http.ResponseWriter, r *http.Request) (searchParams, bool) {
+	q := r.URL.Query()
+	p := searchParams{
+		query:         q.Get("q"),
+		userID:        q.Get("user"),
+		excludeHidden: q.Get("exclude_hidden") == "true",
+		queryID:       newRequestID(),
+	}
+	// An invalid session only matters when weights need an admin; otherwise
+	// the search runs as anonymous
+	caller, supplied, authErr := s.authenticate(r)
+	if authErr == nil {
+		p.callerID = caller.ID
+		p.trusted = p.userID != "" && (caller.ID == p.userID || caller.Role == RoleAdmin)
+	}
+
+	if p.query == "" {
+		p.query = "*"
+	} else if len(p.query) > maxQueryLength {
+		writeProblem(w, r, http.StatusBadRequest, codeQueryTooLong, fmt.Sprintf("Query too long (max %d characters)", maxQueryLength))
+		return p, false
+	}
+
+	if prefsJSON := q.Get("prefs"); prefsJSON != "" {
+		if err := json.Unmarshal([]byte(prefsJSON), &p.prefs); err != nil {
 			slog.Warn("Failed to unmarshal override preferences", "error", err)
-			prefs = getUserPreferences(r.Context(), userID)
+			p.prefs = s.userPreferences(r.Context(), p.userID)
+		} else {
+			p.prefsOverridden = true
 		}
 	} else {
-		prefs = getUserPreferences(r.Context(), userID)
+		p.prefs = s.userPreferences(r.Context(), p.userID)
 	}
 
-	vespaURL := buildVespaQuery(query, prefs, 100)
+	if raw := q.Get("weights"); raw != "" {
+		if !supplied || authErr != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="vespa-demo"`)
+			writeProblem(w, r, http.StatusUnauthorized, codeAuthRequired, "Authentication required to set ranking weights")
+			return p, false
+		}
+		if caller.Role != RoleAdmin {
+			writeProblem(w, r, http.StatusForbidden, codeForbidden, "Only admins can set ranking weights")
+			return p, false
+		}
+		var err error
+		if p.weights, err = parseRankWeights(raw); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid weights: "+err.Error())
+			return p, false
+		}
+	}
 
-	resp, err := vespaClient.Get(vespaURL)
+	p.variants = assignVariants(s.cfg.Experiments, p.callerID)
+	if len(p.variants) > 0 {
+		w.Header().Set(experimentsHeader, p.variants.String())
+	}
+	return p, true
+}
+
+// queryVespa runs a query and decodes the response, recording its hit count
+// under handler and its trace, if any, on the request span. The raw body is
+// returned for callers that need more than VespaResponse holds.
+func (s *Server) queryVespa(ctx context.Context, handler, vespaURL string) (VespaResponse, []byte, error) {
+	var vespaResp VespaResponse
+	resp, err := s.vespaGet(ctx, vespaURL)
 	if err != nil {
-		slog.Error("Vespa query failed", "error", err, "query", query)
-		http.Error(w, "Vespa query failed: "+err.Error(), http.StatusBadGateway)
-		return
+		return vespaResp, nil, err
 	}
 	defer resp.Body.Close()
 
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return vespaResp, nil, fmt.Errorf("reading Vespa response: %w", err)
+	}
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		slog.Error("Vespa returned error", "status", resp.StatusCode, "body", string(body))
-		http.Error(w, fmt.Sprintf("Vespa error (status %d)", resp.StatusCode), http.StatusBadGateway)
+		return vespaResp, nil, fmt.Errorf("Vespa returned status %d: %s", resp.StatusCode, body)
+	}
+	if err := json.Unmarshal(body, &vespaResp); err != nil {
+		return vespaResp, nil, fmt.Errorf("parsing Vespa response: %w", err)
+	}
+
+	s.metrics.observeTotalCount(handler, vespaResp.Root.Fields.TotalCount)
+	recordVespaTrace(ctx, vespaResp.Trace)
+	vespaResp.Trace = nil
+	return vespaResp, body, nil
+}
+
+// search runs p against Vespa, ranked for p's user and experiment variants,
+// and optionally drops films the user has hidden via feedback. The user's
+// feedback is only used when p is trusted, since it would otherwise let
+// anyone probe another user's hidden films.
+func (s *Server) search(ctx context.Context, p searchParams, hits int, extra ...queryOption) (VespaResponse, []byte, error) {
+	opts := s.vespaTraceOptions(ctx)
+	if p.trusted {
+		opts = append(opts, withAffinities(s.userAffinities(ctx, p.userID)))
+	}
+	opts = append(opts, p.variants.queryOption(), p.weights.queryOption())
+	opts = append(opts, extra...)
+
+	vespaResp, body, err := s.queryVespa(ctx, "search", s.buildVespaQuery(p.query, p.prefs, hits, opts...))
+	if err != nil {
+		return vespaResp, nil, err
+	}
+
+	if p.trusted && p.excludeHidden {
+		hidden := s.hiddenFilmIDs(ctx, p.userID)
+		kept := vespaResp.Root.Children[:0]
+		for _, hit := range vespaResp.Root.Children {
+			if !hidden[filmIDFromDocID(hit.ID)] {
+				kept = append(kept, hit)
+			}
+		}
+		vespaResp.Root.Fields.TotalCount -= len(vespaResp.Root.Children) - len(kept)
+		vespaResp.Root.Children = kept
+	}
+	return vespaResp, body, nil
+}
+
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	p, ok := s.parseSearchParams(w, r)
+	if !ok {
 		return
 	}
 
-	var vespaResp VespaResponse
-	if err := json.NewDecoder(resp.Body).Decode(&vespaResp); err != nil {
-		http.Error(w, "Failed to parse Vespa response: "+err.Error(), http.StatusInternalServerError)
+	vespaResp, _, err := s.search(r.Context(), p, p.variants.hits(s.cfg.Search.Hits))
+	if err != nil {
+		upstreamError(w, r, "Vespa query failed", "error", err, "query", p.query)
 		return
 	}
 
-	slog.Info("Search completed", "query", query, "user_id", userID, "duration_ms", time.Since(start).Milliseconds())
+	s.logSearch("v1", start, p, 0, 0, vespaResp)
+	vespaResp.QueryID = p.queryID
+	slog.Info("Search completed", "query", p.query, "user_id", p.userID, "experiments", p.variants.String(), "duration_ms", time.Since(start).Milliseconds())
 
+	_, span := s.tracing.tracer.Start(r.Context(), "encode response")
+	defer span.End()
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(vespaResp)
 }
 
-func handleUsers(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.QueryContext(r.Context(), "SELECT id, name FROM users ORDER BY id")
+func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request) {
+	stored, err := s.store.ListUsers(r.Context())
 	if err != nil {
-		http.Error(w, "DB error: "+err.Error(), http.StatusInternalServerError)
+		internalError(w, r, "Failed to list users", "error", err)
 		return
 	}
-	defer rows.Close()
 
 	var users []UserResponse
-	for rows.Next() {
-		var u UserResponse
-		if err := rows.Scan(&u.ID, &u.Name); err != nil {
-			slog.Error("Failed to scan user row", "error", err)
-			continue
-		}
-		u.Preferences = getUserPreferences(r.Context(), u.ID)
-		users = append(users, u)
-	}
-	if err := rows.Err(); err != nil {
-		slog.Error("Error iterating user rows", "error", err)
-		http.Error(w, "DB error: "+err.Error(), http.StatusInternalServerError)
-		return
+	for _, u := range stored {
+		users = append(users, UserResponse{ID: u.ID, Name: u.Name, Preferences: s.userPreferences(r.Context(), u.ID)})
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(users)
 }
 
-func handleUpdatePreferences(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleUpdatePreferences(w http.ResponseWriter, r *http.Request) {
 	userID := r.PathValue("id")
 
-	var exists int
-	if err := db.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM users WHERE id = ?", userID).Scan(&exists); err != nil {
-		slog.Error("Failed to check user existence", "user_id", userID, "error", err)
-		http.Error(w, "DB error", http.StatusInternalServerError)
-		return
-	}
-	if exists == 0 {
-		http.Error(w, "User not found", http.StatusNotFound)
+	if !s.checkUserExists(w, r, userID) {
 		return
 	}
 
@@ -700,114 +757,58 @@ func handleUpdatePreferences(w http.ResponseWriter, r *http.Request) {
 
 	var req PreferencesRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON: "+err.Error())
 		return
 	}
 
 	for _, p := range req.Preferences {
 		if p.Type != PrefTypeGenre && p.Type != PrefTypeTag {
-			http.Error(w, "Invalid preference type: "+p.Type, http.StatusBadRequest)
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidPreference, "Invalid preference type: "+p.Type)
 			return
 		}
 		if p.State != PrefStateLike && p.State != PrefStateDislike {
-			http.Error(w, "Invalid preference state: "+p.State, http.StatusBadRequest)
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidPreference, "Invalid preference state: "+p.State)
 			return
 		}
 		if p.Type == PrefTypeGenre && !validGenres[p.Value] {
-			http.Error(w, "Invalid genre: "+p.Value, http.StatusBadRequest)
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidGenre, "Invalid genre: "+p.Value)
 			return
 		}
 		if p.Type == PrefTypeTag && !validTags[p.Value] {
-			http.Error(w, "Invalid tag: "+p.Value, http.StatusBadRequest)
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidTag, "Invalid tag: "+p.Value)
 			return
 		}
 	}
 
-	tx, err := db.Begin()
-	if err != nil {
-		slog.Error("Failed to begin transaction", "error", err)
-		http.Error(w, "DB error", http.StatusInternalServerError)
-		return
-	}
-	defer tx.Rollback()
-
-	if _, err := tx.Exec("DELETE FROM user_preferences WHERE user_id = ?", userID); err != nil {
-		slog.Error("Failed to delete preferences", "user_id", userID, "error", err)
-		http.Error(w, "DB error", http.StatusInternalServerError)
-		return
-	}
-	for _, p := range req.Preferences {
-		if _, err := tx.Exec("INSERT INTO user_preferences (user_id, pref_type, pref_value, pref_state) VALUES (?, ?, ?, ?)",
-			userID, p.Type, p.Value, p.State); err != nil {
-			slog.Error("Failed to insert preference", "user_id", userID, "error", err)
-			http.Error(w, "DB error", http.StatusInternalServerError)
-			return
-		}
-	}
-	if err := tx.Commit(); err != nil {
-		slog.Error("Failed to commit transaction", "user_id", userID, "error", err)
-		http.Error(w, "DB error", http.StatusInternalServerError)
+	if err := s.store.ReplacePreferences(r.Context(), userID, req.Preferences); err != nil {
+		internalError(w, r, "Failed to replace preferences", "user_id", userID, "error", err)
 		return
 	}
 
 	slog.Info("Preferences updated", "user_id", userID, "count", len(req.Preferences))
+	s.changes.publish(userID)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
-func handleHistory(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
 	userID := r.PathValue("id")
 
-	rows, err := db.QueryContext(r.Context(),
-		"SELECT film_id, film_title, film_genre, film_year, film_tags, user_rating FROM watch_history WHERE user_id = ? ORDER BY id DESC",
-		userID,
-	)
+	history, err := s.store.WatchHistory(r.Context(), userID)
 	if err != nil {
-		http.Error(w, "DB error: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
-	var history []WatchHistoryEntry
-	for rows.Next() {
-		var e WatchHistoryEntry
-		var tagsJSON string
-		if err := rows.Scan(&e.FilmID, &e.FilmTitle, &e.FilmGenre, &e.FilmYear, &tagsJSON, &e.UserRating); err != nil {
-			slog.Error("Failed to scan history row", "user_id", userID, "error", err)
-			continue
-		}
-		if err := json.Unmarshal([]byte(tagsJSON), &e.FilmTags); err != nil {
-			e.FilmTags = []string{}
-		}
-		if e.FilmTags == nil {
-			e.FilmTags = []string{}
-		}
-		history = append(history, e)
-	}
-	if err := rows.Err(); err != nil {
-		slog.Error("Error iterating history rows", "user_id", userID, "error", err)
-		http.Error(w, "DB error: "+err.Error(), http.StatusInternalServerError)
+		internalError(w, r, "Failed to query watch history", "user_id", userID, "error", err)
 		return
 	}
-	if history == nil {
-		history = []WatchHistoryEntry{}
-	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(history)
 }
 
-func handleAddHistory(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleAddHistory(w http.ResponseWriter, r *http.Request) {
 	userID := r.PathValue("id")
 
-	var exists int
-	if err := db.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM users WHERE id = ?", userID).Scan(&exists); err != nil {
-		http.Error(w, "DB error", http.StatusInternalServerError)
-		return
-	}
-	if exists == 0 {
-		http.Error(w, "User not found", http.StatusNotFound)
+	if !s.checkUserExists(w, r, userID) {
 		return
 	}
 
@@ -815,89 +816,114 @@ func handleAddHistory(w http.ResponseWriter, r *http.Request) {
 
 	var req AddHistoryRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON: "+err.Error())
 		return
 	}
 
 	if req.UserRating < 1 || req.UserRating > 5 {
-		http.Error(w, "Rating must be between 1 and 5", http.StatusBadRequest)
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidRating, "Rating must be between 1 and 5")
 		return
 	}
 
-	tagsJSON, _ := json.Marshal(req.FilmTags)
-	if _, err := db.ExecContext(r.Context(),
-		"INSERT INTO watch_history (user_id, film_id, film_title, film_genre, film_year, film_tags, user_rating) VALUES (?, ?, ?, ?, ?, ?, ?)",
-		userID, req.FilmID, req.FilmTitle, req.FilmGenre, req.FilmYear, string(tagsJSON), req.UserRating,
-	); err != nil {
-		http.Error(w, "DB error: "+err.Error(), http.StatusInternalServerError)
+	// Also takes the film off the watchlist
+	if err := s.store.AddWatch(r.Context(), userID, WatchHistoryEntry(req)); err != nil {
+		internalError(w, r, "Failed to add watch history", "user_id", userID, "film_id", req.FilmID, "error", err)
 		return
 	}
+	s.changes.publish(userID)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
-func handleRecommendations(w http.ResponseWriter, r *http.Request) {
-	userID := r.PathValue("id")
+// parseWatchlistMode reads the watchlist query parameter. When it is invalid
+// it writes the problem response and returns false.
+func parseWatchlistMode(w http.ResponseWriter, r *http.Request) (string, bool) {
+	mode := r.URL.Query().Get("watchlist")
+	if mode == "" {
+		mode = WatchlistInclude
+	}
+	if mode != WatchlistInclude && mode != WatchlistExclude && mode != WatchlistSurface {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid watchlist mode: "+mode)
+		return "", false
+	}
+	return mode, true
+}
 
-	prefs := getUserPreferences(r.Context(), userID)
-	watchedMap := getWatchedFilmIDs(r.Context(), userID)
+// recommend returns up to the configured number of films for userID that it
+// has not watched or hidden, handling watchlisted films as watchlistMode
+// says.
+func (s *Server) recommend(ctx context.Context, userID, watchlistMode string) ([]VespaHit, error) {
+	prefs := s.userPreferences(ctx, userID)
+	watchedMap := s.watchedFilmIDs(ctx, userID)
+	hiddenMap := s.hiddenFilmIDs(ctx, userID)
+	listedMap := map[string]bool{}
+	if watchlistMode != WatchlistInclude {
+		listedMap = s.watchlistFilmIDs(ctx, userID)
+	}
 
 	// Request extra hits to account for client-side watched-film filtering
-	vespaURL := buildVespaQuery("*", prefs, len(watchedMap)+5)
+	count := s.cfg.Search.RecommendationCount
+	opts := append(s.vespaTraceOptions(ctx), withAffinities(s.userAffinities(ctx, userID)))
+	vespaURL := s.buildVespaQuery("*", prefs, len(watchedMap)+len(hiddenMap)+len(listedMap)+count, opts...)
 
-	resp, err := vespaClient.Get(vespaURL)
+	vespaResp, _, err := s.queryVespa(ctx, "recommendations", vespaURL)
 	if err != nil {
-		slog.Error("Vespa query failed for recommendations", "error", err)
-		http.Error(w, "Vespa query failed: "+err.Error(), http.StatusBadGateway)
-		return
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		slog.Error("Vespa returned error for recommendations", "status", resp.StatusCode, "body", string(body))
-		http.Error(w, fmt.Sprintf("Vespa error (status %d)", resp.StatusCode), http.StatusBadGateway)
-		return
+	// Filter out watched and hidden films and take the top count. In surface mode
+	// watchlisted films are moved ahead of the rest, keeping Vespa's order
+	// within each group.
+	var listed, unlisted []VespaHit
+	for _, hit := range vespaResp.Root.Children {
+		filmID := filmIDFromDocID(hit.ID)
+		if watchedMap[filmID] || hiddenMap[filmID] {
+			continue
+		}
+		switch {
+		case listedMap[filmID] && watchlistMode == WatchlistExclude:
+			continue
+		case listedMap[filmID] && watchlistMode == WatchlistSurface:
+			listed = append(listed, hit)
+		default:
+			unlisted = append(unlisted, hit)
+		}
+	}
+	recs := append(listed, unlisted...)
+	if len(recs) > count {
+		recs = recs[:count]
 	}
+	return recs, nil
+}
 
-	var vespaResp VespaResponse
-	if err := json.NewDecoder(resp.Body).Decode(&vespaResp); err != nil {
-		http.Error(w, "Failed to parse Vespa response: "+err.Error(), http.StatusInternalServerError)
+func (s *Server) handleRecommendations(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("id")
+	watchlistMode, ok := parseWatchlistMode(w, r)
+	if !ok {
 		return
 	}
 
-	// Filter out watched films and take top 5
-	var recs []VespaHit
-	for _, hit := range vespaResp.Root.Children {
-		filmID := ""
-		if parts := strings.Split(hit.ID, "::"); len(parts) == 2 {
-			filmID = parts[1]
-		}
-		if !watchedMap[filmID] {
-			recs = append(recs, hit)
-			if len(recs) >= 5 {
-				break
-			}
-		}
+	recs, err := s.recommend(r.Context(), userID, watchlistMode)
+	if err != nil {
+		upstreamError(w, r, "Vespa query failed for recommendations", "error", err)
+		return
 	}
 
 	result := VespaResponse{}
 	result.Root.Fields.TotalCount = len(recs)
 	result.Root.Children = recs
 
+	_, span := s.tracing.tracer.Start(r.Context(), "encode response")
+	defer span.End()
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
 }
 
-func handleHealth(w http.ResponseWriter, r *http.Request) {
-	if err := db.Ping(); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusServiceUnavailable)
-		json.NewEncoder(w).Encode(map[string]string{
-			"status": "unhealthy",
-			"error":  err.Error(),
-		})
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if err := s.store.Ping(r.Context()); err != nil {
+		slog.Error("Health check failed", "error", err, "request_id", requestIDFromContext(r.Context()))
+		writeProblem(w, r, http.StatusServiceUnavailable, codeServiceUnavailable, "The database is unavailable")
 		return
 	}
 
@@ -908,20 +934,86 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	initDB()
-	defer db.Close()
-
-	mux := http.NewServeMux()
-
-	mux.HandleFunc("GET /health", handleHealth)
-	mux.HandleFunc("GET /api/search", handleSearch)
-	mux.HandleFunc("GET /api/users", handleUsers)
-	mux.HandleFunc("PUT /api/users/{id}/preferences", handleUpdatePreferences)
-	mux.HandleFunc("GET /api/users/{id}/history", handleHistory)
-	mux.HandleFunc("POST /api/users/{id}/history", handleAddHistory)
-	mux.HandleFunc("GET /api/users/{id}/recommendations", handleRecommendations)
-	mux.Handle("GET /", http.FileServer(http.Dir("static/dist")))
-
-	fmt.Println("Server running at http://localhost:3000")
-	log.Fatal(http.ListenAndServe(":3000", mux))
+	if len(os.Args) > 1 {
+		var run func([]string, io.Writer) error
+		switch os.Args[1] {
+		case "migrate":
+			run = runMigrate
+		case "config":
+			run = runConfig
+		case "export-ltr":
+			run = runExportLTR
+		case "eval":
+			run = runEval
+		case "deploy":
+			run = runDeploy
+		}
+		if run != nil {
+			if err := run(os.Args[2:], os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	fset := flag.NewFlagSet("vespa-demo", flag.ExitOnError)
+	configPath := addConfigFlags(fset)
+	fset.Parse(os.Args[1:])
+	cfg, err := loadConfig(fset, *configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	tp, shutdownTracing, err := newTracerProvider(context.Background(), cfg.Tracing)
+	if err != nil {
+		log.Fatal("Failed to set up tracing:", err)
+	}
+	otel.SetTracerProvider(tp)
+
+	store, err := openStore(cfg)
+	if err != nil {
+		log.Fatal("Failed to open store:", err)
+	}
+	if err := seedIfEmpty(context.Background(), store); err != nil {
+		log.Fatal("Failed to seed store:", err)
+	}
+	slog.Info("Store ready", "backend", cfg.Store)
+
+	srv := newServer(cfg, store)
+	srv.bootstrapAdmin()
+
+	if cfg.DevMode {
+		slog.Warn("Dev mode enabled: unauthenticated requests may act as any user")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// A second signal during shutdown kills the process immediately.
+	context.AfterFunc(ctx, stop)
+
+	ln, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		log.Fatal("Failed to listen:", err)
+	}
+	slog.Info("Server starting", "addr", ln.Addr().String())
+	hs := newHTTPServer(cfg.HTTP, srv.routes())
+	// Streams never finish on their own, so end them as draining starts
+	hs.RegisterOnShutdown(srv.changes.close)
+	if err := serveUntilDone(ctx, hs, ln, cfg.HTTP.ShutdownTimeout); err != nil {
+		slog.Error("HTTP server did not stop cleanly", "error", err)
+	}
+
+	// Only close the store once no handler can still be using it.
+	srv.close()
+	if err := store.Close(); err != nil {
+		slog.Error("Failed to close store", "error", err)
+	}
+	flushCtx, cancel := context.WithTimeout(context.Background(), cfg.HTTP.ShutdownTimeout)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Error("Failed to flush traces", "error", err)
+	}
+	slog.Info("Shutdown complete")
 }
\ No newline at end of file
@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
 
 	_ "modernc.org/sqlite"
@@ -92,9 +93,8 @@ func TestGetEnv(t *testing.T) {
 // =============================================================================
 
 func TestBuildVespaQuery(t *testing.T) {
-	oldURL := vespaBaseURL
-	t.Cleanup(func() { vespaBaseURL = oldURL })
-	vespaBaseURL = "http://test:8080"
+	srv := newServer(defaultConfig(), nil)
+	srv.cfg.Vespa.URL = "http://test:8080"
 
 	parseQuery := func(t *testing.T, rawURL string) url.Values {
 		t.Helper()
@@ -106,7 +106,7 @@ func TestBuildVespaQuery(t *testing.T) {
 	}
 
 	t.Run("wildcard query uses where true", func(t *testing.T) {
-		result := buildVespaQuery("*", nil, 10)
+		result := srv.buildVespaQuery("*", nil, 10)
 		params := parseQuery(t, result)
 		yql := params.Get("yql")
 		if !strings.Contains(yql, "where true") {
@@ -121,7 +121,7 @@ func TestBuildVespaQuery(t *testing.T) {
 	})
 
 	t.Run("text query uses userQuery", func(t *testing.T) {
-		result := buildVespaQuery("dark knight", nil, 20)
+		result := srv.buildVespaQuery("dark knight", nil, 20)
 		params := parseQuery(t, result)
 		yql := params.Get("yql")
 		if !strings.Contains(yql, "userQuery()") {
@@ -137,7 +137,7 @@ func TestBuildVespaQuery(t *testing.T) {
 			{Type: "genre", Value: "Action", State: "like"},
 			{Type: "genre", Value: "Sci-Fi", State: "like"},
 		}
-		result := buildVespaQuery("*", prefs, 10)
+		result := srv.buildVespaQuery("*", prefs, 10)
 		params := parseQuery(t, result)
 
 		if params.Get("ranking.profile") != "personalized" {
@@ -156,7 +156,7 @@ func TestBuildVespaQuery(t *testing.T) {
 		prefs := []Preference{
 			{Type: "genre", Value: "Horror", State: "dislike"},
 		}
-		result := buildVespaQuery("*", prefs, 10)
+		result := srv.buildVespaQuery("*", prefs, 10)
 		params := parseQuery(t, result)
 
 		penalty := params.Get("input.query(genre_penalty)")
@@ -170,7 +170,7 @@ func TestBuildVespaQuery(t *testing.T) {
 			{Type: "tag", Value: "blockbuster", State: "like"},
 			{Type: "tag", Value: "indie", State: "dislike"},
 		}
-		result := buildVespaQuery("*", prefs, 10)
+		result := srv.buildVespaQuery("*", prefs, 10)
 		params := parseQuery(t, result)
 
 		tagBoost := params.Get("input.query(tag_boost)")
@@ -190,7 +190,7 @@ func TestBuildVespaQuery(t *testing.T) {
 			{Type: "tag", Value: "classic", State: "like"},
 			{Type: "tag", Value: "sequel", State: "dislike"},
 		}
-		result := buildVespaQuery("test", prefs, 10)
+		result := srv.buildVespaQuery("test", prefs, 10)
 		params := parseQuery(t, result)
 
 		if params.Get("ranking.profile") != "personalized" {
@@ -211,7 +211,7 @@ func TestBuildVespaQuery(t *testing.T) {
 	})
 
 	t.Run("empty preferences no ranking profile", func(t *testing.T) {
-		result := buildVespaQuery("*", []Preference{}, 10)
+		result := srv.buildVespaQuery("*", []Preference{}, 10)
 		params := parseQuery(t, result)
 
 		if params.Get("ranking.profile") != "" {
@@ -220,7 +220,7 @@ func TestBuildVespaQuery(t *testing.T) {
 	})
 
 	t.Run("nil preferences no ranking profile", func(t *testing.T) {
-		result := buildVespaQuery("*", nil, 10)
+		result := srv.buildVespaQuery("*", nil, 10)
 		params := parseQuery(t, result)
 
 		if params.Get("ranking.profile") != "" {
@@ -229,7 +229,7 @@ func TestBuildVespaQuery(t *testing.T) {
 	})
 
 	t.Run("YQL never references id field", func(t *testing.T) {
-		result := buildVespaQuery("*", nil, 10)
+		result := srv.buildVespaQuery("*", nil, 10)
 		params := parseQuery(t, result)
 		yql := params.Get("yql")
 		if strings.Contains(yql, "id =") || strings.Contains(yql, "id=") {
@@ -242,7 +242,7 @@ func TestBuildVespaQuery(t *testing.T) {
 			{Type: "genre", Value: "Action", State: "like"},
 			{Type: "genre", Value: "bad value!", State: "like"}, // invalid: has space and !
 		}
-		result := buildVespaQuery("*", prefs, 10)
+		result := srv.buildVespaQuery("*", prefs, 10)
 		params := parseQuery(t, result)
 
 		boost := params.Get("input.query(genre_boost)")
@@ -255,7 +255,7 @@ func TestBuildVespaQuery(t *testing.T) {
 	})
 
 	t.Run("hits parameter passed through", func(t *testing.T) {
-		result := buildVespaQuery("*", nil, 42)
+		result := srv.buildVespaQuery("*", nil, 42)
 		params := parseQuery(t, result)
 		if params.Get("hits") != "42" {
 			t.Errorf("hits should be 42, got: %s", params.Get("hits"))
@@ -263,9 +263,9 @@ func TestBuildVespaQuery(t *testing.T) {
 	})
 
 	t.Run("base URL is used", func(t *testing.T) {
-		result := buildVespaQuery("*", nil, 10)
+		result := srv.buildVespaQuery("*", nil, 10)
 		if !strings.HasPrefix(result, "http://test:8080/search/?") {
-			t.Errorf("URL should start with vespaBaseURL, got: %s", result)
+			t.Errorf("URL should start with the configured Vespa URL, got: %s", result)
 		}
 	})
 }
@@ -274,65 +274,49 @@ func TestBuildVespaQuery(t *testing.T) {
 // Tier 3: HTTP handlers
 // =============================================================================
 
-func setupTestDB(t *testing.T) {
+var testDBCount atomic.Int64
+
+// newTestServer returns a server backed by a fresh in-memory SQLite database
+// seeded with user 1, two preferences and one watched film.
+func newTestServer(t *testing.T) *Server {
 	t.Helper()
-	var err error
-	testDB, err := sql.Open("sqlite", "file::memory:?mode=memory&cache=shared")
+	dsn := fmt.Sprintf("file:test-%d?mode=memory&cache=shared", testDBCount.Add(1))
+	testDB, err := sql.Open("sqlite", dsn)
 	if err != nil {
 		t.Fatalf("failed to open in-memory db: %v", err)
 	}
-
-	_, err = testDB.Exec(`
-		CREATE TABLE IF NOT EXISTS users (
-			id TEXT PRIMARY KEY,
-			name TEXT NOT NULL
-		);
-		CREATE TABLE IF NOT EXISTS user_preferences (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id TEXT NOT NULL,
-			pref_type TEXT NOT NULL,
-			pref_value TEXT NOT NULL,
-			pref_state TEXT NOT NULL,
-			FOREIGN KEY (user_id) REFERENCES users(id)
-		);
-		CREATE TABLE IF NOT EXISTS watch_history (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id TEXT NOT NULL,
-			film_id TEXT NOT NULL,
-			film_title TEXT NOT NULL,
-			film_genre TEXT NOT NULL,
-			film_year INTEGER NOT NULL,
-			film_tags TEXT NOT NULL,
-			user_rating INTEGER NOT NULL,
-			FOREIGN KEY (user_id) REFERENCES users(id)
-		);
-	`)
-	if err != nil {
-		t.Fatalf("failed to create tables: %v", err)
+	if _, err := migrateUp(testDB); err != nil {
+		t.Fatalf("failed to apply migrations: %v", err)
 	}
+	store := newSQLiteStore(testDB)
+	t.Cleanup(func() { store.Close() })
 
 	// Seed test user
-	testDB.Exec("INSERT INTO users (id, name) VALUES ('1', 'TestUser')")
-	testDB.Exec("INSERT INTO user_preferences (user_id, pref_type, pref_value, pref_state) VALUES ('1', 'genre', 'Action', 'like')")
-	testDB.Exec("INSERT INTO user_preferences (user_id, pref_type, pref_value, pref_state) VALUES ('1', 'tag', 'classic', 'dislike')")
-	tagsJSON, _ := json.Marshal([]string{"blockbuster", "visually-stunning"})
-	testDB.Exec("INSERT INTO watch_history (user_id, film_id, film_title, film_genre, film_year, film_tags, user_rating) VALUES ('1', 'film-1', 'Test Film', 'Action', 2020, ?, 4)", string(tagsJSON))
-
-	oldDB := db
-	db = testDB
-	t.Cleanup(func() {
-		testDB.Close()
-		db = oldDB
+	ctx := context.Background()
+	if err := store.CreateUser(ctx, User{ID: "1", Name: "TestUser"}); err != nil {
+		t.Fatalf("failed to seed user: %v", err)
+	}
+	store.ReplacePreferences(ctx, "1", []Preference{
+		{Type: "genre", Value: "Action", State: "like"},
+		{Type: "tag", Value: "classic", State: "dislike"},
+	})
+	store.AddWatch(ctx, "1", WatchHistoryEntry{
+		FilmID: "film-1", FilmTitle: "Test Film", FilmGenre: "Action", FilmYear: 2020,
+		FilmTags: []string{"blockbuster", "visually-stunning"}, UserRating: 4,
 	})
+
+	srv := newServer(defaultConfig(), store)
+	t.Cleanup(srv.close)
+	return srv
 }
 
 func TestHandleHealth(t *testing.T) {
-	setupTestDB(t)
+	srv := newTestServer(t)
 
 	req := httptest.NewRequest(http.MethodGet, "/health", nil)
 	w := httptest.NewRecorder()
 
-	handleHealth(w, req)
+	srv.handleHealth(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Errorf("expected 200, got %d", w.Code)
@@ -343,15 +327,22 @@ func TestHandleHealth(t *testing.T) {
 	if resp["status"] != "healthy" {
 		t.Errorf("expected status=healthy, got %s", resp["status"])
 	}
+
+	srv.store.Close()
+	w = httptest.NewRecorder()
+	srv.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if p := decodeProblem(t, w, http.StatusServiceUnavailable, codeServiceUnavailable); strings.Contains(p.Detail, "sql") {
+		t.Errorf("the database error should not reach the client, got %q", p.Detail)
+	}
 }
 
 func TestHandleUsers(t *testing.T) {
-	setupTestDB(t)
+	srv := newTestServer(t)
 
 	req := httptest.NewRequest(http.MethodGet, "/api/users", nil)
 	w := httptest.NewRecorder()
 
-	handleUsers(w, req)
+	srv.handleUsers(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Fatalf("expected 200, got %d", w.Code)
@@ -374,21 +365,21 @@ func TestHandleUsers(t *testing.T) {
 
 func TestHandleUpdatePreferences(t *testing.T) {
 	t.Run("valid update", func(t *testing.T) {
-		setupTestDB(t)
+		srv := newTestServer(t)
 
 		body := `{"preferences":[{"type":"genre","value":"Comedy","state":"like"},{"type":"tag","value":"indie","state":"dislike"}]}`
 		req := httptest.NewRequest(http.MethodPut, "/api/users/1/preferences", strings.NewReader(body))
 		req.SetPathValue("id", "1")
 		w := httptest.NewRecorder()
 
-		handleUpdatePreferences(w, req)
+		srv.handleUpdatePreferences(w, req)
 
 		if w.Code != http.StatusOK {
 			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
 		}
 
 		// Verify preferences were saved
-		prefs := getUserPreferences(context.Background(), "1")
+		prefs := srv.userPreferences(context.Background(), "1")
 		if len(prefs) != 2 {
 			t.Fatalf("expected 2 preferences after update, got %d", len(prefs))
 		}
@@ -404,14 +395,14 @@ func TestHandleUpdatePreferences(t *testing.T) {
 	})
 
 	t.Run("invalid type", func(t *testing.T) {
-		setupTestDB(t)
+		srv := newTestServer(t)
 
 		body := `{"preferences":[{"type":"invalid","value":"Action","state":"like"}]}`
 		req := httptest.NewRequest(http.MethodPut, "/api/users/1/preferences", strings.NewReader(body))
 		req.SetPathValue("id", "1")
 		w := httptest.NewRecorder()
 
-		handleUpdatePreferences(w, req)
+		srv.handleUpdatePreferences(w, req)
 
 		if w.Code != http.StatusBadRequest {
 			t.Errorf("expected 400, got %d", w.Code)
@@ -419,14 +410,14 @@ func TestHandleUpdatePreferences(t *testing.T) {
 	})
 
 	t.Run("invalid genre value", func(t *testing.T) {
-		setupTestDB(t)
+		srv := newTestServer(t)
 
 		body := `{"preferences":[{"type":"genre","value":"NotAGenre","state":"like"}]}`
 		req := httptest.NewRequest(http.MethodPut, "/api/users/1/preferences", strings.NewReader(body))
 		req.SetPathValue("id", "1")
 		w := httptest.NewRecorder()
 
-		handleUpdatePreferences(w, req)
+		srv.handleUpdatePreferences(w, req)
 
 		if w.Code != http.StatusBadRequest {
 			t.Errorf("expected 400, got %d", w.Code)
@@ -434,14 +425,14 @@ func TestHandleUpdatePreferences(t *testing.T) {
 	})
 
 	t.Run("invalid tag value", func(t *testing.T) {
-		setupTestDB(t)
+		srv := newTestServer(t)
 
 		body := `{"preferences":[{"type":"tag","value":"not-a-tag","state":"like"}]}`
 		req := httptest.NewRequest(http.MethodPut, "/api/users/1/preferences", strings.NewReader(body))
 		req.SetPathValue("id", "1")
 		w := httptest.NewRecorder()
 
-		handleUpdatePreferences(w, req)
+		srv.handleUpdatePreferences(w, req)
 
 		if w.Code != http.StatusBadRequest {
 			t.Errorf("expected 400, got %d", w.Code)
@@ -449,14 +440,14 @@ func TestHandleUpdatePreferences(t *testing.T) {
 	})
 
 	t.Run("invalid state", func(t *testing.T) {
-		setupTestDB(t)
+		srv := newTestServer(t)
 
 		body := `{"preferences":[{"type":"genre","value":"Action","state":"neutral"}]}`
 		req := httptest.NewRequest(http.MethodPut, "/api/users/1/preferences", strings.NewReader(body))
 		req.SetPathValue("id", "1")
 		w := httptest.NewRecorder()
 
-		handleUpdatePreferences(w, req)
+		srv.handleUpdatePreferences(w, req)
 
 		if w.Code != http.StatusBadRequest {
 			t.Errorf("expected 400, got %d", w.Code)
@@ -464,14 +455,14 @@ func TestHandleUpdatePreferences(t *testing.T) {
 	})
 
 	t.Run("user not found", func(t *testing.T) {
-		setupTestDB(t)
+		srv := newTestServer(t)
 
 		body := `{"preferences":[]}`
 		req := httptest.NewRequest(http.MethodPut, "/api/users/999/preferences", strings.NewReader(body))
 		req.SetPathValue("id", "999")
 		w := httptest.NewRecorder()
 
-		handleUpdatePreferences(w, req)
+		srv.handleUpdatePreferences(w, req)
 
 		if w.Code != http.StatusNotFound {
 			t.Errorf("expected 404, got %d", w.Code)
@@ -480,13 +471,13 @@ func TestHandleUpdatePreferences(t *testing.T) {
 }
 
 func TestHandleHistory(t *testing.T) {
-	setupTestDB(t)
+	srv := newTestServer(t)
 
 	req := httptest.NewRequest(http.MethodGet, "/api/users/1/history", nil)
 	req.SetPathValue("id", "1")
 	w := httptest.NewRecorder()
 
-	handleHistory(w, req)
+	srv.handleHistory(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Fatalf("expected 200, got %d", w.Code)
@@ -511,15 +502,15 @@ func TestHandleHistory(t *testing.T) {
 }
 
 func TestHandleHistory_EmptyUser(t *testing.T) {
-	setupTestDB(t)
+	srv := newTestServer(t)
 	// Add user with no history
-	db.Exec("INSERT INTO users (id, name) VALUES ('2', 'EmptyUser')")
+	srv.store.CreateUser(context.Background(), User{ID: "2", Name: "EmptyUser"})
 
 	req := httptest.NewRequest(http.MethodGet, "/api/users/2/history", nil)
 	req.SetPathValue("id", "2")
 	w := httptest.NewRecorder()
 
-	handleHistory(w, req)
+	srv.handleHistory(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Fatalf("expected 200, got %d", w.Code)
@@ -534,36 +525,35 @@ func TestHandleHistory_EmptyUser(t *testing.T) {
 
 func TestHandleAddHistory(t *testing.T) {
 	t.Run("valid add", func(t *testing.T) {
-		setupTestDB(t)
+		srv := newTestServer(t)
 
 		body := `{"film_id":"film-99","film_title":"New Film","film_genre":"Comedy","film_year":2023,"film_tags":["indie"],"user_rating":3}`
 		req := httptest.NewRequest(http.MethodPost, "/api/users/1/history", strings.NewReader(body))
 		req.SetPathValue("id", "1")
 		w := httptest.NewRecorder()
 
-		handleAddHistory(w, req)
+		srv.handleAddHistory(w, req)
 
 		if w.Code != http.StatusOK {
 			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
 		}
 
 		// Verify it was added
-		var count int
-		db.QueryRow("SELECT COUNT(*) FROM watch_history WHERE user_id = '1'").Scan(&count)
-		if count != 2 {
-			t.Errorf("expected 2 history entries after add, got %d", count)
+		history, _ := srv.store.WatchHistory(context.Background(), "1")
+		if len(history) != 2 {
+			t.Errorf("expected 2 history entries after add, got %d", len(history))
 		}
 	})
 
 	t.Run("rating too low", func(t *testing.T) {
-		setupTestDB(t)
+		srv := newTestServer(t)
 
 		body := `{"film_id":"film-99","film_title":"Bad","film_genre":"Comedy","film_year":2023,"film_tags":[],"user_rating":0}`
 		req := httptest.NewRequest(http.MethodPost, "/api/users/1/history", strings.NewReader(body))
 		req.SetPathValue("id", "1")
 		w := httptest.NewRecorder()
 
-		handleAddHistory(w, req)
+		srv.handleAddHistory(w, req)
 
 		if w.Code != http.StatusBadRequest {
 			t.Errorf("expected 400 for rating 0, got %d", w.Code)
@@ -571,14 +561,14 @@ func TestHandleAddHistory(t *testing.T) {
 	})
 
 	t.Run("rating too high", func(t *testing.T) {
-		setupTestDB(t)
+		srv := newTestServer(t)
 
 		body := `{"film_id":"film-99","film_title":"Bad","film_genre":"Comedy","film_year":2023,"film_tags":[],"user_rating":6}`
 		req := httptest.NewRequest(http.MethodPost, "/api/users/1/history", strings.NewReader(body))
 		req.SetPathValue("id", "1")
 		w := httptest.NewRecorder()
 
-		handleAddHistory(w, req)
+		srv.handleAddHistory(w, req)
 
 		if w.Code != http.StatusBadRequest {
 			t.Errorf("expected 400 for rating 6, got %d", w.Code)
@@ -586,14 +576,14 @@ func TestHandleAddHistory(t *testing.T) {
 	})
 
 	t.Run("user not found", func(t *testing.T) {
-		setupTestDB(t)
+		srv := newTestServer(t)
 
 		body := `{"film_id":"film-99","film_title":"X","film_genre":"Comedy","film_year":2023,"film_tags":[],"user_rating":3}`
 		req := httptest.NewRequest(http.MethodPost, "/api/users/999/history", strings.NewReader(body))
 		req.SetPathValue("id", "999")
 		w := httptest.NewRecorder()
 
-		handleAddHistory(w, req)
+		srv.handleAddHistory(w, req)
 
 		if w.Code != http.StatusNotFound {
 			t.Errorf("expected 404, got %d", w.Code)
@@ -602,7 +592,7 @@ func TestHandleAddHistory(t *testing.T) {
 }
 
 func TestHandleSearch(t *testing.T) {
-	setupTestDB(t)
+	srv := newTestServer(t)
 
 	// Mock Vespa server
 	vespaResp := VespaResponse{}
@@ -635,14 +625,12 @@ func TestHandleSearch(t *testing.T) {
 	}))
 	defer mockVespa.Close()
 
-	oldURL := vespaBaseURL
-	vespaBaseURL = mockVespa.URL
-	t.Cleanup(func() { vespaBaseURL = oldURL })
+	srv.cfg.Vespa.URL = mockVespa.URL
 
 	req := httptest.NewRequest(http.MethodGet, "/api/search?q=dark+knight&user=1", nil)
 	w := httptest.NewRecorder()
 
-	handleSearch(w, req)
+	srv.handleSearch(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
@@ -664,7 +652,7 @@ func TestHandleSearch(t *testing.T) {
 }
 
 func TestHandleSearch_EmptyQuery(t *testing.T) {
-	setupTestDB(t)
+	srv := newTestServer(t)
 
 	mockVespa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Verify the query that reaches Vespa uses wildcard
@@ -677,14 +665,12 @@ func TestHandleSearch_EmptyQuery(t *testing.T) {
 	}))
 	defer mockVespa.Close()
 
-	oldURL := vespaBaseURL
-	vespaBaseURL = mockVespa.URL
-	t.Cleanup(func() { vespaBaseURL = oldURL })
+	srv.cfg.Vespa.URL = mockVespa.URL
 
 	req := httptest.NewRequest(http.MethodGet, "/api/search", nil)
 	w := httptest.NewRecorder()
 
-	handleSearch(w, req)
+	srv.handleSearch(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Errorf("expected 200, got %d", w.Code)
@@ -692,13 +678,13 @@ func TestHandleSearch_EmptyQuery(t *testing.T) {
 }
 
 func TestHandleSearch_QueryTooLong(t *testing.T) {
-	setupTestDB(t)
+	srv := newTestServer(t)
 
 	longQuery := strings.Repeat("a", maxQueryLength+1)
 	req := httptest.NewRequest(http.MethodGet, "/api/search?q="+longQuery, nil)
 	w := httptest.NewRecorder()
 
-	handleSearch(w, req)
+	srv.handleSearch(w, req)
 
 	if w.Code != http.StatusBadRequest {
 		t.Errorf("expected 400 for long query, got %d", w.Code)
@@ -706,11 +692,13 @@ func TestHandleSearch_QueryTooLong(t *testing.T) {
 }
 
 func TestHandleRecommendations(t *testing.T) {
-	setupTestDB(t)
+	srv := newTestServer(t)
 
 	// Add a second watched film
-	tagsJSON, _ := json.Marshal([]string{"classic"})
-	db.Exec("INSERT INTO watch_history (user_id, film_id, film_title, film_genre, film_year, film_tags, user_rating) VALUES ('1', 'film-2', 'Watched Film 2', 'Drama', 2019, ?, 3)", string(tagsJSON))
+	srv.store.AddWatch(context.Background(), "1", WatchHistoryEntry{
+		FilmID: "film-2", FilmTitle: "Watched Film 2", FilmGenre: "Drama", FilmYear: 2019,
+		FilmTags: []string{"classic"}, UserRating: 3,
+	})
 
 	// Mock Vespa returns 8 films, some of which the user has watched
 	vespaResp := VespaResponse{}
@@ -744,15 +732,13 @@ func TestHandleRecommendations(t *testing.T) {
 	}))
 	defer mockVespa.Close()
 
-	oldURL := vespaBaseURL
-	vespaBaseURL = mockVespa.URL
-	t.Cleanup(func() { vespaBaseURL = oldURL })
+	srv.cfg.Vespa.URL = mockVespa.URL
 
 	req := httptest.NewRequest(http.MethodGet, "/api/users/1/recommendations", nil)
 	req.SetPathValue("id", "1")
 	w := httptest.NewRecorder()
 
-	handleRecommendations(w, req)
+	srv.handleRecommendations(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
@@ -792,15 +778,14 @@ func TestHandleRecommendations(t *testing.T) {
 // =============================================================================
 
 func TestIntegration_RecommendationsQueryHasNoIDField(t *testing.T) {
-	setupTestDB(t)
+	srv := newTestServer(t)
 
 	// Add several watched films so the old code would have generated id filters
 	for i := 1; i <= 10; i++ {
-		tagsJSON, _ := json.Marshal([]string{"classic"})
-		db.Exec(
-			"INSERT INTO watch_history (user_id, film_id, film_title, film_genre, film_year, film_tags, user_rating) VALUES ('1', ?, ?, 'Action', 2020, ?, 4)",
-			fmt.Sprintf("film-%d", i+100), fmt.Sprintf("Watched %d", i), string(tagsJSON),
-		)
+		srv.store.AddWatch(context.Background(), "1", WatchHistoryEntry{
+			FilmID: fmt.Sprintf("film-%d", i+100), FilmTitle: fmt.Sprintf("Watched %d", i), FilmGenre: "Action", FilmYear: 2020,
+			FilmTags: []string{"classic"}, UserRating: 4,
+		})
 	}
 
 	var capturedYQL string
@@ -811,15 +796,13 @@ func TestIntegration_RecommendationsQueryHasNoIDField(t *testing.T) {
 	}))
 	defer mockVespa.Close()
 
-	oldURL := vespaBaseURL
-	vespaBaseURL = mockVespa.URL
-	t.Cleanup(func() { vespaBaseURL = oldURL })
+	srv.cfg.Vespa.URL = mockVespa.URL
 
 	req := httptest.NewRequest(http.MethodGet, "/api/users/1/recommendations", nil)
 	req.SetPathValue("id", "1")
 	w := httptest.NewRecorder()
 
-	handleRecommendations(w, req)
+	srv.handleRecommendations(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
@@ -836,15 +819,14 @@ func TestIntegration_RecommendationsQueryHasNoIDField(t *testing.T) {
 }
 
 func TestIntegration_RecommendationsRequestsEnoughHits(t *testing.T) {
-	setupTestDB(t)
+	srv := newTestServer(t)
 
-	// User has 1 watched film from setupTestDB. Add 4 more.
+	// User has 1 watched film from newTestServer. Add 4 more.
 	for i := 2; i <= 5; i++ {
-		tagsJSON, _ := json.Marshal([]string{"classic"})
-		db.Exec(
-			"INSERT INTO watch_history (user_id, film_id, film_title, film_genre, film_year, film_tags, user_rating) VALUES ('1', ?, ?, 'Action', 2020, ?, 3)",
-			fmt.Sprintf("film-%d", i), fmt.Sprintf("Watched %d", i), string(tagsJSON),
-		)
+		srv.store.AddWatch(context.Background(), "1", WatchHistoryEntry{
+			FilmID: fmt.Sprintf("film-%d", i), FilmTitle: fmt.Sprintf("Watched %d", i), FilmGenre: "Action", FilmYear: 2020,
+			FilmTags: []string{"classic"}, UserRating: 3,
+		})
 	}
 	// Now user has 5 watched films
 
@@ -856,15 +838,13 @@ func TestIntegration_RecommendationsRequestsEnoughHits(t *testing.T) {
 	}))
 	defer mockVespa.Close()
 
-	oldURL := vespaBaseURL
-	vespaBaseURL = mockVespa.URL
-	t.Cleanup(func() { vespaBaseURL = oldURL })
+	srv.cfg.Vespa.URL = mockVespa.URL
 
 	req := httptest.NewRequest(http.MethodGet, "/api/users/1/recommendations", nil)
 	req.SetPathValue("id", "1")
 	w := httptest.NewRecorder()
 
-	handleRecommendations(w, req)
+	srv.handleRecommendations(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
@@ -877,14 +857,13 @@ func TestIntegration_RecommendationsRequestsEnoughHits(t *testing.T) {
 }
 
 func TestIntegration_RecommendationsFiltersWatchedClientSide(t *testing.T) {
-	setupTestDB(t)
+	srv := newTestServer(t)
 
-	// User has film-1 watched from setupTestDB. Add film-3.
-	tagsJSON, _ := json.Marshal([]string{"indie"})
-	db.Exec(
-		"INSERT INTO watch_history (user_id, film_id, film_title, film_genre, film_year, film_tags, user_rating) VALUES ('1', 'film-3', 'Another Watched', 'Drama', 2021, ?, 5)",
-		string(tagsJSON),
-	)
+	// User has film-1 watched from newTestServer. Add film-3.
+	srv.store.AddWatch(context.Background(), "1", WatchHistoryEntry{
+		FilmID: "film-3", FilmTitle: "Another Watched", FilmGenre: "Drama", FilmYear: 2021,
+		FilmTags: []string{"indie"}, UserRating: 5,
+	})
 
 	// Mock returns films including watched ones (since Vespa no longer filters them)
 	vespaResp := VespaResponse{}
@@ -916,15 +895,13 @@ func TestIntegration_RecommendationsFiltersWatchedClientSide(t *testing.T) {
 	}))
 	defer mockVespa.Close()
 
-	oldURL := vespaBaseURL
-	vespaBaseURL = mockVespa.URL
-	t.Cleanup(func() { vespaBaseURL = oldURL })
+	srv.cfg.Vespa.URL = mockVespa.URL
 
 	req := httptest.NewRequest(http.MethodGet, "/api/users/1/recommendations", nil)
 	req.SetPathValue("id", "1")
 	w := httptest.NewRecorder()
 
-	handleRecommendations(w, req)
+	srv.handleRecommendations(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
@@ -952,14 +929,14 @@ func TestIntegration_RecommendationsFiltersWatchedClientSide(t *testing.T) {
 }
 
 func TestIntegration_PreferencesFlowThroughToVespaQuery(t *testing.T) {
-	setupTestDB(t)
+	srv := newTestServer(t)
 
 	// Update preferences via the handler
 	body := `{"preferences":[{"type":"genre","value":"Sci-Fi","state":"like"},{"type":"genre","value":"Horror","state":"dislike"},{"type":"tag","value":"visually-stunning","state":"like"}]}`
 	putReq := httptest.NewRequest(http.MethodPut, "/api/users/1/preferences", strings.NewReader(body))
 	putReq.SetPathValue("id", "1")
 	putW := httptest.NewRecorder()
-	handleUpdatePreferences(putW, putReq)
+	srv.handleUpdatePreferences(putW, putReq)
 	if putW.Code != http.StatusOK {
 		t.Fatalf("failed to update preferences: %d %s", putW.Code, putW.Body.String())
 	}
@@ -973,15 +950,13 @@ func TestIntegration_PreferencesFlowThroughToVespaQuery(t *testing.T) {
 	}))
 	defer mockVespa.Close()
 
-	oldURL := vespaBaseURL
-	vespaBaseURL = mockVespa.URL
-	t.Cleanup(func() { vespaBaseURL = oldURL })
+	srv.cfg.Vespa.URL = mockVespa.URL
 
 	req := httptest.NewRequest(http.MethodGet, "/api/users/1/recommendations", nil)
 	req.SetPathValue("id", "1")
 	w := httptest.NewRecorder()
 
-	handleRecommendations(w, req)
+	srv.handleRecommendations(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
@@ -1012,8 +987,8 @@ func TestIntegration_PreferencesFlowThroughToVespaQuery(t *testing.T) {
 }
 
 func TestIntegration_SearchWithDBPreferences(t *testing.T) {
-	setupTestDB(t)
-	// User 1 has: genre=Action/like, tag=classic/dislike from setupTestDB
+	srv := newTestServer(t)
+	// User 1 has: genre=Action/like, tag=classic/dislike from newTestServer
 
 	var capturedParams url.Values
 	mockVespa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -1023,14 +998,12 @@ func TestIntegration_SearchWithDBPreferences(t *testing.T) {
 	}))
 	defer mockVespa.Close()
 
-	oldURL := vespaBaseURL
-	vespaBaseURL = mockVespa.URL
-	t.Cleanup(func() { vespaBaseURL = oldURL })
+	srv.cfg.Vespa.URL = mockVespa.URL
 
 	req := httptest.NewRequest(http.MethodGet, "/api/search?q=adventure&user=1", nil)
 	w := httptest.NewRecorder()
 
-	handleSearch(w, req)
+	srv.handleSearch(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
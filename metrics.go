@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// --- Metrics ---
+//
+// Each Server has its own registry so tests can run several servers without
+// colliding on metric names. Everything is exposed at GET /metrics.
+
+type metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests *prometheus.CounterVec
+	httpDuration *prometheus.HistogramVec
+	httpInFlight prometheus.Gauge
+
+	vespaDuration   *prometheus.HistogramVec
+	vespaErrors     *prometheus.CounterVec
+	vespaTotalCount *prometheus.HistogramVec
+	vespaZeroHits   *prometheus.CounterVec
+
+	storeDuration *prometheus.HistogramVec
+	cacheLookups  *prometheus.CounterVec
+	rateLimited   *prometheus.CounterVec
+
+	searchLogDropped prometheus.Counter
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "HTTP requests handled, by route pattern and status code.",
+		}, []string{"route", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "HTTP request latency, by route pattern and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "status"}),
+		httpInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "HTTP requests currently being handled.",
+		}),
+		vespaDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "vespa_request_duration_seconds",
+			Help:    "Latency of calls to Vespa, by endpoint and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"endpoint", "status"}),
+		vespaErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "vespa_request_errors_total",
+			Help: "Failed calls to Vespa, by endpoint and status code (\"error\" when no response was received).",
+		}, []string{"endpoint", "status"}),
+		vespaTotalCount: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "vespa_result_total_count",
+			Help:    "totalCount reported by Vespa per query, by handler.",
+			Buckets: []float64{0, 1, 5, 10, 25, 50, 100, 250, 1000},
+		}, []string{"handler"}),
+		vespaZeroHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "vespa_zero_results_total",
+			Help: "Vespa queries that matched no documents, by handler.",
+		}, []string{"handler"}),
+		storeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "store_operation_duration_seconds",
+			Help:    "Latency of storage operations, by backend and operation.",
+			Buckets: []float64{.0001, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, 1},
+		}, []string{"backend", "operation"}),
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cache_lookups_total",
+			Help: "Cache lookups, by cache and result (hit or miss).",
+		}, []string{"cache", "result"}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rate_limited_requests_total",
+			Help: "Requests rejected with 429, by limit class.",
+		}, []string{"class"}),
+		searchLogDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "search_log_dropped_total",
+			Help: "Search log entries lost because the queue was full or the write failed.",
+		}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequests, m.httpDuration, m.httpInFlight,
+		m.vespaDuration, m.vespaErrors, m.vespaTotalCount, m.vespaZeroHits,
+		m.storeDuration, m.cacheLookups, m.rateLimited,
+		m.searchLogDropped,
+	)
+	return m
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// observeTotalCount records the totalCount of a Vespa result for handler.
+func (m *metrics) observeTotalCount(handler string, totalCount int) {
+	m.vespaTotalCount.WithLabelValues(handler).Observe(float64(totalCount))
+	if totalCount == 0 {
+		m.vespaZeroHits.WithLabelValues(handler).Inc()
+	}
+}
+
+func (m *metrics) cacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cacheLookups.WithLabelValues(cache, result).Inc()
+}
+
+// --- HTTP instrumentation ---
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrument records every request under the pattern the mux matched, so
+// path parameters do not blow up label cardinality. The mux sets r.Pattern on
+// the request it is given, which is the one we hold here.
+func (m *metrics) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.httpInFlight.Inc()
+		defer m.httpInFlight.Dec()
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		status := strconv.Itoa(rec.status)
+		m.httpRequests.WithLabelValues(route, status).Inc()
+		m.httpDuration.WithLabelValues(route, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+// --- Vespa instrumentation ---
+
+// vespaTransport times and traces every call the Vespa client makes.
+type vespaTransport struct {
+	next    http.RoundTripper
+	metrics *metrics
+	tracing *tracing
+}
+
+func (t vespaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := vespaEndpoint(req.URL.Path)
+	req, span := t.tracing.startVespaSpan(req, endpoint)
+	defer span.End()
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+		span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	}
+	t.metrics.vespaDuration.WithLabelValues(endpoint, status).Observe(time.Since(start).Seconds())
+	if err != nil || resp.StatusCode >= 400 {
+		t.metrics.vespaErrors.WithLabelValues(endpoint, status).Inc()
+		span.SetStatus(codes.Error, "vespa "+status)
+	}
+	if err != nil {
+		span.RecordError(err)
+	}
+	return resp, err
+}
+
+// CloseIdleConnections lets http.Client.CloseIdleConnections reach the
+// wrapped transport.
+func (t vespaTransport) CloseIdleConnections() {
+	if c, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// vespaEndpoint maps a Vespa URL path to a fixed label.
+func vespaEndpoint(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/search/"):
+		return "search"
+	case strings.HasPrefix(path, "/document/v1/"):
+		return "document"
+	case strings.HasPrefix(path, "/state/v1/"):
+		return "state"
+	case strings.HasPrefix(path, "/application/v2/"):
+		return "application"
+	default:
+		return "other"
+	}
+}
+
+// --- Store instrumentation ---
+
+// instrumentedStore times and traces every call to the wrapped store.
+type instrumentedStore struct {
+	next    Store
+	backend string
+	metrics *metrics
+	tracing *tracing
+}
+
+// begin starts a span for op. Call the returned func when op completes.
+func (s instrumentedStore) begin(ctx context.Context, op string) (context.Context, func()) {
+	start := time.Now()
+	ctx, span := s.tracing.tracer.Start(ctx, "store."+op, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", s.backend), attribute.String("db.operation", op)))
+	return ctx, func() {
+		s.metrics.storeDuration.WithLabelValues(s.backend, op).Observe(time.Since(start).Seconds())
+		span.End()
+	}
+}
+
+func (s instrumentedStore) Ping(ctx context.Context) error {
+	ctx, end := s.begin(ctx, "ping")
+	defer end()
+	return s.next.Ping(ctx)
+}
+
+func (s instrumentedStore) Close() error { return s.next.Close() }
+
+func (s instrumentedStore) ListUsers(ctx context.Context) ([]User, error) {
+	ctx, end := s.begin(ctx, "list_users")
+	defer end()
+	return s.next.ListUsers(ctx)
+}
+
+func (s instrumentedStore) UserExists(ctx context.Context, userID string) (bool, error) {
+	ctx, end := s.begin(ctx, "user_exists")
+	defer end()
+	return s.next.UserExists(ctx, userID)
+}
+
+func (s instrumentedStore) CreateUser(ctx context.Context, u User) error {
+	ctx, end := s.begin(ctx, "create_user")
+	defer end()
+	return s.next.CreateUser(ctx, u)
+}
+
+func (s instrumentedStore) CreateAccount(ctx context.Context, u User, c Credentials) error {
+	ctx, end := s.begin(ctx, "create_account")
+	defer end()
+	return s.next.CreateAccount(ctx, u, c)
+}
+
+func (s instrumentedStore) Credentials(ctx context.Context, userID string) (Credentials, error) {
+	ctx, end := s.begin(ctx, "credentials")
+	defer end()
+	return s.next.Credentials(ctx, userID)
+}
+
+func (s instrumentedStore) SetCredentials(ctx context.Context, c Credentials, setRole bool) error {
+	ctx, end := s.begin(ctx, "set_credentials")
+	defer end()
+	return s.next.SetCredentials(ctx, c, setRole)
+}
+
+func (s instrumentedStore) CreateSession(ctx context.Context, tokenHash, userID string, expiresAt time.Time) error {
+	ctx, end := s.begin(ctx, "create_session")
+	defer end()
+	return s.next.CreateSession(ctx, tokenHash, userID, expiresAt)
+}
+
+func (s instrumentedStore) Session(ctx context.Context, tokenHash string) (Session, error) {
+	ctx, end := s.begin(ctx, "session")
+	defer end()
+	return s.next.Session(ctx, tokenHash)
+}
+
+func (s instrumentedStore) DeleteSession(ctx context.Context, tokenHash string) error {
+	ctx, end := s.begin(ctx, "delete_session")
+	defer end()
+	return s.next.DeleteSession(ctx, tokenHash)
+}
+
+func (s instrumentedStore) DeleteUserSessions(ctx context.Context, userID string) error {
+	ctx, end := s.begin(ctx, "delete_user_sessions")
+	defer end()
+	return s.next.DeleteUserSessions(ctx, userID)
+}
+
+func (s instrumentedStore) Preferences(ctx context.Context, userID string) ([]Preference, error) {
+	ctx, end := s.begin(ctx, "preferences")
+	defer end()
+	return s.next.Preferences(ctx, userID)
+}
+
+func (s instrumentedStore) ReplacePreferences(ctx context.Context, userID string, prefs []Preference) error {
+	ctx, end := s.begin(ctx, "replace_preferences")
+	defer end()
+	return s.next.ReplacePreferences(ctx, userID, prefs)
+}
+
+func (s instrumentedStore) WatchHistory(ctx context.Context, userID string) ([]WatchHistoryEntry, error) {
+	ctx, end := s.begin(ctx, "watch_history")
+	defer end()
+	return s.next.WatchHistory(ctx, userID)
+}
+
+func (s instrumentedStore) AddWatch(ctx context.Context, userID string, e WatchHistoryEntry) error {
+	ctx, end := s.begin(ctx, "add_watch")
+	defer end()
+	return s.next.AddWatch(ctx, userID, e)
+}
+
+func (s instrumentedStore) Watchlist(ctx context.Context, userID string) ([]WatchlistEntry, error) {
+	ctx, end := s.begin(ctx, "watchlist")
+	defer end()
+	return s.next.Watchlist(ctx, userID)
+}
+
+func (s instrumentedStore) PutWatchlistEntry(ctx context.Context, userID string, req AddWatchlistRequest) (int, error) {
+	ctx, end := s.begin(ctx, "put_watchlist_entry")
+	defer end()
+	return s.next.PutWatchlistEntry(ctx, userID, req)
+}
+
+func (s instrumentedStore) RemoveWatchlistEntry(ctx context.Context, userID, filmID string) error {
+	ctx, end := s.begin(ctx, "remove_watchlist_entry")
+	defer end()
+	return s.next.RemoveWatchlistEntry(ctx, userID, filmID)
+}
+
+func (s instrumentedStore) Feedback(ctx context.Context, userID string) ([]FeedbackEntry, error) {
+	ctx, end := s.begin(ctx, "feedback")
+	defer end()
+	return s.next.Feedback(ctx, userID)
+}
+
+func (s instrumentedStore) PutFeedback(ctx context.Context, userID string, e FeedbackEntry) error {
+	ctx, end := s.begin(ctx, "put_feedback")
+	defer end()
+	return s.next.PutFeedback(ctx, userID, e)
+}
+
+func (s instrumentedStore) DeleteFeedback(ctx context.Context, userID, filmID string) error {
+	ctx, end := s.begin(ctx, "delete_feedback")
+	defer end()
+	return s.next.DeleteFeedback(ctx, userID, filmID)
+}
+
+func (s instrumentedStore) AddSearchLogs(ctx context.Context, entries []SearchLogEntry) error {
+	ctx, end := s.begin(ctx, "add_search_logs")
+	defer end()
+	return s.next.AddSearchLogs(ctx, entries)
+}
+
+func (s instrumentedStore) SearchAnalytics(ctx context.Context, since time.Time, limit int) (SearchAnalytics, error) {
+	ctx, end := s.begin(ctx, "search_analytics")
+	defer end()
+	return s.next.SearchAnalytics(ctx, since, limit)
+}
+
+func (s instrumentedStore) AddEvents(ctx context.Context, events []SearchEvent) error {
+	ctx, end := s.begin(ctx, "add_events")
+	defer end()
+	return s.next.AddEvents(ctx, events)
+}
+
+func (s instrumentedStore) LabeledQueries(ctx context.Context, since time.Time) ([]LabeledQuery, error) {
+	ctx, end := s.begin(ctx, "labeled_queries")
+	defer end()
+	return s.next.LabeledQueries(ctx, since)
+}
+
+func (s instrumentedStore) VariantOutcomes(ctx context.Context, experiment string, since time.Time) ([]VariantOutcome, error) {
+	ctx, end := s.begin(ctx, "variant_outcomes")
+	defer end()
+	return s.next.VariantOutcomes(ctx, experiment, since)
+}
+
+func (s instrumentedStore) PruneSearchLog(ctx context.Context, cutoff time.Time) (int, error) {
+	ctx, end := s.begin(ctx, "prune_search_log")
+	defer end()
+	return s.next.PruneSearchLog(ctx, cutoff)
+}
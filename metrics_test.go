@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// scrapeMetrics fetches /metrics from ts and returns the exposition text.
+func scrapeMetrics(t *testing.T, ts *httptest.Server) string {
+	t.Helper()
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("scrape failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 from /metrics, got %d", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	mockVespa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/search/" && r.URL.Query().Get("query") == "fail":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.URL.Path == "/search/":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(VespaResponse{})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer mockVespa.Close()
+
+	srv := newTestServer(t)
+	srv.cfg.Vespa.URL = mockVespa.URL
+	srv.cfg.DevMode = true
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	for _, path := range []string{
+		"/api/search?q=nothing",
+		"/api/search?q=fail",
+		"/api/users/1/history",
+		"/api/users/1/history",
+	} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+	}
+	srv.lookupFilms(t.Context(), []string{"film-1"})
+
+	scraped := scrapeMetrics(t, ts)
+	for _, want := range []string{
+		`http_requests_total{route="GET /api/search",status="200"} 1`,
+		`http_requests_total{route="GET /api/search",status="502"} 1`,
+		`http_requests_total{route="GET /api/users/{id}/history",status="200"} 2`,
+		`http_request_duration_seconds_count{route="GET /api/users/{id}/history",status="200"} 2`,
+		`http_requests_in_flight 1`, // the scrape itself
+		`vespa_request_duration_seconds_count{endpoint="search",status="200"} 1`,
+		`vespa_request_errors_total{endpoint="search",status="503"} 1`,
+		`vespa_request_errors_total{endpoint="document",status="404"} 1`,
+		`vespa_result_total_count_count{handler="search"} 1`,
+		`vespa_zero_results_total{handler="search"} 1`,
+		`store_operation_duration_seconds_count{backend="sqlite",operation="watch_history"} 2`,
+		`cache_lookups_total{cache="film",result="miss"} 1`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(scraped, want) {
+			t.Errorf("expected %q in /metrics output", want)
+		}
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		srv := newTestServer(t)
+		srv.cfg.Features.Metrics = false
+		w := httptest.NewRecorder()
+		srv.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if strings.Contains(w.Body.String(), "http_requests_total") {
+			t.Error("metrics should not be served when disabled")
+		}
+	})
+}
+
+func TestVespaEndpoint(t *testing.T) {
+	tests := map[string]string{
+		"/search/":                             "search",
+		"/document/v1/films/film/docid/film-1": "document",
+		"/state/v1/health":                     "state",
+		"/application/v2/tenant/default":       "application",
+		"/":                                    "other",
+	}
+	for path, want := range tests {
+		if got := vespaEndpoint(path); got != want {
+			t.Errorf("vespaEndpoint(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
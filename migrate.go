@@ -0,0 +1,283 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// --- Schema migrations ---
+//
+// Migrations live in migrations/ as NNNN_name.up.sql and NNNN_name.down.sql
+// pairs. Versions must be contiguous from 1. Each step runs in its own
+// transaction together with its schema_migrations bookkeeping row.
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type migrationState struct {
+	migration
+	AppliedAt time.Time // zero if pending
+}
+
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	paths, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for _, p := range paths {
+		base := path.Base(p)
+		stem, direction, ok := strings.Cut(strings.TrimSuffix(base, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("migration %s: expected NNNN_name.up.sql or NNNN_name.down.sql", base)
+		}
+		versionStr, name, ok := strings.Cut(stem, "_")
+		version, err := strconv.Atoi(versionStr)
+		if !ok || err != nil || version < 1 {
+			return nil, fmt.Errorf("migration %s: invalid version prefix", base)
+		}
+
+		body, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return nil, err
+		}
+
+		m, exists := byVersion[version]
+		if !exists {
+			m = &migration{Version: version, Name: name}
+			byVersion[version] = m
+		} else if m.Name != name {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, m.Name, name)
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for v := 1; v <= len(byVersion); v++ {
+		m, ok := byVersion[v]
+		if !ok {
+			return nil, fmt.Errorf("migration %d is missing; versions must be contiguous", v)
+		}
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d (%s) needs both up and down files", v, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	return migrations, nil
+}
+
+func ensureMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at INTEGER NOT NULL
+	)`)
+	return err
+}
+
+func appliedMigrations(db *sql.DB) (map[int]time.Time, error) {
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = time.Unix(appliedAt, 0).UTC()
+	}
+	return applied, rows.Err()
+}
+
+func applyMigrationStep(db *sql.DB, m migration, up bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if up {
+		if _, err := tx.Exec(m.Up); err != nil {
+			return fmt.Errorf("migration %d (%s) up: %w", m.Version, m.Name, err)
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+			m.Version, m.Name, time.Now().Unix()); err != nil {
+			return err
+		}
+	} else {
+		if _, err := tx.Exec(m.Down); err != nil {
+			return fmt.Errorf("migration %d (%s) down: %w", m.Version, m.Name, err)
+		}
+		if _, err := tx.Exec("DELETE FROM schema_migrations WHERE version = ?", m.Version); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// migrateUp applies all pending migrations in order and returns how many ran.
+func migrateUp(db *sql.DB) (int, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return 0, err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+	for v := range applied {
+		if v > len(migrations) {
+			return 0, fmt.Errorf("database is at migration %d but this binary only knows %d", v, len(migrations))
+		}
+	}
+
+	n := 0
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if err := applyMigrationStep(db, m, true); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// migrateDown reverts up to steps of the most recently applied migrations and
+// returns how many ran.
+func migrateDown(db *sql.DB, steps int) (int, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return 0, err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, m := range slices.Backward(migrations) {
+		if n >= steps {
+			break
+		}
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if err := applyMigrationStep(db, m, false); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func migrationStatus(db *sql.DB) ([]migrationState, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]migrationState, len(migrations))
+	for i, m := range migrations {
+		states[i] = migrationState{migration: m, AppliedAt: applied[m.Version]}
+	}
+	return states, nil
+}
+
+// --- CLI ---
+
+// runMigrate implements `vespa-demo migrate up|down|status`.
+func runMigrate(args []string, stdout io.Writer) error {
+	fset := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	configPath := addConfigFlags(fset)
+	steps := fset.Int("steps", 1, "number of migrations to revert (down only)")
+	fset.Usage = func() {
+		fmt.Fprintln(fset.Output(), "Usage: vespa-demo migrate [flags] up|down|status")
+		fset.PrintDefaults()
+	}
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if fset.NArg() != 1 {
+		fset.Usage()
+		return errors.New("expected exactly one of up, down or status")
+	}
+
+	cfg, err := loadConfig(fset, *configPath)
+	if err != nil {
+		return err
+	}
+	conn, err := openDB(cfg.DatabaseDSN)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	switch fset.Arg(0) {
+	case "up":
+		n, err := migrateUp(conn)
+		fmt.Fprintf(stdout, "Applied %d migration(s)\n", n)
+		return err
+	case "down":
+		if *steps < 1 {
+			return errors.New("-steps must be at least 1")
+		}
+		n, err := migrateDown(conn, *steps)
+		fmt.Fprintf(stdout, "Reverted %d migration(s)\n", n)
+		return err
+	case "status":
+		states, err := migrationStatus(conn)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+		for _, s := range states {
+			appliedAt := "pending"
+			if !s.AppliedAt.IsZero() {
+				appliedAt = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%04d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+		}
+		return tw.Flush()
+	default:
+		fset.Usage()
+		return fmt.Errorf("unknown migrate command %q", fset.Arg(0))
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func openTempDB(t *testing.T) (*sql.DB, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.db")
+	conn, err := openDB(path)
+	if err != nil {
+		t.Fatalf("openDB failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, path
+}
+
+func tableExists(t *testing.T, conn *sql.DB, kind, name string) bool {
+	t.Helper()
+	var n int
+	if err := conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = ? AND name = ?", kind, name).Scan(&n); err != nil {
+		t.Fatalf("failed to query sqlite_master: %v", err)
+	}
+	return n > 0
+}
+
+func columnExists(t *testing.T, conn *sql.DB, table, column string) bool {
+	t.Helper()
+	var n int
+	if err := conn.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&n); err != nil {
+		t.Fatalf("failed to query table info: %v", err)
+	}
+	return n > 0
+}
+
+func TestLoadMigrations(t *testing.T) {
+	t.Run("embedded migrations are valid", func(t *testing.T) {
+		migrations, err := loadMigrations(migrationFiles)
+		if err != nil {
+			t.Fatalf("loadMigrations failed: %v", err)
+		}
+		for i, m := range migrations {
+			if m.Version != i+1 {
+				t.Errorf("migration %d has version %d", i, m.Version)
+			}
+		}
+	})
+
+	t.Run("ordered by version", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"migrations/0002_b.up.sql":   {Data: []byte("B")},
+			"migrations/0002_b.down.sql": {Data: []byte("-B")},
+			"migrations/0001_a.up.sql":   {Data: []byte("A")},
+			"migrations/0001_a.down.sql": {Data: []byte("-A")},
+		}
+		migrations, err := loadMigrations(fsys)
+		if err != nil {
+			t.Fatalf("loadMigrations failed: %v", err)
+		}
+		if len(migrations) != 2 || migrations[0].Name != "a" || migrations[1].Up != "B" || migrations[1].Down != "-B" {
+			t.Errorf("unexpected migrations: %+v", migrations)
+		}
+	})
+
+	for _, tt := range []struct {
+		name string
+		fsys fstest.MapFS
+	}{
+		{"gap in versions", fstest.MapFS{
+			"migrations/0001_a.up.sql": {}, "migrations/0001_a.down.sql": {},
+			"migrations/0003_c.up.sql": {}, "migrations/0003_c.down.sql": {},
+		}},
+		{"missing down", fstest.MapFS{
+			"migrations/0001_a.up.sql": {Data: []byte("A")},
+		}},
+		{"bad name", fstest.MapFS{
+			"migrations/first.up.sql": {Data: []byte("A")},
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadMigrations(tt.fsys); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	conn, _ := openTempDB(t)
+	migrations, _ := loadMigrations(migrationFiles)
+
+	n, err := migrateUp(conn)
+	if err != nil {
+		t.Fatalf("migrateUp failed: %v", err)
+	}
+	if n != len(migrations) {
+		t.Errorf("expected %d migrations applied, got %d", len(migrations), n)
+	}
+	if !tableExists(t, conn, "table", "watch_history") || !tableExists(t, conn, "index", "idx_watch_history_user_id") ||
+		!columnExists(t, conn, "search_log", "experiments") {
+		t.Fatal("expected tables, indexes and columns after migrating up")
+	}
+
+	// Re-running is a no-op
+	if n, err := migrateUp(conn); err != nil || n != 0 {
+		t.Errorf("second migrateUp should apply nothing, got %d (err=%v)", n, err)
+	}
+
+	n, err = migrateDown(conn, 1)
+	if err != nil || n != 1 {
+		t.Fatalf("migrateDown(1) = %d, %v", n, err)
+	}
+	if columnExists(t, conn, "search_log", "experiments") {
+		t.Error("latest migration's column should be dropped")
+	}
+	if !tableExists(t, conn, "table", "search_events") || !tableExists(t, conn, "index", "idx_watch_history_user_id") {
+		t.Error("earlier migrations should stay applied")
+	}
+
+	states, err := migrationStatus(conn)
+	if err != nil {
+		t.Fatalf("migrationStatus failed: %v", err)
+	}
+	if states[0].AppliedAt.IsZero() || !states[len(states)-1].AppliedAt.IsZero() {
+		t.Errorf("expected all but the last migration applied, got %+v", states)
+	}
+
+	if _, err := migrateDown(conn, len(migrations)); err != nil {
+		t.Fatalf("migrateDown(all) failed: %v", err)
+	}
+	if tableExists(t, conn, "table", "users") {
+		t.Error("all tables should be gone after migrating fully down")
+	}
+}
+
+func TestMigrateUp_AdoptsPreMigrationDatabase(t *testing.T) {
+	conn, _ := openTempDB(t)
+
+	// A database created by the old CREATE TABLE IF NOT EXISTS startup code
+	if _, err := conn.Exec(`
+		CREATE TABLE users (id TEXT PRIMARY KEY, name TEXT NOT NULL);
+		INSERT INTO users (id, name) VALUES ('1', 'Alex');
+	`); err != nil {
+		t.Fatalf("failed to create legacy schema: %v", err)
+	}
+
+	if _, err := migrateUp(conn); err != nil {
+		t.Fatalf("migrateUp failed on legacy database: %v", err)
+	}
+	var name string
+	if err := conn.QueryRow("SELECT name FROM users WHERE id = '1'").Scan(&name); err != nil || name != "Alex" {
+		t.Errorf("existing data should survive, got %q (err=%v)", name, err)
+	}
+}
+
+func TestMigrateUp_RejectsNewerDatabase(t *testing.T) {
+	conn, _ := openTempDB(t)
+	if _, err := migrateUp(conn); err != nil {
+		t.Fatalf("migrateUp failed: %v", err)
+	}
+	conn.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (9999, 'future', 0)")
+
+	if _, err := migrateUp(conn); err == nil {
+		t.Error("expected an error for a database migrated by a newer binary")
+	}
+}
+
+func TestRunMigrate(t *testing.T) {
+	_, path := openTempDB(t)
+
+	var out bytes.Buffer
+	if err := runMigrate([]string{"-db", path, "status"}, &out); err != nil {
+		t.Fatalf("status failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "pending") {
+		t.Errorf("fresh database should show pending migrations:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := runMigrate([]string{"-db", path, "up"}, &out); err != nil {
+		t.Fatalf("up failed: %v", err)
+	}
+	out.Reset()
+	runMigrate([]string{"-db", path, "status"}, &out)
+	if strings.Contains(out.String(), "pending") {
+		t.Errorf("no migrations should be pending after up:\n%s", out.String())
+	}
+
+	if err := runMigrate([]string{"-db", path, "sideways"}, &bytes.Buffer{}); err == nil {
+		t.Error("expected an error for an unknown command")
+	}
+}
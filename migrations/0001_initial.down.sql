@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS film_feedback;
+DROP TABLE IF EXISTS watchlist;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS user_credentials;
+DROP TABLE IF EXISTS watch_history;
+DROP TABLE IF EXISTS user_preferences;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,68 @@
+-- Baseline schema. Every statement uses IF NOT EXISTS so databases created
+-- before migrations existed adopt this version without changes.
+CREATE TABLE IF NOT EXISTS users (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_preferences (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id TEXT NOT NULL,
+	pref_type TEXT NOT NULL,
+	pref_value TEXT NOT NULL,
+	pref_state TEXT NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS watch_history (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id TEXT NOT NULL,
+	film_id TEXT NOT NULL,
+	film_title TEXT NOT NULL,
+	film_genre TEXT NOT NULL,
+	film_year INTEGER NOT NULL,
+	film_tags TEXT NOT NULL,
+	user_rating INTEGER NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS user_credentials (
+	user_id TEXT PRIMARY KEY,
+	password_hash TEXT NOT NULL,
+	role TEXT NOT NULL DEFAULT 'user',
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+	token_hash TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	expires_at INTEGER NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS watchlist (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id TEXT NOT NULL,
+	film_id TEXT NOT NULL,
+	film_title TEXT NOT NULL,
+	film_genre TEXT NOT NULL,
+	film_year INTEGER NOT NULL,
+	note TEXT NOT NULL,
+	position INTEGER NOT NULL,
+	added_at INTEGER NOT NULL,
+	UNIQUE (user_id, film_id),
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS film_feedback (
+	user_id TEXT NOT NULL,
+	film_id TEXT NOT NULL,
+	action TEXT NOT NULL,
+	film_title TEXT NOT NULL,
+	film_genre TEXT NOT NULL,
+	film_director TEXT NOT NULL,
+	film_tags TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	PRIMARY KEY (user_id, film_id),
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_user_preferences_user_id;
+DROP INDEX IF EXISTS idx_watch_history_user_id;
@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS idx_watch_history_user_id ON watch_history(user_id);
+CREATE INDEX IF NOT EXISTS idx_user_preferences_user_id ON user_preferences(user_id);
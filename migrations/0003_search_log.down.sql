@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_search_log_created_at;
+DROP TABLE IF EXISTS search_log;
@@ -0,0 +1,15 @@
+-- One row per search request. query is normalized (lower case, single
+-- spaces); user_id is empty for anonymous searches.
+CREATE TABLE search_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	created_at INTEGER NOT NULL,
+	api TEXT NOT NULL,
+	query TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	filters TEXT NOT NULL,
+	total_count INTEGER NOT NULL,
+	latency_ms REAL NOT NULL,
+	top_hits TEXT NOT NULL
+);
+
+CREATE INDEX idx_search_log_created_at ON search_log(created_at);
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_search_events_created_at;
+DROP INDEX IF EXISTS idx_search_events_query_id;
+DROP TABLE IF EXISTS search_events;
+DROP INDEX IF EXISTS idx_search_log_query_id;
+ALTER TABLE search_log DROP COLUMN preferences;
+ALTER TABLE search_log DROP COLUMN query_id;
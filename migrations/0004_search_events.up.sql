@@ -0,0 +1,17 @@
+-- query_id links a search to the impression, click and play events the
+-- frontend reports for its results; preferences are the ones it ranked with.
+ALTER TABLE search_log ADD COLUMN query_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE search_log ADD COLUMN preferences TEXT NOT NULL DEFAULT '[]';
+CREATE INDEX idx_search_log_query_id ON search_log(query_id);
+
+CREATE TABLE search_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	query_id TEXT NOT NULL,
+	type TEXT NOT NULL,
+	film_id TEXT NOT NULL,
+	position INTEGER NOT NULL,
+	created_at INTEGER NOT NULL
+);
+
+CREATE INDEX idx_search_events_query_id ON search_events(query_id);
+CREATE INDEX idx_search_events_created_at ON search_events(created_at);
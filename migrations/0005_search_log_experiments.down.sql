@@ -0,0 +1 @@
+ALTER TABLE search_log DROP COLUMN experiments;
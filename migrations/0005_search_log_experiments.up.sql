@@ -0,0 +1,3 @@
+-- Records the experiment variants each search was served with, as a JSON
+-- object of experiment name to variant name.
+ALTER TABLE search_log ADD COLUMN experiments TEXT NOT NULL DEFAULT '{}';
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/legacy"
+)
+
+// --- OpenAPI ---
+//
+// api/openapi.json describes every endpoint. It is served unchanged at
+// /api/openapi.json, API requests are checked against it before they reach a
+// handler, and the contract test checks handler responses against
+// it, so the spec and the Go types cannot drift apart unnoticed.
+
+//go:embed api/openapi.json
+var openAPISpec []byte
+
+type apiSpec struct {
+	doc    *openapi3.T
+	router routers.Router
+}
+
+func loadAPISpec() (*apiSpec, error) {
+	doc, err := openapi3.NewLoader().LoadFromData(openAPISpec)
+	if err != nil {
+		return nil, fmt.Errorf("parsing OpenAPI spec: %w", err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI spec: %w", err)
+	}
+	router, err := legacy.NewRouter(doc)
+	if err != nil {
+		return nil, fmt.Errorf("building OpenAPI router: %w", err)
+	}
+	return &apiSpec{doc: doc, router: router}, nil
+}
+
+// mustLoadAPISpec panics if the embedded spec is broken, which can only
+// happen through a bad edit to api/openapi.json.
+func mustLoadAPISpec() *apiSpec {
+	spec, err := loadAPISpec()
+	if err != nil {
+		panic(err)
+	}
+	return spec
+}
+
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// validated checks the request against the spec before calling next and
+// rejects it with a 400 problem if it does not match. It goes innermost, so
+// authentication and rate limits apply first. Handlers decode every body as
+// JSON whatever its Content-Type, and validation does the same.
+func (s *Server) validated(next http.HandlerFunc) http.HandlerFunc {
+	if !s.cfg.Features.RequestValidation {
+		return next
+	}
+	opts := &openapi3filter.Options{
+		AuthenticationFunc:  openapi3filter.NoopAuthenticationFunc,
+		SkipSettingDefaults: true,
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		route, params, err := s.spec.router.FindRoute(r)
+		if err != nil {
+			slog.Warn("Route missing from OpenAPI spec", "method", r.Method, "path", r.URL.Path)
+			next(w, r)
+			return
+		}
+
+		vr := r.Clone(r.Context())
+		vr.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
+		vr.Header.Set("Content-Type", "application/json")
+		err = openapi3filter.ValidateRequest(r.Context(), &openapi3filter.RequestValidationInput{
+			Request:    vr,
+			PathParams: params,
+			Route:      route,
+			Options:    opts,
+		})
+		if err != nil {
+			code := codeInvalidRequest
+			var parseErr *openapi3filter.ParseError
+			if errors.As(err, &parseErr) {
+				code = codeInvalidJSON
+			}
+			writeProblem(w, r, http.StatusBadRequest, code, validationDetail(err))
+			return
+		}
+		// Validation consumed the body and left a replayable copy.
+		r.Body = vr.Body
+		next(w, r)
+	}
+}
+
+// validationDetail turns a validation error into a one-line message. The
+// errors' own text embeds the offending schema, which is too noisy for a
+// problem detail.
+func validationDetail(err error) string {
+	var where string
+	var reqErr *openapi3filter.RequestError
+	if errors.As(err, &reqErr) {
+		switch {
+		case reqErr.Parameter != nil:
+			where = fmt.Sprintf("parameter %q", reqErr.Parameter.Name)
+		case reqErr.RequestBody != nil:
+			where = "request body"
+		}
+	}
+
+	var schemaErr *openapi3.SchemaError
+	if errors.As(err, &schemaErr) {
+		if field := strings.Join(schemaErr.JSONPointer(), "."); field != "" {
+			where = strings.TrimSpace(where + " field " + field)
+		}
+		if where == "" {
+			return schemaErr.Reason
+		}
+		return where + ": " + schemaErr.Reason
+	}
+	if reqErr != nil {
+		return reqErr.Error()
+	}
+	return "Request does not match the API specification"
+}
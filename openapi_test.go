@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3filter"
+)
+
+func TestAPISpecLoads(t *testing.T) {
+	if _, err := loadAPISpec(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAPIContract sends requests to every documented operation and checks
+// each response against the spec. It fails when a handler returns something
+// the spec does not describe, or when an operation is never exercised.
+func TestAPIContract(t *testing.T) {
+	mockVespa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/state/v1/health":
+			w.Write([]byte(`{"status":{"code":"up"}}`))
+		case "/search/":
+			group := ""
+			if strings.Contains(r.URL.Query().Get("yql"), "all(group") {
+				group = `,` + testGroupingResult
+			}
+			w.Write([]byte(`{"root":{"fields":{"totalCount":1},"children":[` + testMatrixHit + group + `]}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer mockVespa.Close()
+
+	srv := newTestServer(t)
+	srv.cfg.Vespa.URL = mockVespa.URL
+	srv.cfg.Experiments = []ExperimentConfig{{Name: "ranking", Variants: []VariantConfig{
+		{Name: "control", Weight: 1},
+		{Name: "more-hits", Weight: 1, Hits: 20},
+	}}}
+	h := srv.routes()
+	userToken := setupTestAccount(t, srv, "1", RoleUser)
+	adminToken := setupTestAccount(t, srv, "admin", RoleAdmin)
+
+	covered := map[string]bool{}
+	check := func(method, path, token, body string, wantStatus int) {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != wantStatus {
+			t.Errorf("%s %s: expected %d, got %d: %s", method, path, wantStatus, w.Code, w.Body.String())
+			return
+		}
+
+		route, params, err := srv.spec.router.FindRoute(req)
+		if err != nil {
+			t.Errorf("%s %s: not in the spec: %v", method, path, err)
+			return
+		}
+		covered[method+" "+route.Path] = true
+		err = openapi3filter.ValidateResponse(context.Background(), &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: &openapi3filter.RequestValidationInput{
+				Request:    req,
+				PathParams: params,
+				Route:      route,
+			},
+			Status:  w.Code,
+			Header:  w.Header(),
+			Body:    io.NopCloser(bytes.NewReader(w.Body.Bytes())),
+			Options: &openapi3filter.Options{IncludeResponseStatus: true},
+		})
+		if err != nil {
+			t.Errorf("%s %s: response does not match the spec: %v", method, path, err)
+		}
+	}
+
+	check(http.MethodGet, "/health", "", "", http.StatusOK)
+	check(http.MethodGet, "/livez", "", "", http.StatusOK)
+	check(http.MethodGet, "/readyz", "", "", http.StatusOK)
+	check(http.MethodGet, "/api/openapi.json", "", "", http.StatusOK)
+
+	check(http.MethodGet, "/api/search?q=matrix&user=1&exclude_hidden=true", "", "", http.StatusOK)
+	check(http.MethodGet, "/api/search?q="+strings.Repeat("a", maxQueryLength+1), "", "", http.StatusBadRequest)
+	check(http.MethodGet, "/api/users", "", "", http.StatusOK)
+	check(http.MethodGet, "/api/v2/search?q=matrix&user=1&limit=5&offset=0", "", "", http.StatusOK)
+	check(http.MethodGet, "/api/v2/search?limit=1000", "", "", http.StatusBadRequest)
+	check(http.MethodGet, "/api/search?q=matrix&weights=rating_weight:2", adminToken, "", http.StatusOK)
+	check(http.MethodGet, "/api/search?q=matrix&weights=rating_weight:2", "", "", http.StatusUnauthorized)
+	check(http.MethodGet, "/api/v2/search?q=matrix&weights=rating_weight:2", userToken, "", http.StatusForbidden)
+	check(http.MethodPost, "/api/events", "", `{"query_id":"q-1","events":[{"type":"impression","film_id":"1","position":0},{"type":"click","film_id":"1","position":0}]}`, http.StatusOK)
+	check(http.MethodPost, "/api/events", "", `{"query_id":"q-1","events":[{"type":"hover","film_id":"1","position":0}]}`, http.StatusBadRequest)
+
+	check(http.MethodPost, "/api/auth/register", "", `{"name":"New User","password":"password123"}`, http.StatusCreated)
+	check(http.MethodPost, "/api/auth/login", "", `{"user_id":"1","password":"password123"}`, http.StatusOK)
+	check(http.MethodPost, "/api/auth/login", "", `{"user_id":"1","password":"wrong-password"}`, http.StatusUnauthorized)
+	check(http.MethodGet, "/api/auth/me", userToken, "", http.StatusOK)
+	check(http.MethodGet, "/api/auth/me", "", "", http.StatusUnauthorized)
+
+	check(http.MethodGet, "/api/admin/rate-limits", adminToken, "", http.StatusOK)
+	check(http.MethodPatch, "/api/admin/rate-limits", adminToken, `{"writes":{"rate":10,"burst":50}}`, http.StatusOK)
+	check(http.MethodPatch, "/api/admin/rate-limits", userToken, `{}`, http.StatusForbidden)
+	check(http.MethodGet, "/api/admin/search-analytics?window=1h&limit=5", adminToken, "", http.StatusOK)
+	check(http.MethodGet, "/api/admin/search-analytics?window=soon", adminToken, "", http.StatusBadRequest)
+	check(http.MethodGet, "/api/admin/experiments", adminToken, "", http.StatusOK)
+	check(http.MethodGet, "/api/admin/experiments/ranking/report?window=1h", adminToken, "", http.StatusOK)
+	check(http.MethodGet, "/api/admin/experiments/unknown/report", adminToken, "", http.StatusNotFound)
+
+	check(http.MethodPut, "/api/users/1/preferences", userToken, `{"preferences":[{"type":"genre","value":"Sci-Fi","state":"like"}]}`, http.StatusOK)
+	check(http.MethodPut, "/api/users/1/preferences", userToken, `{"preferences":[{"type":"genre","value":"Nope","state":"like"}]}`, http.StatusBadRequest)
+	check(http.MethodPost, "/api/users/1/history", userToken, `{"film_id":"7","film_title":"Heat","film_genre":"Crime","film_year":1995,"film_tags":["heist"],"user_rating":4}`, http.StatusOK)
+	check(http.MethodGet, "/api/users/1/history", userToken, "", http.StatusOK)
+	check(http.MethodGet, "/api/users/2/history", userToken, "", http.StatusForbidden)
+
+	check(http.MethodPost, "/api/users/1/watchlist", userToken, `{"film_id":"42","film_title":"The Matrix","note":"rewatch"}`, http.StatusOK)
+	check(http.MethodGet, "/api/users/1/watchlist", userToken, "", http.StatusOK)
+	check(http.MethodGet, "/api/users/1/recommendations?watchlist=surface", userToken, "", http.StatusOK)
+	check(http.MethodGet, "/api/v2/users/1/recommendations?watchlist=surface", userToken, "", http.StatusOK)
+	// A successful stream never ends, so only its errors are checked here
+	check(http.MethodGet, "/api/users/1/recommendations/stream?watchlist=all", userToken, "", http.StatusBadRequest)
+	check(http.MethodGet, "/api/users/999/recommendations/stream", adminToken, "", http.StatusNotFound)
+	check(http.MethodPost, "/api/group-recommendations", adminToken, `{"user_ids":["1","admin"],"strategy":"least_misery"}`, http.StatusOK)
+	check(http.MethodPost, "/api/group-recommendations", userToken, `{"user_ids":["1","admin"]}`, http.StatusForbidden)
+	check(http.MethodPost, "/api/group-recommendations", userToken, `{"user_ids":["1"]}`, http.StatusBadRequest)
+	check(http.MethodPost, "/api/group-recommendations", userToken, `{"user_ids":["admin","999"]}`, http.StatusForbidden)
+	check(http.MethodPost, "/api/group-recommendations", adminToken, `{"user_ids":["1","999"]}`, http.StatusNotFound)
+	check(http.MethodDelete, "/api/users/1/watchlist/42", userToken, "", http.StatusOK)
+	check(http.MethodDelete, "/api/users/1/watchlist/42", userToken, "", http.StatusNotFound)
+
+	check(http.MethodPost, "/api/users/1/feedback", userToken, `{"film_id":"42","action":"not_interested","film_genre":"Sci-Fi"}`, http.StatusOK)
+	check(http.MethodGet, "/api/users/1/feedback", userToken, "", http.StatusOK)
+	check(http.MethodDelete, "/api/users/1/feedback/42", userToken, "", http.StatusOK)
+
+	check(http.MethodGet, "/api/users/1/stats", userToken, "", http.StatusOK)
+	check(http.MethodGet, "/api/users/999/stats", adminToken, "", http.StatusNotFound)
+	check(http.MethodPut, "/api/users/1/password", userToken, `{"password":"new-password123"}`, http.StatusOK)
+	check(http.MethodPost, "/api/auth/logout", userToken, "", http.StatusOK)
+
+	for path, item := range srv.spec.doc.Paths.Map() {
+		for method := range item.Operations() {
+			if !covered[method+" "+path] {
+				t.Errorf("%s %s is in the spec but not exercised by this test", method, path)
+			}
+		}
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	do := func(srv *Server, body string) *httptest.ResponseRecorder {
+		token := setupTestAccount(t, srv, "1", RoleUser)
+		req := httptest.NewRequest(http.MethodPost, "/api/users/1/history", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		srv.routes().ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("wrong type", func(t *testing.T) {
+		w := do(newTestServer(t), `{"film_id":"7","user_rating":"five"}`)
+		p := decodeProblem(t, w, http.StatusBadRequest, codeInvalidRequest)
+		if !strings.Contains(p.Detail, "user_rating") {
+			t.Errorf("expected the detail to name the field, got %q", p.Detail)
+		}
+	})
+
+	t.Run("missing required field", func(t *testing.T) {
+		w := do(newTestServer(t), `{"film_id":"7"}`)
+		decodeProblem(t, w, http.StatusBadRequest, codeInvalidRequest)
+	})
+
+	t.Run("malformed JSON", func(t *testing.T) {
+		w := do(newTestServer(t), `{"film_id":`)
+		decodeProblem(t, w, http.StatusBadRequest, codeInvalidJSON)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		srv := newTestServer(t)
+		srv.cfg.Features.RequestValidation = false
+		// The handler's own range check answers instead
+		w := do(srv, `{"film_id":"7"}`)
+		decodeProblem(t, w, http.StatusBadRequest, codeInvalidRating)
+	})
+}
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// --- Watch parties ---
+//
+// A watch party is a WebSocket session at /ws/party/{code} where users pick a
+// film together. Members join the lobby under a shared code, one of them
+// starts the vote, and every member swipes yes or no on candidates drawn from
+// their merged preferences. The first film every member says yes to is the
+// pick. Sessions live in memory only and end after PartyConfig.SessionTTL.
+
+const (
+	PartyStatusLobby  = "lobby"
+	PartyStatusVoting = "voting"
+	PartyStatusEnded  = "ended"
+
+	// Messages sent by members.
+	PartyCommandStart = "start"
+	PartyCommandVote  = "vote"
+
+	// Messages sent by the server.
+	PartyMessageState = "state"
+	PartyMessageMatch = "match"
+	PartyMessageEnded = "ended"
+	PartyMessageError = "error"
+
+	// Reasons a session ended without a match.
+	PartyEndExpired     = "expired"
+	PartyEndNoConsensus = "no_consensus"
+	PartyEndShutdown    = "shutdown"
+
+	// partySendBuffer is how many messages may queue for a slow member
+	// before they are disconnected.
+	partySendBuffer   = 32
+	partyWriteTimeout = 10 * time.Second
+)
+
+var partyCodePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// PartyCommand is a message from a member. LogPick applies to start and
+// records the pick in every member's watch history; FilmID and Like apply to
+// vote.
+type PartyCommand struct {
+	Type    string `json:"type"`
+	LogPick bool   `json:"log_pick,omitempty"`
+	FilmID  string `json:"film_id,omitempty"`
+	Like    bool   `json:"like,omitempty"`
+}
+
+// PartyCandidate is a film up for a vote with the votes cast so far.
+type PartyCandidate struct {
+	ScoredFilm
+	Yes int `json:"yes"`
+	No  int `json:"no"`
+}
+
+// PartyMessage is a message to members. State messages carry the session;
+// match messages the pick; ended messages the reason; error messages a problem
+// code and detail for the member whose command failed.
+type PartyMessage struct {
+	Type       string           `json:"type"`
+	Code       string           `json:"code,omitempty"`
+	Status     string           `json:"status,omitempty"`
+	Members    []string         `json:"members,omitempty"`
+	Candidates []PartyCandidate `json:"candidates,omitempty"`
+	Pick       *ScoredFilm      `json:"pick,omitempty"`
+	Logged     bool             `json:"logged,omitempty"`
+	Reason     string           `json:"reason,omitempty"`
+	Detail     string           `json:"detail,omitempty"`
+}
+
+func partyError(code, detail string) PartyMessage {
+	return PartyMessage{Type: PartyMessageError, Code: code, Detail: detail}
+}
+
+// mergePreferences combines the preferences of several users. A value liked
+// by some and disliked by others is dropped, so the group's ranking neither
+// boosts nor buries it.
+func mergePreferences(members [][]Preference) []Preference {
+	type key struct{ typ, value string }
+	var order []key
+	states := map[key]string{}
+	for _, prefs := range members {
+		for _, p := range prefs {
+			k := key{p.Type, p.Value}
+			state, seen := states[k]
+			switch {
+			case !seen:
+				order = append(order, k)
+				states[k] = p.State
+			case state != p.State:
+				states[k] = ""
+			}
+		}
+	}
+	var merged []Preference
+	for _, k := range order {
+		if state := states[k]; state != "" {
+			merged = append(merged, Preference{Type: k.typ, Value: k.value, State: state})
+		}
+	}
+	return merged
+}
+
+// partyCandidates ranks films for voters over their merged preferences,
+// leaving out films any of them has watched or hidden.
+func (s *Server) partyCandidates(ctx context.Context, voters []string) ([]PartyCandidate, error) {
+	var prefs [][]Preference
+	skip := map[string]bool{}
+	for _, userID := range voters {
+		prefs = append(prefs, s.userPreferences(ctx, userID))
+		for id := range s.watchedFilmIDs(ctx, userID) {
+			skip[id] = true
+		}
+		for id := range s.hiddenFilmIDs(ctx, userID) {
+			skip[id] = true
+		}
+	}
+
+	count := s.cfg.Party.Candidates
+	vespaURL := s.buildVespaQuery("*", mergePreferences(prefs), count+len(skip), s.vespaTraceOptions(ctx)...)
+	resp, _, err := s.queryVespa(ctx, "party", vespaURL)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []PartyCandidate
+	for _, hit := range resp.Root.Children {
+		if len(candidates) == count {
+			break
+		}
+		if skip[filmIDFromDocID(hit.ID)] {
+			continue
+		}
+		candidates = append(candidates, PartyCandidate{ScoredFilm: scoredFilmFromHit(hit)})
+	}
+	return candidates, nil
+}
+
+// --- Sessions ---
+
+// partyHub holds the open sessions by code, at most maxSessions of them.
+type partyHub struct {
+	ttl         time.Duration
+	maxSessions int
+
+	mu       sync.Mutex
+	sessions map[string]*partySession
+}
+
+func newPartyHub(ttl time.Duration, maxSessions int) *partyHub {
+	return &partyHub{ttl: ttl, maxSessions: maxSessions, sessions: map[string]*partySession{}}
+}
+
+// partyConn is one member's connection. The session closes send when it
+// drops the connection, which tells the writer to close the WebSocket.
+type partyConn struct {
+	userID string
+	send   chan PartyMessage
+}
+
+type partySession struct {
+	code string
+	hub  *partyHub
+
+	mu     sync.Mutex
+	timer  *time.Timer
+	status string
+	// starting is set while candidates are fetched, so the vote is only
+	// started once.
+	starting bool
+	// picking is set while a matched film is logged, so no more votes are
+	// taken.
+	picking bool
+	conns   []*partyConn
+	// voters are the members when the vote started. Only they may vote or
+	// rejoin afterwards.
+	voters     []string
+	candidates []PartyCandidate
+	// votes maps film IDs to each voter's vote.
+	votes   map[string]map[string]bool
+	logPick bool
+}
+
+var (
+	errPartyStarted   = errors.New("this party has already started voting")
+	errPartyFull      = fmt.Errorf("a party holds at most %d members", maxGroupSize)
+	errTooManyParties = errors.New("too many watch parties are open, try again later")
+)
+
+// join adds a connection for userID to the session with code. A new session
+// is only created, and its TTL started, once the first member is in it.
+func (h *partyHub) join(code, userID string) (*partySession, *partyConn, error) {
+	// h.mu is held throughout so a new session cannot be joined or counted
+	// before it is registered. end takes h.mu only after releasing the
+	// session's lock, so the two never wait on each other.
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sess, ok := h.sessions[code]
+	if !ok {
+		if len(h.sessions) >= h.maxSessions {
+			return nil, nil, errTooManyParties
+		}
+		sess = &partySession{code: code, hub: h, status: PartyStatusLobby, votes: map[string]map[string]bool{}}
+	}
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	switch {
+	case sess.status == PartyStatusEnded:
+		// The session ended but has not been removed from the hub yet
+		return nil, nil, errors.New("this party has ended")
+	case sess.status == PartyStatusVoting && !slices.Contains(sess.voters, userID):
+		return nil, nil, errPartyStarted
+	case !slices.Contains(sess.members(), userID) && len(sess.members()) >= maxGroupSize:
+		return nil, nil, errPartyFull
+	}
+	c := &partyConn{userID: userID, send: make(chan PartyMessage, partySendBuffer)}
+	sess.conns = append(sess.conns, c)
+	if !ok {
+		sess.timer = time.AfterFunc(h.ttl, func() { sess.end(PartyMessage{Type: PartyMessageEnded, Reason: PartyEndExpired}) })
+		h.sessions[code] = sess
+	}
+	sess.broadcast(sess.state())
+	return sess, c, nil
+}
+
+// together reports whether both users are connected to the same open
+// session.
+func (h *partyHub) together(userID, other string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, sess := range h.sessions {
+		sess.mu.Lock()
+		members := sess.members()
+		sess.mu.Unlock()
+		if slices.Contains(members, userID) && slices.Contains(members, other) {
+			return true
+		}
+	}
+	return false
+}
+
+// close ends every session.
+func (h *partyHub) close() {
+	h.mu.Lock()
+	sessions := make([]*partySession, 0, len(h.sessions))
+	for _, sess := range h.sessions {
+		sessions = append(sessions, sess)
+	}
+	h.mu.Unlock()
+	for _, sess := range sessions {
+		sess.end(PartyMessage{Type: PartyMessageEnded, Reason: PartyEndShutdown})
+	}
+}
+
+// members returns the connected users in the order they joined. A user
+// connected more than once is listed once. The caller must hold mu.
+func (p *partySession) members() []string {
+	var ids []string
+	for _, c := range p.conns {
+		if !slices.Contains(ids, c.userID) {
+			ids = append(ids, c.userID)
+		}
+	}
+	return ids
+}
+
+// state describes the session. The caller must hold mu.
+func (p *partySession) state() PartyMessage {
+	msg := PartyMessage{Type: PartyMessageState, Code: p.code, Status: p.status, Members: p.members()}
+	for _, c := range p.candidates {
+		for _, like := range p.votes[c.ID] {
+			if like {
+				c.Yes++
+			} else {
+				c.No++
+			}
+		}
+		msg.Candidates = append(msg.Candidates, c)
+	}
+	return msg
+}
+
+// send queues msg for c, dropping connections that have fallen behind.
+// Connections no longer in the session are skipped. The caller must hold mu.
+func (p *partySession) send(c *partyConn, msg PartyMessage) {
+	if !slices.Contains(p.conns, c) {
+		return
+	}
+	select {
+	case c.send <- msg:
+	default:
+		slog.Warn("Dropping slow party member", "code", p.code, "user_id", c.userID)
+		p.drop(c)
+	}
+}
+
+// broadcast queues msg for every member. The caller must hold mu.
+func (p *partySession) broadcast(msg PartyMessage) {
+	for _, c := range slices.Clone(p.conns) {
+		p.send(c, msg)
+	}
+}
+
+// drop removes c from the session. The caller must hold mu.
+func (p *partySession) drop(c *partyConn) {
+	i := slices.Index(p.conns, c)
+	if i < 0 {
+		return
+	}
+	p.conns = slices.Delete(p.conns, i, i+1)
+	close(c.send)
+}
+
+// leave removes c after its member disconnected. The session stays open
+// until it ends so members can reconnect.
+func (p *partySession) leave(c *partyConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if slices.Contains(p.conns, c) {
+		p.drop(c)
+		p.broadcast(p.state())
+	}
+}
+
+// end sends msg to every member, disconnects them and forgets the session.
+// Ending an ended session does nothing.
+func (p *partySession) end(msg PartyMessage) {
+	p.mu.Lock()
+	if p.status == PartyStatusEnded {
+		p.mu.Unlock()
+		return
+	}
+	p.status = PartyStatusEnded
+	p.timer.Stop()
+	p.broadcast(msg)
+	for _, c := range slices.Clone(p.conns) {
+		p.drop(c)
+	}
+	p.mu.Unlock()
+
+	p.hub.mu.Lock()
+	if p.hub.sessions[p.code] == p {
+		delete(p.hub.sessions, p.code)
+	}
+	p.hub.mu.Unlock()
+}
+
+// --- Commands ---
+
+func (s *Server) partyStart(ctx context.Context, p *partySession, c *partyConn, cmd PartyCommand) {
+	p.mu.Lock()
+	voters := p.members()
+	switch {
+	case p.status != PartyStatusLobby || p.starting:
+		p.send(c, partyError(codeInvalidRequest, "The vote has already started"))
+		p.mu.Unlock()
+		return
+	case len(voters) < minGroupSize:
+		p.send(c, partyError(codeInvalidRequest, fmt.Sprintf("A party needs at least %d members to start", minGroupSize)))
+		p.mu.Unlock()
+		return
+	}
+	p.starting = true
+	p.mu.Unlock()
+
+	candidates, err := s.partyCandidates(ctx, voters)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.starting = false
+	if p.status != PartyStatusLobby {
+		return
+	}
+	if err != nil {
+		slog.Error("Vespa query failed for party candidates", "code", p.code, "error", err)
+		p.send(c, partyError(codeUpstreamUnavailable, "Failed to find films for the party"))
+		return
+	}
+	if len(candidates) == 0 {
+		p.send(c, partyError(codeInvalidRequest, "No films left that nobody in the party has watched"))
+		return
+	}
+	p.status = PartyStatusVoting
+	p.voters = voters
+	p.candidates = candidates
+	p.logPick = cmd.LogPick
+	p.broadcast(p.state())
+}
+
+func (s *Server) partyVote(ctx context.Context, p *partySession, c *partyConn, cmd PartyCommand) {
+	p.mu.Lock()
+	if p.status != PartyStatusVoting || p.picking {
+		p.send(c, partyError(codeInvalidRequest, "The vote is not open"))
+		p.mu.Unlock()
+		return
+	}
+	if !slices.Contains(p.voters, c.userID) {
+		p.send(c, partyError(codeForbidden, "Only members present when the vote started can vote"))
+		p.mu.Unlock()
+		return
+	}
+	i := slices.IndexFunc(p.candidates, func(f PartyCandidate) bool { return f.ID == cmd.FilmID })
+	if i < 0 {
+		p.send(c, partyError(codeInvalidRequest, "Film "+cmd.FilmID+" is not a candidate"))
+		p.mu.Unlock()
+		return
+	}
+	if p.votes[cmd.FilmID] == nil {
+		p.votes[cmd.FilmID] = map[string]bool{}
+	}
+	p.votes[cmd.FilmID][c.userID] = cmd.Like
+
+	yes, decided := 0, 0
+	for _, f := range p.candidates {
+		if len(p.votes[f.ID]) == len(p.voters) {
+			decided++
+		}
+	}
+	for _, like := range p.votes[cmd.FilmID] {
+		if like {
+			yes++
+		}
+	}
+	switch {
+	case yes == len(p.voters):
+		p.picking = true
+		pick := p.candidates[i].ScoredFilm
+		voters, logPick := p.voters, p.logPick
+		p.mu.Unlock()
+
+		logged := logPick && s.logPartyPick(ctx, p.code, voters, pick)
+		p.end(PartyMessage{Type: PartyMessageMatch, Pick: &pick, Logged: logged})
+	case decided == len(p.candidates):
+		p.mu.Unlock()
+		p.end(PartyMessage{Type: PartyMessageEnded, Reason: PartyEndNoConsensus})
+	default:
+		p.broadcast(p.state())
+		p.mu.Unlock()
+	}
+}
+
+// logPartyPick adds pick to every voter's watch history and reports whether
+// all the writes succeeded.
+func (s *Server) logPartyPick(ctx context.Context, code string, voters []string, pick ScoredFilm) bool {
+	ok := true
+	for _, userID := range voters {
+		err := s.store.AddWatch(ctx, userID, WatchHistoryEntry{
+			FilmID: pick.ID, FilmTitle: pick.Title, FilmGenre: pick.Genre, FilmYear: pick.Year, FilmTags: pick.Tags,
+			UserRating: s.cfg.Party.PickRating,
+		})
+		if err != nil {
+			slog.Error("Failed to log party pick", "code", code, "user_id", userID, "film_id", pick.ID, "error", err)
+			ok = false
+			continue
+		}
+		s.changes.publish(userID)
+	}
+	return ok
+}
+
+// --- HTTP handlers ---
+
+// partyOriginPatterns turns the CORS allowed origins into the host patterns
+// the WebSocket handshake checks. Same-origin requests are always accepted.
+func partyOriginPatterns(allowedOrigins []string) []string {
+	var patterns []string
+	for _, o := range allowedOrigins {
+		if o == "*" {
+			return []string{"*"}
+		}
+		if u, err := url.Parse(o); err == nil {
+			patterns = append(patterns, u.Host)
+		}
+	}
+	return patterns
+}
+
+func (s *Server) handleParty(w http.ResponseWriter, r *http.Request) {
+	code := r.PathValue("code")
+	if !partyCodePattern.MatchString(code) {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, "Party code must be 1-32 letters, digits, '-' or '_'")
+		return
+	}
+	userID := r.URL.Query().Get("user")
+	u, authenticated := authUserFromContext(r.Context())
+	switch {
+	case authenticated && userID == "":
+		userID = u.ID
+	case authenticated && userID != u.ID && u.Role != RoleAdmin:
+		writeProblem(w, r, http.StatusForbidden, codeForbidden, "Not allowed to join as another user")
+		return
+	case userID == "":
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, "The user query parameter is required without credentials")
+		return
+	}
+	if !s.checkUserExists(w, r, userID) {
+		return
+	}
+
+	// The server's read and write timeouts would otherwise cut the session
+	// short; the hijacked connection keeps their deadlines
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		OriginPatterns: partyOriginPatterns(s.cfg.CORS.AllowedOrigins),
+	})
+	if err != nil {
+		// Accept has already written the response
+		slog.Warn("WebSocket handshake failed", "code", code, "error", err)
+		return
+	}
+	defer conn.CloseNow()
+
+	// The request context must not be used once the connection is hijacked
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	defer cancel()
+
+	sess, c, err := s.party.join(code, userID)
+	if errors.Is(err, errTooManyParties) {
+		slog.Warn("Party session limit reached", "code", code, "limit", s.cfg.Party.MaxSessions)
+		conn.Close(websocket.StatusTryAgainLater, err.Error())
+		return
+	}
+	if err != nil {
+		conn.Close(websocket.StatusPolicyViolation, err.Error())
+		return
+	}
+	defer sess.leave(c)
+	slog.Info("Party member joined", "code", code, "user_id", userID)
+
+	go func() {
+		defer cancel()
+		for msg := range c.send {
+			wctx, wcancel := context.WithTimeout(ctx, partyWriteTimeout)
+			err := wsjson.Write(wctx, conn, msg)
+			wcancel()
+			if err != nil {
+				return
+			}
+		}
+		conn.Close(websocket.StatusNormalClosure, "")
+	}()
+
+	for {
+		var cmd PartyCommand
+		if err := wsjson.Read(ctx, conn, &cmd); err != nil {
+			return
+		}
+		switch cmd.Type {
+		case PartyCommandStart:
+			s.partyStart(ctx, sess, c, cmd)
+		case PartyCommandVote:
+			s.partyVote(ctx, sess, c, cmd)
+		default:
+			sess.mu.Lock()
+			sess.send(c, partyError(codeInvalidRequest, fmt.Sprintf("Unknown message type %q", cmd.Type)))
+			sess.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestMergePreferences(t *testing.T) {
+	merged := mergePreferences([][]Preference{
+		{{Type: "genre", Value: "Sci-Fi", State: "like"}, {Type: "genre", Value: "Horror", State: "dislike"}},
+		{{Type: "genre", Value: "Sci-Fi", State: "dislike"}, {Type: "tag", Value: "mind-bending", State: "like"}},
+		{{Type: "genre", Value: "Horror", State: "dislike"}},
+	})
+	want := []Preference{
+		{Type: "genre", Value: "Horror", State: "dislike"},
+		{Type: "tag", Value: "mind-bending", State: "like"},
+	}
+	if len(merged) != len(want) {
+		t.Fatalf("expected %v, got %v", want, merged)
+	}
+	for i := range want {
+		if merged[i] != want[i] {
+			t.Errorf("expected %v, got %v", want, merged)
+		}
+	}
+}
+
+func TestPartySessionExpires(t *testing.T) {
+	hub := newPartyHub(20*time.Millisecond, 10)
+	_, c, err := hub.join("abc", "1")
+	if err != nil {
+		t.Fatalf("join failed: %v", err)
+	}
+	var last PartyMessage
+	for msg := range c.send {
+		last = msg
+	}
+	if last.Type != PartyMessageEnded || last.Reason != PartyEndExpired {
+		t.Errorf("expected the session to expire, got %+v", last)
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if len(hub.sessions) != 0 {
+		t.Errorf("expected the expired session to be removed, got %v", hub.sessions)
+	}
+}
+
+func TestPartyHubJoin(t *testing.T) {
+	hub := newPartyHub(time.Hour, 1)
+	t.Cleanup(hub.close)
+	sess, _, err := hub.join("full", "1")
+	if err != nil {
+		t.Fatalf("join failed: %v", err)
+	}
+	for i := 2; i <= maxGroupSize; i++ {
+		if _, _, err := hub.join("full", strconv.Itoa(i)); err != nil {
+			t.Fatalf("join as %d failed: %v", i, err)
+		}
+	}
+	if _, _, err := hub.join("full", "extra"); !errors.Is(err, errPartyFull) {
+		t.Errorf("expected errPartyFull, got %v", err)
+	}
+
+	// A rejected join leaves no session behind
+	if _, _, err := hub.join("other", "1"); !errors.Is(err, errTooManyParties) {
+		t.Errorf("expected errTooManyParties, got %v", err)
+	}
+	hub.mu.Lock()
+	if _, ok := hub.sessions["other"]; ok || len(hub.sessions) != 1 {
+		t.Errorf("expected only the first session, got %v", hub.sessions)
+	}
+	hub.mu.Unlock()
+
+	sess.end(PartyMessage{Type: PartyMessageEnded, Reason: PartyEndShutdown})
+	if _, _, err := hub.join("other", "1"); err != nil {
+		t.Errorf("expected a new session once the first ended, got %v", err)
+	}
+}
+
+func TestHandleParty(t *testing.T) {
+	var mu sync.Mutex
+	var query string
+	mockVespa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		query = r.URL.RawQuery
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"root":{"fields":{"totalCount":3},"children":[
+			{"id":"id:films:film::10","relevance":3,"fields":{"title":"Film 10","genre":"Sci-Fi"}},
+			{"id":"id:films:film::11","relevance":2,"fields":{"title":"Film 11","genre":"Sci-Fi"}},
+			{"id":"id:films:film::12","relevance":1,"fields":{"title":"Film 12","genre":"Comedy"}}]}}`))
+	}))
+	defer mockVespa.Close()
+
+	srv := newTestServer(t)
+	srv.cfg.Vespa.URL = mockVespa.URL
+	srv.cfg.Party.Candidates = 2
+	srv.limiter.SetLimits(RateLimits{})
+	ctx := context.Background()
+	srv.store.ReplacePreferences(ctx, "1", []Preference{{Type: "genre", Value: "Sci-Fi", State: "like"}})
+	srv.store.AddWatch(ctx, "1", WatchHistoryEntry{FilmID: "10", FilmTitle: "Film 10", UserRating: 4})
+	tokens := map[string]string{
+		"2": setupTestAccount(t, srv, "2", RoleUser),
+		"3": setupTestAccount(t, srv, "3", RoleUser),
+	}
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws/party/"
+
+	dial := func(code, user string) *websocket.Conn {
+		t.Helper()
+		opts := &websocket.DialOptions{HTTPHeader: http.Header{}}
+		if token, ok := tokens[user]; ok {
+			opts.HTTPHeader.Set("Authorization", "Bearer "+token)
+		} else {
+			code += "?user=" + user
+		}
+		conn, _, err := websocket.Dial(ctx, wsURL+code, opts)
+		if err != nil {
+			t.Fatalf("dial as %s failed: %v", user, err)
+		}
+		t.Cleanup(func() { conn.CloseNow() })
+		return conn
+	}
+	// next reads messages until one of type typ arrives
+	next := func(conn *websocket.Conn, typ string) PartyMessage {
+		t.Helper()
+		rctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		for {
+			var msg PartyMessage
+			if err := wsjson.Read(rctx, conn, &msg); err != nil {
+				t.Fatalf("waiting for %s: %v", typ, err)
+			}
+			if msg.Type == typ {
+				return msg
+			}
+		}
+	}
+	voting := func(conn *websocket.Conn) PartyMessage {
+		t.Helper()
+		for {
+			if msg := next(conn, PartyMessageState); msg.Status == PartyStatusVoting {
+				return msg
+			}
+		}
+	}
+	send := func(conn *websocket.Conn, cmd PartyCommand) {
+		t.Helper()
+		if err := wsjson.Write(ctx, conn, cmd); err != nil {
+			t.Fatalf("send failed: %v", err)
+		}
+	}
+
+	// User 1 joins without credentials, which dev mode allows
+	srv.cfg.DevMode = true
+	one := dial("movie-night", "1")
+	if msg := next(one, PartyMessageState); msg.Status != PartyStatusLobby || len(msg.Members) != 1 {
+		t.Fatalf("unexpected state: %+v", msg)
+	}
+	send(one, PartyCommand{Type: PartyCommandStart})
+	if msg := next(one, PartyMessageError); msg.Code != codeInvalidRequest {
+		t.Errorf("expected starting alone to fail, got %+v", msg)
+	}
+
+	two := dial("movie-night", "2")
+	if msg := next(one, PartyMessageState); strings.Join(msg.Members, ",") != "1,2" {
+		t.Fatalf("expected both members, got %+v", msg)
+	}
+	send(two, PartyCommand{Type: PartyCommandStart, LogPick: true})
+	state := voting(two)
+	voting(one)
+	// Film 10 is watched by user 1, so the next two are the candidates
+	if len(state.Candidates) != 2 || state.Candidates[0].ID != "11" || state.Candidates[1].ID != "12" {
+		t.Fatalf("unexpected candidates: %+v", state.Candidates)
+	}
+	mu.Lock()
+	if !strings.Contains(query, "Sci-Fi") {
+		t.Errorf("expected the members' preferences in the query, got %s", query)
+	}
+	mu.Unlock()
+
+	conn, _, err := websocket.Dial(ctx, wsURL+"movie-night", &websocket.DialOptions{
+		HTTPHeader: http.Header{"Authorization": {"Bearer " + tokens["3"]}},
+	})
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	if _, _, err := conn.Read(ctx); websocket.CloseStatus(err) != websocket.StatusPolicyViolation {
+		t.Errorf("expected late joiners to be turned away, got %v", err)
+	}
+
+	send(one, PartyCommand{Type: PartyCommandVote, FilmID: "11", Like: true})
+	send(two, PartyCommand{Type: PartyCommandVote, FilmID: "11", Like: false})
+	send(one, PartyCommand{Type: PartyCommandVote, FilmID: "99", Like: true})
+	if msg := next(one, PartyMessageError); msg.Code != codeInvalidRequest {
+		t.Errorf("expected voting on a non-candidate to fail, got %+v", msg)
+	}
+	send(one, PartyCommand{Type: PartyCommandVote, FilmID: "12", Like: true})
+	send(two, PartyCommand{Type: PartyCommandVote, FilmID: "12", Like: true})
+	for _, conn := range []*websocket.Conn{one, two} {
+		msg := next(conn, PartyMessageMatch)
+		if msg.Pick == nil || msg.Pick.ID != "12" || !msg.Logged {
+			t.Errorf("expected film 12 to be picked and logged, got %+v", msg)
+		}
+	}
+	for _, user := range []string{"1", "2"} {
+		if !srv.watchedFilmIDs(ctx, user)["12"] {
+			t.Errorf("expected the pick in user %s's watch history", user)
+		}
+	}
+
+	// A party ends once every candidate has a no vote. User 2 watched film
+	// 12 in the first party, so films 10 and 11 are the candidates
+	one, two = dial("rerun", "2"), dial("rerun", "3")
+	send(one, PartyCommand{Type: PartyCommandStart})
+	voting(one)
+	voting(two)
+	for _, id := range []string{"10", "11"} {
+		send(one, PartyCommand{Type: PartyCommandVote, FilmID: id, Like: true})
+		send(two, PartyCommand{Type: PartyCommandVote, FilmID: id, Like: false})
+	}
+	if msg := next(one, PartyMessageEnded); msg.Reason != PartyEndNoConsensus {
+		t.Errorf("expected no consensus, got %+v", msg)
+	}
+
+	for _, tc := range []struct {
+		path, token string
+		want        int
+	}{
+		{"/ws/party/bad%20code?user=1", "", http.StatusBadRequest},
+		{"/ws/party/abc", "", http.StatusBadRequest},
+		{"/ws/party/abc?user=999", "", http.StatusNotFound},
+		{"/ws/party/abc?user=3", tokens["2"], http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		srv.routes().ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("GET %s: expected %d, got %d", tc.path, tc.want, w.Code)
+		}
+	}
+}
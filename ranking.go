@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// --- Ranking weights ---
+//
+// The weights of the personalized rank profile are query inputs with defaults
+// in film.sd, so they can be tuned without redeploying Vespa. Queries send the
+// configured weights; experiment variants may override them through their
+// inputs, and an admin may override both with the weights parameter. The
+// default profile reads none of them, so they are dropped from queries that
+// end up ranked by it.
+
+// rankingWeightNames are the weight inputs of the personalized profile. The
+// same names are used in the ranking config section and the weights
+// parameter.
+var rankingWeightNames = []string{
+	"genre_boost_weight",
+	"genre_penalty_weight",
+	"tag_boost_weight",
+	"tag_penalty_weight",
+	"rating_weight",
+	"recency_weight",
+}
+
+// rankWeights maps weight input names to values.
+type rankWeights map[string]float64
+
+func (c RankingConfig) weights() rankWeights {
+	return rankWeights{
+		"genre_boost_weight":   c.GenreBoostWeight,
+		"genre_penalty_weight": c.GenrePenaltyWeight,
+		"tag_boost_weight":     c.TagBoostWeight,
+		"tag_penalty_weight":   c.TagPenaltyWeight,
+		"rating_weight":        c.RatingWeight,
+		"recency_weight":       c.RecencyWeight,
+	}
+}
+
+func (w rankWeights) queryOption() queryOption {
+	return func(params url.Values) {
+		for name, v := range w {
+			params.Set("input.query("+name+")", strconv.FormatFloat(v, 'g', -1, 64))
+		}
+	}
+}
+
+// dropUnusedWeights removes the weight inputs when params rank with the
+// default profile, which does not declare them.
+func dropUnusedWeights(params url.Values) {
+	if p := params.Get("ranking.profile"); p != "" && p != "default" {
+		return
+	}
+	for _, name := range rankingWeightNames {
+		params.Del("input.query(" + name + ")")
+	}
+}
+
+func isValidWeight(v float64) bool {
+	return v >= 0 && !math.IsInf(v, 1)
+}
+
+// parseRankWeights parses the weights parameter, a comma-separated list of
+// name:value pairs such as "rating_weight:2,tag_boost_weight:3".
+func parseRankWeights(s string) (rankWeights, error) {
+	w := rankWeights{}
+	for _, pair := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok {
+			return nil, fmt.Errorf("%q is not a name:value pair", pair)
+		}
+		if !slices.Contains(rankingWeightNames, name) {
+			return nil, fmt.Errorf("unknown weight %q, expected one of %s", name, strings.Join(rankingWeightNames, ", "))
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || !isValidWeight(v) {
+			return nil, fmt.Errorf("weight %s must be a non-negative number, got %q", name, value)
+		}
+		w[name] = v
+	}
+	return w, nil
+}
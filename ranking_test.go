@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseRankWeights(t *testing.T) {
+	w, err := parseRankWeights("rating_weight:2, tag_boost_weight:0.5")
+	if err != nil {
+		t.Fatalf("parseRankWeights failed: %v", err)
+	}
+	if len(w) != 2 || w["rating_weight"] != 2 || w["tag_boost_weight"] != 0.5 {
+		t.Errorf("unexpected weights: %v", w)
+	}
+
+	for _, tc := range []struct{ input, want string }{
+		{"rating_weight", "not a name:value pair"},
+		{"bm25_weight:1", "unknown weight"},
+		{"rating_weight:high", "non-negative number"},
+		{"rating_weight:-1", "non-negative number"},
+		{"rating_weight:+Inf", "non-negative number"},
+	} {
+		if _, err := parseRankWeights(tc.input); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("parseRankWeights(%q) = %v, want an error containing %q", tc.input, err, tc.want)
+		}
+	}
+}
+
+func TestBuildVespaQueryWeights(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Ranking.RatingWeight = 1.5
+	srv := newServer(cfg, nil)
+
+	u, _ := url.Parse(srv.buildVespaQuery("*", nil, 10))
+	for _, name := range rankingWeightNames {
+		if got := u.Query().Get("input.query(" + name + ")"); got != "" {
+			t.Errorf("expected no input.query(%s) for the default profile, got %q", name, got)
+		}
+	}
+
+	prefs := []Preference{{Type: PrefTypeGenre, Value: "Action", State: PrefStateLike}}
+	u, _ = url.Parse(srv.buildVespaQuery("*", prefs, 10))
+	params := u.Query()
+	for name, want := range map[string]string{
+		"genre_boost_weight":   "10",
+		"genre_penalty_weight": "10",
+		"tag_boost_weight":     "5",
+		"tag_penalty_weight":   "5",
+		"rating_weight":        "1.5",
+		"recency_weight":       "0",
+	} {
+		if got := params.Get("input.query(" + name + ")"); got != want {
+			t.Errorf("expected input.query(%s)=%s, got %q", name, want, got)
+		}
+	}
+}
+
+func TestSearchWeightOverrides(t *testing.T) {
+	var mu sync.Mutex
+	var last url.Values
+	mockVespa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		last = r.URL.Query()
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"root":{"fields":{"totalCount":1},"children":[` + testMatrixHit + `]}}`))
+	}))
+	defer mockVespa.Close()
+
+	srv := newTestServer(t)
+	srv.cfg.Vespa.URL = mockVespa.URL
+	srv.cfg.Ranking.RatingWeight = 1
+	srv.cfg.Experiments = []ExperimentConfig{{Name: "ranking", Variants: []VariantConfig{
+		{Name: "rated", Weight: 1, Inputs: map[string]string{"rating_weight": "2", "recency_weight": "3"}},
+	}}}
+	adminToken := setupTestAccount(t, srv, "admin", RoleAdmin)
+	userToken := setupTestAccount(t, srv, "1", RoleUser)
+	h := srv.routes()
+
+	search := func(path, token string) (int, url.Values) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		mu.Lock()
+		defer mu.Unlock()
+		q := last
+		last = nil
+		return w.Code, q
+	}
+
+	_, q := search("/api/search?q=matrix", "")
+	if q.Has("input.query(rating_weight)") {
+		t.Errorf("expected no weights without personalized ranking, got %v", q)
+	}
+
+	prefs := url.QueryEscape(`[{"type":"genre","value":"Action","state":"like"}]`)
+	_, q = search("/api/search?q=matrix&prefs="+prefs, "")
+	if q.Get("input.query(rating_weight)") != "1" {
+		t.Errorf("expected the configured rating_weight, got %v", q)
+	}
+
+	_, q = search("/api/search?q=matrix&user=1&prefs="+prefs, userToken)
+	if q.Get("input.query(rating_weight)") != "2" || q.Get("input.query(recency_weight)") != "3" {
+		t.Errorf("expected the variant's weights, got %v", q)
+	}
+
+	code, q := search("/api/v2/search?q=matrix&prefs="+prefs+"&weights=rating_weight:4", adminToken)
+	if code != http.StatusOK {
+		t.Fatalf("expected 200 for an admin, got %d", code)
+	}
+	if q.Get("input.query(rating_weight)") != "4" || q.Get("input.query(recency_weight)") != "3" {
+		t.Errorf("expected the admin's rating_weight over the variant's, got %v", q)
+	}
+
+	for _, tc := range []struct {
+		path, token string
+		want        int
+	}{
+		{"/api/search?weights=rating_weight:4", "", http.StatusUnauthorized},
+		{"/api/search?weights=rating_weight:4", userToken, http.StatusForbidden},
+		{"/api/search?weights=rating_weight:-4", adminToken, http.StatusBadRequest},
+	} {
+		if code, q := search(tc.path, tc.token); code != tc.want || q != nil {
+			t.Errorf("GET %s: expected %d without querying Vespa, got %d", tc.path, tc.want, code)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Rate limiting ---
+//
+// Each client gets one token bucket per limit class. Clients are identified
+// by user ID when authenticated and by IP address otherwise. Limits can be
+// changed at runtime through the admin API; buckets pick up the new rate and
+// burst on their next request.
+
+const (
+	limitSearch          = "search"
+	limitRecommendations = "recommendations"
+	limitWrites          = "writes"
+
+	bucketSweepInterval = time.Minute
+)
+
+// RateLimits holds the limit for each class. It is both the runtime state
+// and the admin API payload.
+type RateLimits struct {
+	Search          LimitConfig `json:"search" yaml:"search"`
+	Recommendations LimitConfig `json:"recommendations" yaml:"recommendations"`
+	Writes          LimitConfig `json:"writes" yaml:"writes"`
+}
+
+func (l RateLimits) forClass(class string) LimitConfig {
+	switch class {
+	case limitSearch:
+		return l.Search
+	case limitRecommendations:
+		return l.Recommendations
+	default:
+		return l.Writes
+	}
+}
+
+func (l RateLimits) validate() error {
+	for class, c := range map[string]LimitConfig{
+		limitSearch:          l.Search,
+		limitRecommendations: l.Recommendations,
+		limitWrites:          l.Writes,
+	} {
+		if c.Rate < 0 {
+			return fmt.Errorf("%s rate must not be negative", class)
+		}
+		if c.Rate > 0 && c.Burst < 1 {
+			return fmt.Errorf("%s burst must be at least 1", class)
+		}
+	}
+	return nil
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type rateLimiter struct {
+	mu        sync.Mutex
+	limits    RateLimits
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	return &rateLimiter{
+		limits:  limits,
+		buckets: map[string]*tokenBucket{},
+		now:     time.Now,
+	}
+}
+
+func (l *rateLimiter) Limits() RateLimits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limits
+}
+
+func (l *rateLimiter) SetLimits(limits RateLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+}
+
+// limitDecision is the outcome of one request against a bucket.
+type limitDecision struct {
+	allowed   bool
+	limit     LimitConfig
+	remaining int
+	// reset is how long until the bucket is full again.
+	reset time.Duration
+	// retryAfter is how long until the next token, when not allowed.
+	retryAfter time.Duration
+}
+
+// refill brings b up to date and reports the tokens it now holds.
+func refill(b *tokenBucket, c LimitConfig, now time.Time) float64 {
+	b.tokens = math.Min(float64(c.Burst), b.tokens+now.Sub(b.updated).Seconds()*c.Rate)
+	b.updated = now
+	return b.tokens
+}
+
+// allow takes a token from client's bucket for class. Classes with a zero
+// rate are unlimited.
+func (l *rateLimiter) allow(class, client string) limitDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c := l.limits.forClass(class)
+	if c.Rate <= 0 {
+		return limitDecision{allowed: true, limit: c}
+	}
+
+	now := l.now()
+	if now.Sub(l.lastSweep) > bucketSweepInterval {
+		l.sweep(now)
+	}
+
+	key := class + "|" + client
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(c.Burst), updated: now}
+		l.buckets[key] = b
+	}
+	tokens := refill(b, c, now)
+
+	d := limitDecision{limit: c}
+	if tokens >= 1 {
+		b.tokens--
+		d.allowed = true
+	} else {
+		d.retryAfter = time.Duration((1 - tokens) / c.Rate * float64(time.Second))
+	}
+	d.remaining = int(b.tokens)
+	d.reset = time.Duration((float64(c.Burst) - b.tokens) / c.Rate * float64(time.Second))
+	return d
+}
+
+// sweep drops buckets that have refilled completely; they are
+// indistinguishable from new ones. The caller must hold l.mu.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		class, _, _ := strings.Cut(key, "|")
+		c := l.limits.forClass(class)
+		if c.Rate <= 0 || refill(b, c, now) >= float64(c.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// ceilSeconds rounds d up to whole seconds, as the rate limit headers
+// require.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// rateLimited applies the limit for class before calling next. Put it inside
+// requireUser so the authenticated user is already known.
+func (s *Server) rateLimited(class string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d := s.limiter.allow(class, s.rateLimitKey(r))
+		if d.limit.Rate > 0 {
+			window := ceilSeconds(time.Duration(float64(d.limit.Burst) / d.limit.Rate * float64(time.Second)))
+			w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", d.limit.Burst, window))
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(d.limit.Burst))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(d.remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.reset)))
+		}
+		if !d.allowed {
+			s.metrics.rateLimited.WithLabelValues(class).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(d.retryAfter)))
+			writeProblem(w, r, http.StatusTooManyRequests, codeRateLimited, "Rate limit exceeded")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// rateLimitKey identifies the client: the authenticated user if there is
+// one, otherwise its IP address.
+func (s *Server) rateLimitKey(r *http.Request) string {
+	if u, ok := authUserFromContext(r.Context()); ok {
+		return "user:" + u.ID
+	}
+	if sessionToken(r) != "" {
+		if u, _, err := s.authenticate(r); err == nil {
+			return "user:" + u.ID
+		}
+	}
+	return "ip:" + clientIP(r, s.trustedProxies)
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only
+// believed when the request came from a trusted proxy, and then only as far
+// back as the last hop that is not itself trusted.
+func clientIP(r *http.Request, trusted []netip.Prefix) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !isTrustedProxy(addr, trusted) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop
+		if !isTrustedProxy(hop, trusted) {
+			break
+		}
+	}
+	return addr.Unmap().String()
+}
+
+func isTrustedProxy(addr netip.Addr, trusted []netip.Prefix) bool {
+	addr = addr.Unmap()
+	for _, p := range trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies accepts CIDR prefixes and bare IP addresses.
+func parseTrustedProxies(entries []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, e := range entries {
+		if p, err := netip.ParsePrefix(e); err == nil {
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", e)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// --- Admin API ---
+
+func (s *Server) handleGetRateLimits(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.limiter.Limits())
+}
+
+// handleSetRateLimits updates the limits of the classes present in the body;
+// the others keep their current values.
+func (s *Server) handleSetRateLimits(w http.ResponseWriter, r *http.Request) {
+	limits := s.limiter.Limits()
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&limits); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON: "+err.Error())
+		return
+	}
+	if err := limits.validate(); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	s.limiter.SetLimits(limits)
+	u, _ := authUserFromContext(r.Context())
+	slog.Info("Rate limits updated", "by", u.ID, "search", limits.Search, "recommendations", limits.Recommendations, "writes", limits.Writes)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limits)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := newRateLimiter(RateLimits{Search: LimitConfig{Rate: 2, Burst: 3}})
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if d := l.allow(limitSearch, "a"); !d.allowed || d.remaining != 2-i {
+			t.Fatalf("request %d: expected allowed with %d remaining, got %+v", i, 2-i, d)
+		}
+	}
+	d := l.allow(limitSearch, "a")
+	if d.allowed {
+		t.Fatal("expected the fourth request in a burst of 3 to be denied")
+	}
+	if d.retryAfter != 500*time.Millisecond || d.reset != 1500*time.Millisecond {
+		t.Errorf("expected retry after 500ms and reset in 1.5s, got %v and %v", d.retryAfter, d.reset)
+	}
+	if !l.allow(limitSearch, "b").allowed {
+		t.Error("other clients should have their own bucket")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if !l.allow(limitSearch, "a").allowed {
+		t.Error("expected one token to have refilled after 500ms")
+	}
+
+	t.Run("zero rate is unlimited", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			if !l.allow(limitWrites, "a").allowed {
+				t.Fatal("writes have no limit configured")
+			}
+		}
+	})
+
+	t.Run("new limits apply to existing buckets", func(t *testing.T) {
+		now = now.Add(time.Hour)
+		l.SetLimits(RateLimits{Search: LimitConfig{Rate: 1, Burst: 1}})
+		if d := l.allow(limitSearch, "a"); !d.allowed || d.limit.Burst != 1 || d.remaining != 0 {
+			t.Errorf("expected the bucket to be capped at the new burst, got %+v", d)
+		}
+		if l.allow(limitSearch, "a").allowed {
+			t.Error("expected the second request to be denied under the new limit")
+		}
+	})
+
+	t.Run("full buckets are swept", func(t *testing.T) {
+		now = now.Add(2 * bucketSweepInterval)
+		l.allow(limitSearch, "c")
+		if len(l.buckets) != 1 {
+			t.Errorf("expected only the new bucket to remain, got %d", len(l.buckets))
+		}
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("parseTrustedProxies failed: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"direct client", "203.0.113.7:5000", "", "203.0.113.7"},
+		{"untrusted peer cannot spoof", "203.0.113.7:5000", "198.51.100.1", "203.0.113.7"},
+		{"trusted proxy", "10.1.2.3:5000", "198.51.100.1", "198.51.100.1"},
+		{"chain of trusted proxies", "10.1.2.3:5000", "198.51.100.1, 192.168.1.1, 10.9.9.9", "198.51.100.1"},
+		{"spoofed hop left of the client is ignored", "10.1.2.3:5000", "1.2.3.4, 198.51.100.1", "198.51.100.1"},
+		{"trusted proxy without header", "10.1.2.3:5000", "", "10.1.2.3"},
+		{"garbage in header", "10.1.2.3:5000", "not-an-ip", "10.1.2.3"},
+		{"ipv6", "[2001:db8::1]:5000", "", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := clientIP(r, trusted); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("expected an error for an invalid prefix")
+	}
+	if p, _ := parseTrustedProxies([]string{"::ffff:10.0.0.1"}); len(p) != 1 || !p[0].Contains(netip.MustParseAddr("10.0.0.1")) {
+		t.Errorf("expected IPv4-mapped address to be unmapped, got %v", p)
+	}
+}
+
+func TestRateLimitedRoutes(t *testing.T) {
+	mockVespa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(VespaResponse{})
+	}))
+	defer mockVespa.Close()
+
+	newLimitedServer := func(t *testing.T) (*Server, http.Handler) {
+		srv := newTestServer(t)
+		srv.cfg.Vespa.URL = mockVespa.URL
+		srv.limiter.SetLimits(RateLimits{
+			Search:          LimitConfig{Rate: 0.01, Burst: 2},
+			Recommendations: LimitConfig{Rate: 0.01, Burst: 1},
+		})
+		return srv, srv.routes()
+	}
+	do := func(h http.Handler, method, path, token, remoteAddr, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if remoteAddr != "" {
+			req.RemoteAddr = remoteAddr
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("search by IP", func(t *testing.T) {
+		_, h := newLimitedServer(t)
+		for i := 0; i < 2; i++ {
+			w := do(h, http.MethodGet, "/api/search?q=x", "", "203.0.113.7:1", "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("request %d: expected 200, got %d", i, w.Code)
+			}
+			if w.Header().Get("RateLimit-Limit") != "2" {
+				t.Errorf("expected RateLimit-Limit: 2, got %q", w.Header().Get("RateLimit-Limit"))
+			}
+		}
+
+		w := do(h, http.MethodGet, "/api/search?q=x", "", "203.0.113.7:1", "")
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected 429, got %d", w.Code)
+		}
+		for header, want := range map[string]string{
+			"Retry-After":         "100",
+			"RateLimit-Remaining": "0",
+			"RateLimit-Reset":     "200",
+			"RateLimit-Policy":    "2;w=200",
+		} {
+			if got := w.Header().Get(header); got != want {
+				t.Errorf("expected %s: %s, got %q", header, want, got)
+			}
+		}
+
+		if w := do(h, http.MethodGet, "/api/search?q=x", "", "198.51.100.1:1", ""); w.Code != http.StatusOK {
+			t.Errorf("another IP should not be limited, got %d", w.Code)
+		}
+	})
+
+	t.Run("recommendations by user", func(t *testing.T) {
+		srv, h := newLimitedServer(t)
+		token1 := setupTestAccount(t, srv, "1", RoleUser)
+		token2 := setupTestAccount(t, srv, "2", RoleUser)
+
+		if w := do(h, http.MethodGet, "/api/users/1/recommendations", token1, "", ""); w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if w := do(h, http.MethodGet, "/api/users/1/recommendations", token1, "", ""); w.Code != http.StatusTooManyRequests {
+			t.Errorf("expected 429 for user 1, got %d", w.Code)
+		}
+		// Same IP, different user
+		if w := do(h, http.MethodGet, "/api/users/2/recommendations", token2, "", ""); w.Code != http.StatusOK {
+			t.Errorf("user 2 should have its own budget, got %d", w.Code)
+		}
+		// Search is a separate budget
+		if w := do(h, http.MethodGet, "/api/search?q=x", token1, "", ""); w.Code != http.StatusOK {
+			t.Errorf("search should not share the recommendations budget, got %d", w.Code)
+		}
+	})
+
+	t.Run("admin updates limits", func(t *testing.T) {
+		srv, h := newLimitedServer(t)
+		userToken := setupTestAccount(t, srv, "1", RoleUser)
+		adminToken := setupTestAccount(t, srv, "admin", RoleAdmin)
+
+		if w := do(h, http.MethodPatch, "/api/admin/rate-limits", userToken, "", `{"search":{"rate":0}}`); w.Code != http.StatusForbidden {
+			t.Errorf("expected 403 for non-admin, got %d", w.Code)
+		}
+		if w := do(h, http.MethodPatch, "/api/admin/rate-limits", adminToken, "", `{"search":{"rate":-1,"burst":1}}`); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for a negative rate, got %d", w.Code)
+		}
+
+		w := do(h, http.MethodPatch, "/api/admin/rate-limits", adminToken, "", `{"search":{"rate":0,"burst":0}}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var limits RateLimits
+		json.NewDecoder(w.Body).Decode(&limits)
+		if limits.Search.Rate != 0 || limits.Recommendations.Burst != 1 {
+			t.Errorf("expected search disabled and recommendations unchanged, got %+v", limits)
+		}
+
+		for i := 0; i < 5; i++ {
+			w := do(h, http.MethodGet, "/api/search?q=x", "", "", "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("request %d: expected search to be unlimited, got %d", i, w.Code)
+			}
+			if w.Header().Get("RateLimit-Limit") != "" {
+				t.Error("unlimited classes should not send rate limit headers")
+			}
+		}
+
+		w = do(h, http.MethodGet, "/api/admin/rate-limits", adminToken, "", "")
+		json.NewDecoder(w.Body).Decode(&limits)
+		if limits.Search.Rate != 0 {
+			t.Errorf("expected GET to return the updated limits, got %+v", limits)
+		}
+	})
+}
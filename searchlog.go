@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Search log ---
+//
+// Every search is recorded in search_log for the admin analytics. Handlers
+// hand entries to a searchLogger, which writes them in batches from its own
+// goroutine so the database is never on the search path.
+
+const (
+	maxTopHitsLogged       = 10
+	searchLogBufferSize    = 1024
+	searchLogPruneInterval = time.Hour
+	searchLogWriteTimeout  = 5 * time.Second
+
+	defaultAnalyticsWindow = 24 * time.Hour
+	defaultAnalyticsLimit  = 10
+	maxAnalyticsLimit      = 100
+)
+
+// SearchFilters are the request options that narrowed or reranked a search.
+type SearchFilters struct {
+	ExcludeHidden bool `json:"exclude_hidden,omitempty"`
+	// PrefsOverridden is set when the request supplied its own preferences
+	// instead of the user's stored ones.
+	PrefsOverridden bool `json:"prefs_overridden,omitempty"`
+	Offset          int  `json:"offset,omitempty"`
+	Limit           int  `json:"limit,omitempty"`
+}
+
+type SearchLogEntry struct {
+	Time time.Time
+	// QueryID is returned to the client, which quotes it when it reports
+	// events for the results.
+	QueryID string
+	// API is the version of the search endpoint, v1 or v2.
+	API   string
+	Query string
+	// UserID is the signed-in caller, "" for anonymous searches. The user
+	// query parameter is never logged since anyone can set it.
+	UserID string
+	// Preferences are the ones the search was ranked with.
+	Preferences []Preference
+	// Experiments maps each experiment the user was in to their variant.
+	Experiments map[string]string
+	Filters     SearchFilters
+	TotalCount  int
+	Latency     time.Duration
+	// TopHits holds the film IDs of the first results, best first.
+	TopHits []string
+}
+
+// SearchAnalytics summarizes the search log over a time window. The match-all
+// query "*" counts towards the totals but is left out of the query lists.
+type SearchAnalytics struct {
+	Window             string      `json:"window"`
+	Since              time.Time   `json:"since"`
+	TotalSearches      int         `json:"total_searches"`
+	ZeroResultSearches int         `json:"zero_result_searches"`
+	AverageLatencyMs   float64     `json:"average_latency_ms"`
+	TopQueries         []CountStat `json:"top_queries"`
+	ZeroResultQueries  []CountStat `json:"zero_result_queries"`
+	// QueriesPerUser counts searches by signed-in users; anonymous searches
+	// are only part of the totals.
+	QueriesPerUser []CountStat `json:"queries_per_user"`
+}
+
+// normalizeQuery lower-cases q and collapses whitespace, so the same search
+// typed slightly differently is counted once.
+func normalizeQuery(q string) string {
+	return strings.Join(strings.Fields(strings.ToLower(q)), " ")
+}
+
+// --- Writer ---
+
+type searchLogger struct {
+	store   SearchLogStore
+	cfg     SearchLogConfig
+	metrics *metrics
+
+	entries   chan SearchLogEntry
+	quit      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newSearchLogger starts the writer goroutine. Call close to flush and stop
+// it.
+func newSearchLogger(store SearchLogStore, cfg SearchLogConfig, m *metrics) *searchLogger {
+	l := &searchLogger{
+		store:   store,
+		cfg:     cfg,
+		metrics: m,
+		entries: make(chan SearchLogEntry, searchLogBufferSize),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// log queues e without blocking. When the buffer is full the entry is
+// dropped and counted rather than slowing the search down.
+func (l *searchLogger) log(e SearchLogEntry) {
+	select {
+	case l.entries <- e:
+	default:
+		l.metrics.searchLogDropped.Inc()
+	}
+}
+
+// close writes out everything queued so far and stops the writer.
+func (l *searchLogger) close() {
+	l.closeOnce.Do(func() { close(l.quit) })
+	<-l.done
+}
+
+func (l *searchLogger) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	l.prune()
+	lastPrune := time.Now()
+	batch := make([]SearchLogEntry, 0, l.cfg.BatchSize)
+	for {
+		select {
+		case e := <-l.entries:
+			batch = append(batch, e)
+			if len(batch) >= l.cfg.BatchSize {
+				batch = l.flush(batch)
+			}
+		case <-ticker.C:
+			batch = l.flush(batch)
+			if time.Since(lastPrune) >= searchLogPruneInterval {
+				l.prune()
+				lastPrune = time.Now()
+			}
+		case <-l.quit:
+			for {
+				select {
+				case e := <-l.entries:
+					batch = append(batch, e)
+				default:
+					l.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush writes batch and returns it emptied for reuse.
+func (l *searchLogger) flush(batch []SearchLogEntry) []SearchLogEntry {
+	if len(batch) == 0 {
+		return batch
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), searchLogWriteTimeout)
+	defer cancel()
+	if err := l.store.AddSearchLogs(ctx, batch); err != nil {
+		slog.Error("Failed to write search log", "entries", len(batch), "error", err)
+		l.metrics.searchLogDropped.Add(float64(len(batch)))
+	}
+	return batch[:0]
+}
+
+// prune deletes entries older than the retention period. Zero retention
+// keeps everything.
+func (l *searchLogger) prune() {
+	if l.cfg.Retention <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), searchLogWriteTimeout)
+	defer cancel()
+	n, err := l.store.PruneSearchLog(ctx, time.Now().Add(-l.cfg.Retention))
+	if err != nil {
+		slog.Error("Failed to prune search log", "error", err)
+		return
+	}
+	if n > 0 {
+		slog.Info("Pruned search log", "deleted", n, "retention", l.cfg.Retention)
+	}
+}
+
+// logSearch records a completed search. offset and limit are the paging the
+// client asked for, zero for v1. It does nothing when the search log is
+// disabled.
+func (s *Server) logSearch(api string, start time.Time, p searchParams, offset, limit int, resp VespaResponse) {
+	if s.searchLog == nil {
+		return
+	}
+	filters := SearchFilters{
+		ExcludeHidden:   p.excludeHidden,
+		PrefsOverridden: p.prefsOverridden,
+		Offset:          offset,
+		Limit:           limit,
+	}
+	var topHits []string
+	for _, hit := range resp.Root.Children {
+		if len(topHits) == maxTopHitsLogged {
+			break
+		}
+		if !strings.HasPrefix(hit.ID, "group:") {
+			topHits = append(topHits, filmIDFromDocID(hit.ID))
+		}
+	}
+	s.searchLog.log(SearchLogEntry{
+		Time:        start,
+		QueryID:     p.queryID,
+		API:         api,
+		Query:       normalizeQuery(p.query),
+		UserID:      p.callerID,
+		Preferences: p.prefs,
+		Experiments: p.variants.byExperiment(),
+		Filters:     filters,
+		TotalCount:  resp.Root.Fields.TotalCount,
+		Latency:     time.Since(start),
+		TopHits:     topHits,
+	})
+}
+
+// --- HTTP handlers ---
+
+// parseWindow reads the window query parameter, a duration to look back
+// over. When it is invalid it writes the problem response and returns false.
+func parseWindow(w http.ResponseWriter, r *http.Request, def time.Duration) (time.Duration, bool) {
+	v := r.URL.Query().Get("window")
+	if v == "" {
+		return def, true
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, "window must be a positive duration such as 24h")
+		return 0, false
+	}
+	return d, true
+}
+
+// handleSearchAnalytics reports on the searches of the last window, 24h by
+// default. Entries are written in batches, so the most recent few seconds
+// may be missing.
+func (s *Server) handleSearchAnalytics(w http.ResponseWriter, r *http.Request) {
+	window, ok := parseWindow(w, r, defaultAnalyticsWindow)
+	if !ok {
+		return
+	}
+	limit := defaultAnalyticsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAnalyticsLimit {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, "limit must be between 1 and "+strconv.Itoa(maxAnalyticsLimit))
+			return
+		}
+		limit = n
+	}
+
+	analytics, err := s.store.SearchAnalytics(r.Context(), time.Now().Add(-window), limit)
+	if err != nil {
+		internalError(w, r, "Failed to aggregate search log", "error", err)
+		return
+	}
+	analytics.Window = window.String()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(analytics)
+}
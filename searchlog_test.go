@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNormalizeQuery(t *testing.T) {
+	for in, want := range map[string]string{
+		"The Matrix":       "the matrix",
+		"  the   MATRIX\t": "the matrix",
+		"*":                "*",
+	} {
+		if got := normalizeQuery(in); got != want {
+			t.Errorf("normalizeQuery(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// blockingSearchLogStore holds every write until release is closed.
+type blockingSearchLogStore struct {
+	SearchLogStore
+	release chan struct{}
+	mu      sync.Mutex
+	written int
+}
+
+func (s *blockingSearchLogStore) AddSearchLogs(ctx context.Context, entries []SearchLogEntry) error {
+	<-s.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.written += len(entries)
+	return nil
+}
+
+func counterValue(t *testing.T, m *metrics, name string) float64 {
+	t.Helper()
+	families, err := m.registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	for _, f := range families {
+		if f.GetName() == name {
+			return f.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestSearchLogger(t *testing.T) {
+	t.Run("writes full batches and flushes on close", func(t *testing.T) {
+		store := newMemoryStore()
+		l := newSearchLogger(store, SearchLogConfig{FlushInterval: time.Hour, BatchSize: 2}, newMetrics())
+		now := time.Now()
+		count := func() int {
+			a, _ := store.SearchAnalytics(context.Background(), now.Add(-time.Minute), 10)
+			return a.TotalSearches
+		}
+
+		l.log(SearchLogEntry{Time: now, Query: "a"})
+		l.log(SearchLogEntry{Time: now, Query: "b"})
+		deadline := time.Now().Add(2 * time.Second)
+		for count() != 2 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if n := count(); n != 2 {
+			t.Fatalf("expected a full batch to be written, got %d entries", n)
+		}
+
+		l.log(SearchLogEntry{Time: now, Query: "c"})
+		l.close()
+		if n := count(); n != 3 {
+			t.Errorf("expected close to flush the partial batch, got %d entries", n)
+		}
+		l.close() // closing twice is harmless
+	})
+
+	t.Run("drops entries instead of blocking", func(t *testing.T) {
+		store := &blockingSearchLogStore{release: make(chan struct{})}
+		m := newMetrics()
+		l := newSearchLogger(store, SearchLogConfig{FlushInterval: time.Hour, BatchSize: 1}, m)
+
+		start := time.Now()
+		for range searchLogBufferSize + 10 {
+			l.log(SearchLogEntry{Time: start, Query: "q"})
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("log blocked for %v", elapsed)
+		}
+		if dropped := counterValue(t, m, "search_log_dropped_total"); dropped < 9 {
+			t.Errorf("expected at least 9 dropped entries, got %v", dropped)
+		}
+
+		close(store.release)
+		l.close()
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		if store.written < searchLogBufferSize {
+			t.Errorf("expected the queued entries to be written, got %d", store.written)
+		}
+	})
+}
+
+func TestHandleSearchAnalytics(t *testing.T) {
+	mockVespa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("query") == "nothing" {
+			w.Write([]byte(`{"root":{"fields":{"totalCount":0}}}`))
+			return
+		}
+		w.Write([]byte(`{"root":{"fields":{"totalCount":1},"children":[` + testMatrixHit + `]}}`))
+	}))
+	defer mockVespa.Close()
+
+	srv := newTestServer(t)
+	srv.cfg.Vespa.URL = mockVespa.URL
+	h := srv.routes()
+	adminToken := setupTestAccount(t, srv, "admin", RoleAdmin)
+
+	do := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	userToken := setupTestAccount(t, srv, "1", RoleUser)
+	for _, tc := range []struct{ path, token string }{
+		{"/api/search?q=The+Matrix&user=1", userToken},
+		// The user parameter is only a claim and is not logged
+		{"/api/v2/search?q=the+matrix&user=2&exclude_hidden=true&limit=5", ""},
+		{"/api/search?q=nothing", ""},
+		{"/api/search", ""},
+	} {
+		if w := do(tc.path, tc.token); w.Code != http.StatusOK {
+			t.Fatalf("GET %s: expected 200, got %d: %s", tc.path, w.Code, w.Body.String())
+		}
+	}
+	// Write out the queued entries
+	srv.searchLog.close()
+
+	w := do("/api/admin/search-analytics?window=1h&limit=5", adminToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var a SearchAnalytics
+	if err := json.NewDecoder(w.Body).Decode(&a); err != nil {
+		t.Fatalf("failed to decode analytics: %v", err)
+	}
+	if a.Window != "1h0m0s" || a.TotalSearches != 4 || a.ZeroResultSearches != 1 {
+		t.Errorf("unexpected totals: %+v", a)
+	}
+	if len(a.TopQueries) != 2 || a.TopQueries[0] != (CountStat{Value: "the matrix", Count: 2}) {
+		t.Errorf("expected both spellings of the matrix counted together, got %+v", a.TopQueries)
+	}
+	if len(a.ZeroResultQueries) != 1 || a.ZeroResultQueries[0].Value != "nothing" {
+		t.Errorf("expected nothing as the zero-result query, got %+v", a.ZeroResultQueries)
+	}
+	if len(a.QueriesPerUser) != 1 || a.QueriesPerUser[0] != (CountStat{Value: "1", Count: 1}) {
+		t.Errorf("expected one search by user 1, got %+v", a.QueriesPerUser)
+	}
+
+	t.Run("invalid window", func(t *testing.T) {
+		decodeProblem(t, do("/api/admin/search-analytics?window=-1h", adminToken), http.StatusBadRequest, codeInvalidRequest)
+	})
+
+	t.Run("admin only", func(t *testing.T) {
+		decodeProblem(t, do("/api/admin/search-analytics", userToken), http.StatusForbidden, codeForbidden)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.Features.SearchLog = false
+		srv := newServer(cfg, newMemoryStore())
+		if srv.searchLog != nil {
+			t.Error("expected no search log writer")
+		}
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/search-analytics", nil)
+		w := httptest.NewRecorder()
+		srv.routes().ServeHTTP(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", w.Code)
+		}
+	})
+}
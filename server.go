@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"go.opentelemetry.io/otel"
+)
+
+// --- Server ---
+
+// Server holds everything the HTTP handlers depend on. Nothing is shared
+// between instances, so several servers can run side by side in one process.
+type Server struct {
+	cfg     Config
+	store   Store
+	vespa   *http.Client
+	catalog *filmCache
+	metrics *metrics
+	tracing *tracing
+
+	readiness      *readinessCache
+	limiter        *rateLimiter
+	spec           *apiSpec
+	trustedProxies []netip.Prefix
+	// searchLog is nil when the search log is disabled.
+	searchLog *searchLogger
+	party     *partyHub
+	changes   *changeBus
+}
+
+func newServer(cfg Config, store Store) *Server {
+	m := newMetrics()
+	t := newTracing(otel.GetTracerProvider())
+	if store != nil {
+		if ss, ok := store.(*sqliteStore); ok {
+			m.registry.MustRegister(collectors.NewDBStatsCollector(ss.db, "sqlite"))
+		}
+		store = instrumentedStore{next: store, backend: cfg.Store, metrics: m, tracing: t}
+	}
+	// Validate has already rejected malformed entries
+	trusted, _ := parseTrustedProxies(cfg.RateLimit.TrustedProxies)
+	var searchLog *searchLogger
+	if cfg.Features.SearchLog && store != nil {
+		searchLog = newSearchLogger(store, cfg.SearchLog, m)
+	}
+	return &Server{
+		cfg:   cfg,
+		store: store,
+		vespa: &http.Client{
+			Timeout:   cfg.Vespa.Timeout,
+			Transport: vespaTransport{next: http.DefaultTransport, metrics: m, tracing: t},
+		},
+		catalog: newFilmCache(catalogCacheTTL),
+		metrics: m,
+		tracing: t,
+
+		readiness:      newReadinessCache(readinessCacheTTL),
+		limiter:        newRateLimiter(cfg.RateLimit.RateLimits),
+		spec:           mustLoadAPISpec(),
+		trustedProxies: trusted,
+		searchLog:      searchLog,
+		party:          newPartyHub(cfg.Party.SessionTTL, cfg.Party.MaxSessions),
+		changes:        newChangeBus(),
+	}
+}
+
+// routes returns the server's HTTP handler. Routes for disabled features are
+// not registered at all.
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /health", s.handleHealth)
+	mux.HandleFunc("GET /livez", s.handleLivez)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+	if s.cfg.Features.Metrics {
+		mux.Handle("GET /metrics", s.metrics.handler())
+	}
+	mux.HandleFunc("GET /api/openapi.json", s.handleOpenAPI)
+	mux.HandleFunc("GET /api/search", s.rateLimited(limitSearch, s.validated(s.handleSearch)))
+	mux.HandleFunc("GET /api/users", s.validated(s.handleUsers))
+	mux.HandleFunc("GET /api/v2/search", s.rateLimited(limitSearch, s.validated(s.handleSearchV2)))
+	if s.cfg.Features.Events {
+		mux.HandleFunc("POST /api/events", s.rateLimited(limitWrites, s.validated(s.handleAddEvents)))
+	}
+	if s.cfg.Features.Registration {
+		mux.HandleFunc("POST /api/auth/register", s.rateLimited(limitWrites, s.validated(s.handleRegister)))
+	}
+	mux.HandleFunc("POST /api/auth/login", s.rateLimited(limitWrites, s.validated(s.handleLogin)))
+	mux.HandleFunc("POST /api/auth/logout", s.rateLimited(limitWrites, s.validated(s.handleLogout)))
+	mux.HandleFunc("GET /api/auth/me", s.requireUser(s.validated(s.handleMe)))
+	mux.HandleFunc("GET /api/admin/rate-limits", s.requireAdmin(s.validated(s.handleGetRateLimits)))
+	mux.HandleFunc("PATCH /api/admin/rate-limits", s.requireAdmin(s.validated(s.handleSetRateLimits)))
+	if s.cfg.Features.SearchLog {
+		mux.HandleFunc("GET /api/admin/search-analytics", s.requireAdmin(s.validated(s.handleSearchAnalytics)))
+	}
+	mux.HandleFunc("GET /api/admin/experiments", s.requireAdmin(s.validated(s.handleExperiments)))
+	mux.HandleFunc("GET /api/admin/experiments/{name}/report", s.requireAdmin(s.validated(s.handleExperimentReport)))
+	mux.HandleFunc("PUT /api/users/{id}/password", s.requireAccountOwner(s.rateLimited(limitWrites, s.validated(s.handleSetPassword))))
+	mux.HandleFunc("PUT /api/users/{id}/preferences", s.requireUser(s.rateLimited(limitWrites, s.validated(s.handleUpdatePreferences))))
+	mux.HandleFunc("GET /api/users/{id}/history", s.requireUser(s.validated(s.handleHistory)))
+	if s.cfg.Features.Stream {
+		mux.HandleFunc("GET /api/users/{id}/recommendations/stream", s.requireUser(s.rateLimited(limitRecommendations, s.validated(s.handleRecommendationStream))))
+	}
+	mux.HandleFunc("POST /api/users/{id}/history", s.requireUser(s.rateLimited(limitWrites, s.validated(s.handleAddHistory))))
+	mux.HandleFunc("GET /api/users/{id}/recommendations", s.requireUser(s.rateLimited(limitRecommendations, s.validated(s.handleRecommendations))))
+	mux.HandleFunc("GET /api/v2/users/{id}/recommendations", s.requireUser(s.rateLimited(limitRecommendations, s.validated(s.handleRecommendationsV2))))
+	mux.HandleFunc("POST /api/group-recommendations", s.requireUser(s.rateLimited(limitRecommendations, s.validated(s.handleGroupRecommendations))))
+	if s.cfg.Features.Party {
+		mux.HandleFunc("GET /ws/party/{code}", s.requireUser(s.rateLimited(limitWrites, s.handleParty)))
+	}
+	if s.cfg.Features.Stats {
+		mux.HandleFunc("GET /api/users/{id}/stats", s.requireUser(s.validated(s.handleStats)))
+	}
+	if s.cfg.Features.Watchlist {
+		mux.HandleFunc("GET /api/users/{id}/watchlist", s.requireUser(s.validated(s.handleWatchlist)))
+		mux.HandleFunc("POST /api/users/{id}/watchlist", s.requireUser(s.rateLimited(limitWrites, s.validated(s.handleAddWatchlist))))
+		mux.HandleFunc("DELETE /api/users/{id}/watchlist/{filmID}", s.requireUser(s.rateLimited(limitWrites, s.validated(s.handleDeleteWatchlist))))
+	}
+	if s.cfg.Features.Feedback {
+		mux.HandleFunc("GET /api/users/{id}/feedback", s.requireUser(s.validated(s.handleFeedback)))
+		mux.HandleFunc("POST /api/users/{id}/feedback", s.requireUser(s.rateLimited(limitWrites, s.validated(s.handleAddFeedback))))
+		mux.HandleFunc("DELETE /api/users/{id}/feedback/{filmID}", s.requireUser(s.rateLimited(limitWrites, s.validated(s.handleDeleteFeedback))))
+	}
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		mux.HandleFunc(method+" /api/", handleAPINotFound)
+	}
+	mux.Handle("GET /", http.FileServer(http.Dir(s.cfg.StaticDir)))
+
+	return withAPIv1Alias(withRequestID(s.tracing.instrument(s.metrics.instrument(withCORS(s.cfg.CORS.AllowedOrigins, mux)))))
+}
+
+// --- HTTP server lifecycle ---
+
+// newHTTPServer wraps h in an http.Server with the configured limits, so a
+// slow or idle client cannot hold a connection open indefinitely.
+func newHTTPServer(cfg HTTPConfig, h http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+}
+
+// serveUntilDone serves on ln until ctx is cancelled, then stops accepting
+// connections and waits up to timeout for in-flight requests to finish.
+// Requests still running after that are cut off and an error is returned.
+func serveUntilDone(ctx context.Context, hs *http.Server, ln net.Listener, timeout time.Duration) error {
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- hs.Serve(ln) }()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutdown started, draining in-flight requests", "timeout", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := hs.Shutdown(shutdownCtx); err != nil {
+		hs.Close()
+		return fmt.Errorf("draining requests: %w", err)
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	slog.Info("HTTP server stopped")
+	return nil
+}
+
+// close ends open watch parties, writes out the queued search log and
+// releases the server's outbound connections. Call it only after the HTTP
+// server has stopped and before the store is closed.
+func (s *Server) close() {
+	s.party.close()
+	if s.searchLog != nil {
+		s.searchLog.close()
+		slog.Info("Search log flushed")
+	}
+	s.vespa.CloseIdleConnections()
+	slog.Info("Vespa client connections closed")
+}
+
+// openStore opens the store selected by the config.
+func openStore(cfg Config) (Store, error) {
+	switch cfg.Store {
+	case StoreMemory:
+		return newMemoryStore(), nil
+	case StoreSQLite:
+		return openSQLiteStore(cfg.DatabaseDSN)
+	default:
+		return nil, fmt.Errorf("unknown store %q", cfg.Store)
+	}
+}
+
+// --- Store helpers ---
+//
+// These wrap store reads whose failure should degrade a response rather than
+// fail it. Errors are logged and an empty result is returned.
+
+func (s *Server) userPreferences(ctx context.Context, userID string) []Preference {
+	prefs, err := s.store.Preferences(ctx, userID)
+	if err != nil {
+		slog.Error("Failed to query preferences", "user_id", userID, "error", err)
+		return []Preference{}
+	}
+	return prefs
+}
+
+func (s *Server) watchedFilmIDs(ctx context.Context, userID string) map[string]bool {
+	history, err := s.store.WatchHistory(ctx, userID)
+	if err != nil {
+		slog.Error("Failed to query watch history", "user_id", userID, "error", err)
+		return map[string]bool{}
+	}
+	watched := map[string]bool{}
+	for _, e := range history {
+		watched[e.FilmID] = true
+	}
+	return watched
+}
+
+func (s *Server) watchlistFilmIDs(ctx context.Context, userID string) map[string]bool {
+	entries, err := s.store.Watchlist(ctx, userID)
+	if err != nil {
+		slog.Error("Failed to query watchlist", "user_id", userID, "error", err)
+		return map[string]bool{}
+	}
+	listed := map[string]bool{}
+	for _, e := range entries {
+		listed[e.FilmID] = true
+	}
+	return listed
+}
+
+// hiddenFilmIDs returns every film the user gave feedback on. Both actions
+// keep a film out of recommendations.
+func (s *Server) hiddenFilmIDs(ctx context.Context, userID string) map[string]bool {
+	entries, err := s.store.Feedback(ctx, userID)
+	if err != nil {
+		slog.Error("Failed to query feedback", "user_id", userID, "error", err)
+		return map[string]bool{}
+	}
+	hidden := map[string]bool{}
+	for _, e := range entries {
+		hidden[e.FilmID] = true
+	}
+	return hidden
+}
+
+// userAffinities turns not-interested feedback into small negative
+// affinities for the genres, tags and directors of those films. The films
+// are looked up in the catalog rather than trusting stored fields, and films
+// it does not have are skipped.
+func (s *Server) userAffinities(ctx context.Context, userID string) Affinities {
+	entries, err := s.store.Feedback(ctx, userID)
+	if err != nil {
+		slog.Error("Failed to query feedback", "user_id", userID, "error", err)
+		return Affinities{}
+	}
+	var filmIDs []string
+	for _, e := range entries {
+		if e.Action == FeedbackNotInterested {
+			filmIDs = append(filmIDs, e.FilmID)
+		}
+	}
+	films := s.lookupFilms(ctx, filmIDs)
+	var resolved []FeedbackEntry
+	for _, e := range entries {
+		if hit, ok := films[e.FilmID]; ok && e.Action == FeedbackNotInterested {
+			resolved = append(resolved, withFilmFields(e, hit))
+		}
+	}
+	return feedbackAffinities(resolved, s.cfg.Ranking)
+}
+
+// checkUserExists reports whether userID exists. When it does not, or the
+// lookup fails, it has already written the 404 or 500 response.
+func (s *Server) checkUserExists(w http.ResponseWriter, r *http.Request, userID string) bool {
+	exists, err := s.store.UserExists(r.Context(), userID)
+	if err != nil {
+		internalError(w, r, "Failed to check user existence", "user_id", userID, "error", err)
+		return false
+	}
+	if !exists {
+		writeProblem(w, r, http.StatusNotFound, codeUserNotFound, "User "+userID+" does not exist")
+		return false
+	}
+	return true
+}
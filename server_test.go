@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startServing runs serveUntilDone with h on a random local port and returns
+// the base URL, a cancel func that triggers shutdown, and serveUntilDone's
+// result.
+func startServing(t *testing.T, h http.Handler, timeout time.Duration) (string, context.CancelFunc, <-chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	done := make(chan error, 1)
+	go func() { done <- serveUntilDone(ctx, newHTTPServer(defaultConfig().HTTP, h), ln, timeout) }()
+	return "http://" + ln.Addr().String(), cancel, done
+}
+
+func TestServeUntilDone(t *testing.T) {
+	t.Run("drains in-flight requests", func(t *testing.T) {
+		started, release := make(chan struct{}), make(chan struct{})
+		base, shutdown, done := startServing(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			io.WriteString(w, "finished")
+		}), 5*time.Second)
+
+		type result struct {
+			body string
+			err  error
+		}
+		got := make(chan result, 1)
+		go func() {
+			resp, err := http.Get(base + "/slow")
+			if err != nil {
+				got <- result{err: err}
+				return
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			got <- result{string(body), err}
+		}()
+
+		<-started
+		shutdown()
+		// New connections are refused once shutdown has begun
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			conn, err := net.Dial("tcp", base[len("http://"):])
+			if err != nil {
+				break
+			}
+			conn.Close()
+			if time.Now().After(deadline) {
+				t.Fatal("listener still accepting connections after shutdown")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		close(release)
+		r := <-got
+		if r.err != nil || r.body != "finished" {
+			t.Errorf("expected in-flight request to complete, got body=%q err=%v", r.body, r.err)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("expected clean shutdown, got %v", err)
+		}
+	})
+
+	t.Run("gives up after the deadline", func(t *testing.T) {
+		started, release := make(chan struct{}), make(chan struct{})
+		defer close(release)
+		base, shutdown, done := startServing(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		}), 50*time.Millisecond)
+
+		go http.Get(base + "/stuck")
+		<-started
+		shutdown()
+
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Error("expected an error when requests outlive the shutdown timeout")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("serveUntilDone did not return after the shutdown timeout")
+		}
+	})
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+)
+
+// --- Stats constants ---
+
+const maxTopStats = 10
+
+// --- Stats types ---
+
+type CountStat struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+type RatingStat struct {
+	Value         string  `json:"value"`
+	Count         int     `json:"count"`
+	AverageRating float64 `json:"average_rating"`
+}
+
+type RatingBucket struct {
+	Rating int `json:"rating"`
+	Count  int `json:"count"`
+}
+
+// DislikedWatchStats describes how often a user watches films whose genre or
+// tags they marked as disliked.
+type DislikedWatchStats struct {
+	Count         int     `json:"count"`
+	Share         float64 `json:"share"`
+	AverageRating float64 `json:"average_rating"`
+}
+
+type UserStats struct {
+	UserID            string             `json:"user_id"`
+	TotalWatched      int                `json:"total_watched"`
+	AverageRating     float64            `json:"average_rating"`
+	GenreDistribution []CountStat        `json:"genre_distribution"`
+	TagDistribution   []CountStat        `json:"tag_distribution"`
+	RatingByGenre     []RatingStat       `json:"rating_by_genre"`
+	RatingByDecade    []RatingStat       `json:"rating_by_decade"`
+	RatingByDirector  []RatingStat       `json:"rating_by_director"`
+	RatingHistogram   []RatingBucket     `json:"rating_histogram"`
+	DislikedWatches   DislikedWatchStats `json:"disliked_watches"`
+	TopDirectors      []CountStat        `json:"top_directors"`
+	TopCast           []CountStat        `json:"top_cast"`
+	// CatalogMisses counts watched films that could not be found in the
+	// catalog; director and cast stats leave them out.
+	CatalogMisses int `json:"catalog_misses"`
+}
+
+// --- Aggregation ---
+
+type ratingAgg struct {
+	count int
+	sum   int
+}
+
+func round2(f float64) float64 {
+	return math.Round(f*100) / 100
+}
+
+func sortedCounts(counts map[string]int, limit int) []CountStat {
+	stats := make([]CountStat, 0, len(counts))
+	for v, c := range counts {
+		stats = append(stats, CountStat{Value: v, Count: c})
+	}
+	slices.SortFunc(stats, func(a, b CountStat) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Value, b.Value))
+	})
+	if limit > 0 && len(stats) > limit {
+		stats = stats[:limit]
+	}
+	return stats
+}
+
+func sortedRatings(aggs map[string]*ratingAgg) []RatingStat {
+	stats := make([]RatingStat, 0, len(aggs))
+	for v, a := range aggs {
+		stats = append(stats, RatingStat{Value: v, Count: a.count, AverageRating: round2(float64(a.sum) / float64(a.count))})
+	}
+	slices.SortFunc(stats, func(a, b RatingStat) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Value, b.Value))
+	})
+	return stats
+}
+
+// computeUserStats aggregates a user's watch history. catalog supplies
+// director and cast, which watch_history does not store, and the current
+// genre, tags and year of every film it has.
+func computeUserStats(userID string, history []WatchHistoryEntry, prefs []Preference, catalog map[string]VespaHit) UserStats {
+	stats := UserStats{
+		UserID:       userID,
+		TotalWatched: len(history),
+	}
+
+	dislikedGenres := map[string]bool{}
+	dislikedTags := map[string]bool{}
+	for _, p := range prefs {
+		if p.State != PrefStateDislike {
+			continue
+		}
+		switch p.Type {
+		case PrefTypeGenre:
+			dislikedGenres[p.Value] = true
+		case PrefTypeTag:
+			dislikedTags[p.Value] = true
+		}
+	}
+
+	genres := map[string]int{}
+	tags := map[string]int{}
+	directors := map[string]int{}
+	cast := map[string]int{}
+	byGenre := map[string]*ratingAgg{}
+	byDecade := map[string]*ratingAgg{}
+	byDirector := map[string]*ratingAgg{}
+	histogram := make([]int, 5)
+	var ratingSum, dislikedSum int
+
+	addRating := func(aggs map[string]*ratingAgg, key string, rating int) {
+		a, ok := aggs[key]
+		if !ok {
+			a = &ratingAgg{}
+			aggs[key] = a
+		}
+		a.count++
+		a.sum += rating
+	}
+
+	for _, e := range history {
+		ratingSum += e.UserRating
+		if e.UserRating >= 1 && e.UserRating <= 5 {
+			histogram[e.UserRating-1]++
+		}
+
+		// The catalog is the source of truth; the genre, tags and year
+		// copied into watch_history are only used for films it no longer has.
+		genre, filmTags, year := e.FilmGenre, e.FilmTags, e.FilmYear
+		film, ok := catalog[e.FilmID]
+		if ok {
+			genre, filmTags, year = film.Fields.Genre, film.Fields.Tags, film.Fields.Year
+		}
+
+		if genre != "" {
+			genres[genre]++
+			addRating(byGenre, genre, e.UserRating)
+		}
+		for _, t := range filmTags {
+			tags[t]++
+		}
+		if year > 0 {
+			addRating(byDecade, fmt.Sprintf("%ds", year/10*10), e.UserRating)
+		}
+
+		disliked := dislikedGenres[genre]
+		for _, t := range filmTags {
+			disliked = disliked || dislikedTags[t]
+		}
+		if disliked {
+			stats.DislikedWatches.Count++
+			dislikedSum += e.UserRating
+		}
+
+		if !ok {
+			stats.CatalogMisses++
+			continue
+		}
+		if film.Fields.Director != "" {
+			directors[film.Fields.Director]++
+			addRating(byDirector, film.Fields.Director, e.UserRating)
+		}
+		for _, c := range film.Fields.Cast {
+			cast[c]++
+		}
+	}
+
+	if len(history) > 0 {
+		stats.AverageRating = round2(float64(ratingSum) / float64(len(history)))
+		stats.DislikedWatches.Share = round2(float64(stats.DislikedWatches.Count) / float64(len(history)))
+	}
+	if stats.DislikedWatches.Count > 0 {
+		stats.DislikedWatches.AverageRating = round2(float64(dislikedSum) / float64(stats.DislikedWatches.Count))
+	}
+
+	stats.GenreDistribution = sortedCounts(genres, 0)
+	stats.TagDistribution = sortedCounts(tags, 0)
+	stats.RatingByGenre = sortedRatings(byGenre)
+	stats.RatingByDecade = sortedRatings(byDecade)
+	slices.SortFunc(stats.RatingByDecade, func(a, b RatingStat) int { return cmp.Compare(a.Value, b.Value) })
+	stats.RatingByDirector = sortedRatings(byDirector)
+	stats.TopDirectors = sortedCounts(directors, maxTopStats)
+	stats.TopCast = sortedCounts(cast, maxTopStats)
+	for i, c := range histogram {
+		stats.RatingHistogram = append(stats.RatingHistogram, RatingBucket{Rating: i + 1, Count: c})
+	}
+
+	return stats
+}
+
+// --- HTTP handlers ---
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("id")
+
+	if !s.checkUserExists(w, r, userID) {
+		return
+	}
+
+	history, err := s.store.WatchHistory(r.Context(), userID)
+	if err != nil {
+		internalError(w, r, "Failed to query watch history", "user_id", userID, "error", err)
+		return
+	}
+	prefs := s.userPreferences(r.Context(), userID)
+
+	filmIDs := make([]string, len(history))
+	for i, e := range history {
+		filmIDs[i] = e.FilmID
+	}
+	catalog := s.lookupFilms(r.Context(), filmIDs)
+
+	stats := computeUserStats(userID, history, prefs, catalog)
+	if stats.CatalogMisses > 0 {
+		slog.Warn("Stats computed without full catalog data", "user_id", userID, "misses", stats.CatalogMisses)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
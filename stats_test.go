@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestComputeUserStats(t *testing.T) {
+	history := []WatchHistoryEntry{
+		{FilmID: "1", FilmGenre: "Action", FilmYear: 2008, FilmTags: []string{"blockbuster"}, UserRating: 5},
+		{FilmID: "2", FilmGenre: "Action", FilmYear: 1999, FilmTags: []string{"blockbuster", "classic"}, UserRating: 4},
+		// Stale copy; the catalog's genre, tags and year win
+		{FilmID: "3", FilmGenre: "Drama", UserRating: 1},
+		{FilmID: "4", FilmGenre: "Drama", FilmYear: 1994, FilmTags: []string{}, UserRating: 3},
+	}
+	prefs := []Preference{
+		{Type: "genre", Value: "Romance", State: "dislike"},
+		{Type: "tag", Value: "classic", State: "dislike"},
+		{Type: "genre", Value: "Action", State: "like"},
+	}
+	catalog := map[string]VespaHit{}
+	for _, f := range []struct {
+		id, director, genre string
+		year                int
+		tags                []string
+	}{
+		{"1", "Christopher Nolan", "Action", 2008, []string{"blockbuster"}},
+		{"2", "Christopher Nolan", "Action", 1999, []string{"blockbuster", "classic"}},
+		{"3", "James Cameron", "Romance", 1997, []string{"classic"}},
+	} {
+		var hit VespaHit
+		hit.Fields.Director = f.director
+		hit.Fields.Cast = []string{"Shared Actor"}
+		hit.Fields.Genre, hit.Fields.Year, hit.Fields.Tags = f.genre, f.year, f.tags
+		catalog[f.id] = hit
+	}
+
+	stats := computeUserStats("1", history, prefs, catalog)
+
+	if stats.TotalWatched != 4 || stats.AverageRating != 3.25 {
+		t.Errorf("expected 4 watched at 3.25 average, got %d at %v", stats.TotalWatched, stats.AverageRating)
+	}
+	if len(stats.GenreDistribution) != 3 || stats.GenreDistribution[0] != (CountStat{Value: "Action", Count: 2}) ||
+		stats.GenreDistribution[1] != (CountStat{Value: "Drama", Count: 1}) {
+		t.Errorf("expected Action, Drama and Romance in genre distribution, got %+v", stats.GenreDistribution)
+	}
+	if len(stats.TagDistribution) != 2 || stats.TagDistribution[0].Value != "blockbuster" {
+		t.Errorf("expected blockbuster then classic (ties by name), got %+v", stats.TagDistribution)
+	}
+	if stats.RatingByGenre[0] != (RatingStat{Value: "Action", Count: 2, AverageRating: 4.5}) {
+		t.Errorf("unexpected rating by genre: %+v", stats.RatingByGenre)
+	}
+
+	var decades []string
+	for _, d := range stats.RatingByDecade {
+		decades = append(decades, d.Value)
+	}
+	if len(decades) != 2 || decades[0] != "1990s" || decades[1] != "2000s" {
+		t.Errorf("expected decades in chronological order, got %v", decades)
+	}
+
+	if stats.RatingByDirector[0] != (RatingStat{Value: "Christopher Nolan", Count: 2, AverageRating: 4.5}) {
+		t.Errorf("unexpected rating by director: %+v", stats.RatingByDirector)
+	}
+	if stats.TopCast[0] != (CountStat{Value: "Shared Actor", Count: 3}) {
+		t.Errorf("unexpected top cast: %+v", stats.TopCast)
+	}
+	if stats.CatalogMisses != 1 {
+		t.Errorf("expected 1 catalog miss, got %d", stats.CatalogMisses)
+	}
+
+	wantHist := []int{1, 0, 1, 1, 1}
+	for i, b := range stats.RatingHistogram {
+		if b.Rating != i+1 || b.Count != wantHist[i] {
+			t.Errorf("histogram bucket %d = %+v, want count %d", i, b, wantHist[i])
+		}
+	}
+
+	// Films 2 (classic tag) and 3 (Romance genre, classic tag) are disliked
+	if stats.DislikedWatches != (DislikedWatchStats{Count: 2, Share: 0.5, AverageRating: 2.5}) {
+		t.Errorf("unexpected disliked watches: %+v", stats.DislikedWatches)
+	}
+}
+
+func TestComputeUserStats_Empty(t *testing.T) {
+	stats := computeUserStats("1", []WatchHistoryEntry{}, nil, nil)
+
+	if stats.TotalWatched != 0 || stats.AverageRating != 0 {
+		t.Errorf("unexpected totals for empty history: %+v", stats)
+	}
+	if stats.GenreDistribution == nil || stats.TopCast == nil || len(stats.RatingHistogram) != 5 {
+		t.Error("empty stats should still encode lists as [] and a full histogram")
+	}
+}
+
+func TestHandleStats(t *testing.T) {
+	t.Run("joins history with catalog", func(t *testing.T) {
+		srv := newTestServer(t)
+		setupMockCatalog(t, srv, map[string]string{
+			"film-1": `{"title":"Test Film","director":"Test Director","cast":["Lead Actor","Second Actor"]}`,
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/api/users/1/stats", nil)
+		req.SetPathValue("id", "1")
+		w := httptest.NewRecorder()
+
+		srv.handleStats(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var stats UserStats
+		if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if stats.TotalWatched != 1 || stats.CatalogMisses != 0 {
+			t.Errorf("unexpected totals: %+v", stats)
+		}
+		if len(stats.TopDirectors) != 1 || stats.TopDirectors[0].Value != "Test Director" {
+			t.Errorf("expected director from catalog, got %+v", stats.TopDirectors)
+		}
+		if len(stats.TopCast) != 2 {
+			t.Errorf("expected 2 cast members, got %+v", stats.TopCast)
+		}
+	})
+
+	t.Run("catalog unavailable", func(t *testing.T) {
+		srv := newTestServer(t)
+		setupMockCatalog(t, srv, nil)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/users/1/stats", nil)
+		req.SetPathValue("id", "1")
+		w := httptest.NewRecorder()
+
+		srv.handleStats(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200 with partial stats, got %d", w.Code)
+		}
+		var stats UserStats
+		json.NewDecoder(w.Body).Decode(&stats)
+		if stats.CatalogMisses != 1 || len(stats.GenreDistribution) != 1 {
+			t.Errorf("expected history-only stats with 1 miss, got %+v", stats)
+		}
+	})
+
+	t.Run("user not found", func(t *testing.T) {
+		srv := newTestServer(t)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/users/999/stats", nil)
+		req.SetPathValue("id", "999")
+		w := httptest.NewRecorder()
+
+		srv.handleStats(w, req)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", w.Code)
+		}
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// --- Storage ---
+//
+// Store is everything the server persists. It is split by table so a new
+// feature adds its own interface here and an implementation to both
+// sqliteStore and memoryStore.
+
+var (
+	errNotFound   = errors.New("not found")
+	errUserExists = errors.New("user already exists")
+)
+
+type Store interface {
+	UserStore
+	AccountStore
+	PreferenceStore
+	HistoryStore
+	WatchlistStore
+	FeedbackStore
+	SearchLogStore
+	EventStore
+
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+type User struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type UserStore interface {
+	// ListUsers returns all users ordered by ID.
+	ListUsers(ctx context.Context) ([]User, error)
+	UserExists(ctx context.Context, userID string) (bool, error)
+	// CreateUser returns errUserExists if the ID is taken.
+	CreateUser(ctx context.Context, u User) error
+}
+
+type Credentials struct {
+	UserID       string
+	PasswordHash string
+	Role         string
+}
+
+type Session struct {
+	UserID    string
+	Role      string
+	ExpiresAt time.Time
+}
+
+type AccountStore interface {
+	// CreateAccount creates a user together with its credentials.
+	CreateAccount(ctx context.Context, u User, c Credentials) error
+	// Credentials returns errNotFound for users without a password.
+	Credentials(ctx context.Context, userID string) (Credentials, error)
+	// SetCredentials creates or replaces a user's password. An existing role
+	// is only overwritten when setRole is true.
+	SetCredentials(ctx context.Context, c Credentials, setRole bool) error
+
+	// CreateSession stores a session and prunes expired ones.
+	CreateSession(ctx context.Context, tokenHash, userID string, expiresAt time.Time) error
+	// Session resolves a token hash, including the user's role. It returns
+	// errNotFound for unknown tokens; expiry is left to the caller.
+	Session(ctx context.Context, tokenHash string) (Session, error)
+	DeleteSession(ctx context.Context, tokenHash string) error
+	// DeleteUserSessions signs a user out everywhere.
+	DeleteUserSessions(ctx context.Context, userID string) error
+}
+
+type PreferenceStore interface {
+	Preferences(ctx context.Context, userID string) ([]Preference, error)
+	ReplacePreferences(ctx context.Context, userID string, prefs []Preference) error
+}
+
+type HistoryStore interface {
+	// WatchHistory returns a user's history, most recent first.
+	WatchHistory(ctx context.Context, userID string) ([]WatchHistoryEntry, error)
+	// AddWatch records a watched film and removes it from the watchlist.
+	AddWatch(ctx context.Context, userID string, e WatchHistoryEntry) error
+}
+
+type WatchlistStore interface {
+	// Watchlist returns a user's watchlist ordered by position.
+	Watchlist(ctx context.Context, userID string) ([]WatchlistEntry, error)
+	// PutWatchlistEntry adds or updates a film and returns its final
+	// position. Existing entries keep the fields the request leaves out and
+	// their added_at time. A nil position appends new films and keeps
+	// existing ones in place; positions past the end are clamped.
+	PutWatchlistEntry(ctx context.Context, userID string, req AddWatchlistRequest) (int, error)
+	// RemoveWatchlistEntry returns errNotFound if the film is not listed.
+	RemoveWatchlistEntry(ctx context.Context, userID, filmID string) error
+}
+
+type FeedbackStore interface {
+	// Feedback returns a user's feedback, newest first.
+	Feedback(ctx context.Context, userID string) ([]FeedbackEntry, error)
+	// PutFeedback creates or replaces the feedback for e.FilmID.
+	PutFeedback(ctx context.Context, userID string, e FeedbackEntry) error
+	// DeleteFeedback returns errNotFound if there is no feedback for the film.
+	DeleteFeedback(ctx context.Context, userID, filmID string) error
+}
+
+type SearchLogStore interface {
+	// AddSearchLogs inserts a batch of entries.
+	AddSearchLogs(ctx context.Context, entries []SearchLogEntry) error
+	// SearchAnalytics aggregates the entries logged at or after since. Each
+	// top list holds at most limit values.
+	SearchAnalytics(ctx context.Context, since time.Time, limit int) (SearchAnalytics, error)
+	// PruneSearchLog deletes entries and events recorded before cutoff and
+	// returns how many entries were deleted.
+	PruneSearchLog(ctx context.Context, cutoff time.Time) (int, error)
+}
+
+type EventStore interface {
+	AddEvents(ctx context.Context, events []SearchEvent) error
+	// LabeledQueries returns the searches logged at or after since that have
+	// events, oldest first. Events for unknown query IDs are left out.
+	LabeledQueries(ctx context.Context, since time.Time) ([]LabeledQuery, error)
+	// VariantOutcomes groups the searches logged at or after since by their
+	// variant in experiment, ordered by variant name. Weight and
+	// ClickThroughRate are left for the caller.
+	VariantOutcomes(ctx context.Context, experiment string, since time.Time) ([]VariantOutcome, error)
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- In-memory store ---
+
+// memoryStore keeps everything in maps guarded by one mutex. It is meant for
+// tests and throwaway demos; nothing survives a restart.
+type memoryStore struct {
+	mu sync.Mutex
+
+	users       map[string]User
+	credentials map[string]Credentials
+	sessions    map[string]memorySession
+	preferences map[string][]Preference
+	history     map[string][]WatchHistoryEntry // oldest first
+	watchlist   map[string][]WatchlistEntry    // in position order
+	feedback    map[string]map[string]FeedbackEntry
+	searchLog   []SearchLogEntry
+	events      []SearchEvent
+}
+
+type memorySession struct {
+	userID    string
+	expiresAt time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:       map[string]User{},
+		credentials: map[string]Credentials{},
+		sessions:    map[string]memorySession{},
+		preferences: map[string][]Preference{},
+		history:     map[string][]WatchHistoryEntry{},
+		watchlist:   map[string][]WatchlistEntry{},
+		feedback:    map[string]map[string]FeedbackEntry{},
+	}
+}
+
+// now matches the second resolution of the SQLite store's timestamps.
+func (m *memoryStore) now() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+func (m *memoryStore) Ping(ctx context.Context) error { return nil }
+
+func (m *memoryStore) Close() error { return nil }
+
+// --- Users ---
+
+func (m *memoryStore) ListUsers(ctx context.Context) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := make([]User, 0, len(m.users))
+	for _, u := range m.users {
+		users = append(users, u)
+	}
+	slices.SortFunc(users, func(a, b User) int { return cmp.Compare(a.ID, b.ID) })
+	return users, nil
+}
+
+func (m *memoryStore) UserExists(ctx context.Context, userID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.users[userID]
+	return ok, nil
+}
+
+func (m *memoryStore) CreateUser(ctx context.Context, u User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[u.ID]; ok {
+		return errUserExists
+	}
+	m.users[u.ID] = u
+	return nil
+}
+
+// --- Accounts ---
+
+func (m *memoryStore) CreateAccount(ctx context.Context, u User, c Credentials) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[u.ID]; ok {
+		return errUserExists
+	}
+	m.users[u.ID] = u
+	c.UserID = u.ID
+	m.credentials[u.ID] = c
+	return nil
+}
+
+func (m *memoryStore) Credentials(ctx context.Context, userID string) (Credentials, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.credentials[userID]
+	if !ok {
+		return Credentials{}, errNotFound
+	}
+	return c, nil
+}
+
+func (m *memoryStore) SetCredentials(ctx context.Context, c Credentials, setRole bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if existing, ok := m.credentials[c.UserID]; ok && !setRole {
+		c.Role = existing.Role
+	}
+	m.credentials[c.UserID] = c
+	return nil
+}
+
+func (m *memoryStore) CreateSession(ctx context.Context, tokenHash, userID string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for hash, sess := range m.sessions {
+		if sess.expiresAt.Before(now) {
+			delete(m.sessions, hash)
+		}
+	}
+	m.sessions[tokenHash] = memorySession{userID: userID, expiresAt: expiresAt.UTC().Truncate(time.Second)}
+	return nil
+}
+
+func (m *memoryStore) Session(ctx context.Context, tokenHash string) (Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sess, ok := m.sessions[tokenHash]
+	if !ok {
+		return Session{}, errNotFound
+	}
+	role := RoleUser
+	if c, ok := m.credentials[sess.userID]; ok {
+		role = c.Role
+	}
+	return Session{UserID: sess.userID, Role: role, ExpiresAt: sess.expiresAt}, nil
+}
+
+func (m *memoryStore) DeleteSession(ctx context.Context, tokenHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, tokenHash)
+	return nil
+}
+
+func (m *memoryStore) DeleteUserSessions(ctx context.Context, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for hash, sess := range m.sessions {
+		if sess.userID == userID {
+			delete(m.sessions, hash)
+		}
+	}
+	return nil
+}
+
+// --- Preferences ---
+
+func (m *memoryStore) Preferences(ctx context.Context, userID string) ([]Preference, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Preference{}, m.preferences[userID]...), nil
+}
+
+func (m *memoryStore) ReplacePreferences(ctx context.Context, userID string, prefs []Preference) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.preferences[userID] = append([]Preference(nil), prefs...)
+	return nil
+}
+
+// --- Watch history ---
+
+func (m *memoryStore) WatchHistory(ctx context.Context, userID string) ([]WatchHistoryEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	history := append([]WatchHistoryEntry{}, m.history[userID]...)
+	slices.Reverse(history)
+	return history, nil
+}
+
+func (m *memoryStore) AddWatch(ctx context.Context, userID string, e WatchHistoryEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e.FilmTags = append([]string{}, e.FilmTags...)
+	m.history[userID] = append(m.history[userID], e)
+	m.removeFromWatchlist(userID, e.FilmID)
+	return nil
+}
+
+// --- Watchlist ---
+
+func (m *memoryStore) Watchlist(ctx context.Context, userID string) ([]WatchlistEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := append([]WatchlistEntry{}, m.watchlist[userID]...)
+	for i := range entries {
+		entries[i].Position = i
+	}
+	return entries, nil
+}
+
+// removeFromWatchlist reports whether the film was listed. The caller must
+// hold m.mu.
+func (m *memoryStore) removeFromWatchlist(userID, filmID string) (int, bool) {
+	list := m.watchlist[userID]
+	i := slices.IndexFunc(list, func(e WatchlistEntry) bool { return e.FilmID == filmID })
+	if i < 0 {
+		return 0, false
+	}
+	m.watchlist[userID] = slices.Delete(list, i, i+1)
+	return i, true
+}
+
+func (m *memoryStore) PutWatchlistEntry(ctx context.Context, userID string, req AddWatchlistRequest) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := m.watchlist[userID]
+	current := slices.IndexFunc(list, func(e WatchlistEntry) bool { return e.FilmID == req.FilmID })
+	if current < 0 {
+		e := WatchlistEntry{AddedAt: m.now()}
+		req.apply(&e)
+		target := len(list)
+		if req.Position != nil {
+			target = min(*req.Position, len(list))
+		}
+		m.watchlist[userID] = slices.Insert(list, target, e)
+		return target, nil
+	}
+
+	e := list[current]
+	req.apply(&e)
+	target := current
+	if req.Position != nil {
+		target = min(*req.Position, len(list)-1)
+	}
+	list = slices.Delete(list, current, current+1)
+	m.watchlist[userID] = slices.Insert(list, target, e)
+	return target, nil
+}
+
+func (m *memoryStore) RemoveWatchlistEntry(ctx context.Context, userID, filmID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.removeFromWatchlist(userID, filmID); !ok {
+		return errNotFound
+	}
+	return nil
+}
+
+// --- Feedback ---
+
+func (m *memoryStore) Feedback(ctx context.Context, userID string) ([]FeedbackEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := []FeedbackEntry{}
+	for _, e := range m.feedback[userID] {
+		entries = append(entries, e)
+	}
+	slices.SortFunc(entries, func(a, b FeedbackEntry) int {
+		return cmp.Or(b.CreatedAt.Compare(a.CreatedAt), cmp.Compare(a.FilmID, b.FilmID))
+	})
+	return entries, nil
+}
+
+func (m *memoryStore) PutFeedback(ctx context.Context, userID string, e FeedbackEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.feedback[userID] == nil {
+		m.feedback[userID] = map[string]FeedbackEntry{}
+	}
+	e.FilmTags = append([]string{}, e.FilmTags...)
+	e.CreatedAt = m.now()
+	m.feedback[userID][e.FilmID] = e
+	return nil
+}
+
+func (m *memoryStore) DeleteFeedback(ctx context.Context, userID, filmID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.feedback[userID][filmID]; !ok {
+		return errNotFound
+	}
+	delete(m.feedback[userID], filmID)
+	return nil
+}
+
+// --- Search log ---
+
+func (m *memoryStore) AddSearchLogs(ctx context.Context, entries []SearchLogEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range entries {
+		e.Time = e.Time.UTC().Truncate(time.Second)
+		e.TopHits = append([]string{}, e.TopHits...)
+		e.Preferences = append([]Preference{}, e.Preferences...)
+		e.Experiments = maps.Clone(e.Experiments)
+		m.searchLog = append(m.searchLog, e)
+	}
+	return nil
+}
+
+func (m *memoryStore) SearchAnalytics(ctx context.Context, since time.Time, limit int) (SearchAnalytics, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a := SearchAnalytics{Since: since.UTC().Truncate(time.Second)}
+	queries := map[string]int{}
+	zeroQueries := map[string]int{}
+	users := map[string]int{}
+	var latency time.Duration
+	for _, e := range m.searchLog {
+		if e.Time.Before(a.Since) {
+			continue
+		}
+		a.TotalSearches++
+		latency += e.Latency
+		if e.TotalCount == 0 {
+			a.ZeroResultSearches++
+		}
+		if e.Query != "*" {
+			queries[e.Query]++
+			if e.TotalCount == 0 {
+				zeroQueries[e.Query]++
+			}
+		}
+		if e.UserID != "" {
+			users[e.UserID]++
+		}
+	}
+	if a.TotalSearches > 0 {
+		a.AverageLatencyMs = round2(float64(latency) / float64(time.Millisecond) / float64(a.TotalSearches))
+	}
+	a.TopQueries = sortedCounts(queries, limit)
+	a.ZeroResultQueries = sortedCounts(zeroQueries, limit)
+	a.QueriesPerUser = sortedCounts(users, limit)
+	return a, nil
+}
+
+func (m *memoryStore) PruneSearchLog(ctx context.Context, cutoff time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.searchLog[:0]
+	for _, e := range m.searchLog {
+		if !e.Time.Before(cutoff.Truncate(time.Second)) {
+			kept = append(kept, e)
+		}
+	}
+	n := len(m.searchLog) - len(kept)
+	m.searchLog = kept
+
+	keptEvents := m.events[:0]
+	for _, e := range m.events {
+		if !e.Time.Before(cutoff.Truncate(time.Second)) {
+			keptEvents = append(keptEvents, e)
+		}
+	}
+	m.events = keptEvents
+	return n, nil
+}
+
+// --- Search events ---
+
+func (m *memoryStore) AddEvents(ctx context.Context, events []SearchEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range events {
+		e.Time = e.Time.UTC().Truncate(time.Second)
+		m.events = append(m.events, e)
+	}
+	return nil
+}
+
+func (m *memoryStore) LabeledQueries(ctx context.Context, since time.Time) ([]LabeledQuery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	byQuery := map[string][]SearchEvent{}
+	for _, e := range m.events {
+		byQuery[e.QueryID] = append(byQuery[e.QueryID], e)
+	}
+
+	queries := []LabeledQuery{}
+	for _, l := range m.searchLog {
+		events := byQuery[l.QueryID]
+		if l.QueryID == "" || len(events) == 0 || l.Time.Before(since.Truncate(time.Second)) {
+			continue
+		}
+		q := LabeledQuery{
+			QueryID:     l.QueryID,
+			Query:       l.Query,
+			UserID:      l.UserID,
+			Preferences: append([]Preference{}, l.Preferences...),
+			Time:        l.Time,
+		}
+		for _, e := range events {
+			q.addEvent(e.Type, e.FilmID, e.Position)
+		}
+		q.sortFilms()
+		queries = append(queries, q)
+	}
+	slices.SortStableFunc(queries, func(a, b LabeledQuery) int { return a.Time.Compare(b.Time) })
+	return queries, nil
+}
+
+func (m *memoryStore) VariantOutcomes(ctx context.Context, experiment string, since time.Time) ([]VariantOutcome, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	since = since.Truncate(time.Second)
+	byQuery := map[string][]SearchEvent{}
+	for _, e := range m.events {
+		if !e.Time.Before(since) {
+			byQuery[e.QueryID] = append(byQuery[e.QueryID], e)
+		}
+	}
+
+	outcomes := map[string]*VariantOutcome{}
+	type userFilm struct{ variant, userID, filmID string }
+	engaged := map[userFilm]bool{}
+	for _, l := range m.searchLog {
+		variant, ok := l.Experiments[experiment]
+		if !ok || l.Time.Before(since) {
+			continue
+		}
+		o := outcomes[variant]
+		if o == nil {
+			o = &VariantOutcome{Variant: variant}
+			outcomes[variant] = o
+		}
+		o.Searches++
+		clicked := false
+		for _, e := range byQuery[l.QueryID] {
+			switch e.Type {
+			case EventImpression:
+				o.Impressions++
+			case EventClick:
+				o.Clicks++
+			case EventPlay:
+				o.Plays++
+			}
+			if e.Type != EventImpression {
+				clicked = true
+				if l.UserID != "" {
+					engaged[userFilm{variant, l.UserID, e.FilmID}] = true
+				}
+			}
+		}
+		if clicked {
+			o.ClickedSearches++
+		}
+	}
+
+	ratingSums := map[string]int{}
+	for uf := range engaged {
+		for _, h := range m.history[uf.userID] {
+			if h.FilmID == uf.filmID {
+				outcomes[uf.variant].Ratings++
+				ratingSums[uf.variant] += h.UserRating
+			}
+		}
+	}
+
+	result := []VariantOutcome{}
+	for _, o := range outcomes {
+		if o.Ratings > 0 {
+			o.AverageRating = round2(float64(ratingSums[o.Variant]) / float64(o.Ratings))
+		}
+		result = append(result, *o)
+	}
+	slices.SortFunc(result, func(a, b VariantOutcome) int { return strings.Compare(a.Variant, b.Variant) })
+	return result, nil
+}
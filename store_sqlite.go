@@ -0,0 +1,702 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// --- SQLite store ---
+
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func newSQLiteStore(db *sql.DB) *sqliteStore {
+	return &sqliteStore{db: db}
+}
+
+// openSQLiteStore opens the database at dsn and brings its schema up to date.
+func openSQLiteStore(dsn string) (*sqliteStore, error) {
+	conn, err := openDB(dsn)
+	if err != nil {
+		return nil, err
+	}
+	n, err := migrateUp(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if n > 0 {
+		slog.Info("Applied database migrations", "count", n)
+	}
+	return newSQLiteStore(conn), nil
+}
+
+func (s *sqliteStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) &&
+		(sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY || sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE)
+}
+
+// --- Users ---
+
+func (s *sqliteStore) ListUsers(ctx context.Context) ([]User, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, name FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Name); err != nil {
+			slog.Error("Failed to scan user row", "error", err)
+			continue
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (s *sqliteStore) UserExists(ctx context.Context, userID string) (bool, error) {
+	var exists int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE id = ?", userID).Scan(&exists)
+	return exists > 0, err
+}
+
+func (s *sqliteStore) CreateUser(ctx context.Context, u User) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO users (id, name) VALUES (?, ?)", u.ID, u.Name)
+	if isUniqueViolation(err) {
+		return errUserExists
+	}
+	return err
+}
+
+// --- Accounts ---
+
+func (s *sqliteStore) CreateAccount(ctx context.Context, u User, c Credentials) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO users (id, name) VALUES (?, ?)", u.ID, u.Name); err != nil {
+		if isUniqueViolation(err) {
+			return errUserExists
+		}
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO user_credentials (user_id, password_hash, role) VALUES (?, ?, ?)",
+		u.ID, c.PasswordHash, c.Role); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Credentials(ctx context.Context, userID string) (Credentials, error) {
+	c := Credentials{UserID: userID}
+	err := s.db.QueryRowContext(ctx, "SELECT password_hash, role FROM user_credentials WHERE user_id = ?", userID).
+		Scan(&c.PasswordHash, &c.Role)
+	if err == sql.ErrNoRows {
+		return Credentials{}, errNotFound
+	}
+	return c, err
+}
+
+func (s *sqliteStore) SetCredentials(ctx context.Context, c Credentials, setRole bool) error {
+	query := `INSERT INTO user_credentials (user_id, password_hash, role) VALUES (?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET password_hash = excluded.password_hash`
+	if setRole {
+		query += ", role = excluded.role"
+	}
+	_, err := s.db.ExecContext(ctx, query, c.UserID, c.PasswordHash, c.Role)
+	return err
+}
+
+func (s *sqliteStore) CreateSession(ctx context.Context, tokenHash, userID string, expiresAt time.Time) error {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE expires_at < ?", time.Now().Unix()); err != nil {
+		slog.Warn("Failed to prune expired sessions", "error", err)
+	}
+	_, err := s.db.ExecContext(ctx, "INSERT INTO sessions (token_hash, user_id, expires_at) VALUES (?, ?, ?)",
+		tokenHash, userID, expiresAt.Unix())
+	return err
+}
+
+func (s *sqliteStore) Session(ctx context.Context, tokenHash string) (Session, error) {
+	var sess Session
+	var expiresAt int64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT s.user_id, COALESCE(c.role, ?), s.expires_at
+		FROM sessions s LEFT JOIN user_credentials c ON c.user_id = s.user_id
+		WHERE s.token_hash = ?`,
+		RoleUser, tokenHash,
+	).Scan(&sess.UserID, &sess.Role, &expiresAt)
+	if err == sql.ErrNoRows {
+		return Session{}, errNotFound
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	sess.ExpiresAt = time.Unix(expiresAt, 0).UTC()
+	return sess, nil
+}
+
+func (s *sqliteStore) DeleteSession(ctx context.Context, tokenHash string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE token_hash = ?", tokenHash)
+	return err
+}
+
+func (s *sqliteStore) DeleteUserSessions(ctx context.Context, userID string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE user_id = ?", userID)
+	return err
+}
+
+// --- Preferences ---
+
+func (s *sqliteStore) Preferences(ctx context.Context, userID string) ([]Preference, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT pref_type, pref_value, pref_state FROM user_preferences WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prefs := []Preference{}
+	for rows.Next() {
+		var p Preference
+		if err := rows.Scan(&p.Type, &p.Value, &p.State); err != nil {
+			slog.Error("Failed to scan preference row", "user_id", userID, "error", err)
+			continue
+		}
+		prefs = append(prefs, p)
+	}
+	return prefs, rows.Err()
+}
+
+func (s *sqliteStore) ReplacePreferences(ctx context.Context, userID string, prefs []Preference) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM user_preferences WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for _, p := range prefs {
+		if _, err := tx.Exec("INSERT INTO user_preferences (user_id, pref_type, pref_value, pref_state) VALUES (?, ?, ?, ?)",
+			userID, p.Type, p.Value, p.State); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// --- Watch history ---
+
+func (s *sqliteStore) WatchHistory(ctx context.Context, userID string) ([]WatchHistoryEntry, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT film_id, film_title, film_genre, film_year, film_tags, user_rating FROM watch_history WHERE user_id = ? ORDER BY id DESC",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []WatchHistoryEntry{}
+	for rows.Next() {
+		var e WatchHistoryEntry
+		var tagsJSON string
+		if err := rows.Scan(&e.FilmID, &e.FilmTitle, &e.FilmGenre, &e.FilmYear, &tagsJSON, &e.UserRating); err != nil {
+			slog.Error("Failed to scan history row", "user_id", userID, "error", err)
+			continue
+		}
+		if err := json.Unmarshal([]byte(tagsJSON), &e.FilmTags); err != nil || e.FilmTags == nil {
+			e.FilmTags = []string{}
+		}
+		history = append(history, e)
+	}
+	return history, rows.Err()
+}
+
+func (s *sqliteStore) AddWatch(ctx context.Context, userID string, e WatchHistoryEntry) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	tagsJSON, _ := json.Marshal(e.FilmTags)
+	if _, err := tx.Exec(
+		"INSERT INTO watch_history (user_id, film_id, film_title, film_genre, film_year, film_tags, user_rating) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		userID, e.FilmID, e.FilmTitle, e.FilmGenre, e.FilmYear, string(tagsJSON), e.UserRating,
+	); err != nil {
+		return err
+	}
+	// A watched film no longer belongs on the watchlist
+	if _, err := removeFromWatchlist(tx, userID, e.FilmID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// --- Watchlist ---
+
+func (s *sqliteStore) Watchlist(ctx context.Context, userID string) ([]WatchlistEntry, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT film_id, film_title, film_genre, film_year, note, position, added_at FROM watchlist WHERE user_id = ? ORDER BY position",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []WatchlistEntry{}
+	for rows.Next() {
+		var e WatchlistEntry
+		var addedAt int64
+		if err := rows.Scan(&e.FilmID, &e.FilmTitle, &e.FilmGenre, &e.FilmYear, &e.Note, &e.Position, &addedAt); err != nil {
+			slog.Error("Failed to scan watchlist row", "user_id", userID, "error", err)
+			continue
+		}
+		e.AddedAt = time.Unix(addedAt, 0).UTC()
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// renumberWatchlist rewrites positions as 0..n-1 in the current order, closing
+// any gaps left by removals.
+func renumberWatchlist(tx *sql.Tx, userID string) error {
+	rows, err := tx.Query("SELECT id FROM watchlist WHERE user_id = ? ORDER BY position, id", userID)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i, id := range ids {
+		if _, err := tx.Exec("UPDATE watchlist SET position = ? WHERE id = ?", i, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeFromWatchlist drops a film from a user's watchlist and reports
+// whether it was listed.
+func removeFromWatchlist(tx *sql.Tx, userID, filmID string) (bool, error) {
+	res, err := tx.Exec("DELETE FROM watchlist WHERE user_id = ? AND film_id = ?", userID, filmID)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	return true, renumberWatchlist(tx, userID)
+}
+
+func (s *sqliteStore) PutWatchlistEntry(ctx context.Context, userID string, req AddWatchlistRequest) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM watchlist WHERE user_id = ?", userID).Scan(&count); err != nil {
+		return 0, err
+	}
+
+	var current int
+	err = tx.QueryRow("SELECT position FROM watchlist WHERE user_id = ? AND film_id = ?", userID, req.FilmID).Scan(&current)
+	if err == sql.ErrNoRows {
+		target := count
+		if req.Position != nil {
+			target = min(*req.Position, count)
+		}
+		var e WatchlistEntry
+		req.apply(&e)
+		if _, err := tx.Exec("UPDATE watchlist SET position = position + 1 WHERE user_id = ? AND position >= ?", userID, target); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(
+			"INSERT INTO watchlist (user_id, film_id, film_title, film_genre, film_year, note, position, added_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			userID, e.FilmID, e.FilmTitle, e.FilmGenre, e.FilmYear, e.Note, target, time.Now().Unix(),
+		); err != nil {
+			return 0, err
+		}
+		return target, tx.Commit()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Listed films are updated in place; moving one shifts the films in
+	// between by one towards its old slot.
+	target := current
+	if req.Position != nil {
+		target = min(*req.Position, count-1)
+	}
+	switch {
+	case target < current:
+		_, err = tx.Exec("UPDATE watchlist SET position = position + 1 WHERE user_id = ? AND position >= ? AND position < ?", userID, target, current)
+	case target > current:
+		_, err = tx.Exec("UPDATE watchlist SET position = position - 1 WHERE user_id = ? AND position > ? AND position <= ?", userID, current, target)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(
+		`UPDATE watchlist SET film_title = COALESCE(?, film_title), film_genre = COALESCE(?, film_genre),
+			film_year = COALESCE(?, film_year), note = COALESCE(?, note), position = ?
+		WHERE user_id = ? AND film_id = ?`,
+		req.FilmTitle, req.FilmGenre, req.FilmYear, req.Note, target, userID, req.FilmID,
+	); err != nil {
+		return 0, err
+	}
+	return target, tx.Commit()
+}
+
+func (s *sqliteStore) RemoveWatchlistEntry(ctx context.Context, userID, filmID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	removed, err := removeFromWatchlist(tx, userID, filmID)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return errNotFound
+	}
+	return tx.Commit()
+}
+
+// --- Feedback ---
+
+func (s *sqliteStore) Feedback(ctx context.Context, userID string) ([]FeedbackEntry, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT film_id, action, film_title, film_genre, film_director, film_tags, created_at FROM film_feedback WHERE user_id = ? ORDER BY created_at DESC, film_id",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []FeedbackEntry{}
+	for rows.Next() {
+		var e FeedbackEntry
+		var tagsJSON string
+		var createdAt int64
+		if err := rows.Scan(&e.FilmID, &e.Action, &e.FilmTitle, &e.FilmGenre, &e.FilmDirector, &tagsJSON, &createdAt); err != nil {
+			slog.Error("Failed to scan feedback row", "user_id", userID, "error", err)
+			continue
+		}
+		if err := json.Unmarshal([]byte(tagsJSON), &e.FilmTags); err != nil || e.FilmTags == nil {
+			e.FilmTags = []string{}
+		}
+		e.CreatedAt = time.Unix(createdAt, 0).UTC()
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (s *sqliteStore) PutFeedback(ctx context.Context, userID string, e FeedbackEntry) error {
+	if e.FilmTags == nil {
+		e.FilmTags = []string{}
+	}
+	tagsJSON, _ := json.Marshal(e.FilmTags)
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO film_feedback (user_id, film_id, action, film_title, film_genre, film_director, film_tags, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, film_id) DO UPDATE SET
+			action = excluded.action, film_title = excluded.film_title, film_genre = excluded.film_genre,
+			film_director = excluded.film_director, film_tags = excluded.film_tags, created_at = excluded.created_at`,
+		userID, e.FilmID, e.Action, e.FilmTitle, e.FilmGenre, e.FilmDirector, string(tagsJSON), time.Now().Unix(),
+	)
+	return err
+}
+
+func (s *sqliteStore) DeleteFeedback(ctx context.Context, userID, filmID string) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM film_feedback WHERE user_id = ? AND film_id = ?", userID, filmID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// --- Search log ---
+
+func (s *sqliteStore) AddSearchLogs(ctx context.Context, entries []SearchLogEntry) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO search_log (created_at, query_id, api, query, user_id, preferences, experiments, filters, total_count, latency_ms, top_hits)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, e := range entries {
+		if e.TopHits == nil {
+			e.TopHits = []string{}
+		}
+		if e.Preferences == nil {
+			e.Preferences = []Preference{}
+		}
+		if e.Experiments == nil {
+			e.Experiments = map[string]string{}
+		}
+		prefsJSON, _ := json.Marshal(e.Preferences)
+		experimentsJSON, _ := json.Marshal(e.Experiments)
+		filtersJSON, _ := json.Marshal(e.Filters)
+		hitsJSON, _ := json.Marshal(e.TopHits)
+		latencyMs := float64(e.Latency) / float64(time.Millisecond)
+		if _, err := stmt.ExecContext(ctx, e.Time.Unix(), e.QueryID, e.API, e.Query, e.UserID, string(prefsJSON), string(experimentsJSON), string(filtersJSON),
+			e.TotalCount, latencyMs, string(hitsJSON)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) SearchAnalytics(ctx context.Context, since time.Time, limit int) (SearchAnalytics, error) {
+	a := SearchAnalytics{Since: since.UTC().Truncate(time.Second)}
+	from := since.Unix()
+
+	err := s.db.QueryRowContext(ctx,
+		"SELECT COUNT(*), COALESCE(SUM(total_count = 0), 0), COALESCE(AVG(latency_ms), 0) FROM search_log WHERE created_at >= ?",
+		from,
+	).Scan(&a.TotalSearches, &a.ZeroResultSearches, &a.AverageLatencyMs)
+	if err != nil {
+		return a, err
+	}
+	a.AverageLatencyMs = round2(a.AverageLatencyMs)
+
+	if a.TopQueries, err = s.countSearchLog(ctx, "query", "query != '*'", from, limit); err != nil {
+		return a, err
+	}
+	if a.ZeroResultQueries, err = s.countSearchLog(ctx, "query", "query != '*' AND total_count = 0", from, limit); err != nil {
+		return a, err
+	}
+	if a.QueriesPerUser, err = s.countSearchLog(ctx, "user_id", "user_id != ''", from, limit); err != nil {
+		return a, err
+	}
+	return a, nil
+}
+
+// countSearchLog counts entries since from by column, most frequent first.
+// column and cond are constants from SearchAnalytics, never user input.
+func (s *sqliteStore) countSearchLog(ctx context.Context, column, cond string, from int64, limit int) ([]CountStat, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+column+", COUNT(*) AS n FROM search_log WHERE created_at >= ? AND "+cond+
+			" GROUP BY "+column+" ORDER BY n DESC, "+column+" LIMIT ?",
+		from, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []CountStat{}
+	for rows.Next() {
+		var c CountStat
+		if err := rows.Scan(&c.Value, &c.Count); err != nil {
+			return nil, err
+		}
+		stats = append(stats, c)
+	}
+	return stats, rows.Err()
+}
+
+func (s *sqliteStore) PruneSearchLog(ctx context.Context, cutoff time.Time) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM search_log WHERE created_at < ?", cutoff.Unix())
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM search_events WHERE created_at < ?", cutoff.Unix()); err != nil {
+		return 0, err
+	}
+	return int(n), tx.Commit()
+}
+
+// --- Search events ---
+
+func (s *sqliteStore) AddEvents(ctx context.Context, events []SearchEvent) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO search_events (query_id, type, film_id, position, created_at) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, e := range events {
+		if _, err := stmt.ExecContext(ctx, e.QueryID, e.Type, e.FilmID, e.Position, e.Time.Unix()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) LabeledQueries(ctx context.Context, since time.Time) ([]LabeledQuery, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT l.query_id, l.query, l.user_id, l.preferences, l.created_at, e.type, e.film_id, e.position
+		FROM search_log l JOIN search_events e ON e.query_id = l.query_id
+		WHERE l.created_at >= ? AND l.query_id != ''
+		ORDER BY l.created_at, l.id, e.id`,
+		since.Unix(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queries := []LabeledQuery{}
+	for rows.Next() {
+		var q LabeledQuery
+		var prefsJSON, eventType, filmID string
+		var createdAt int64
+		var position int
+		if err := rows.Scan(&q.QueryID, &q.Query, &q.UserID, &prefsJSON, &createdAt, &eventType, &filmID, &position); err != nil {
+			return nil, err
+		}
+		if n := len(queries); n == 0 || queries[n-1].QueryID != q.QueryID {
+			if err := json.Unmarshal([]byte(prefsJSON), &q.Preferences); err != nil || q.Preferences == nil {
+				q.Preferences = []Preference{}
+			}
+			q.Time = time.Unix(createdAt, 0).UTC()
+			queries = append(queries, q)
+		}
+		queries[len(queries)-1].addEvent(eventType, filmID, position)
+	}
+	for i := range queries {
+		queries[i].sortFilms()
+	}
+	return queries, rows.Err()
+}
+
+// VariantOutcomes reads the variant from the experiments column with
+// json_extract. Experiment names are validated to letters, digits, '-' and
+// '_', so quoting them in the JSON path is enough.
+func (s *sqliteStore) VariantOutcomes(ctx context.Context, experiment string, since time.Time) ([]VariantOutcome, error) {
+	path := `$."` + experiment + `"`
+	from := since.Unix()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT l.variant, COUNT(*),
+			COALESCE(SUM(e.clicks + e.plays > 0), 0),
+			COALESCE(SUM(e.impressions), 0), COALESCE(SUM(e.clicks), 0), COALESCE(SUM(e.plays), 0)
+		FROM (
+			SELECT query_id, json_extract(experiments, ?) AS variant
+			FROM search_log WHERE created_at >= ?
+		) l
+		LEFT JOIN (
+			SELECT query_id, SUM(type = 'impression') AS impressions, SUM(type = 'click') AS clicks, SUM(type = 'play') AS plays
+			FROM search_events WHERE created_at >= ? GROUP BY query_id
+		) e ON e.query_id = l.query_id AND l.query_id != ''
+		WHERE l.variant IS NOT NULL
+		GROUP BY l.variant ORDER BY l.variant`,
+		path, from, from,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	outcomes := []VariantOutcome{}
+	for rows.Next() {
+		var o VariantOutcome
+		if err := rows.Scan(&o.Variant, &o.Searches, &o.ClickedSearches, &o.Impressions, &o.Clicks, &o.Plays); err != nil {
+			return nil, err
+		}
+		outcomes = append(outcomes, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Each clicked or played film counts once per variant and user
+	rows, err = s.db.QueryContext(ctx, `
+		SELECT c.variant, COUNT(*), AVG(h.user_rating)
+		FROM (
+			SELECT DISTINCT json_extract(l.experiments, ?) AS variant, l.user_id, e.film_id
+			FROM search_log l JOIN search_events e ON e.query_id = l.query_id
+			WHERE l.created_at >= ? AND e.created_at >= ? AND l.user_id != '' AND l.query_id != ''
+				AND e.type IN ('click', 'play')
+		) c
+		JOIN watch_history h ON h.user_id = c.user_id AND h.film_id = c.film_id
+		WHERE c.variant IS NOT NULL
+		GROUP BY c.variant`,
+		path, from, from,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var variant string
+		var n int
+		var avg float64
+		if err := rows.Scan(&variant, &n, &avg); err != nil {
+			return nil, err
+		}
+		for i := range outcomes {
+			if outcomes[i].Variant == variant {
+				outcomes[i].Ratings = n
+				outcomes[i].AverageRating = round2(avg)
+			}
+		}
+	}
+	return outcomes, rows.Err()
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storeBackends runs fn against every Store implementation so both backends
+// are held to the same contract.
+func storeBackends(t *testing.T, fn func(t *testing.T, store Store)) {
+	t.Run("sqlite", func(t *testing.T) {
+		dsn := fmt.Sprintf("file:test-%d?mode=memory&cache=shared", testDBCount.Add(1))
+		testDB, err := sql.Open("sqlite", dsn)
+		if err != nil {
+			t.Fatalf("failed to open in-memory db: %v", err)
+		}
+		if _, err := migrateUp(testDB); err != nil {
+			t.Fatalf("failed to apply migrations: %v", err)
+		}
+		store := newSQLiteStore(testDB)
+		t.Cleanup(func() { store.Close() })
+		fn(t, store)
+	})
+	t.Run("memory", func(t *testing.T) {
+		fn(t, newMemoryStore())
+	})
+}
+
+func TestStoreUsers(t *testing.T) {
+	storeBackends(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		store.CreateUser(ctx, User{ID: "2", Name: "Bob"})
+		store.CreateUser(ctx, User{ID: "1", Name: "Alice"})
+
+		if err := store.CreateUser(ctx, User{ID: "1", Name: "Again"}); !errors.Is(err, errUserExists) {
+			t.Errorf("expected errUserExists for duplicate ID, got %v", err)
+		}
+		users, err := store.ListUsers(ctx)
+		if err != nil {
+			t.Fatalf("ListUsers failed: %v", err)
+		}
+		if len(users) != 2 || users[0] != (User{ID: "1", Name: "Alice"}) || users[1].ID != "2" {
+			t.Errorf("expected users ordered by ID, got %+v", users)
+		}
+		if ok, _ := store.UserExists(ctx, "2"); !ok {
+			t.Error("user 2 should exist")
+		}
+		if ok, _ := store.UserExists(ctx, "3"); ok {
+			t.Error("user 3 should not exist")
+		}
+	})
+}
+
+func TestStoreAccounts(t *testing.T) {
+	storeBackends(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+
+		if err := store.CreateAccount(ctx, User{ID: "1", Name: "Alice"}, Credentials{PasswordHash: "h1", Role: RoleUser}); err != nil {
+			t.Fatalf("CreateAccount failed: %v", err)
+		}
+		if err := store.CreateAccount(ctx, User{ID: "1", Name: "Alice"}, Credentials{PasswordHash: "h1", Role: RoleUser}); !errors.Is(err, errUserExists) {
+			t.Errorf("expected errUserExists, got %v", err)
+		}
+		if _, err := store.Credentials(ctx, "2"); !errors.Is(err, errNotFound) {
+			t.Errorf("expected errNotFound for user without credentials, got %v", err)
+		}
+
+		// Without setRole only the hash changes
+		store.SetCredentials(ctx, Credentials{UserID: "1", PasswordHash: "h2", Role: RoleAdmin}, false)
+		c, _ := store.Credentials(ctx, "1")
+		if c.PasswordHash != "h2" || c.Role != RoleUser {
+			t.Errorf("expected hash h2 and role user, got %+v", c)
+		}
+		store.SetCredentials(ctx, Credentials{UserID: "1", PasswordHash: "h3", Role: RoleAdmin}, true)
+		c, _ = store.Credentials(ctx, "1")
+		if c.PasswordHash != "h3" || c.Role != RoleAdmin {
+			t.Errorf("expected hash h3 and role admin, got %+v", c)
+		}
+
+		expires := time.Now().Add(time.Hour)
+		store.CreateSession(ctx, "token", "1", expires)
+		sess, err := store.Session(ctx, "token")
+		if err != nil {
+			t.Fatalf("Session failed: %v", err)
+		}
+		if sess.UserID != "1" || sess.Role != RoleAdmin || sess.ExpiresAt.Unix() != expires.Unix() {
+			t.Errorf("unexpected session: %+v", sess)
+		}
+
+		store.DeleteSession(ctx, "token")
+		if _, err := store.Session(ctx, "token"); !errors.Is(err, errNotFound) {
+			t.Errorf("expected errNotFound after delete, got %v", err)
+		}
+
+		// Expired sessions are pruned when the next one is created
+		store.CreateSession(ctx, "old", "1", time.Now().Add(-time.Hour))
+		store.CreateSession(ctx, "new", "1", expires)
+		if _, err := store.Session(ctx, "old"); !errors.Is(err, errNotFound) {
+			t.Errorf("expected expired session to be pruned, got %v", err)
+		}
+
+		store.CreateSession(ctx, "other", "2", expires)
+		store.DeleteUserSessions(ctx, "1")
+		if _, err := store.Session(ctx, "new"); !errors.Is(err, errNotFound) {
+			t.Errorf("expected user 1's sessions to be deleted, got %v", err)
+		}
+		if _, err := store.Session(ctx, "other"); err != nil {
+			t.Errorf("expected other users' sessions to be kept, got %v", err)
+		}
+	})
+}
+
+func TestStorePreferences(t *testing.T) {
+	storeBackends(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		store.CreateUser(ctx, User{ID: "1", Name: "Alice"})
+
+		store.ReplacePreferences(ctx, "1", []Preference{
+			{Type: "genre", Value: "Action", State: "like"},
+			{Type: "tag", Value: "classic", State: "dislike"},
+		})
+		store.ReplacePreferences(ctx, "1", []Preference{{Type: "genre", Value: "Drama", State: "like"}})
+
+		prefs, err := store.Preferences(ctx, "1")
+		if err != nil {
+			t.Fatalf("Preferences failed: %v", err)
+		}
+		if len(prefs) != 1 || prefs[0].Value != "Drama" {
+			t.Errorf("expected preferences to be replaced, got %+v", prefs)
+		}
+	})
+}
+
+func TestStoreHistoryAndWatchlist(t *testing.T) {
+	storeBackends(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		store.CreateUser(ctx, User{ID: "1", Name: "Alice"})
+
+		put := func(filmID string, position *int) int {
+			t.Helper()
+			title := "Film " + filmID
+			pos, err := store.PutWatchlistEntry(ctx, "1", AddWatchlistRequest{FilmID: filmID, FilmTitle: &title, Position: position})
+			if err != nil {
+				t.Fatalf("PutWatchlistEntry(%s) failed: %v", filmID, err)
+			}
+			return pos
+		}
+		order := func() string {
+			t.Helper()
+			entries, err := store.Watchlist(ctx, "1")
+			if err != nil {
+				t.Fatalf("Watchlist failed: %v", err)
+			}
+			var ids []string
+			for i, e := range entries {
+				if e.Position != i {
+					t.Errorf("entry %s has position %d, want %d", e.FilmID, e.Position, i)
+				}
+				ids = append(ids, e.FilmID)
+			}
+			return strings.Join(ids, ",")
+		}
+
+		put("a", nil)
+		put("b", nil)
+		put("c", nil)
+		zero, far := 0, 99
+		if pos := put("c", &zero); pos != 0 {
+			t.Errorf("expected c moved to 0, got %d", pos)
+		}
+		if pos := put("d", &far); pos != 3 {
+			t.Errorf("expected position past the end to clamp to 3, got %d", pos)
+		}
+		if pos := put("a", nil); pos != 1 {
+			t.Errorf("expected updating a to keep its position 1, got %d", pos)
+		}
+		if got := order(); got != "c,a,b,d" {
+			t.Errorf("expected c,a,b,d, got %s", got)
+		}
+
+		// Moving a film keeps its note and when it was added
+		note, two := "with popcorn", 2
+		store.PutWatchlistEntry(ctx, "1", AddWatchlistRequest{FilmID: "c", Note: &note})
+		before, _ := store.Watchlist(ctx, "1")
+		if pos, err := store.PutWatchlistEntry(ctx, "1", AddWatchlistRequest{FilmID: "c", Position: &two}); err != nil || pos != 2 {
+			t.Fatalf("expected c moved to 2, got %d, %v", pos, err)
+		}
+		if got := order(); got != "a,b,c,d" {
+			t.Errorf("expected a,b,c,d, got %s", got)
+		}
+		after, _ := store.Watchlist(ctx, "1")
+		if moved := after[2]; moved.FilmTitle != "Film c" || moved.Note != note || !moved.AddedAt.Equal(before[0].AddedAt) {
+			t.Errorf("expected c to keep its fields, got %+v (was %+v)", moved, before[0])
+		}
+		zero = 0
+		store.PutWatchlistEntry(ctx, "1", AddWatchlistRequest{FilmID: "c", Position: &zero})
+		if got := order(); got != "c,a,b,d" {
+			t.Errorf("expected c,a,b,d, got %s", got)
+		}
+
+		if err := store.RemoveWatchlistEntry(ctx, "1", "a"); err != nil {
+			t.Fatalf("RemoveWatchlistEntry failed: %v", err)
+		}
+		if err := store.RemoveWatchlistEntry(ctx, "1", "a"); !errors.Is(err, errNotFound) {
+			t.Errorf("expected errNotFound for unlisted film, got %v", err)
+		}
+
+		// Watching a film takes it off the watchlist
+		store.AddWatch(ctx, "1", WatchHistoryEntry{FilmID: "b", FilmTitle: "Film b", UserRating: 4})
+		store.AddWatch(ctx, "1", WatchHistoryEntry{FilmID: "x", FilmTitle: "Film x", FilmTags: []string{"indie"}, UserRating: 2})
+		if got := order(); got != "c,d" {
+			t.Errorf("expected c,d after watching b, got %s", got)
+		}
+
+		history, err := store.WatchHistory(ctx, "1")
+		if err != nil {
+			t.Fatalf("WatchHistory failed: %v", err)
+		}
+		if len(history) != 2 || history[0].FilmID != "x" || history[1].FilmID != "b" {
+			t.Fatalf("expected history newest first, got %+v", history)
+		}
+		if history[1].FilmTags == nil || len(history[0].FilmTags) != 1 {
+			t.Errorf("expected tags to round-trip as non-nil slices, got %+v", history)
+		}
+	})
+}
+
+func TestStoreFeedback(t *testing.T) {
+	storeBackends(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		store.CreateUser(ctx, User{ID: "1", Name: "Alice"})
+
+		store.PutFeedback(ctx, "1", FeedbackEntry{FilmID: "b", Action: FeedbackHide})
+		store.PutFeedback(ctx, "1", FeedbackEntry{FilmID: "a", Action: FeedbackHide})
+		store.PutFeedback(ctx, "1", FeedbackEntry{FilmID: "a", Action: FeedbackNotInterested, FilmTags: []string{"sequel"}})
+
+		entries, err := store.Feedback(ctx, "1")
+		if err != nil {
+			t.Fatalf("Feedback failed: %v", err)
+		}
+		if len(entries) != 2 || entries[0].FilmID != "a" || entries[1].FilmID != "b" {
+			t.Fatalf("expected one entry per film ordered a,b, got %+v", entries)
+		}
+		if entries[0].Action != FeedbackNotInterested || len(entries[0].FilmTags) != 1 {
+			t.Errorf("expected a to be replaced, got %+v", entries[0])
+		}
+
+		if err := store.DeleteFeedback(ctx, "1", "a"); err != nil {
+			t.Fatalf("DeleteFeedback failed: %v", err)
+		}
+		if err := store.DeleteFeedback(ctx, "1", "a"); !errors.Is(err, errNotFound) {
+			t.Errorf("expected errNotFound, got %v", err)
+		}
+	})
+}
+
+func TestStoreSearchLog(t *testing.T) {
+	storeBackends(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		now := time.Now()
+		old := now.Add(-48 * time.Hour)
+		err := store.AddSearchLogs(ctx, []SearchLogEntry{
+			{Time: old, API: "v1", Query: "matrix", TotalCount: 3, Latency: time.Second},
+			{Time: now, API: "v1", Query: "matrix", UserID: "1", TotalCount: 3, Latency: 10 * time.Millisecond, TopHits: []string{"42"}},
+			{Time: now, API: "v2", Query: "matrix", UserID: "2", TotalCount: 3, Latency: 20 * time.Millisecond},
+			{Time: now, API: "v2", Query: "zzz", UserID: "1", TotalCount: 0, Latency: 30 * time.Millisecond,
+				Filters: SearchFilters{ExcludeHidden: true, Limit: 10}},
+			{Time: now, API: "v1", Query: "*", UserID: "1", TotalCount: 0, Latency: 40 * time.Millisecond},
+		})
+		if err != nil {
+			t.Fatalf("AddSearchLogs failed: %v", err)
+		}
+
+		a, err := store.SearchAnalytics(ctx, now.Add(-time.Hour), 10)
+		if err != nil {
+			t.Fatalf("SearchAnalytics failed: %v", err)
+		}
+		if a.TotalSearches != 4 || a.ZeroResultSearches != 2 || a.AverageLatencyMs != 25 {
+			t.Errorf("unexpected totals: %+v", a)
+		}
+		if len(a.TopQueries) != 2 || a.TopQueries[0] != (CountStat{Value: "matrix", Count: 2}) {
+			t.Errorf("expected matrix first and * left out, got %+v", a.TopQueries)
+		}
+		if len(a.ZeroResultQueries) != 1 || a.ZeroResultQueries[0].Value != "zzz" {
+			t.Errorf("expected only zzz with zero results, got %+v", a.ZeroResultQueries)
+		}
+		if len(a.QueriesPerUser) != 2 || a.QueriesPerUser[0] != (CountStat{Value: "1", Count: 3}) {
+			t.Errorf("expected user 1 with 3 searches first, got %+v", a.QueriesPerUser)
+		}
+
+		a, _ = store.SearchAnalytics(ctx, now.Add(-time.Hour), 1)
+		if len(a.TopQueries) != 1 || len(a.QueriesPerUser) != 1 {
+			t.Errorf("expected top lists capped at 1, got %+v", a)
+		}
+
+		n, err := store.PruneSearchLog(ctx, now.Add(-24*time.Hour))
+		if err != nil || n != 1 {
+			t.Fatalf("PruneSearchLog = %d, %v; want 1", n, err)
+		}
+		a, _ = store.SearchAnalytics(ctx, old.Add(-time.Hour), 10)
+		if a.TotalSearches != 4 {
+			t.Errorf("expected 4 searches after pruning, got %d", a.TotalSearches)
+		}
+	})
+}
+
+func TestStoreEvents(t *testing.T) {
+	storeBackends(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		now := time.Now()
+		old := now.Add(-48 * time.Hour)
+		prefs := []Preference{{Type: PrefTypeGenre, Value: "Sci-Fi", State: PrefStateLike}}
+		err := store.AddSearchLogs(ctx, []SearchLogEntry{
+			{Time: old, QueryID: "q-old", API: "v2", Query: "heat"},
+			{Time: now, QueryID: "q-1", API: "v2", Query: "matrix", UserID: "1", Preferences: prefs},
+			{Time: now, QueryID: "q-2", API: "v1", Query: "alien"},
+			{Time: now, QueryID: "q-3", API: "v1", Query: "no events"},
+		})
+		if err != nil {
+			t.Fatalf("AddSearchLogs failed: %v", err)
+		}
+		err = store.AddEvents(ctx, []SearchEvent{
+			{QueryID: "q-old", Type: EventClick, FilmID: "7", Position: 0, Time: old},
+			{QueryID: "q-1", Type: EventImpression, FilmID: "42", Position: 1, Time: now},
+			{QueryID: "q-1", Type: EventImpression, FilmID: "43", Position: 0, Time: now},
+			{QueryID: "q-1", Type: EventClick, FilmID: "42", Position: 1, Time: now},
+			{QueryID: "q-1", Type: EventPlay, FilmID: "42", Position: 1, Time: now},
+			{QueryID: "q-2", Type: EventClick, FilmID: "9", Position: 3, Time: now},
+			{QueryID: "unknown", Type: EventClick, FilmID: "1", Position: 0, Time: now},
+		})
+		if err != nil {
+			t.Fatalf("AddEvents failed: %v", err)
+		}
+
+		queries, err := store.LabeledQueries(ctx, now.Add(-time.Hour))
+		if err != nil {
+			t.Fatalf("LabeledQueries failed: %v", err)
+		}
+		if len(queries) != 2 || queries[0].QueryID != "q-1" || queries[1].QueryID != "q-2" {
+			t.Fatalf("expected q-1 and q-2, got %+v", queries)
+		}
+		q := queries[0]
+		if q.Query != "matrix" || q.UserID != "1" || len(q.Preferences) != 1 || q.Preferences[0] != prefs[0] {
+			t.Errorf("unexpected query: %+v", q)
+		}
+		want := []LabeledFilm{
+			{FilmID: "43", Position: 0, Impressed: true},
+			{FilmID: "42", Position: 1, Impressed: true, Clicked: true, Played: true},
+		}
+		if !slices.Equal(q.Films, want) {
+			t.Errorf("Films = %+v, want %+v", q.Films, want)
+		}
+		if q.Films[0].Label() != 0 || q.Films[1].Label() != 2 || queries[1].Films[0].Label() != 1 {
+			t.Errorf("unexpected labels: %+v, %+v", q.Films, queries[1].Films)
+		}
+
+		if _, err := store.PruneSearchLog(ctx, now.Add(-24*time.Hour)); err != nil {
+			t.Fatalf("PruneSearchLog failed: %v", err)
+		}
+		// q-old's search is gone; logging it again must not revive its events
+		store.AddSearchLogs(ctx, []SearchLogEntry{{Time: now, QueryID: "q-old", API: "v2", Query: "heat"}})
+		queries, _ = store.LabeledQueries(ctx, old.Add(-time.Hour))
+		for _, q := range queries {
+			if q.QueryID == "q-old" {
+				t.Errorf("expected q-old's events to be pruned, got %+v", q)
+			}
+		}
+	})
+}
+
+func TestStoreVariantOutcomes(t *testing.T) {
+	storeBackends(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		now := time.Now()
+		old := now.Add(-48 * time.Hour)
+		store.CreateUser(ctx, User{ID: "1", Name: "Alice"})
+		store.CreateUser(ctx, User{ID: "2", Name: "Bob"})
+		store.AddWatch(ctx, "1", WatchHistoryEntry{FilmID: "42", FilmTitle: "The Matrix", UserRating: 5})
+		store.AddWatch(ctx, "2", WatchHistoryEntry{FilmID: "7", FilmTitle: "Heat", UserRating: 2})
+		store.AddWatch(ctx, "2", WatchHistoryEntry{FilmID: "9", FilmTitle: "Alien", UserRating: 4})
+
+		treatment := map[string]string{"ranking": "treatment", "other": "x"}
+		control := map[string]string{"ranking": "control"}
+		err := store.AddSearchLogs(ctx, []SearchLogEntry{
+			{Time: old, QueryID: "q-old", API: "v2", Query: "old", UserID: "1", Experiments: treatment},
+			{Time: now, QueryID: "q-1", API: "v2", Query: "matrix", UserID: "1", Experiments: treatment},
+			{Time: now, QueryID: "q-2", API: "v2", Query: "matrix again", UserID: "1", Experiments: treatment},
+			{Time: now, QueryID: "q-3", API: "v1", Query: "heat", UserID: "2", Experiments: control},
+			{Time: now, QueryID: "q-4", API: "v1", Query: "anonymous", Experiments: nil},
+		})
+		if err != nil {
+			t.Fatalf("AddSearchLogs failed: %v", err)
+		}
+		err = store.AddEvents(ctx, []SearchEvent{
+			{QueryID: "q-old", Type: EventClick, FilmID: "42", Time: old},
+			{QueryID: "q-1", Type: EventImpression, FilmID: "42", Position: 0, Time: now},
+			{QueryID: "q-1", Type: EventImpression, FilmID: "43", Position: 1, Time: now},
+			{QueryID: "q-1", Type: EventClick, FilmID: "42", Position: 0, Time: now},
+			// Playing the same film again is one rating, not two
+			{QueryID: "q-2", Type: EventPlay, FilmID: "42", Position: 0, Time: now},
+			{QueryID: "q-3", Type: EventImpression, FilmID: "7", Position: 0, Time: now},
+			{QueryID: "q-3", Type: EventClick, FilmID: "7", Position: 0, Time: now},
+			{QueryID: "q-3", Type: EventClick, FilmID: "9", Position: 2, Time: now},
+		})
+		if err != nil {
+			t.Fatalf("AddEvents failed: %v", err)
+		}
+
+		outcomes, err := store.VariantOutcomes(ctx, "ranking", now.Add(-time.Hour))
+		if err != nil {
+			t.Fatalf("VariantOutcomes failed: %v", err)
+		}
+		want := []VariantOutcome{
+			{Variant: "control", Searches: 1, ClickedSearches: 1, Impressions: 1, Clicks: 2, Ratings: 2, AverageRating: 3},
+			{Variant: "treatment", Searches: 2, ClickedSearches: 2, Impressions: 2, Clicks: 1, Plays: 1, Ratings: 1, AverageRating: 5},
+		}
+		if !slices.Equal(outcomes, want) {
+			t.Errorf("VariantOutcomes = %+v, want %+v", outcomes, want)
+		}
+
+		if outcomes, _ := store.VariantOutcomes(ctx, "unknown", now.Add(-time.Hour)); len(outcomes) != 0 {
+			t.Errorf("expected no outcomes for an unknown experiment, got %+v", outcomes)
+		}
+	})
+}
+
+func TestOpenStore(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Store = StoreMemory
+	store, err := openStore(cfg)
+	if err != nil {
+		t.Fatalf("openStore failed: %v", err)
+	}
+	if _, ok := store.(*memoryStore); !ok {
+		t.Errorf("expected a memoryStore, got %T", store)
+	}
+
+	cfg.Store = "postgres"
+	if _, err := openStore(cfg); err == nil {
+		t.Error("expected an error for an unknown store")
+	}
+}
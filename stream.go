@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --- Change notifications ---
+
+// changeBus tells subscribers when something that feeds a user's
+// recommendations changes: preferences, watch history, feedback or the
+// watchlist. Every change gets a new version, which the recommendation stream
+// uses as its event ID.
+type changeBus struct {
+	mu     sync.Mutex
+	closed bool
+	// Versions start at the bus's creation time in nanoseconds, so they keep
+	// growing across restarts and a client reconnecting after one always gets
+	// a fresh list. Users without changes since then are at base.
+	base     int64
+	last     int64
+	versions map[string]int64
+	subs     map[string]map[chan struct{}]bool
+}
+
+func newChangeBus() *changeBus {
+	now := time.Now().UnixNano()
+	return &changeBus{base: now, last: now, versions: map[string]int64{}, subs: map[string]map[chan struct{}]bool{}}
+}
+
+// publish records a change for userID and wakes its subscribers.
+func (b *changeBus) publish(userID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.last++
+	b.versions[userID] = b.last
+	for ch := range b.subs[userID] {
+		// A subscriber that has not caught up yet already has a wakeup
+		// pending; it reads the latest version when it does
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// version returns userID's latest version.
+func (b *changeBus) version(userID string) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if v, ok := b.versions[userID]; ok {
+		return v
+	}
+	return b.base
+}
+
+// subscribe returns a channel that receives a value after each change for
+// userID, and a function to unsubscribe. Changes that arrive while an earlier
+// one is unread are coalesced. The channel is closed when the bus closes.
+func (b *changeBus) subscribe(userID string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if b.subs[userID] == nil {
+		b.subs[userID] = map[chan struct{}]bool{}
+	}
+	b.subs[userID][ch] = true
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.subs[userID][ch] {
+			delete(b.subs[userID], ch)
+			if len(b.subs[userID]) == 0 {
+				delete(b.subs, userID)
+			}
+			close(ch)
+		}
+	}
+}
+
+// close ends every subscription. HTTP shutdown waits for open requests, so
+// it must run as soon as shutdown starts for streams to end.
+func (b *changeBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for _, chans := range b.subs {
+		for ch := range chans {
+			close(ch)
+		}
+	}
+	b.subs = map[string]map[chan struct{}]bool{}
+}
+
+// --- HTTP handlers ---
+
+// writeEvent writes one server-sent event and flushes it to the client.
+func writeEvent(w http.ResponseWriter, rc *http.ResponseController, id, event string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+// handleRecommendationStream sends the user's recommendations as a
+// server-sent event, then a fresh list after every change. A client
+// reconnecting with the Last-Event-ID of the latest list is not sent it
+// again.
+func (s *Server) handleRecommendationStream(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("id")
+	watchlistMode, ok := parseWatchlistMode(w, r)
+	if !ok {
+		return
+	}
+	if !s.checkUserExists(w, r, userID) {
+		return
+	}
+
+	changes, unsubscribe := s.changes.subscribe(userID)
+	defer unsubscribe()
+
+	// The server's write timeout would otherwise end the stream
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	// Keeps nginx and similar proxies from buffering events
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	sent := r.Header.Get("Last-Event-ID")
+	heartbeat := time.NewTicker(s.cfg.Stream.HeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		// A failed list is retried on the next change or heartbeat
+		if id := strconv.FormatInt(s.changes.version(userID), 10); id != sent {
+			var err error
+			recs, qerr := s.recommend(r.Context(), userID, watchlistMode)
+			if qerr != nil {
+				slog.Error("Vespa query failed for recommendation stream", "user_id", userID, "error", qerr,
+					"request_id", requestIDFromContext(r.Context()))
+				err = writeEvent(w, rc, "", "error", Problem{
+					Type:      problemTypePrefix + codeUpstreamUnavailable,
+					Title:     http.StatusText(http.StatusBadGateway),
+					Status:    http.StatusBadGateway,
+					Detail:    "The search backend is unavailable",
+					Instance:  r.URL.Path,
+					Code:      codeUpstreamUnavailable,
+					RequestID: requestIDFromContext(r.Context()),
+				})
+			} else {
+				err = writeEvent(w, rc, id, "recommendations", RecommendationList{
+					UserID:        userID,
+					WatchlistMode: watchlistMode,
+					Films:         scoredFilms(recs),
+				})
+				sent = id
+			}
+			if err != nil {
+				return
+			}
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case _, ok := <-changes:
+			if !ok {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChangeBus(t *testing.T) {
+	bus := newChangeBus()
+	start := bus.version("1")
+	changes, unsubscribe := bus.subscribe("1")
+
+	bus.publish("2")
+	select {
+	case <-changes:
+		t.Fatal("expected no wakeup for another user's change")
+	default:
+	}
+
+	bus.publish("1")
+	bus.publish("1")
+	<-changes
+	select {
+	case <-changes:
+		t.Error("expected changes made before the wakeup was read to be coalesced")
+	default:
+	}
+	if v := bus.version("1"); v != start+3 {
+		t.Errorf("expected version %d, got %d", start+3, v)
+	}
+
+	unsubscribe()
+	if _, ok := <-changes; ok {
+		t.Error("expected unsubscribing to close the channel")
+	}
+	unsubscribe()
+
+	changes, _ = bus.subscribe("1")
+	bus.close()
+	if _, ok := <-changes; ok {
+		t.Error("expected closing the bus to end subscriptions")
+	}
+	if _, ok := <-func() <-chan struct{} { ch, _ := bus.subscribe("1"); return ch }(); ok {
+		t.Error("expected subscriptions after close to be closed")
+	}
+}
+
+// sseEvent is one server-sent event; comment holds a comment line.
+type sseEvent struct {
+	id, event, data, comment string
+}
+
+func readSSE(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+	var e sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return e
+		case strings.HasPrefix(line, ":"):
+			e.comment = strings.TrimSpace(line[1:])
+		default:
+			field, value, _ := strings.Cut(line, ": ")
+			switch field {
+			case "id":
+				e.id = value
+			case "event":
+				e.event = value
+			case "data":
+				e.data = value
+			}
+		}
+	}
+}
+
+func TestRecommendationStream(t *testing.T) {
+	mockVespa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"root":{"fields":{"totalCount":2},"children":[
+			{"id":"id:films:film::10","relevance":2,"fields":{"title":"Film 10"}},
+			{"id":"id:films:film::11","relevance":1,"fields":{"title":"Film 11"}}]}}`))
+	}))
+	defer mockVespa.Close()
+
+	srv := newTestServer(t)
+	srv.cfg.Vespa.URL = mockVespa.URL
+	srv.cfg.Stream.HeartbeatInterval = 50 * time.Millisecond
+	srv.limiter.SetLimits(RateLimits{})
+	token := setupTestAccount(t, srv, "1", RoleUser)
+	// Closing the server waits for open streams, so it must run after the
+	// cleanups that cancel them
+	ts := httptest.NewServer(srv.routes())
+	t.Cleanup(ts.Close)
+
+	open := func(lastEventID string) *bufio.Reader {
+		t.Helper()
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/api/users/1/recommendations/stream", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("expected an event stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		return bufio.NewReader(resp.Body)
+	}
+	// next skips heartbeats
+	next := func(r *bufio.Reader) sseEvent {
+		t.Helper()
+		for {
+			if e := readSSE(t, r); e.comment != "heartbeat" {
+				return e
+			}
+		}
+	}
+
+	stream := open("")
+	first := next(stream)
+	var list RecommendationList
+	if err := json.Unmarshal([]byte(first.data), &list); err != nil {
+		t.Fatalf("invalid event data %q: %v", first.data, err)
+	}
+	if first.event != "recommendations" || first.id == "" || list.UserID != "1" || len(list.Films) != 2 {
+		t.Fatalf("unexpected first event: %+v", first)
+	}
+
+	// Watching film 10 takes it out of the recommendations
+	req := httptest.NewRequest(http.MethodPost, "/api/users/1/history",
+		strings.NewReader(`{"film_id":"10","film_title":"Film 10","user_rating":4}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	srv.routes().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("adding history failed: %d %s", w.Code, w.Body.String())
+	}
+	second := next(stream)
+	json.Unmarshal([]byte(second.data), &list)
+	if second.id == first.id || len(list.Films) != 1 || list.Films[0].ID != "11" {
+		t.Errorf("expected a fresh list without film 10, got %+v", second)
+	}
+
+	// A client that already has the latest list only gets heartbeats
+	resumed := open(second.id)
+	if e := readSSE(t, resumed); e.comment != "heartbeat" {
+		t.Errorf("expected a heartbeat after resuming, got %+v", e)
+	}
+	srv.changes.publish("1")
+	if e := next(resumed); e.event != "recommendations" || e.id == second.id {
+		t.Errorf("expected a list after the next change, got %+v", e)
+	}
+	if e := next(open(first.id)); e.id != strconv.FormatInt(srv.changes.version("1"), 10) {
+		t.Errorf("expected a stale client to get the latest list, got %+v", e)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// --- Tracing ---
+//
+// Spans are created for every HTTP request, every store operation and every
+// call to Vespa. Trace context arrives and leaves in W3C traceparent headers.
+
+const (
+	TraceExporterNone   = "none"
+	TraceExporterStdout = "stdout"
+	TraceExporterOTLP   = "otlp"
+
+	tracerName = "vespa-demo"
+)
+
+// tracing is shared by the server, its store wrapper and its Vespa transport,
+// so swapping the tracer (as tests do) affects all three.
+type tracing struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+func newTracing(tp trace.TracerProvider) *tracing {
+	return &tracing{
+		tracer:     tp.Tracer(tracerName),
+		propagator: propagation.TraceContext{},
+	}
+}
+
+// newTracerProvider builds the provider selected by cfg. The returned
+// shutdown function flushes buffered spans.
+func newTracerProvider(ctx context.Context, cfg TracingConfig) (trace.TracerProvider, func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case TraceExporterNone:
+		return noop.NewTracerProvider(), func(context.Context) error { return nil }, nil
+	case TraceExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case TraceExporterOTLP:
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	default:
+		err = fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(tracerName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	return tp, tp.Shutdown, nil
+}
+
+// instrument starts a server span for each request, continuing any trace
+// the caller propagated. It must wrap the metrics middleware rather than sit
+// inside it: the request carrying the span context is a copy, and only the
+// handlers downstream of it see the route the mux matched.
+func (t *tracing) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := t.propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := t.tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+			))
+		defer span.End()
+		if id := requestIDFromContext(ctx); id != "" {
+			span.SetAttributes(attribute.String("http.request.id", id))
+		}
+
+		r = r.WithContext(ctx)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if r.Pattern != "" {
+			span.SetName(r.Pattern)
+			span.SetAttributes(semconv.HTTPRoute(r.Pattern))
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.status))
+		if rec.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// startVespaSpan starts a client span for an outbound Vespa call and returns
+// a copy of req carrying its traceparent.
+func (t *tracing) startVespaSpan(req *http.Request, endpoint string) (*http.Request, trace.Span) {
+	ctx, span := t.tracer.Start(req.Context(), "vespa "+endpoint, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.ServerAddress(req.URL.Hostname()),
+			attribute.String("vespa.endpoint", endpoint),
+		))
+	req = req.Clone(ctx)
+	t.propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return req, span
+}
+
+// --- Vespa query tracing ---
+
+// vespaTrace is the nested trace Vespa returns when trace.level is set. A
+// message is usually a string but can be a JSON object at higher levels.
+type vespaTrace struct {
+	Timestamp int64           `json:"timestamp"`
+	Message   json.RawMessage `json:"message"`
+	Children  []vespaTrace    `json:"children"`
+}
+
+// withTraceLevel asks Vespa to return a query trace of the given depth.
+func withTraceLevel(level int) queryOption {
+	return func(params url.Values) {
+		params.Set("trace.level", strconv.Itoa(level))
+	}
+}
+
+// vespaTraceOptions requests a Vespa query trace when one is configured and
+// the current span is being recorded, so unsampled requests pay nothing.
+func (s *Server) vespaTraceOptions(ctx context.Context) []queryOption {
+	if s.cfg.Vespa.TraceLevel == 0 || !trace.SpanFromContext(ctx).IsRecording() {
+		return nil
+	}
+	return []queryOption{withTraceLevel(s.cfg.Vespa.TraceLevel)}
+}
+
+// recordVespaTrace adds each message of a Vespa query trace as an event on
+// the current span.
+func recordVespaTrace(ctx context.Context, t *vespaTrace) {
+	span := trace.SpanFromContext(ctx)
+	if t == nil || !span.IsRecording() {
+		return
+	}
+	var walk func(t vespaTrace, depth int)
+	walk = func(t vespaTrace, depth int) {
+		if len(t.Message) > 0 {
+			var msg string
+			if err := json.Unmarshal(t.Message, &msg); err != nil {
+				msg = string(t.Message)
+			}
+			span.AddEvent("vespa.trace", trace.WithAttributes(
+				attribute.String("message", msg),
+				attribute.Int("depth", depth),
+			))
+		}
+		for _, c := range t.Children {
+			walk(c, depth+1)
+		}
+	}
+	walk(*t, 0)
+}
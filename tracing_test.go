@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans points srv at an in-memory exporter and returns it.
+func recordSpans(t *testing.T, srv *Server) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+	srv.tracing.tracer = tp.Tracer(tracerName)
+	return exporter
+}
+
+func findSpan(spans tracetest.SpanStubs, name string) *tracetest.SpanStub {
+	for i := range spans {
+		if spans[i].Name == name {
+			return &spans[i]
+		}
+	}
+	return nil
+}
+
+func TestTracingSearch(t *testing.T) {
+	const (
+		incomingTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+		traceparent   = "00-" + incomingTrace + "-00f067aa0ba902b7-01"
+	)
+
+	var gotTraceparent, gotTraceLevel string
+	mockVespa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTraceparent = r.Header.Get("traceparent")
+		gotTraceLevel = r.URL.Query().Get("trace.level")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"root": {"fields": {"totalCount": 0}, "children": []},
+			"trace": {"children": [
+				{"message": "Query parsed"},
+				{"children": [{"message": "Dispatching to search cluster"}, {"message": {"nodes": 1}}]}
+			]}
+		}`))
+	}))
+	defer mockVespa.Close()
+
+	srv := newTestServer(t)
+	srv.cfg.Vespa.URL = mockVespa.URL
+	srv.cfg.Vespa.TraceLevel = 3
+	token := setupTestAccount(t, srv, "1", RoleUser)
+	exporter := recordSpans(t, srv)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/search?q=matrix&user=1", nil)
+	req.Header.Set("traceparent", traceparent)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	srv.routes().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "Query parsed") {
+		t.Error("Vespa trace should not be passed on to the client")
+	}
+
+	spans := exporter.GetSpans()
+	handler := findSpan(spans, "GET /api/search")
+	if handler == nil {
+		t.Fatalf("expected a handler span named after the route, got %v", spanNames(spans))
+	}
+	if handler.SpanContext.TraceID().String() != incomingTrace {
+		t.Errorf("handler span should continue the incoming trace, got %s", handler.SpanContext.TraceID())
+	}
+	if handler.SpanKind != trace.SpanKindServer {
+		t.Errorf("expected a server span, got %v", handler.SpanKind)
+	}
+
+	vespa := findSpan(spans, "vespa search")
+	if vespa == nil {
+		t.Fatalf("expected a Vespa client span, got %v", spanNames(spans))
+	}
+	if vespa.Parent.SpanID() != handler.SpanContext.SpanID() {
+		t.Error("Vespa span should be a child of the handler span")
+	}
+	if !strings.Contains(gotTraceparent, incomingTrace) || !strings.Contains(gotTraceparent, vespa.SpanContext.SpanID().String()) {
+		t.Errorf("expected traceparent naming the Vespa span, got %q", gotTraceparent)
+	}
+	if gotTraceLevel != "3" {
+		t.Errorf("expected trace.level=3, got %q", gotTraceLevel)
+	}
+
+	for _, name := range []string{"store.preferences", "store.feedback", "encode response"} {
+		s := findSpan(spans, name)
+		if s == nil {
+			t.Errorf("expected a %q span, got %v", name, spanNames(spans))
+			continue
+		}
+		if s.SpanContext.TraceID().String() != incomingTrace {
+			t.Errorf("%s span should belong to the request trace", name)
+		}
+	}
+
+	var messages []string
+	for _, e := range handler.Events {
+		for _, a := range e.Attributes {
+			if a.Key == attribute.Key("message") {
+				messages = append(messages, a.Value.AsString())
+			}
+		}
+	}
+	if strings.Join(messages, "|") != `Query parsed|Dispatching to search cluster|{"nodes": 1}` {
+		t.Errorf("unexpected Vespa trace events: %q", messages)
+	}
+}
+
+func TestTracingWithoutTraceLevel(t *testing.T) {
+	var gotTraceLevel string
+	mockVespa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTraceLevel = r.URL.Query().Get("trace.level")
+		w.Write([]byte(`{"root":{"fields":{"totalCount":0}}}`))
+	}))
+	defer mockVespa.Close()
+
+	srv := newTestServer(t)
+	srv.cfg.Vespa.URL = mockVespa.URL
+	recordSpans(t, srv)
+
+	w := httptest.NewRecorder()
+	srv.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/search?q=matrix", nil))
+	if gotTraceLevel != "" {
+		t.Errorf("trace.level should not be sent when unset, got %q", gotTraceLevel)
+	}
+}
+
+func spanNames(spans tracetest.SpanStubs) []string {
+	var names []string
+	for _, s := range spans {
+		names = append(names, s.Name)
+	}
+	return names
+}
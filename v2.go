@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- API v2 ---
+//
+// v2 responses use our own types instead of passing Vespa's wire format
+// through, so schema changes in Vespa stay inside the server. The
+// unversioned /api routes are v1 and are also served under /api/v1.
+
+const (
+	maxSearchLimit  = 100
+	maxSearchOffset = 1000 // Vespa's default maxOffset
+	maxFacetValues  = 50
+)
+
+// facetFields are the attributes search results are grouped by.
+var facetFields = []string{"genre", "tags"}
+
+// Film is a film from the catalog, identified by its plain film ID.
+type Film struct {
+	ID          string   `json:"id"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Genre       string   `json:"genre"`
+	Director    string   `json:"director"`
+	Year        int      `json:"year"`
+	Rating      float64  `json:"rating"`
+	Tags        []string `json:"tags"`
+	Cast        []string `json:"cast"`
+}
+
+// ScoredFilm is a film with its ranking score for the request.
+type ScoredFilm struct {
+	Film
+	Score float64 `json:"score"`
+}
+
+type FacetValue struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// Paging describes where a page of results sits. NextOffset is omitted on
+// the last page.
+type Paging struct {
+	Offset     int  `json:"offset"`
+	Limit      int  `json:"limit"`
+	Total      int  `json:"total"`
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+// SearchResult is one page of search results. QueryID identifies the search
+// when the client reports impressions and clicks on it.
+type SearchResult struct {
+	QueryID string                  `json:"query_id"`
+	Query   string                  `json:"query"`
+	Films   []ScoredFilm            `json:"films"`
+	Facets  map[string][]FacetValue `json:"facets"`
+	Paging  Paging                  `json:"paging"`
+}
+
+type RecommendationList struct {
+	UserID        string       `json:"user_id"`
+	WatchlistMode string       `json:"watchlist_mode"`
+	Films         []ScoredFilm `json:"films"`
+}
+
+// scoredFilmFromHit maps a Vespa hit to the v2 type. Slices are never nil so
+// clients always see arrays.
+func scoredFilmFromHit(hit VespaHit) ScoredFilm {
+	f := hit.Fields
+	film := Film{
+		ID:          filmIDFromDocID(hit.ID),
+		Title:       f.Title,
+		Description: f.Description,
+		Genre:       f.Genre,
+		Director:    f.Director,
+		Year:        f.Year,
+		Rating:      f.Rating,
+		Tags:        f.Tags,
+		Cast:        f.Cast,
+	}
+	if film.Tags == nil {
+		film.Tags = []string{}
+	}
+	if film.Cast == nil {
+		film.Cast = []string{}
+	}
+	return ScoredFilm{Film: film, Score: hit.Relevance}
+}
+
+// scoredFilms maps document hits, skipping grouping results that Vespa
+// returns alongside them.
+func scoredFilms(hits []VespaHit) []ScoredFilm {
+	films := []ScoredFilm{}
+	for _, hit := range hits {
+		if strings.HasPrefix(hit.ID, "group:") {
+			continue
+		}
+		films = append(films, scoredFilmFromHit(hit))
+	}
+	return films
+}
+
+// --- Vespa grouping ---
+
+// withFacets adds a grouping over facetFields to the query.
+func withFacets() queryOption {
+	return func(params url.Values) {
+		var groups []string
+		for _, field := range facetFields {
+			groups = append(groups, fmt.Sprintf("all(group(%s) max(%d) each(output(count())))", field, maxFacetValues))
+		}
+		params.Set("yql", params.Get("yql")+" | all("+strings.Join(groups, " ")+")")
+	}
+}
+
+// withOffset skips the first offset hits.
+func withOffset(offset int) queryOption {
+	return func(params url.Values) {
+		if offset > 0 {
+			params.Set("offset", strconv.Itoa(offset))
+		}
+	}
+}
+
+// vespaGrouping is the part of a Vespa response that holds grouping results.
+type vespaGrouping struct {
+	Root struct {
+		Children []struct {
+			ID       string `json:"id"`
+			Children []struct {
+				Label    string `json:"label"`
+				Children []struct {
+					Value  string `json:"value"`
+					Fields struct {
+						Count int `json:"count()"`
+					} `json:"fields"`
+				} `json:"children"`
+			} `json:"children"`
+		} `json:"children"`
+	} `json:"root"`
+}
+
+// parseFacets extracts facet counts from a raw Vespa response. Every facet
+// field is present in the result, empty when Vespa returned no groups.
+func parseFacets(body []byte) (map[string][]FacetValue, error) {
+	var grouping vespaGrouping
+	if err := json.Unmarshal(body, &grouping); err != nil {
+		return nil, err
+	}
+
+	facets := map[string][]FacetValue{}
+	for _, field := range facetFields {
+		facets[field] = []FacetValue{}
+	}
+	for _, child := range grouping.Root.Children {
+		if !strings.HasPrefix(child.ID, "group:root") {
+			continue
+		}
+		for _, list := range child.Children {
+			if _, ok := facets[list.Label]; !ok {
+				continue
+			}
+			for _, g := range list.Children {
+				facets[list.Label] = append(facets[list.Label], FacetValue{Value: g.Value, Count: g.Fields.Count})
+			}
+		}
+	}
+	return facets, nil
+}
+
+// --- HTTP handlers ---
+
+// parsePaging reads limit and offset, defaulting limit to defaultLimit. When
+// they are invalid it writes the problem response and returns false.
+func parsePaging(w http.ResponseWriter, r *http.Request, defaultLimit int) (Paging, bool) {
+	p := Paging{Limit: defaultLimit}
+	for _, param := range []struct {
+		name string
+		dst  *int
+		min  int
+		max  int
+	}{
+		{"limit", &p.Limit, 1, maxSearchLimit},
+		{"offset", &p.Offset, 0, maxSearchOffset},
+	} {
+		raw := r.URL.Query().Get(param.name)
+		if raw == "" {
+			continue
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < param.min || n > param.max {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest,
+				fmt.Sprintf("%s must be an integer between %d and %d", param.name, param.min, param.max))
+			return p, false
+		}
+		*param.dst = n
+	}
+	return p, true
+}
+
+func (s *Server) handleSearchV2(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	p, ok := s.parseSearchParams(w, r)
+	if !ok {
+		return
+	}
+	paging, ok := parsePaging(w, r, p.variants.hits(s.cfg.Search.Hits))
+	if !ok {
+		return
+	}
+
+	vespaResp, body, err := s.search(r.Context(), p, paging.Limit, withOffset(paging.Offset), withFacets())
+	if err != nil {
+		upstreamError(w, r, "Vespa query failed", "error", err, "query", p.query)
+		return
+	}
+	facets, err := parseFacets(body)
+	if err != nil {
+		upstreamError(w, r, "Failed to parse Vespa grouping", "error", err)
+		return
+	}
+
+	paging.Total = vespaResp.Root.Fields.TotalCount
+	if next := paging.Offset + paging.Limit; next < paging.Total && next <= maxSearchOffset {
+		paging.NextOffset = &next
+	}
+	result := SearchResult{
+		QueryID: p.queryID,
+		Query:   p.query,
+		Films:   scoredFilms(vespaResp.Root.Children),
+		Facets:  facets,
+		Paging:  paging,
+	}
+
+	s.logSearch("v2", start, p, paging.Offset, paging.Limit, vespaResp)
+	slog.Info("Search completed", "query", p.query, "user_id", p.userID, "api", "v2", "experiments", p.variants.String(),
+		"duration_ms", time.Since(start).Milliseconds())
+
+	_, span := s.tracing.tracer.Start(r.Context(), "encode response")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (s *Server) handleRecommendationsV2(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("id")
+	watchlistMode, ok := parseWatchlistMode(w, r)
+	if !ok {
+		return
+	}
+
+	recs, err := s.recommend(r.Context(), userID, watchlistMode)
+	if err != nil {
+		upstreamError(w, r, "Vespa query failed for recommendations", "error", err)
+		return
+	}
+
+	_, span := s.tracing.tracer.Start(r.Context(), "encode response")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecommendationList{
+		UserID:        userID,
+		WatchlistMode: watchlistMode,
+		Films:         scoredFilms(recs),
+	})
+}
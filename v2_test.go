@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const (
+	testMatrixHit = `{"id":"id:films:film::42","relevance":0.5,"fields":{"title":"The Matrix","genre":"Sci-Fi",
+		"director":"Wachowskis","year":1999,"rating":8.7,"tags":["cyberpunk"],"cast":["Keanu Reeves"]}}`
+	testGroupingResult = `{"id":"group:root:0","relevance":1.0,"children":[
+		{"id":"grouplist:genre","label":"genre","children":[
+			{"id":"group:string:Sci-Fi","relevance":1.0,"value":"Sci-Fi","fields":{"count()":12}},
+			{"id":"group:string:Drama","relevance":0.9,"value":"Drama","fields":{"count()":30}}]},
+		{"id":"grouplist:tags","label":"tags","children":[
+			{"id":"group:string:cyberpunk","relevance":1.0,"value":"cyberpunk","fields":{"count()":3}}]}]}`
+)
+
+func TestParseFacets(t *testing.T) {
+	body := `{"root":{"fields":{"totalCount":1},"children":[` + testMatrixHit + `,` + testGroupingResult + `]}}`
+	facets, err := parseFacets([]byte(body))
+	if err != nil {
+		t.Fatalf("parseFacets failed: %v", err)
+	}
+	if len(facets["genre"]) != 2 || facets["genre"][1] != (FacetValue{Value: "Drama", Count: 30}) {
+		t.Errorf("unexpected genre facet: %+v", facets["genre"])
+	}
+	if len(facets["tags"]) != 1 || facets["tags"][0].Count != 3 {
+		t.Errorf("unexpected tags facet: %+v", facets["tags"])
+	}
+
+	facets, _ = parseFacets([]byte(`{"root":{"fields":{"totalCount":0}}}`))
+	if facets["genre"] == nil || facets["tags"] == nil {
+		t.Errorf("expected empty facets rather than missing ones, got %+v", facets)
+	}
+}
+
+func TestScoredFilms(t *testing.T) {
+	var resp VespaResponse
+	json.Unmarshal([]byte(`{"root":{"children":[`+testMatrixHit+`,`+testGroupingResult+`,{"id":"id:films:film::7","relevance":0.1}]}}`), &resp)
+
+	films := scoredFilms(resp.Root.Children)
+	if len(films) != 2 {
+		t.Fatalf("expected the grouping result to be skipped, got %d films", len(films))
+	}
+	if films[0].ID != "42" || films[0].Title != "The Matrix" || films[0].Score != 0.5 {
+		t.Errorf("unexpected film: %+v", films[0])
+	}
+	if films[1].Tags == nil || films[1].Cast == nil {
+		t.Error("expected empty slices for missing tags and cast")
+	}
+}
+
+func TestHandleSearchV2(t *testing.T) {
+	var lastQuery url.Values
+	mockVespa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastQuery = r.URL.Query()
+		w.Write([]byte(`{"root":{"fields":{"totalCount":25},"children":[` + testMatrixHit + `,` + testGroupingResult + `]}}`))
+	}))
+	defer mockVespa.Close()
+
+	srv := newTestServer(t)
+	srv.cfg.Vespa.URL = mockVespa.URL
+	h := srv.routes()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	w := get("/api/v2/search?q=matrix&limit=10&offset=10")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var result SearchResult
+	json.NewDecoder(w.Body).Decode(&result)
+
+	if lastQuery.Get("hits") != "10" || lastQuery.Get("offset") != "10" {
+		t.Errorf("expected hits=10 and offset=10, got %v", lastQuery)
+	}
+	if !strings.Contains(lastQuery.Get("yql"), "| all(all(group(genre)") {
+		t.Errorf("expected a grouping in the YQL, got %q", lastQuery.Get("yql"))
+	}
+	if len(result.Films) != 1 || result.Films[0].ID != "42" {
+		t.Errorf("expected one film with a plain ID, got %+v", result.Films)
+	}
+	if len(result.Facets["genre"]) != 2 {
+		t.Errorf("expected genre facets, got %+v", result.Facets)
+	}
+	if result.Paging.Total != 25 || result.Paging.NextOffset == nil || *result.Paging.NextOffset != 20 {
+		t.Errorf("expected total 25 and next offset 20, got %+v", result.Paging)
+	}
+
+	w = get("/api/v2/search?limit=10&offset=20")
+	var last SearchResult
+	json.NewDecoder(w.Body).Decode(&last)
+	if last.Paging.NextOffset != nil {
+		t.Errorf("expected no next offset on the last page, got %d", *last.Paging.NextOffset)
+	}
+
+	t.Run("invalid paging", func(t *testing.T) {
+		srv.cfg.Features.RequestValidation = false
+		h := srv.routes()
+		for _, q := range []string{"limit=0", "limit=101", "offset=-1", "offset=x"} {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v2/search?"+q, nil))
+			decodeProblem(t, w, http.StatusBadRequest, codeInvalidRequest)
+		}
+	})
+}
+
+func TestAPIv1Alias(t *testing.T) {
+	mockVespa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"root":{"fields":{"totalCount":1},"children":[` + testMatrixHit + `]}}`))
+	}))
+	defer mockVespa.Close()
+
+	srv := newTestServer(t)
+	srv.cfg.Vespa.URL = mockVespa.URL
+	h := srv.routes()
+
+	for _, path := range []string{"/api/search?q=matrix", "/api/v1/search?q=matrix"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", path, w.Code)
+		}
+		var resp VespaResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		if len(resp.Root.Children) != 1 || resp.Root.Children[0].ID != "id:films:film::42" {
+			t.Errorf("%s: expected the v1 response shape, got %+v", path, resp)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/nope", nil))
+	decodeProblem(t, w, http.StatusNotFound, codeNotFound)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// --- Watchlist constants ---
+
+const (
+	WatchlistInclude = "include"
+	WatchlistExclude = "exclude"
+	WatchlistSurface = "surface"
+
+	maxWatchlistNoteLength = 500
+)
+
+// --- Watchlist types ---
+
+type WatchlistEntry struct {
+	FilmID    string    `json:"film_id"`
+	FilmTitle string    `json:"film_title"`
+	FilmGenre string    `json:"film_genre"`
+	FilmYear  int       `json:"film_year"`
+	Note      string    `json:"note"`
+	Position  int       `json:"position"`
+	AddedAt   time.Time `json:"added_at"`
+}
+
+// AddWatchlistRequest adds a film to the watchlist, or updates it if it is
+// already there. Only the fields that are sent change an existing entry.
+// Position is zero-based; when omitted, new films are appended and existing
+// films keep their place.
+type AddWatchlistRequest struct {
+	FilmID    string  `json:"film_id"`
+	FilmTitle *string `json:"film_title,omitempty"`
+	FilmGenre *string `json:"film_genre,omitempty"`
+	FilmYear  *int    `json:"film_year,omitempty"`
+	Note      *string `json:"note,omitempty"`
+	Position  *int    `json:"position,omitempty"`
+}
+
+// apply copies the fields that were sent onto e.
+func (req AddWatchlistRequest) apply(e *WatchlistEntry) {
+	e.FilmID = req.FilmID
+	if req.FilmTitle != nil {
+		e.FilmTitle = *req.FilmTitle
+	}
+	if req.FilmGenre != nil {
+		e.FilmGenre = *req.FilmGenre
+	}
+	if req.FilmYear != nil {
+		e.FilmYear = *req.FilmYear
+	}
+	if req.Note != nil {
+		e.Note = *req.Note
+	}
+}
+
+// --- HTTP handlers ---
+
+func (s *Server) handleWatchlist(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("id")
+
+	entries, err := s.store.Watchlist(r.Context(), userID)
+	if err != nil {
+		internalError(w, r, "Failed to query watchlist", "user_id", userID, "error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+func (s *Server) handleAddWatchlist(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("id")
+
+	if !s.checkUserExists(w, r, userID) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
+
+	var req AddWatchlistRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON: "+err.Error())
+		return
+	}
+	if req.FilmID == "" {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, "film_id is required")
+		return
+	}
+	if req.Note != nil && len(*req.Note) > maxWatchlistNoteLength {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, "Note too long")
+		return
+	}
+	if req.Position != nil && *req.Position < 0 {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidRequest, "Position must not be negative")
+		return
+	}
+
+	target, err := s.store.PutWatchlistEntry(r.Context(), userID, req)
+	if err != nil {
+		internalError(w, r, "Failed to update watchlist", "user_id", userID, "error", err)
+		return
+	}
+
+	slog.Info("Watchlist updated", "user_id", userID, "film_id", req.FilmID, "position", target)
+	s.changes.publish(userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+func (s *Server) handleDeleteWatchlist(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("id")
+	filmID := r.PathValue("filmID")
+
+	err := s.store.RemoveWatchlistEntry(r.Context(), userID, filmID)
+	if errors.Is(err, errNotFound) {
+		writeProblem(w, r, http.StatusNotFound, codeNotFound, "Film not on watchlist")
+		return
+	}
+	if err != nil {
+		internalError(w, r, "Failed to delete watchlist entry", "user_id", userID, "error", err)
+		return
+	}
+
+	slog.Info("Removed from watchlist", "user_id", userID, "film_id", filmID)
+	s.changes.publish(userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func addToWatchlist(t *testing.T, srv *Server, userID, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/users/"+userID+"/watchlist", strings.NewReader(body))
+	req.SetPathValue("id", userID)
+	w := httptest.NewRecorder()
+	srv.handleAddWatchlist(w, req)
+	return w
+}
+
+func watchlistFilmIDs(t *testing.T, srv *Server, userID string) []string {
+	t.Helper()
+	entries, err := srv.store.Watchlist(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("Watchlist failed: %v", err)
+	}
+	var ids []string
+	for i, e := range entries {
+		if e.Position != i {
+			t.Errorf("entry %s has position %d, want %d", e.FilmID, e.Position, i)
+		}
+		ids = append(ids, e.FilmID)
+	}
+	return ids
+}
+
+func TestHandleAddWatchlist(t *testing.T) {
+	t.Run("appends in order", func(t *testing.T) {
+		srv := newTestServer(t)
+
+		for _, id := range []string{"10", "20", "30"} {
+			if w := addToWatchlist(t, srv, "1", fmt.Sprintf(`{"film_id":%q,"film_title":"Film %s"}`, id, id)); w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+			}
+		}
+
+		got := strings.Join(watchlistFilmIDs(t, srv, "1"), ",")
+		if got != "10,20,30" {
+			t.Errorf("expected order 10,20,30, got %s", got)
+		}
+	})
+
+	t.Run("insert at position", func(t *testing.T) {
+		srv := newTestServer(t)
+		addToWatchlist(t, srv, "1", `{"film_id":"10"}`)
+		addToWatchlist(t, srv, "1", `{"film_id":"20"}`)
+
+		addToWatchlist(t, srv, "1", `{"film_id":"30","position":0}`)
+
+		got := strings.Join(watchlistFilmIDs(t, srv, "1"), ",")
+		if got != "30,10,20" {
+			t.Errorf("expected order 30,10,20, got %s", got)
+		}
+	})
+
+	t.Run("re-adding moves and updates note", func(t *testing.T) {
+		srv := newTestServer(t)
+		addToWatchlist(t, srv, "1", `{"film_id":"10"}`)
+		addToWatchlist(t, srv, "1", `{"film_id":"20"}`)
+		addToWatchlist(t, srv, "1", `{"film_id":"30"}`)
+
+		addToWatchlist(t, srv, "1", `{"film_id":"10","note":"with Sam","position":2}`)
+
+		got := strings.Join(watchlistFilmIDs(t, srv, "1"), ",")
+		if got != "20,30,10" {
+			t.Errorf("expected order 20,30,10, got %s", got)
+		}
+		entries, _ := srv.store.Watchlist(context.Background(), "1")
+		if entries[2].Note != "with Sam" {
+			t.Errorf("expected note to be updated, got %q", entries[2].Note)
+		}
+	})
+
+	t.Run("re-adding without position keeps place", func(t *testing.T) {
+		srv := newTestServer(t)
+		addToWatchlist(t, srv, "1", `{"film_id":"10"}`)
+		addToWatchlist(t, srv, "1", `{"film_id":"20"}`)
+
+		addToWatchlist(t, srv, "1", `{"film_id":"10","note":"later"}`)
+
+		got := strings.Join(watchlistFilmIDs(t, srv, "1"), ",")
+		if got != "10,20" {
+			t.Errorf("expected order 10,20, got %s", got)
+		}
+	})
+
+	t.Run("moving with only a position keeps the entry", func(t *testing.T) {
+		srv := newTestServer(t)
+		addToWatchlist(t, srv, "1", `{"film_id":"10","film_title":"Film 10","film_year":1999,"note":"with Sam"}`)
+		addToWatchlist(t, srv, "1", `{"film_id":"20"}`)
+		before, _ := srv.store.Watchlist(context.Background(), "1")
+
+		addToWatchlist(t, srv, "1", `{"film_id":"10","position":1}`)
+
+		entries, _ := srv.store.Watchlist(context.Background(), "1")
+		moved := entries[1]
+		if moved.FilmID != "10" || moved.FilmTitle != "Film 10" || moved.FilmYear != 1999 || moved.Note != "with Sam" {
+			t.Errorf("expected film 10 moved with its fields, got %+v", moved)
+		}
+		if !moved.AddedAt.Equal(before[0].AddedAt) {
+			t.Errorf("expected added_at %v to be kept, got %v", before[0].AddedAt, moved.AddedAt)
+		}
+	})
+
+	t.Run("position past end is clamped", func(t *testing.T) {
+		srv := newTestServer(t)
+		addToWatchlist(t, srv, "1", `{"film_id":"10"}`)
+
+		addToWatchlist(t, srv, "1", `{"film_id":"20","position":99}`)
+
+		got := strings.Join(watchlistFilmIDs(t, srv, "1"), ",")
+		if got != "10,20" {
+			t.Errorf("expected order 10,20, got %s", got)
+		}
+	})
+
+	t.Run("missing film_id", func(t *testing.T) {
+		srv := newTestServer(t)
+
+		if w := addToWatchlist(t, srv, "1", `{"note":"x"}`); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("user not found", func(t *testing.T) {
+		srv := newTestServer(t)
+
+		if w := addToWatchlist(t, srv, "999", `{"film_id":"10"}`); w.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", w.Code)
+		}
+	})
+}
+
+func TestHandleWatchlist(t *testing.T) {
+	srv := newTestServer(t)
+	addToWatchlist(t, srv, "1", `{"film_id":"10","film_title":"Goodfellas","film_genre":"Crime","film_year":1990,"note":"Friday"}`)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/users/1/watchlist", nil)
+	req.SetPathValue("id", "1")
+	w := httptest.NewRecorder()
+
+	srv.handleWatchlist(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var entries []WatchlistEntry
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	if entries[0].FilmTitle != "Goodfellas" || entries[0].Note != "Friday" || entries[0].AddedAt.IsZero() {
+		t.Errorf("unexpected entry: %+v", entries[0])
+	}
+}
+
+func TestHandleDeleteWatchlist(t *testing.T) {
+	t.Run("removes and renumbers", func(t *testing.T) {
+		srv := newTestServer(t)
+		addToWatchlist(t, srv, "1", `{"film_id":"10"}`)
+		addToWatchlist(t, srv, "1", `{"film_id":"20"}`)
+		addToWatchlist(t, srv, "1", `{"film_id":"30"}`)
+
+		req := httptest.NewRequest(http.MethodDelete, "/api/users/1/watchlist/20", nil)
+		req.SetPathValue("id", "1")
+		req.SetPathValue("filmID", "20")
+		w := httptest.NewRecorder()
+
+		srv.handleDeleteWatchlist(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		got := strings.Join(watchlistFilmIDs(t, srv, "1"), ",")
+		if got != "10,30" {
+			t.Errorf("expected order 10,30, got %s", got)
+		}
+	})
+
+	t.Run("not listed", func(t *testing.T) {
+		srv := newTestServer(t)
+
+		req := httptest.NewRequest(http.MethodDelete, "/api/users/1/watchlist/20", nil)
+		req.SetPathValue("id", "1")
+		req.SetPathValue("filmID", "20")
+		w := httptest.NewRecorder()
+
+		srv.handleDeleteWatchlist(w, req)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", w.Code)
+		}
+	})
+}
+
+func TestAddHistoryRemovesFromWatchlist(t *testing.T) {
+	srv := newTestServer(t)
+	addToWatchlist(t, srv, "1", `{"film_id":"film-7"}`)
+	addToWatchlist(t, srv, "1", `{"film_id":"film-8"}`)
+
+	body := `{"film_id":"film-7","film_title":"Seven","film_genre":"Thriller","film_year":1995,"film_tags":[],"user_rating":5}`
+	req := httptest.NewRequest(http.MethodPost, "/api/users/1/history", strings.NewReader(body))
+	req.SetPathValue("id", "1")
+	w := httptest.NewRecorder()
+
+	srv.handleAddHistory(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	got := strings.Join(watchlistFilmIDs(t, srv, "1"), ",")
+	if got != "film-8" {
+		t.Errorf("watched film should leave the watchlist, got %s", got)
+	}
+}
+
+func TestHandleRecommendations_WatchlistModes(t *testing.T) {
+	// Vespa returns film-1 (watched) then film-2..film-8
+	vespaResp := VespaResponse{}
+	for i := 1; i <= 8; i++ {
+		var hit VespaHit
+		hit.ID = fmt.Sprintf("id:films:film::film-%d", i)
+		hit.Relevance = float64(100 - i)
+		vespaResp.Root.Children = append(vespaResp.Root.Children, hit)
+	}
+
+	mockVespa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(vespaResp)
+	}))
+	defer mockVespa.Close()
+
+	recommend := func(t *testing.T, srv *Server, mode string) []string {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/api/users/1/recommendations?watchlist="+mode, nil)
+		req.SetPathValue("id", "1")
+		w := httptest.NewRecorder()
+		srv.handleRecommendations(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var result VespaResponse
+		json.NewDecoder(w.Body).Decode(&result)
+		var ids []string
+		for _, hit := range result.Root.Children {
+			ids = append(ids, filmIDFromDocID(hit.ID))
+		}
+		return ids
+	}
+
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{"", "film-2,film-3,film-4,film-5,film-6"},
+		{"include", "film-2,film-3,film-4,film-5,film-6"},
+		{"exclude", "film-2,film-4,film-5,film-6,film-8"},
+		{"surface", "film-3,film-7,film-2,film-4,film-5"},
+	}
+	for _, tt := range tests {
+		t.Run("mode "+tt.mode, func(t *testing.T) {
+			srv := newTestServer(t)
+			srv.cfg.Vespa.URL = mockVespa.URL
+			addToWatchlist(t, srv, "1", `{"film_id":"film-7"}`)
+			addToWatchlist(t, srv, "1", `{"film_id":"film-3"}`)
+
+			got := strings.Join(recommend(t, srv, tt.mode), ",")
+			if got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+
+	t.Run("invalid mode", func(t *testing.T) {
+		srv := newTestServer(t)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/users/1/recommendations?watchlist=bogus", nil)
+		req.SetPathValue("id", "1")
+		w := httptest.NewRecorder()
+		srv.handleRecommendations(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+	})
+}